@@ -13,24 +13,38 @@
 
 func init() {
 	addFirewall = addFirewallLinux
+	removeFirewall = removeFirewallLinux
+	firewallEnabled = firewallEnabledLinux
 }
 
+// firewallTable is the table of the firewall addFirewallLinux adds. It may
+// have chains besides the firewall's, such as tailscaled's.
+var firewallTable = &nftables.Table{
+	Family: nftables.TableFamilyIPv4, // TableFamilyINet doesn't work (why?. oh well.)
+	Name:   "filter",
+}
+
+// firewallChain is the name of the chain of the firewall addFirewallLinux
+// adds, in firewallTable.
+const firewallChain = "input"
+
 func addFirewallLinux() error {
 	c, err := nftables.New()
 	if err != nil {
 		return err
 	}
+	return addFirewallConn(c)
+}
 
+// addFirewallConn is addFirewallLinux, using the nftables conn c.
+func addFirewallConn(c *nftables.Conn) error {
 	// Create a new table
-	table := &nftables.Table{
-		Family: nftables.TableFamilyIPv4, // TableFamilyINet doesn't work (why?. oh well.)
-		Name:   "filter",
-	}
+	table := firewallTable
 	c.AddTable(table)
 
 	// Create a new chain for incoming traffic
 	inputChain := &nftables.Chain{
-		Name:     "input",
+		Name:     firewallChain,
 		Table:    table,
 		Type:     nftables.ChainTypeFilter,
 		Hooknum:  nftables.ChainHookInput,
@@ -126,3 +140,55 @@ func addFirewallLinux() error {
 
 	return c.Flush()
 }
+
+// removeFirewallLinux removes the firewall addFirewallLinux adds, if it's
+// there, leaving the rest of its table alone.
+func removeFirewallLinux() error {
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	return removeFirewallConn(c)
+}
+
+// removeFirewallConn is removeFirewallLinux, using the nftables conn c.
+func removeFirewallConn(c *nftables.Conn) error {
+	chain, err := findFirewallChain(c)
+	if err != nil || chain == nil {
+		return err
+	}
+	c.FlushChain(chain)
+	c.DelChain(chain)
+	return c.Flush()
+}
+
+// firewallEnabledLinux reports whether the firewall addFirewallLinux adds is
+// there.
+func firewallEnabledLinux() (bool, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return false, err
+	}
+	return firewallEnabledConn(c)
+}
+
+// firewallEnabledConn is firewallEnabledLinux, using the nftables conn c.
+func firewallEnabledConn(c *nftables.Conn) (bool, error) {
+	chain, err := findFirewallChain(c)
+	return chain != nil, err
+}
+
+// findFirewallChain returns the chain of the firewall addFirewallLinux adds,
+// or nil if it isn't there.
+func findFirewallChain(c *nftables.Conn) (*nftables.Chain, error) {
+	chains, err := c.ListChainsOfTableFamily(firewallTable.Family)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chains {
+		if ch.Table.Name == firewallTable.Name && ch.Name == firewallChain {
+			return ch, nil
+		}
+	}
+	return nil, nil
+}
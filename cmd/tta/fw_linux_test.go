@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+// newSysConn returns an nftables conn in a new network namespace, skipping
+// the test if it can't create one.
+func newSysConn(t *testing.T) *nftables.Conn {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip(t.Name(), " requires privileges to create a namespace in order to run")
+	}
+
+	runtime.LockOSThread()
+	ns, err := netns.New()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatalf("netns.New() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		defer runtime.UnlockOSThread()
+		if err := ns.Close(); err != nil {
+			t.Errorf("ns.Close() failed: %v", err)
+		}
+	})
+	c, err := nftables.New(nftables.WithNetNSFd(int(ns)))
+	if err != nil {
+		t.Fatalf("nftables.New() failed: %v", err)
+	}
+	return c
+}
+
+func TestFirewall(t *testing.T) {
+	c := newSysConn(t)
+
+	checkEnabled := func(want bool) {
+		t.Helper()
+		got, err := firewallEnabledConn(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("firewall enabled = %v; want %v", got, want)
+		}
+	}
+	// chainNames returns the names of the chains in firewallTable.
+	chainNames := func() []string {
+		t.Helper()
+		chains, err := c.ListChainsOfTableFamily(firewallTable.Family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, ch := range chains {
+			if ch.Table.Name == firewallTable.Name {
+				names = append(names, ch.Name)
+			}
+		}
+		return names
+	}
+
+	checkEnabled(false)
+	// Removing a firewall that isn't there is fine.
+	if err := removeFirewallConn(c); err != nil {
+		t.Fatalf("removeFirewallConn without a firewall: %v", err)
+	}
+
+	// Another chain in the table, like tailscaled's, survives removal.
+	c.AddTable(firewallTable)
+	c.AddChain(&nftables.Chain{Name: "ts-input", Table: firewallTable})
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := addFirewallConn(c); err != nil {
+		t.Fatalf("addFirewallConn: %v", err)
+	}
+	checkEnabled(true)
+	chain, err := findFirewallChain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := c.GetRules(firewallTable, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Errorf("got %d rules in the firewall chain; want 3", len(rules))
+	}
+
+	if err := removeFirewallConn(c); err != nil {
+		t.Fatalf("removeFirewallConn: %v", err)
+	}
+	checkEnabled(false)
+	if got := chainNames(); len(got) != 1 || got[0] != "ts-input" {
+		t.Errorf("chains after removal = %q; want just ts-input", got)
+	}
+
+	// It can be enabled again.
+	if err := addFirewallConn(c); err != nil {
+		t.Fatalf("addFirewallConn again: %v", err)
+	}
+	checkEnabled(true)
+}
@@ -63,6 +63,26 @@ func serveCmd(w http.ResponseWriter, cmd string, args ...string) {
 	w.Write(out)
 }
 
+// serveCmdStdout is like serveCmd, but only serves the command's standard
+// output, for commands whose output is to be parsed.
+func serveCmdStdout(w http.ResponseWriter, cmd string, args ...string) {
+	log.Printf("Got serveCmdStdout for %q %v", cmd, args)
+	var stderr bytes.Buffer
+	c := exec.Command(absify(cmd), args...)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.Header().Set("Exec-Err", err.Error())
+		w.WriteHeader(500)
+		log.Printf("Err on serveCmdStdout for %q %v: %v; stderr: %s", cmd, args, err, stderr.Bytes())
+		w.Write(stderr.Bytes())
+		return
+	}
+	log.Printf("Did serveCmdStdout for %q %v, %d bytes of output", cmd, args, len(out))
+	w.Write(out)
+}
+
 type localClientRoundTripper struct {
 	lc local.Client
 }
@@ -165,6 +185,11 @@ func main() {
 		serveCmd(w, "tailscale", "up", "--login-server=http://control.tailscale")
 	})
 	ttaMux.HandleFunc("/fw", addFirewallHandler)
+	ttaMux.HandleFunc("/fw/disable", removeFirewallHandler)
+	ttaMux.HandleFunc("/fw/state", firewallStateHandler)
+	ttaMux.HandleFunc("/netcheck", func(w http.ResponseWriter, r *http.Request) {
+		serveCmdStdout(w, "tailscale", "netcheck", "--format=json")
+	})
 	ttaMux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 		logBuf.mu.Lock()
 		defer logBuf.mu.Unlock()
@@ -325,7 +350,43 @@ func addFirewallHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "OK\n")
 }
 
-var addFirewall func() error // set by fw_linux.go
+func removeFirewallHandler(w http.ResponseWriter, r *http.Request) {
+	if removeFirewall == nil {
+		http.Error(w, "firewall not supported", 500)
+		return
+	}
+	if err := removeFirewall(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	io.WriteString(w, "OK\n")
+}
+
+// firewallStateHandler serves "enabled" or "disabled", according to whether
+// the firewall addFirewall adds is there.
+func firewallStateHandler(w http.ResponseWriter, r *http.Request) {
+	if firewallEnabled == nil {
+		http.Error(w, "firewall not supported", 500)
+		return
+	}
+	enabled, err := firewallEnabled()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if enabled {
+		io.WriteString(w, "enabled\n")
+	} else {
+		io.WriteString(w, "disabled\n")
+	}
+}
+
+// Set by fw_linux.go.
+var (
+	addFirewall     func() error
+	removeFirewall  func() error
+	firewallEnabled func() (bool, error)
+)
 
 // logBuffer is a bytes.Buffer that is safe for concurrent use
 // intended to capture early logs from the process, even if
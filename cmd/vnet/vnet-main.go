@@ -29,8 +29,11 @@
 	dgram    = flag.Bool("dgram", false, "enable datagram mode; for use with macOS Hypervisor.Framework and VZFileHandleNetworkDeviceAttachment")
 	blend    = flag.Bool("blend", true, "blend reality (controlplane.tailscale.com and DERPs) into the virtual network")
 	pcapFile = flag.String("pcap", "", "if non-empty, filename to write pcap")
+	pcapSize = flag.Int64("pcap-max-size", 0, "if non-zero, rotate the --pcap file when it reaches this many bytes")
+	pcapAge  = flag.Duration("pcap-max-age", 0, "if non-zero, rotate the --pcap file when it gets this old")
 	v4       = flag.Bool("v4", true, "enable IPv4")
 	v6       = flag.Bool("v6", true, "enable IPv6")
+	config   = flag.String("config", "", "if non-empty, a JSON or YAML file describing the virtual network to run, instead of the one built from the --nat, --portmap, --v4 and --v6 flags")
 )
 
 func main() {
@@ -60,30 +63,50 @@ func main() {
 		log.Fatal(err)
 	}
 
-	var c vnet.Config
-	c.SetPCAPFile(*pcapFile)
-	c.SetBlendReality(*blend)
+	c := new(vnet.Config)
+	if *config != "" {
+		c, err = vnet.ParseConfigFile(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *pcapFile != "" {
+			c.SetPCAPFile(*pcapFile)
+			c.SetPCAPRotation(*pcapSize, *pcapAge)
+		}
+	} else {
+		c.SetPCAPFile(*pcapFile)
+		c.SetPCAPRotation(*pcapSize, *pcapAge)
+		c.SetBlendReality(*blend)
 
-	var net1opt = []any{vnet.NAT(*nat)}
-	if *v4 {
-		net1opt = append(net1opt, "2.1.1.1", "192.168.1.1/24")
+		var net1opt = []any{vnet.NAT(*nat)}
+		if *v4 {
+			net1opt = append(net1opt, "2.1.1.1", "192.168.1.1/24")
+		}
+		if *v6 {
+			net1opt = append(net1opt, "2000:52::1/64")
+		}
+
+		node1 := c.AddNode(c.AddNetwork(net1opt...))
+		c.AddNode(c.AddNetwork("2.2.2.2", "10.2.0.1/16", vnet.NAT(*nat2)))
+		if *portmap && *v4 {
+			node1.Network().AddService(vnet.NATPMP)
+		}
 	}
-	if *v6 {
-		net1opt = append(net1opt, "2000:52::1/64")
+	var node1 *vnet.Node
+	for _, n := range c.Nodes() {
+		node1 = n
+		break
 	}
-
-	node1 := c.AddNode(c.AddNetwork(net1opt...))
-	c.AddNode(c.AddNetwork("2.2.2.2", "10.2.0.1/16", vnet.NAT(*nat2)))
-	if *portmap && *v4 {
-		node1.Network().AddService(vnet.NATPMP)
+	if node1 == nil {
+		log.Fatalf("no nodes configured")
 	}
 
-	s, err := vnet.New(&c)
+	s, err := vnet.New(c)
 	if err != nil {
 		log.Fatalf("newServer: %v", err)
 	}
 
-	if *blend {
+	if c.BlendReality() {
 		if err := s.PopulateDERPMapIPs(); err != nil {
 			log.Printf("warning: ignoring failure to populate DERP map: %v", err)
 		}
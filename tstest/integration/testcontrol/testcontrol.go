@@ -47,7 +47,7 @@
 // Everything is stored in-memory in one tailnet.
 type Server struct {
 	Logf           logger.Logf      // nil means to use the log package
-	DERPMap        *tailcfg.DERPMap // nil means to use prod DERP map
+	DERPMap        *tailcfg.DERPMap // nil means to use prod DERP map; see SetDERPMap
 	RequireAuth    bool
 	RequireAuthKey string // required authkey for all nodes
 	Verbose        bool
@@ -369,6 +369,7 @@ func (s *Server) SetSubnetRoutes(nodeKey key.NodePublic, routes []netip.Prefix)
 	defer s.mu.Unlock()
 	s.logf("Setting subnet routes for %s: %v", nodeKey.ShortString(), routes)
 	mak.Set(&s.nodeSubnetRoutes, nodeKey, routes)
+	s.updateLocked("SetSubnetRoutes", s.nodeIDsLocked(0))
 }
 
 // MasqueradePair is a pair of nodes and the IP address that the
@@ -414,6 +415,18 @@ func (s *Server) SetMasqueradeAddresses(pairs []MasqueradePair) {
 	s.updateLocked("SetMasqueradeAddresses", s.nodeIDsLocked(0))
 }
 
+// SetDERPMap sets the DERP map sent to clients and sends it to the
+// currently connected ones.
+//
+// s.DERPMap may be set directly only before s starts serving. After that,
+// SetDERPMap is the only way to change it.
+func (s *Server) SetDERPMap(dm *tailcfg.DERPMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DERPMap = dm
+	s.updateLocked("SetDERPMap", s.nodeIDsLocked(0))
+}
+
 // SetNodeCapMap overrides the capability map the specified client receives.
 func (s *Server) SetNodeCapMap(nodeKey key.NodePublic, capMap tailcfg.NodeCapMap) {
 	s.mu.Lock()
@@ -944,6 +957,7 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 
 	s.mu.Lock()
 	nodeCapMap := maps.Clone(s.nodeCapMaps[nk])
+	derpMap := s.DERPMap
 	s.mu.Unlock()
 
 	node.CapMap = nodeCapMap
@@ -961,7 +975,7 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 
 	res = &tailcfg.MapResponse{
 		Node:            node,
-		DERPMap:         s.DERPMap,
+		DERPMap:         derpMap,
 		Domain:          domain,
 		CollectServices: "true",
 		PacketFilter:    packetFilterWithIngressCaps(),
@@ -0,0 +1,83 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"io"
+	"net/http"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// This file implements the router's simulated captive portal, as enabled by
+// Network.SetCaptivePortal. While it's enabled, the router answers matching
+// HTTP connections itself, like a hotel or airport Wi-Fi login page would.
+
+// captivePortalLoginPath is the path of the captive portal's login page on
+// the router.
+const captivePortalLoginPath = "/login"
+
+// isCaptivePortalDst reports whether HTTP connections to dst are intercepted
+// by the network's captive portal.
+func (n *network) isCaptivePortalDst(dst netip.Addr) bool {
+	if !n.captivePortal || n.s.vip(fakeControl).Match(dst) {
+		return false
+	}
+	if len(n.captiveDsts) == 0 {
+		return true
+	}
+	for _, p := range n.captiveDsts {
+		if p.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCaptivePortalTCP reports whether pkt is TCP to an HTTP destination
+// intercepted by the network's captive portal.
+func (n *network) isCaptivePortalTCP(pkt gopacket.Packet, dstIP netip.Addr) bool {
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	return ok && tcp.DstPort == 80 && n.isCaptivePortalDst(dstIP)
+}
+
+// captivePortalHandler returns the HTTP handler that the router serves
+// intercepted connections with.
+//
+// Requests for /generate_204 (the connectivity check path used by Tailscale,
+// Android and others) are redirected to the login page rather than getting
+// the 204 No Content they expect. Everything else gets the login page.
+func (n *network) captivePortalHandler() http.Handler {
+	loginURL := captivePortalLoginPath
+	if n.lanIP4.IsValid() {
+		loginURL = "http://" + n.lanIP4.Addr().String() + captivePortalLoginPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate_204", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loginURL, http.StatusFound)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, captivePortalLoginPage)
+	})
+	return mux
+}
+
+// captivePortalLoginPage is the HTML served by the captive portal.
+const captivePortalLoginPage = `<!DOCTYPE html>
+<html>
+<head><title>vnet captive portal</title></head>
+<body>
+<h1>Welcome to vnet Wi-Fi</h1>
+<p>Please log in to access the Internet.</p>
+<form method="POST" action="/login">
+<input type="checkbox" name="accept"> I accept the terms of service
+<input type="submit" value="Connect">
+</form>
+</body>
+</html>
+`
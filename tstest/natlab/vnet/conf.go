@@ -5,16 +5,25 @@
 
 import (
 	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"iter"
+	"math"
 	"net/netip"
-	"os"
 	"slices"
+	"strings"
 	"time"
 
+	"github.com/gaissmai/bart"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
 	"tailscale.com/util/set"
 )
@@ -30,10 +39,34 @@
 // values to modify the config before calling NewServer.
 // Once the NewServer is called, Config is no longer used.
 type Config struct {
-	nodes        []*Node
-	networks     []*Network
-	pcapFile     string
-	blendReality bool
+	nodes               []*Node
+	networks            []*Network
+	pcapFile            string
+	pcapMaxSize         int64          // or 0 to not rotate by size
+	pcapMaxAge          time.Duration  // or 0 to not rotate by age
+	pcapFilter          *CaptureFilter // or nil to write all packets
+	logDir              string         // or empty to not write node logs at Close
+	logUploadMax        int64          // or 0 for defaultLogUploadMax
+	blendReality        bool
+	clock               tstime.Clock            // or nil for the wall clock
+	observer            Observer                // or nil
+	vips                map[string][]netip.Addr // VIP DNS name => override IPs
+	numDERPs            int                     // or 0 for the default (2)
+	derpNodes           map[int]int             // DERP region ID => number of fake DERP servers, if not 1
+	derpLatency         map[int]time.Duration   // DERP region ID => delay before serving its HTTP requests
+	derpDownClosesConns bool                    // whether Server.SetDERPUp(false) closes existing connections
+	derpMapHook         func(*tailcfg.DERPMap)  // or nil
+	dnsRecords          map[string][]netip.Addr // DNS name => IPs
+	dnsCNAMEs           map[string]string       // DNS name => target name
+	dnsLatency          time.Duration           // delay before the fake DNS server replies
+	dnsLossRate         float64                 // chance of the fake DNS server ignoring a UDP query
+	tcpHandlers         []tcpHandler            // from AddTCPHandler
+	tlsCA               *tls.Certificate        // or nil to generate one
+	controlHTTP2        bool                    // whether the fake control server speaks HTTP/2
+	randSeed            uint64                  // see SetRandSeed
+	randSeeded          bool
+	agentPollInterval   time.Duration // or 0 for the default
+	agentConnTimeout    time.Duration // or 0 for none
 }
 
 // SetPCAPFile sets the filename to write a pcap file to,
@@ -42,6 +75,152 @@ func (c *Config) SetPCAPFile(file string) {
 	c.pcapFile = file
 }
 
+// SetLogDir sets a directory for Server.Close to write each node's logs to,
+// or empty to disable writing them. Each node gets a "nodeN-MAC.log" file
+// of the logs it uploaded to the fake logcatcher and, if it sent any, a
+// "nodeN-MAC.syslog" file of its syslog messages, where N is its 1-based
+// node number and MAC its MAC address in hex. The directory is created if
+// needed.
+func (c *Config) SetLogDir(dir string) {
+	c.logDir = dir
+}
+
+// SetLogUploadMaxSize sets the maximum size of a log upload the fake
+// logcatcher accepts, once decompressed; it rejects larger ones with an HTTP
+// 413 error. Zero or less means the default of 16 MiB.
+func (c *Config) SetLogUploadMaxSize(n int64) {
+	c.logUploadMax = n
+}
+
+// SetPCAPRotation makes the pcap file set by SetPCAPFile rotate: rather than
+// one file, the Server writes a sequence of them, starting a new one when the
+// current one has grown to maxSize bytes or is maxAge old, as measured by the
+// Config's clock. Zero disables either limit.
+//
+// The files are named after the pcap file with a sequence number before the
+// extension, so "out.pcapng" becomes "out.000.pcapng", "out.001.pcapng" and
+// so on. Each is a complete pcapng file with all the capture's interfaces.
+func (c *Config) SetPCAPRotation(maxSize int64, maxAge time.Duration) {
+	c.pcapMaxSize = maxSize
+	c.pcapMaxAge = maxAge
+}
+
+// SetPCAPFilter limits the packets written to the pcap file set by
+// SetPCAPFile to those matching f, such as
+// CaptureFilter{Proto: "UDP", Ports: []uint16{3478}} for STUN only.
+func (c *Config) SetPCAPFilter(f CaptureFilter) {
+	c.pcapFilter = &f
+}
+
+// SetClock sets the clock used for NAT and port mapping timestamps and
+// timers, so tests can exercise expiry without sleeping. The default is the
+// wall clock.
+func (c *Config) SetClock(clk tstime.Clock) {
+	c.clock = clk
+}
+
+// SetObserver sets an Observer to be notified of the Server's packet
+// handling decisions. By default there is none.
+func (c *Config) SetObserver(o Observer) {
+	c.observer = o
+}
+
+// SetVIP sets the IP address of the built-in fake service with DNS name name
+// (such as "dns", "control.tailscale" or "derp1.tailscale") to ip, replacing
+// its default IPv4 or IPv6 address, depending on ip's family.
+//
+// It's useful for tests that need the fakes to avoid (or overlap) a certain
+// address range. New fails if name isn't a fake or the addresses collide.
+func (c *Config) SetVIP(name string, ip netip.Addr) {
+	mak.Set(&c.vips, name, append(c.vips[name], ip))
+}
+
+// AddDNSRecord adds A and/or AAAA records for name (such as "foo.example") to
+// the fake DNS server, one per IP in ips. It can be called multiple times for
+// the same name to add more IPs.
+//
+// Names are case insensitive. New fails if name is one of the built-in fakes'
+// names, which can be moved with SetVIP instead.
+func (c *Config) AddDNSRecord(name string, ips ...netip.Addr) {
+	name = dnsNameKey(name)
+	mak.Set(&c.dnsRecords, name, append(c.dnsRecords[name], ips...))
+}
+
+// AddDNSCNAME adds a CNAME record to the fake DNS server, aliasing name to
+// target. The fake DNS server follows CNAMEs when answering queries.
+//
+// Names are case insensitive. New fails if name is one of the built-in fakes'
+// names or has records added with AddDNSRecord.
+func (c *Config) AddDNSCNAME(name, target string) {
+	mak.Set(&c.dnsCNAMEs, dnsNameKey(name), strings.TrimSuffix(target, "."))
+}
+
+// SetDERPLatency sets how long the fake DERP server of the given region (1
+// for the first) waits before serving each HTTP request, such as /derp and
+// /generate_204, and before answering each STUN request sent to its IP, as
+// measured by the Config's clock. It simulates DERP regions being different
+// distances away. The default is no delay.
+func (c *Config) SetDERPLatency(region int, d time.Duration) {
+	mak.Set(&c.derpLatency, region, d)
+}
+
+// SetDERPDownClosesConns sets whether taking a fake DERP server down with
+// Server.SetDERPUp also closes its existing connections, rather than only
+// refusing new ones. The default is false.
+func (c *Config) SetDERPDownClosesConns(v bool) {
+	c.derpDownClosesConns = v
+}
+
+// SetDNSLatency sets how long the fake DNS server takes to reply to each
+// query, as measured by the Config's clock. The default is no delay.
+func (c *Config) SetDNSLatency(d time.Duration) {
+	c.dnsLatency = d
+}
+
+// SetDNSQueryLoss sets the rate at which the fake DNS server ignores DNS
+// queries over UDP, from 0.0 (none) to 1.0 (all), to simulate an unreliable
+// resolver. Queries over TCP are always answered.
+func (c *Config) SetDNSQueryLoss(rate float64) {
+	c.dnsLossRate = max(0, min(rate, 1))
+}
+
+// SetControlHTTP2 sets whether the fake control server speaks HTTP/2 as well
+// as HTTP/1.1: over TLS on port 443, negotiated with ALPN, and on port 80
+// with prior knowledge (h2c). The default is HTTP/1.1 only. Connections to
+// the real control plane blended in with SetBlendReality negotiate their
+// protocol with it directly. HTTP/3 isn't supported.
+func (c *Config) SetControlHTTP2(v bool) {
+	c.controlHTTP2 = v
+}
+
+// SetAgentConnPollInterval sets how often dialing a node's test agent, as
+// with Server.NodeAgentClient, checks for an idle connection from the agent
+// while waiting for one, besides being woken when one arrives. Zero means
+// the default of one second; negative means to only be woken.
+func (c *Config) SetAgentConnPollInterval(d time.Duration) {
+	c.agentPollInterval = d
+}
+
+// SetAgentConnTimeout sets how long dialing a node's test agent waits for an
+// idle connection from the agent before failing, for tests to fail fast when
+// an agent never connects, such as when its VM didn't boot. Zero, the
+// default, means to wait as long as the dial's context allows.
+func (c *Config) SetAgentConnTimeout(d time.Duration) {
+	c.agentConnTimeout = d
+}
+
+// SetRandSeed seeds the random source of all the Server's randomized
+// behavior, such as the external ports its NATs and port mapping services
+// allocate, its randomly chosen source ports and IP IDs, and its simulated
+// packet loss, so that tests see the same choices on every run given the
+// same sequence of packets. It also seeds each network's impairments, unless
+// they're seeded with Network.SetImpairmentSeed. By default, it's seeded
+// randomly.
+func (c *Config) SetRandSeed(seed uint64) {
+	c.randSeed = seed
+	c.randSeeded = true
+}
+
 // NumNodes returns the number of nodes in the configuration.
 func (c *Config) NumNodes() int {
 	return len(c.nodes)
@@ -54,6 +233,38 @@ func (c *Config) SetBlendReality(v bool) {
 	c.blendReality = v
 }
 
+// BlendReality reports whether the config blends reality into the virtual
+// network. See SetBlendReality.
+func (c *Config) BlendReality() bool {
+	return c.blendReality
+}
+
+// SetNumDERPs sets the number of fake DERP servers (and DERP regions) to
+// run, from 1 to 8. The default is 2. Region N's server is at the virtual IP
+// of derpN.tailscale, 33.4.0.N by default.
+func (c *Config) SetNumDERPs(n int) {
+	c.numDERPs = n
+}
+
+// SetNumDERPNodes sets the number of fake DERP servers of the given region
+// (1 for the first), from 1 to 4, as DERP nodes of the region, for tests of
+// load balancing and failover within a region. The default is 1. The first
+// is at the virtual IP of derpN.tailscale, as SetNumDERPs says; the second
+// is at derpNb.tailscale, 33.4.1.N by default, the third at derpNc.tailscale,
+// 33.4.2.N, and so on. Their DERP node names are "Na", "Nb" and so on. A
+// region's servers forward packets to each other's clients, as if meshed.
+func (c *Config) SetNumDERPNodes(region, n int) {
+	mak.Set(&c.derpNodes, region, n)
+}
+
+// SetDERPMapHook sets a func to modify the DERP map the fake control server
+// sends nodes, such as to add regions, before the Server starts. The map it's
+// passed has the fake DERP servers' regions; see SetNumDERPs. To change the
+// DERP map of a running Server, use Server.SetDERPMap.
+func (c *Config) SetDERPMapHook(fn func(dm *tailcfg.DERPMap)) {
+	c.derpMapHook = fn
+}
+
 // FirstNetwork returns the first network in the config, or nil if none.
 func (c *Config) FirstNetwork() *Network {
 	if len(c.networks) == 0 {
@@ -90,24 +301,39 @@ func nodeLANIP6(n int) netip.Addr {
 //
 // The opts may be of the following types:
 //   - *Network: zero, one, or more networks to add this node to
-//   - TODO: more
+//   - MAC: the node's MAC address, as with Node.SetMAC
+//   - netip.Addr: the node's LAN IPv4 address, as with Node.SetLANIP
+//   - TailscaledEnv: an environment variable for tailscaled
+//   - NodeOption: a NodeOption
 //
 // On an error or unknown opt type, AddNode returns a
 // node with a carried error that gets returned later.
 func (c *Config) AddNode(opts ...any) *Node {
-	num := len(c.nodes) + 1
+	n := newNode(len(c.nodes)+1, opts...)
+	c.nodes = append(c.nodes, n)
+	for _, nw := range n.nets {
+		if !slices.Contains(nw.nodes, n) {
+			nw.nodes = append(nw.nodes, n)
+		}
+	}
+	return n
+}
+
+// newNode returns node number num configured by opts, as documented at
+// Config.AddNode. It doesn't add the node to its networks.
+func newNode(num int, opts ...any) *Node {
 	n := &Node{
 		num: num,
 		mac: nodeMac(num),
 	}
-	c.nodes = append(c.nodes, n)
 	for _, o := range opts {
 		switch o := o.(type) {
 		case *Network:
-			if !slices.Contains(o.nodes, n) {
-				o.nodes = append(o.nodes, n)
-			}
 			n.nets = append(n.nets, o)
+		case MAC:
+			n.mac = o
+		case netip.Addr:
+			n.lanIP = o
 		case TailscaledEnv:
 			n.env = append(n.env, o)
 		case NodeOption:
@@ -116,6 +342,8 @@ func (c *Config) AddNode(opts ...any) *Node {
 				n.hostFW = true
 			case VerboseSyslog:
 				n.verboseSyslog = true
+			case HostStack:
+				n.hostStack = true
 			default:
 				if n.err == nil {
 					n.err = fmt.Errorf("unknown NodeOption %q", o)
@@ -136,6 +364,10 @@ func (c *Config) AddNode(opts ...any) *Node {
 const (
 	HostFirewall  NodeOption = "HostFirewall"
 	VerboseSyslog NodeOption = "VerboseSyslog"
+
+	// HostStack backs the node with an in-process network stack instead of
+	// an external VM, so tests can make connections from it with Node.Dial.
+	HostStack NodeOption = "HostStack"
 )
 
 // TailscaledEnv is а option that can be passed to Config.AddNode
@@ -151,17 +383,24 @@ type TailscaledEnv struct {
 //   - string netip.Prefix, for the network's LAN IP (defaults to 192.168.0.0/24)
 //     if IPv4, or its WAN IPv6 + CIDR (e.g. "2000:52::1/64")
 //   - NAT, the type of NAT to use
+//   - PortAllocation, how a HardNAT picks WAN ports (defaults to PortAllocRandom)
 //   - NetworkService, a service to add to the network
 //
 // On an error or unknown opt type, AddNetwork returns a
 // network with a carried error that gets returned later.
 func (c *Config) AddNetwork(opts ...any) *Network {
-	num := len(c.networks) + 1
+	n := newNetwork(len(c.networks)+1, opts...)
+	c.networks = append(c.networks, n)
+	return n
+}
+
+// newNetwork returns network number num configured by opts, as documented at
+// Config.AddNetwork.
+func newNetwork(num int, opts ...any) *Network {
 	n := &Network{
 		num: num,
 		mac: routerMac(num),
 	}
-	c.networks = append(c.networks, n)
 	for _, o := range opts {
 		switch o := o.(type) {
 		case string:
@@ -182,6 +421,14 @@ func (c *Config) AddNetwork(opts ...any) *Network {
 			}
 		case NAT:
 			n.natType = o
+		case PortAllocation:
+			if !o.valid() {
+				if n.err == nil {
+					n.err = fmt.Errorf("unknown port allocation %q", o)
+				}
+				continue
+			}
+			n.portAlloc = o
 		case NetworkService:
 			n.AddService(o)
 		default:
@@ -202,12 +449,17 @@ type Node struct {
 	env           []TailscaledEnv
 	hostFW        bool
 	verboseSyslog bool
+	hostStack     bool
 
 	// TODO(bradfitz): this is halfway converted to supporting multiple NICs
 	// but not done. We need a MAC-per-Network.
 
-	mac  MAC
-	nets []*Network
+	mac   MAC
+	lanIP netip.Addr // or zero value to derive from the MAC
+	nets  []*Network
+
+	subnetRoutes []netip.Prefix // see SetSubnetRoutes
+	clockSkew    time.Duration  // see SetClockSkew
 }
 
 // Num returns the 1-based node number.
@@ -225,6 +477,67 @@ func (n *Node) MAC() MAC {
 	return n.mac
 }
 
+// SetMAC sets the MAC address of the node, overriding the default one
+// derived from its node number.
+func (n *Node) SetMAC(mac MAC) {
+	n.mac = mac
+}
+
+// SetLANIP sets the node's LAN IPv4 address, which must be in its network's
+// LAN prefix. By default, the node's IP is the network's prefix with a final
+// octet of 100 plus the last byte of the node's MAC address.
+func (n *Node) SetLANIP(ip netip.Addr) {
+	n.lanIP = ip
+}
+
+// LANIP returns the node's LAN IPv4 address: the one set with SetLANIP, or
+// else the one derived from its network's LAN prefix and its MAC address.
+// It's the zero value if the node's network lacks IPv4.
+//
+// Addresses are a function of the Config alone, so they're the same on
+// every run, and LANIP can be called before the Server is created. A Config
+// the Server rejects may give a bogus result.
+func (n *Node) LANIP() netip.Addr {
+	if n.n != nil {
+		return n.n.lanIP
+	}
+	net := n.Network()
+	if net == nil {
+		return netip.Addr{}
+	}
+	pfx := net.lanPrefix4()
+	if !pfx.IsValid() {
+		return netip.Addr{}
+	}
+	if n.lanIP.IsValid() {
+		return n.lanIP
+	}
+	return derivedLANIP(pfx, n.mac)
+}
+
+// WANIP returns the IPv4 address that the node's traffic to the internet
+// comes from, its network's WAN IP, or the zero value if there's none.
+// Once the Server is running, that's the current one; see Server.SetWANIP.
+// With a WAN IP pool, traffic may come from the pool's other IPs instead.
+func (n *Node) WANIP() netip.Addr {
+	if n.n != nil {
+		return n.n.net.WANIP()
+	}
+	if net := n.Network(); net != nil {
+		return net.wanIP4
+	}
+	return netip.Addr{}
+}
+
+// derivedLANIP returns the default LAN IPv4 address of a node with MAC
+// address mac on a network with LAN prefix pfx: pfx with a final octet of
+// 100 plus the MAC's last byte.
+func derivedLANIP(pfx netip.Prefix, mac MAC) netip.Addr {
+	ip4 := pfx.Addr().As4()
+	ip4[3] = 100 + mac[5]
+	return netip.AddrFrom4(ip4)
+}
+
 func (n *Node) Env() []TailscaledEnv {
 	return n.env
 }
@@ -241,6 +554,43 @@ func (n *Node) SetVerboseSyslog(v bool) {
 	n.verboseSyslog = v
 }
 
+// SetSubnetRoutes makes the node a subnet router for routes, standing in
+// for it advertising them to control. Traffic to the routes that would
+// otherwise be dropped as unroutable, from any network, is delivered to the
+// node, as if over the tailnet, and the node's UDP traffic from addresses in
+// them goes out without NAT so replies can find their way back. TCP
+// connections to them come from the node's router.
+//
+// A node with the HostStack option accepts traffic to, and can send from,
+// any address, so tests can stand in for hosts behind the router with it.
+func (n *Node) SetSubnetRoutes(routes ...netip.Prefix) {
+	n.subnetRoutes = slices.Clone(routes)
+}
+
+// SetClockSkew sets how far the node's clock is ahead of the Config's
+// clock, or behind it if negative, to reproduce bugs with skewed clocks.
+//
+// The fake NTP server tells the node the skewed time, and the fake syslog
+// server dates the node's messages with yearless timestamps by it. A node
+// with the HostStack option has a network stack using the skewed clock,
+// and in-process services acting for it should use Now. Otherwise, the node
+// is an external VM whose clock vnet can't set, short of the VM syncing it
+// with the fake NTP server, so the skew is logged when the VM connects.
+func (n *Node) SetClockSkew(d time.Duration) {
+	n.clockSkew = d
+}
+
+// ClockSkew returns the node's clock skew set by SetClockSkew.
+func (n *Node) ClockSkew() time.Duration {
+	return n.clockSkew
+}
+
+// Now returns the current time as the node sees it: the Server's clock's,
+// with the node's clock skew. It requires the Server to have been created.
+func (n *Node) Now() time.Time {
+	return n.n.now()
+}
+
 // IsV6Only reports whether this node is only connected to IPv6 networks.
 func (n *Node) IsV6Only() bool {
 	for _, net := range n.nets {
@@ -267,22 +617,67 @@ func (n *Node) Network() *Network {
 
 // Network is the configuration of a network in the virtual network.
 type Network struct {
-	num     int // 1-based
-	mac     MAC // MAC address of the router/gateway
+	num     int      // 1-based
+	n       *network // nil until NewServer called
+	mac     MAC      // MAC address of the router/gateway
 	natType NAT
 
+	portAlloc PortAllocation // HardNAT's port allocation, or empty for the default
+	natLimit  mappingLimit   // from SetNATMappingLimit
+
 	wanIP6 netip.Prefix // global unicast router in host bits; CIDR is /64 delegated to LAN
+	nptLAN netip.Prefix // LAN /64 translated to wanIP6's with NPTv6, if any
 
 	wanIP4    netip.Addr // IPv4 WAN IP, if any
 	lanIP4    netip.Prefix
 	nodes     []*Node
 	breakWAN4 bool // whether to break WAN IPv4 connectivity
 
+	wanPool       []netip.Addr // WAN IPv4s besides wanIP4; see SetWANIPPool
+	wanPoolPolicy WANIPPolicy
+
 	svcs set.Set[NetworkService]
 
+	mtu      int           // or 0 for the default (1500)
 	latency  time.Duration // latency applied to interface writes
 	lossRate float64       // chance of packet loss (0.0 to 1.0)
 
+	largeLossSize int     // IP packets bigger than this are subject to largeLossRate
+	largeLossRate float64 // chance of large packet loss (0.0 to 1.0)
+
+	reorderRate float64       // chance of holding back a packet from the internet (0.0 to 1.0)
+	reorderHold time.Duration // longest a packet is held back
+	dupRate     float64       // chance of duplicating a packet from the internet (0.0 to 1.0)
+
+	corruptRate    float64 // chance of corrupting a packet delivered to a node (0.0 to 1.0)
+	corruptHeaders bool    // whether corruption may hit IP and transport headers
+
+	natFlushEvery time.Duration // see SetNATFlushInterval
+	arpTimeout    time.Duration // see SetARPTimeout
+	proxyARP      bool
+
+	impairSeed   uint64 // see SetImpairmentSeed
+	impairSeeded bool
+
+	icmpErrRate  float64 // ICMP errors per second, or 0 for no limit
+	icmpErrBurst int
+
+	dhcpLeaseTime time.Duration // or 0 for the default (1 hour)
+	dhcpDNS       []netip.Addr  // or nil for the fake DNS server
+	dhcpRoutes    []dhcpRoute
+
+	portForwards []portForward
+
+	captivePortal     bool
+	captivePortalDsts []netip.Prefix // or nil for all HTTP destinations
+
+	firewall []FirewallRule
+
+	udpBlocked          bool
+	udpBlockedAllowSTUN bool
+	udpBlockedLog       bool
+	derpBlocked         bool
+
 	// ...
 	err error // carried error
 }
@@ -302,12 +697,260 @@ func (n *Network) SetPacketLoss(rate float64) {
 	n.lossRate = rate
 }
 
+// SetLargePacketLoss sets the rate at which the network silently drops IP
+// packets bigger than size bytes forwarded between it and the internet, from
+// 0.0 (no loss) to 1.0 (total loss). Smaller packets, and packets within the
+// LAN or to and from the router itself, are unaffected.
+//
+// This simulates broken paths that lose big packets without sending any ICMP
+// errors, unlike SetMTU.
+func (n *Network) SetLargePacketLoss(size int, rate float64) {
+	n.largeLossSize = size
+	n.largeLossRate = max(0, min(rate, 1))
+}
+
+// SetReordering makes the network reorder UDP packets arriving from the
+// internet: each is held back with probability rate, from 0.0 (none) to 1.0
+// (all), to be delivered right after the next one, or after hold, as
+// measured by the Config's clock, if none arrives sooner. Only one packet is
+// held back at a time, so the order always resolves itself.
+func (n *Network) SetReordering(rate float64, hold time.Duration) {
+	n.reorderRate = max(0, min(rate, 1))
+	n.reorderHold = hold
+}
+
+// SetDuplication makes the network duplicate UDP packets arriving from the
+// internet, as some broken networks do: each is delivered twice, the exact
+// copy right after the original, with probability rate, from 0.0 (none) to
+// 1.0 (all). The copy is captured separately in the pcap file.
+func (n *Network) SetDuplication(rate float64) {
+	n.dupRate = max(0, min(rate, 1))
+}
+
+// SetCorruption makes the network corrupt IP packets it delivers to its
+// nodes: with probability rate, from 0.0 (none) to 1.0 (all), one random
+// byte of the packet's TCP or UDP payload is flipped, leaving its checksum
+// stale. Packets without a payload are left alone. If headers is true, the
+// flipped byte may be anywhere in the IP packet instead, headers included.
+func (n *Network) SetCorruption(rate float64, headers bool) {
+	n.corruptRate = max(0, min(rate, 1))
+	n.corruptHeaders = headers
+}
+
+// SetNATFlushInterval makes the network flush its NAT every d, as measured
+// by the Config's clock, dropping all NAT mappings and port mappings at once
+// as Server.FlushNAT does, to model a flaky router that keeps rebooting or
+// losing its state. Zero, the default, means never.
+func (n *Network) SetNATFlushInterval(d time.Duration) {
+	n.natFlushEvery = d
+}
+
+// SetARPTimeout sets how long the router remembers the IPv4 address to MAC
+// mappings it learns from the ARP packets of its nodes, as measured by the
+// Config's clock. Each ARP packet from a node, gratuitous ARPs announcing an
+// address included, maps its sender's address to its MAC, taking precedence
+// over the address the node was configured with; when the mapping ages out,
+// the router falls back to the configured addresses. Zero, the default, means
+// learned mappings never age out.
+func (n *Network) SetARPTimeout(d time.Duration) {
+	n.arpTimeout = d
+}
+
+// SetProxyARP sets whether the router answers ARP requests for IPv4
+// addresses off its LAN, which it would route, with its own MAC, as routers
+// doing proxy ARP do. That lets guests misconfigured to think such addresses
+// are on-link still reach them. By default, it only answers for itself and
+// its nodes.
+func (n *Network) SetProxyARP(v bool) {
+	n.proxyARP = v
+}
+
+// SetImpairmentSeed seeds the random source of the network's simulated
+// faults that are reproducible, such as SetReordering, SetDuplication and
+// SetCorruption, so that tests see the same ones on every run. By default,
+// it's seeded randomly.
+func (n *Network) SetImpairmentSeed(seed uint64) {
+	n.impairSeed = seed
+	n.impairSeeded = true
+}
+
+// SetMTU sets the MTU of the network's link to the internet. The default is
+// 1500.
+//
+// IPv4 packets the router forwards that are bigger than the MTU are
+// fragmented, unless they have the Don't Fragment bit set, in which case the
+// sender gets an ICMP "fragmentation needed" error with the MTU. IPv6 packets
+// that are too big get an ICMPv6 "packet too big" error instead.
+func (n *Network) SetMTU(mtu int) {
+	n.mtu = mtu
+}
+
+// SetWANIPPool gives the network more WAN IPv4s besides its WAN IP, as with
+// an ISP whose NAT spreads its subscribers' traffic over a pool of public
+// addresses. Packets to any of them are routed to the network. The NAT picks
+// the WAN IP of each new outgoing flow from them and the network's WAN IP,
+// per policy.
+//
+// Port mappings and port forwards only use the network's WAN IP.
+func (n *Network) SetWANIPPool(policy WANIPPolicy, ips ...netip.Addr) {
+	n.wanPool = ips
+	n.wanPoolPolicy = policy
+}
+
+// SetNATMappingLimit caps the number of simultaneous mappings in the
+// network's NAT table at max, as on a cheap router that runs out of NAT
+// state. Once the table is full, flows needing a new mapping are dropped or
+// evict the oldest mapping, per policy. The default, 0, means no limit.
+//
+// It doesn't apply to One2OneNAT, which has no mappings, nor to port
+// mappings. With a WAN IP pool (see SetWANIPPool), the limit is per WAN IP.
+func (n *Network) SetNATMappingLimit(max int, policy NATFullPolicy) {
+	n.natLimit = mappingLimit{max: max, policy: policy}
+}
+
+// SetICMPErrorRateLimit limits the rate at which the network's router sends
+// ICMP errors (such as port unreachable or packet too big) to perSec per
+// second, with bursts of up to burst errors. Errors over the limit are
+// silently not sent, as real routers do. By default there's no limit.
+//
+// This lets tests reproduce path MTU discovery being slowed down by
+// throttled packet too big errors.
+func (n *Network) SetICMPErrorRateLimit(perSec float64, burst int) {
+	n.icmpErrRate = perSec
+	n.icmpErrBurst = burst
+}
+
+// SetDHCPLeaseTime sets the lease time the network's DHCP server grants.
+// The default is one hour.
+func (n *Network) SetDHCPLeaseTime(d time.Duration) {
+	n.dhcpLeaseTime = d
+}
+
+// SetDHCPDNSServers sets the IPv4 DNS servers the network's DHCP server
+// tells clients to use, in order of preference. The default is the fake DNS
+// server.
+func (n *Network) SetDHCPDNSServers(ips ...netip.Addr) {
+	n.dhcpDNS = ips
+}
+
+// dhcpRoute is a classless static route added with Network.AddDHCPRoute.
+type dhcpRoute struct {
+	prefix  netip.Prefix
+	gateway netip.Addr
+}
+
+// AddDHCPRoute adds a classless static route (DHCP option 121, RFC 3442) to
+// prefix via gateway to the network's DHCP leases.
+//
+// Clients that support option 121 ignore the router option when it's present,
+// so the default route via the network's router is sent as well, unless a
+// route to 0.0.0.0/0 was added.
+func (n *Network) AddDHCPRoute(prefix netip.Prefix, gateway netip.Addr) {
+	n.dhcpRoutes = append(n.dhcpRoutes, dhcpRoute{prefix.Masked(), gateway})
+}
+
+// portForward is a static port forward added with Network.AddPortForward.
+type portForward struct {
+	wanPort uint16
+	node    *Node
+	lanPort uint16
+}
+
+// AddPortForward adds a static port forward, as a user might configure on
+// their home router, from TCP and UDP port wanPort on the network's WAN IPv4
+// to port lanPort on node, which must be on this network.
+//
+// Unlike port mappings made with NAT-PMP, PCP or UPnP, port forwards never
+// expire.
+func (n *Network) AddPortForward(wanPort uint16, node *Node, lanPort uint16) {
+	n.portForwards = append(n.portForwards, portForward{wanPort, node, lanPort})
+}
+
 // SetBlackholedIPv4 sets whether the network should blackhole all IPv4 traffic
 // out to the Internet. (DHCP etc continues to work on the LAN.)
 func (n *Network) SetBlackholedIPv4(v bool) {
 	n.breakWAN4 = v
 }
 
+// SetCaptivePortal puts the network behind a simulated captive portal.
+//
+// The router intercepts HTTP (TCP port 80) connections to dsts, or to any
+// destination other than the fake control server if dsts is empty, and
+// answers them itself: requests for /generate_204 are redirected to a login
+// page and all other requests get the login page. This includes the DERP
+// servers' /generate_204 endpoint that Tailscale's captive portal detection
+// probes. Other traffic is unaffected.
+func (n *Network) SetCaptivePortal(dsts ...netip.Prefix) {
+	n.captivePortal = true
+	n.captivePortalDsts = dsts
+}
+
+// AddFirewallRule appends r to the network's firewall rules.
+//
+// The router evaluates the rules in the order they were added against UDP
+// and TCP it forwards between the LAN and the internet. The first matching
+// rule decides what happens to a packet; packets matching no rule are
+// allowed.
+func (n *Network) AddFirewallRule(r FirewallRule) {
+	if err := r.validate(); err != nil {
+		n.err = fmt.Errorf("firewall rule %d: %w", len(n.firewall)+1, err)
+		return
+	}
+	n.firewall = append(n.firewall, r)
+}
+
+// SetUDPBlocked sets whether the network's router drops all UDP it would
+// forward between the LAN and the internet, forcing Tailscale to relay
+// through DERP. Blocked packets are counted in NetworkStats.UDPBlocked.
+func (n *Network) SetUDPBlocked(v bool) {
+	n.udpBlocked = v
+}
+
+// SetUDPBlockedAllowSTUN sets whether, with UDP blocked by SetUDPBlocked, the
+// router still lets STUN through to and from the fake STUN server at the
+// DERP servers' IPs, so netcheck can learn the network's WAN IP.
+func (n *Network) SetUDPBlockedAllowSTUN(v bool) {
+	n.udpBlockedAllowSTUN = v
+}
+
+// SetUDPBlockedLogging sets whether the router logs each UDP packet dropped
+// because of SetUDPBlocked.
+func (n *Network) SetUDPBlockedLogging(v bool) {
+	n.udpBlockedLog = v
+}
+
+// SetDERPBlocked sets whether the network's router silently drops TCP to
+// ports 80 and 443 of the DERP servers, both the fakes and, with
+// Config.SetBlendReality, the real ones. Combined with SetUDPBlocked, it
+// leaves the network's nodes with no way to reach their peers.
+func (n *Network) SetDERPBlocked(v bool) {
+	n.derpBlocked = v
+}
+
+// SetNPTv6 makes the network's router do IPv6-to-IPv6 network prefix
+// translation (NPTv6, RFC 6296) between lan, the /64 its LAN uses, and its
+// WAN IPv6 /64. Outgoing packets' source prefixes are rewritten from lan to
+// the WAN's and incoming packets' destination prefixes the other way, keeping
+// the interface identifiers. The router advertises lan in place of its WAN
+// prefix, and its LAN address is in lan with the same host bits as its WAN
+// address.
+func (n *Network) SetNPTv6(lan netip.Prefix) {
+	n.nptLAN = lan
+}
+
+// defaultLANIP4 is the LAN prefix of networks configured without any IPv4
+// LAN or IPv6 WAN prefix.
+var defaultLANIP4 = netip.MustParsePrefix("192.168.0.0/24")
+
+// lanPrefix4 returns the network's LAN IPv4 prefix, or the zero value if
+// it's IPv6-only.
+func (n *Network) lanPrefix4() netip.Prefix {
+	if !n.lanIP4.IsValid() && !n.wanIP6.IsValid() {
+		return defaultLANIP4
+	}
+	return n.lanIP4
+}
+
 func (n *Network) CanV4() bool {
 	return n.lanIP4.IsValid() || n.wanIP4.IsValid()
 }
@@ -342,119 +985,390 @@ func (n *Network) AddService(s NetworkService) {
 	}
 }
 
+// initNetwork returns the runtime network configured by conf, adding its
+// WAN addresses to byWAN. It's used by New and by Server.AddNetwork, which
+// add it to s.networks.
+func (s *Server) initNetwork(conf *Network, byWAN *bart.Table[*network]) (*network, error) {
+	conf.lanIP4 = conf.lanPrefix4()
+	mtu := cmp.Or(conf.mtu, 1500)
+	if mtu < 576 || (conf.wanIP6.IsValid() && mtu < 1280) {
+		return nil, fmt.Errorf("network %d: MTU %d too small", conf.num, mtu)
+	}
+	if conf.natLimit.max < 0 {
+		return nil, fmt.Errorf("network %d: negative NAT mapping limit %d", conf.num, conf.natLimit.max)
+	}
+	if conf.reorderRate > 0 && conf.reorderHold <= 0 {
+		return nil, fmt.Errorf("network %d: reordering hold time %v isn't positive", conf.num, conf.reorderHold)
+	}
+	if conf.natFlushEvery < 0 {
+		return nil, fmt.Errorf("network %d: negative NAT flush interval %v", conf.num, conf.natFlushEvery)
+	}
+	if conf.arpTimeout < 0 {
+		return nil, fmt.Errorf("network %d: negative ARP timeout %v", conf.num, conf.arpTimeout)
+	}
+	leaseSec := cmp.Or(conf.dhcpLeaseTime, time.Hour) / time.Second
+	if leaseSec < 1 || leaseSec > math.MaxUint32 {
+		return nil, fmt.Errorf("network %d: DHCP lease time %v out of range", conf.num, conf.dhcpLeaseTime)
+	}
+	dhcpDNS := conf.dhcpDNS
+	if dhcpDNS == nil {
+		dhcpDNS = []netip.Addr{s.vip(fakeDNS).v4}
+	}
+	if len(dhcpDNS) > math.MaxUint8/4 {
+		return nil, fmt.Errorf("network %d: too many DHCP DNS servers", conf.num)
+	}
+	for _, ip := range dhcpDNS {
+		if !ip.Is4() {
+			return nil, fmt.Errorf("network %d: DHCP DNS server %v isn't IPv4", conf.num, ip)
+		}
+	}
+	dhcpRoutes, err := encodeDHCPRoutes(conf.dhcpRoutes, conf.lanIP4.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("network %d: %w", conf.num, err)
+	}
+	impairSeed := conf.impairSeed
+	if !conf.impairSeeded {
+		impairSeed = s.rng.Uint64()
+	}
+	n := &network{
+		num:           conf.num,
+		s:             s,
+		mac:           conf.mac,
+		portAlloc:     conf.portAlloc,
+		natLimit:      conf.natLimit,
+		wanPool:       conf.wanPool,
+		wanPoolPolicy: conf.wanPoolPolicy,
+		portmap:       conf.svcs.Contains(NATPMP),
+		pcp:           conf.svcs.Contains(PCP),
+		upnp:          conf.svcs.Contains(UPnP),
+		wanIP6:        conf.wanIP6,
+		lanIP6:        conf.wanIP6,
+		v4:            conf.lanIP4.IsValid(),
+		v6:            conf.wanIP6.IsValid(),
+		lanIP4:        conf.lanIP4,
+		breakWAN4:     conf.breakWAN4,
+		captivePortal: conf.captivePortal,
+		captiveDsts:   conf.captivePortalDsts,
+		firewall:      conf.firewall,
+		udpBlocked:    conf.udpBlocked,
+		udpAllowSTUN:  conf.udpBlockedAllowSTUN,
+		udpBlockedLog: conf.udpBlockedLog,
+		derpBlocked:   conf.derpBlocked,
+		mtu:           mtu,
+		dhcpLeaseSec:  uint32(leaseSec),
+		dhcpDNS:       dhcpDNS,
+		dhcpRoutes:    dhcpRoutes,
+		icmpErrLimit:  newICMPErrorLimiter(conf.icmpErrRate, conf.icmpErrBurst),
+		latency:       conf.latency,
+		lossRate:      conf.lossRate,
+		largeLossSize: conf.largeLossSize,
+		largeLossRate: conf.largeLossRate,
+		reorderRate:   conf.reorderRate,
+		reorderHold:   conf.reorderHold,
+		dupRate:       conf.dupRate,
+		corruptRate:   conf.corruptRate,
+		corruptHdrs:   conf.corruptHeaders,
+		natFlushEvery: conf.natFlushEvery,
+		arpTimeout:    conf.arpTimeout,
+		proxyARP:      conf.proxyARP,
+		rng:           newRand(impairSeed, true),
+		logf:          logger.WithPrefix(s.logf, fmt.Sprintf("[net-%v] ", conf.mac)),
+	}
+	n.wanIP4.Store(conf.wanIP4)
+	if conf.wanIP4.IsValid() {
+		if conf.wanIP4.Is6() {
+			return nil, fmt.Errorf("invalid IPv6 address in wanIP")
+		}
+		if _, ok := byWAN.Lookup(conf.wanIP4); ok {
+			return nil, fmt.Errorf("two networks have the same WAN IP %v; Anycast not (yet?) supported", conf.wanIP4)
+		}
+		byWAN.Insert(netip.PrefixFrom(conf.wanIP4, 32), n)
+	}
+	if len(conf.wanPool) > 0 {
+		if !conf.wanIP4.IsValid() {
+			return nil, fmt.Errorf("network %d: WAN IP pool without a WAN IP", conf.num)
+		}
+	}
+	for _, ip := range conf.wanPool {
+		if !ip.Is4() {
+			return nil, fmt.Errorf("network %d: invalid WAN IP %v in pool", conf.num, ip)
+		}
+		if _, ok := byWAN.Lookup(ip); ok {
+			return nil, fmt.Errorf("network %d: WAN IP %v in pool is already in use", conf.num, ip)
+		}
+		byWAN.Insert(netip.PrefixFrom(ip, 32), n)
+	}
+	if conf.wanIP6.IsValid() {
+		if conf.wanIP6.Addr().Is4() {
+			return nil, fmt.Errorf("invalid IPv4 address in wanIP6")
+		}
+		if _, ok := byWAN.LookupPrefix(conf.wanIP6); ok {
+			return nil, fmt.Errorf("two networks have the same WAN IPv6 %v; Anycast not (yet?) supported", conf.wanIP6)
+		}
+		byWAN.Insert(conf.wanIP6, n)
+	}
+	if conf.nptLAN.IsValid() {
+		lan := conf.nptLAN
+		if !conf.wanIP6.IsValid() {
+			return nil, fmt.Errorf("network %d: NPTv6 without a WAN IPv6", conf.num)
+		}
+		if !lan.Addr().Is6() || lan.Bits() != 64 || conf.wanIP6.Bits() != 64 {
+			return nil, fmt.Errorf("network %d: NPTv6 needs IPv6 /64 LAN and WAN prefixes; got %v and %v", conf.num, lan, conf.wanIP6)
+		}
+		if lan.Overlaps(conf.wanIP6) {
+			return nil, fmt.Errorf("network %d: NPTv6 LAN prefix %v is the WAN's", conf.num, lan)
+		}
+		n.lanIP6 = netip.PrefixFrom(translatePrefix6(conf.wanIP6.Addr(), lan), 64)
+		n.npt6 = true
+	}
+	n.lanInterfaceID = must.Get(s.addCaptureInterface(pcapgo.NgInterface{
+		Name:        fmt.Sprintf("net%d-lan", conf.num),
+		Description: fmt.Sprintf("LAN of network %d (%s)", conf.num, joinValid(n.lanIP4, n.lanIP6)),
+		LinkType:    layers.LinkTypeIPv4,
+	}))
+	n.wanInterfaceID = must.Get(s.addCaptureInterface(pcapgo.NgInterface{
+		Name:        fmt.Sprintf("net%d-wan", conf.num),
+		Description: fmt.Sprintf("WAN of network %d (%s, %v NAT)", conf.num, joinValid(n.WANIP(), n.wanIP6), cmp.Or(conf.natType, EasyNAT)),
+		LinkType:    layers.LinkTypeIPv4,
+	}))
+	n.ctx, n.cancel = context.WithCancel(s.shutdownCtx)
+	conf.n = n
+	return n, nil
+}
+
+// addNodeLocked sets up the node configured by conf on the network net,
+// adding it to s. It's used by New and by Server.AddNode. On error, s is
+// left unchanged. s.nodesMu must be held.
+func (s *Server) addNodeLocked(conf *Node, net *network) error {
+	n := &node{
+		num:           conf.num,
+		mac:           conf.mac,
+		net:           net,
+		verboseSyslog: conf.VerboseSyslog(),
+		clockSkew:     conf.clockSkew,
+	}
+	if other, ok := s.nodeByMAC.Load(n.mac); ok {
+		return fmt.Errorf("%v and %v have the same MAC %v", other, n, n.mac)
+	}
+	if net.v4 {
+		// Allocate a lanIP for the node. Use the network's CIDR and use final
+		// octet 101 (for first node), 102, etc. The node number comes from the
+		// last octent of the MAC address (0-based)
+		n.lanIP = derivedLANIP(net.lanIP4, n.mac)
+		if conf.lanIP.IsValid() {
+			if !net.lanIP4.Contains(conf.lanIP) || conf.lanIP == net.lanIP4.Addr() {
+				return fmt.Errorf("%v: LAN IP %v isn't a host address in its network's %v", n, conf.lanIP, net.lanIP4)
+			}
+			n.lanIP = conf.lanIP
+		}
+		if n.lanIP == net.lanIP4.Addr() {
+			// The final octet derived from a custom MAC wrapped around.
+			return fmt.Errorf("%v: LAN IP %v is the router's; set another with SetLANIP", n, n.lanIP)
+		}
+		if other, ok := net.nodesByIP4.Load(n.lanIP); ok {
+			return fmt.Errorf("%v and %v have the same LAN IP %v", other, n, n.lanIP)
+		}
+	} else if conf.lanIP.IsValid() {
+		return fmt.Errorf("%v: LAN IP set on a network without IPv4", n)
+	}
+	if net.v6 {
+		// Like the lanIP, use host number 100 + the node number for
+		// the address DHCPv6 assigns in the network's /64.
+		ip6 := net.lanIP6.Masked().Addr().As16()
+		binary.BigEndian.PutUint16(ip6[14:], 100+uint16(n.mac[5]))
+		n.dhcp6IP = netip.AddrFrom16(ip6)
+		if n.dhcp6IP == net.lanIP6.Addr() {
+			return fmt.Errorf("%v: DHCPv6 address %v is the router's", n, n.dhcp6IP)
+		}
+		for other := range net.nodesByMAC.Values() {
+			if other.dhcp6IP == n.dhcp6IP {
+				return fmt.Errorf("%v and %v have the same DHCPv6 address %v", other, n, n.dhcp6IP)
+			}
+		}
+	}
+	for _, pfx := range conf.subnetRoutes {
+		if !pfx.IsValid() || pfx != pfx.Masked() {
+			return fmt.Errorf("%v: invalid subnet route %v", n, pfx)
+		}
+		if s.subnetRoutes.OverlapsPrefix(pfx) || slices.ContainsFunc(n.subnetRoutes, pfx.Overlaps) {
+			return fmt.Errorf("%v: subnet route %v overlaps another", n, pfx)
+		}
+		n.subnetRoutes = append(n.subnetRoutes, pfx)
+	}
+	id, err := s.addCaptureInterface(pcapgo.NgInterface{
+		Name:        n.String(),
+		Description: fmt.Sprintf("node %d (MAC %v) on network %d", conf.num, n.mac, net.num),
+		LinkType:    layers.LinkTypeEthernet,
+	})
+	if err != nil {
+		return err
+	}
+	n.interfaceID = id
+	if conf.hostStack {
+		n.hs = &hostStack{node: n}
+	}
+
+	for _, pfx := range n.subnetRoutes {
+		s.subnetRoutes.Insert(pfx, n)
+	}
+	conf.n = n
+	s.nodes = append(s.nodes, n)
+	s.nodeByMAC.Store(n.mac, n)
+	if n.lanIP.IsValid() {
+		net.nodesByIP4.Store(n.lanIP, n)
+	}
+	net.nodesByMAC.Store(n.mac, n)
+	return nil
+}
+
+// ValidateConfig checks c for problems that would otherwise make New fail
+// confusingly, or make the virtual network misbehave once running:
+//
+//   - errors carried by its networks and nodes, such as unknown options
+//   - networks with overlapping LAN prefixes, or a WAN IPv4 inside a LAN
+//   - networks missing the IPv4 their WAN IPv4 or services need
+//   - unknown NAT types, and NAT types combined with options they can't
+//     support, such as port mapping with One2OneNAT
+//   - nodes or routers with the same MAC
+//
+// It returns all the problems it finds, joined with errors.Join, or nil. New
+// calls it first.
+func ValidateConfig(c *Config) error {
+	var errs []error
+	macOwner := map[MAC]string{}
+	claimMAC := func(mac MAC, owner string) {
+		if other, ok := macOwner[mac]; ok {
+			errs = append(errs, fmt.Errorf("%s and %s have the same MAC %v", other, owner, mac))
+			return
+		}
+		macOwner[mac] = owner
+	}
+
+	for i, n := range c.networks {
+		if n.err != nil {
+			errs = append(errs, n.err)
+		}
+		claimMAC(n.mac, fmt.Sprintf("network %d's router", n.num))
+		lan4 := n.lanPrefix4()
+		if !lan4.IsValid() {
+			// An IPv6-only network. Nothing on its LAN has IPv4, so nothing
+			// that needs IPv4 can work.
+			if n.wanIP4.IsValid() {
+				errs = append(errs, fmt.Errorf("network %d: WAN IPv4 %v without a LAN IPv4 prefix", n.num, n.wanIP4))
+			}
+			for _, svc := range []NetworkService{NATPMP, PCP, UPnP} {
+				if n.svcs.Contains(svc) {
+					errs = append(errs, fmt.Errorf("network %d: %v needs IPv4 on the LAN", n.num, svc))
+				}
+			}
+		}
+		for _, other := range c.networks[:i] {
+			if o4 := other.lanPrefix4(); lan4.IsValid() && o4.IsValid() && lan4.Overlaps(o4) {
+				errs = append(errs, fmt.Errorf("networks %d and %d have overlapping LAN prefixes %v and %v", other.num, n.num, o4.Masked(), lan4.Masked()))
+			}
+		}
+		for _, other := range c.networks {
+			if o4 := other.lanPrefix4(); n.wanIP4.IsValid() && o4.Contains(n.wanIP4) {
+				errs = append(errs, fmt.Errorf("network %d: WAN IP %v is inside network %d's LAN prefix %v", n.num, n.wanIP4, other.num, o4.Masked()))
+			}
+		}
+
+		natType := cmp.Or(n.natType, EasyNAT)
+		if _, ok := natTypes[natType]; !ok {
+			errs = append(errs, fmt.Errorf("network %d: unknown NAT type %q", n.num, natType))
+		}
+		if n.portAlloc != "" && natType != HardNAT {
+			errs = append(errs, fmt.Errorf("network %d: port allocation %q requires %v NAT, not %v", n.num, n.portAlloc, HardNAT, natType))
+		}
+		if natType == One2OneNAT {
+			if len(n.wanPool) > 0 {
+				errs = append(errs, fmt.Errorf("network %d: WAN IP pool with %v NAT", n.num, One2OneNAT))
+			}
+			for _, svc := range []NetworkService{NATPMP, PCP, UPnP} {
+				if n.svcs.Contains(svc) {
+					errs = append(errs, fmt.Errorf("network %d: %v can't map ports with %v NAT, which uses them all", n.num, svc, One2OneNAT))
+				}
+			}
+		}
+	}
+	for _, n := range c.nodes {
+		if n.err != nil {
+			errs = append(errs, n.err)
+		}
+		claimMAC(n.mac, n.String())
+	}
+	return errors.Join(errs...)
+}
+
 // initFromConfig initializes the server from the previous calls
 // to NewNode and NewNetwork and returns an error if
 // there were any configuration issues.
 func (s *Server) initFromConfig(c *Config) error {
 	netOfConf := map[*Network]*network{}
+	byWAN := &bart.Table[*network]{} // modified in place until the Server is running
+	s.networkByWAN.Store(byWAN)
 	if c.pcapFile != "" {
-		pcf, err := os.OpenFile(c.pcapFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-		if err != nil {
-			return err
+		if c.pcapMaxSize < 0 || c.pcapMaxAge < 0 {
+			return fmt.Errorf("negative pcap rotation limits %v, %v", c.pcapMaxSize, c.pcapMaxAge)
+		}
+		if f := c.pcapFilter; f != nil {
+			if err := f.validate(); err != nil {
+				return err
+			}
+			s.pcapFilter = &CaptureFilter{
+				Proto: f.Proto,
+				Ports: slices.Clone(f.Ports),
+				IPs:   slices.Clone(f.IPs),
+			}
 		}
-		nw, err := pcapgo.NewNgWriter(pcf, layers.LinkTypeEthernet)
+		pw, err := newPCAPWriter(c.pcapFile, c.pcapMaxSize, c.pcapMaxAge, s.clock)
 		if err != nil {
 			return err
 		}
-		pw := &pcapWriter{
-			f: pcf,
-			w: nw,
-		}
 		s.pcapWriter = pw
 	}
-	for i, conf := range c.networks {
-		if conf.err != nil {
-			return conf.err
-		}
-		if !conf.lanIP4.IsValid() && !conf.wanIP6.IsValid() {
-			conf.lanIP4 = netip.MustParsePrefix("192.168.0.0/24")
-		}
-		n := &network{
-			num:        conf.num,
-			s:          s,
-			mac:        conf.mac,
-			portmap:    conf.svcs.Contains(NATPMP), // TODO: expand network.portmap
-			wanIP6:     conf.wanIP6,
-			v4:         conf.lanIP4.IsValid(),
-			v6:         conf.wanIP6.IsValid(),
-			wanIP4:     conf.wanIP4,
-			lanIP4:     conf.lanIP4,
-			breakWAN4:  conf.breakWAN4,
-			latency:    conf.latency,
-			lossRate:   conf.lossRate,
-			nodesByIP4: map[netip.Addr]*node{},
-			nodesByMAC: map[MAC]*node{},
-			logf:       logger.WithPrefix(s.logf, fmt.Sprintf("[net-%v] ", conf.mac)),
+	s.logDir = c.logDir
+	for _, conf := range c.networks {
+		n, err := s.initNetwork(conf, byWAN)
+		if err != nil {
+			return err
 		}
 		netOfConf[conf] = n
 		s.networks.Add(n)
-		if conf.wanIP4.IsValid() {
-			if conf.wanIP4.Is6() {
-				return fmt.Errorf("invalid IPv6 address in wanIP")
-			}
-			if _, ok := s.networkByWAN.Lookup(conf.wanIP4); ok {
-				return fmt.Errorf("two networks have the same WAN IP %v; Anycast not (yet?) supported", conf.wanIP4)
-			}
-			s.networkByWAN.Insert(netip.PrefixFrom(conf.wanIP4, 32), n)
-		}
-		if conf.wanIP6.IsValid() {
-			if conf.wanIP6.Addr().Is4() {
-				return fmt.Errorf("invalid IPv4 address in wanIP6")
-			}
-			if _, ok := s.networkByWAN.LookupPrefix(conf.wanIP6); ok {
-				return fmt.Errorf("two networks have the same WAN IPv6 %v; Anycast not (yet?) supported", conf.wanIP6)
-			}
-			s.networkByWAN.Insert(conf.wanIP6, n)
-		}
-		n.lanInterfaceID = must.Get(s.pcapWriter.AddInterface(pcapgo.NgInterface{
-			Name:     fmt.Sprintf("network%d-lan", i+1),
-			LinkType: layers.LinkTypeIPv4,
-		}))
-		n.wanInterfaceID = must.Get(s.pcapWriter.AddInterface(pcapgo.NgInterface{
-			Name:     fmt.Sprintf("network%d-wan", i+1),
-			LinkType: layers.LinkTypeIPv4,
-		}))
 	}
+	s.lastNetNum = len(c.networks)
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
 	for _, conf := range c.nodes {
-		if conf.err != nil {
-			return conf.err
-		}
-		n := &node{
-			num:           conf.num,
-			mac:           conf.mac,
-			net:           netOfConf[conf.Network()],
-			verboseSyslog: conf.VerboseSyslog(),
-		}
-		n.interfaceID = must.Get(s.pcapWriter.AddInterface(pcapgo.NgInterface{
-			Name:     n.String(),
-			LinkType: layers.LinkTypeEthernet,
-		}))
-		conf.n = n
-		if _, ok := s.nodeByMAC[n.mac]; ok {
-			return fmt.Errorf("two nodes have the same MAC %v", n.mac)
-		}
-		s.nodes = append(s.nodes, n)
-		s.nodeByMAC[n.mac] = n
-
-		if n.net.v4 {
-			// Allocate a lanIP for the node. Use the network's CIDR and use final
-			// octet 101 (for first node), 102, etc. The node number comes from the
-			// last octent of the MAC address (0-based)
-			ip4 := n.net.lanIP4.Addr().As4()
-			ip4[3] = 100 + n.mac[5]
-			n.lanIP = netip.AddrFrom4(ip4)
-			n.net.nodesByIP4[n.lanIP] = n
-		}
-		n.net.nodesByMAC[n.mac] = n
-	}
-
-	// Now that nodes are populated, set up NAT:
+		if err := s.addNodeLocked(conf, netOfConf[conf.Network()]); err != nil {
+			return err
+		}
+	}
+	s.lastNodeNum = len(c.nodes)
+
+	// Now that nodes are populated, set up NAT and port forwards:
 	for _, conf := range c.networks {
 		n := netOfConf[conf]
-		natType := cmp.Or(conf.natType, EasyNAT)
-		if err := n.InitNAT(natType); err != nil {
+		if err := n.InitNAT(cmp.Or(conf.natType, EasyNAT)); err != nil {
 			return err
 		}
+		for _, pf := range conf.portForwards {
+			if pf.node.Network() != conf {
+				return fmt.Errorf("network %d: port forward to %v, which isn't on the network", conf.num, pf.node)
+			}
+			if !n.WANIP().IsValid() || !pf.node.n.lanIP.IsValid() {
+				return fmt.Errorf("network %d: port forward requires IPv4", conf.num)
+			}
+			wanAP := netip.AddrPortFrom(n.WANIP(), pf.wanPort)
+			lanAP := netip.AddrPortFrom(pf.node.n.lanIP, pf.lanPort)
+			for _, proto := range []layers.IPProtocol{layers.IPProtocolUDP, layers.IPProtocolTCP} {
+				k := portMapKey{proto, wanAP}
+				if _, ok := n.portMap[k]; ok {
+					return fmt.Errorf("network %d: duplicate port forward for %v", conf.num, wanAP)
+				}
+				mak.Set(&n.portMap, k, portMapping{dst: lanAP, expiry: noExpiry})
+			}
+		}
 	}
 
 	return nil
@@ -4,6 +4,11 @@
 package vnet
 
 import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -64,6 +69,212 @@ func TestConfig(t *testing.T) {
 			},
 			wantErr: "error creating NAT type \"one2one\" for network 2.1.1.1: can't use one2one NAT type on networks other than single-node networks",
 		},
+		{
+			name: "port-allocation-without-hard-nat",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT, PortAllocSequential))
+			},
+			wantErr: `network 1: port allocation "sequential" requires hard NAT, not easy`,
+		},
+		{
+			name: "wan-ip-pool-overlap",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24"))
+				net2 := c.AddNetwork("2.1.1.2", "192.168.2.1/24")
+				net2.SetWANIPPool(WANIPPerHost, netip.MustParseAddr("2.1.1.1"))
+				c.AddNode(net2)
+			},
+			wantErr: "network 2: WAN IP 2.1.1.1 in pool is already in use",
+		},
+		{
+			name: "reordering-without-hold",
+			setup: func(c *Config) {
+				nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				nw.SetReordering(0.5, 0)
+				c.AddNode(nw)
+			},
+			wantErr: "network 1: reordering hold time 0s isn't positive",
+		},
+		{
+			name: "nat-flush-interval-negative",
+			setup: func(c *Config) {
+				nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				nw.SetNATFlushInterval(-time.Second)
+				c.AddNode(nw)
+			},
+			wantErr: "network 1: negative NAT flush interval -1s",
+		},
+		{
+			name: "arp-timeout-negative",
+			setup: func(c *Config) {
+				nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				nw.SetARPTimeout(-time.Second)
+				c.AddNode(nw)
+			},
+			wantErr: "network 1: negative ARP timeout -1s",
+		},
+		{
+			name: "subnet-route-overlap",
+			setup: func(c *Config) {
+				nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				c.AddNode(nw).SetSubnetRoutes(netip.MustParsePrefix("10.0.0.0/8"))
+				c.AddNode(nw).SetSubnetRoutes(netip.MustParsePrefix("10.1.0.0/24"))
+			},
+			wantErr: "node2: subnet route 10.1.0.0/24 overlaps another",
+		},
+		{
+			name: "subnet-route-unmasked",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetSubnetRoutes(netip.MustParsePrefix("10.1.0.1/24"))
+			},
+			wantErr: "node1: invalid subnet route 10.1.0.1/24",
+		},
+		{
+			name: "mtu-too-small-for-v6",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", "2000:52::1/64")
+				net1.SetMTU(1000)
+				c.AddNode(net1)
+			},
+			wantErr: "network 1: MTU 1000 too small",
+		},
+		{
+			name: "port-forward-to-other-network",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				c.AddNode(net1)
+				node2 := c.AddNode(c.AddNetwork("2.2.2.2", "10.2.0.1/16"))
+				net1.AddPortForward(8080, node2, 80)
+			},
+			wantErr: "network 1: port forward to node2, which isn't on the network",
+		},
+		{
+			name: "lan-ip-outside-network",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetLANIP(netip.MustParseAddr("10.0.0.5"))
+			},
+			wantErr: "node1: LAN IP 10.0.0.5 isn't a host address in its network's 192.168.1.1/24",
+		},
+		{
+			name: "lan-ip-is-router",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 157})
+			},
+			wantErr: "node1: LAN IP 192.168.1.1 is the router's; set another with SetLANIP",
+		},
+		{
+			name: "dup-lan-ip",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				c.AddNode(net1)
+				c.AddNode(net1).SetLANIP(netip.MustParseAddr("192.168.1.101"))
+			},
+			wantErr: "node1 and node2 have the same LAN IP 192.168.1.101",
+		},
+		{
+			name: "bad-firewall-rule",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				net1.AddFirewallRule(FirewallRule{Proto: "UDP", Action: FirewallDrop})
+				net1.AddFirewallRule(FirewallRule{Proto: "TCP", DstPorts: PortRange{443, 80}, Action: FirewallDrop})
+				c.AddNode(net1)
+			},
+			wantErr: "firewall rule 2: bad port range 443-80",
+		},
+		{
+			name: "npt6-without-wan6",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				net1.SetNPTv6(netip.MustParsePrefix("fd00:1::/64"))
+				c.AddNode(net1)
+			},
+			wantErr: "network 1: NPTv6 without a WAN IPv6",
+		},
+		{
+			name: "npt6-not-64",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", "2000:1::1/64")
+				net1.SetNPTv6(netip.MustParsePrefix("fd00:1::/48"))
+				c.AddNode(net1)
+			},
+			wantErr: "network 1: NPTv6 needs IPv6 /64 LAN and WAN prefixes; got fd00:1::/48 and 2000:1::1/64",
+		},
+		{
+			name: "v6-only-with-wan4",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "2000:1::1/64"))
+			},
+			wantErr: "network 1: WAN IPv4 2.1.1.1 without a LAN IPv4 prefix",
+		},
+		{
+			name: "v6-only-with-natpmp",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2000:1::1/64", NATPMP))
+			},
+			wantErr: "network 1: NAT-PMP needs IPv4 on the LAN",
+		},
+		{
+			name: "dhcp6-ip-is-router",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2000:52::65/64"))
+			},
+			wantErr: "node1: DHCPv6 address 2000:52::65 is the router's",
+		},
+		{
+			name: "dup-dhcp6-ip",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2000:52::1/64")
+				c.AddNode(net1).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0x05})
+				c.AddNode(net1).SetMAC(MAC{0x52, 0xcc, 0xcc, 0xcc, 0xdd, 0x05})
+			},
+			wantErr: "node1 and node2 have the same DHCPv6 address 2000:52::69",
+		},
+		{
+			name: "overlapping-lans",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "10.0.0.1/16"))
+				c.AddNode(c.AddNetwork("2.2.2.2", "10.0.5.1/24"))
+			},
+			wantErr: "networks 1 and 2 have overlapping LAN prefixes 10.0.0.0/16 and 10.0.5.0/24",
+		},
+		{
+			name: "wan-ip-in-lan",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "10.0.0.1/16"))
+				c.AddNode(c.AddNetwork("10.0.9.9", "192.168.1.1/24"))
+			},
+			wantErr: "network 2: WAN IP 10.0.9.9 is inside network 1's LAN prefix 10.0.0.0/16",
+		},
+		{
+			name: "unknown-nat",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", NAT("bogus")))
+			},
+			wantErr: `network 1: unknown NAT type "bogus"`,
+		},
+		{
+			name: "one-to-one-nat-with-port-mapping",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT, PCP))
+			},
+			wantErr: "network 1: PCP can't map ports with one2one NAT, which uses them all",
+		},
+		{
+			name: "dup-node-mac",
+			setup: func(c *Config) {
+				net1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24")
+				c.AddNode(net1)
+				c.AddNode(net1).SetMAC(nodeMac(1))
+			},
+			wantErr: "node1 and node2 have the same MAC 52:cc:cc:cc:cc:01",
+		},
+		{
+			name: "node-with-router-mac",
+			setup: func(c *Config) {
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24")).SetMAC(routerMac(1))
+			},
+			wantErr: "network 1's router and node1 have the same MAC 52:ee:ee:ee:ee:01",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -83,6 +294,28 @@ func TestConfig(t *testing.T) {
 	}
 }
 
+func TestValidateConfigAllProblems(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "10.0.0.1/16", NAT("bogus")))
+	c.AddNode(c.AddNetwork("2.2.2.2", "10.0.0.1/24", One2OneNAT, NATPMP)).SetMAC(nodeMac(1))
+	err := ValidateConfig(&c)
+	if err == nil {
+		t.Fatal("got success")
+	}
+	want := []string{
+		`network 1: unknown NAT type "bogus"`,
+		"networks 1 and 2 have overlapping LAN prefixes 10.0.0.0/16 and 10.0.0.0/24",
+		"network 2: NAT-PMP can't map ports with one2one NAT, which uses them all",
+		"node1 and node2 have the same MAC 52:cc:cc:cc:cc:01",
+	}
+	if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if _, err2 := New(&c); err2 == nil || err2.Error() != err.Error() {
+		t.Errorf("New error = %v; want ValidateConfig's", err2)
+	}
+}
+
 func TestNodeString(t *testing.T) {
 	if g, w := (&Node{num: 1}).String(), "node1"; g != w {
 		t.Errorf("got %q; want %q", g, w)
@@ -91,3 +324,160 @@ func TestNodeString(t *testing.T) {
 		t.Errorf("got %q; want %q", g, w)
 	}
 }
+
+func TestNodeAddresses(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	pinnedMAC := MAC{0x52, 0xcc, 0xcc, 0xcc, 0xdd, 0x07}
+	pinned := c.AddNode(nw, pinnedMAC, netip.MustParseAddr("192.168.1.50"))
+	derived := c.AddNode(nw)
+	v6only := c.AddNode(c.AddNetwork("2000:52::1/64"))
+
+	check := func(when string) {
+		t.Helper()
+		for _, tt := range []struct {
+			node         *Node
+			mac          MAC
+			lanIP, wanIP string
+		}{
+			{pinned, pinnedMAC, "192.168.1.50", "2.1.1.1"},
+			{derived, nodeMac(2), "192.168.1.102", "2.1.1.1"},
+			{v6only, nodeMac(3), "invalid IP", "invalid IP"},
+		} {
+			if got := tt.node.MAC(); got != tt.mac {
+				t.Errorf("%s: %v MAC = %v; want %v", when, tt.node, got, tt.mac)
+			}
+			if got := tt.node.LANIP().String(); got != tt.lanIP {
+				t.Errorf("%s: %v LANIP = %v; want %v", when, tt.node, got, tt.lanIP)
+			}
+			if got := tt.node.WANIP().String(); got != tt.wanIP {
+				t.Errorf("%s: %v WANIP = %v; want %v", when, tt.node, got, tt.wanIP)
+			}
+		}
+	}
+	check("before New")
+	s, err := New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check("after New")
+}
+
+func TestParseConfigFile(t *testing.T) {
+	const yamlConf = `
+derps: 1
+networks:
+  - wanIP: 2.1.1.1
+    lanIP: 192.168.1.1/24
+    nat: easy
+    services: [NAT-PMP, UPnP]
+  - wanIP: 2.2.2.2
+    lanIP: 10.2.0.1/16
+    wanIP6: 2000:52::1/64
+    nat: hard
+nodes:
+  - network: 1
+    mac: 52:cc:cc:cc:cc:aa
+    lanIP: 192.168.1.50
+  - network: 2
+    options: [VerboseSyslog]
+`
+	const jsonConf = `{
+		"derps": 1,
+		"networks": [
+			{"wanIP": "2.1.1.1", "lanIP": "192.168.1.1/24", "nat": "easy", "services": ["NAT-PMP", "UPnP"]},
+			{"wanIP": "2.2.2.2", "lanIP": "10.2.0.1/16", "wanIP6": "2000:52::1/64", "nat": "hard"}
+		],
+		"nodes": [
+			{"network": 1, "mac": "52:cc:cc:cc:cc:aa", "lanIP": "192.168.1.50"},
+			{"network": 2, "options": ["VerboseSyslog"]}
+		]
+	}`
+	want := TopologyInfo{
+		Networks: []NetworkInfo{
+			{Num: 1, MAC: routerMac(1), LANIP4: netip.MustParsePrefix("192.168.1.1/24"), WANIP4: netip.MustParseAddr("2.1.1.1"), NAT: EasyNAT},
+			{Num: 2, MAC: routerMac(2), LANIP4: netip.MustParsePrefix("10.2.0.1/16"), WANIP4: netip.MustParseAddr("2.2.2.2"), WANIP6: netip.MustParsePrefix("2000:52::1/64"), NAT: HardNAT},
+		},
+		Nodes: []NodeInfo{
+			{Num: 1, MAC: MAC{0x52, 0xcc, 0xcc, 0xcc, 0xcc, 0xaa}, LANIP: netip.MustParseAddr("192.168.1.50"), Network: 1},
+			{Num: 2, MAC: nodeMac(2), LANIP: netip.MustParseAddr("10.2.0.102"), Network: 2},
+		},
+	}
+	for name, conf := range map[string]string{"yaml": yamlConf, "json": jsonConf} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "vnet."+name)
+			if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := ParseConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if got := s.Topology(); !reflect.DeepEqual(got, want) {
+				t.Errorf("topology = %+v; want %+v", got, want)
+			}
+			if got := len(s.control.DERPMap.Regions); got != 1 {
+				t.Errorf("got %d DERP regions; want 1", got)
+			}
+			if !s.nodes[0].net.portmap || !s.nodes[0].net.upnp {
+				t.Error("network 1 services not enabled")
+			}
+			if !s.nodes[1].verboseSyslog {
+				t.Error("node 2 VerboseSyslog not set")
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr string
+	}{
+		{
+			name:    "unknown-nat",
+			conf:    "networks: [{wanIP: 2.1.1.1, nat: bogus}]",
+			wantErr: `network 1: unknown NAT type "bogus"; valid types are: easy, easyaf, hard, one2one, preserve, roundtrip`,
+		},
+		{
+			name:    "unknown-ports",
+			conf:    "networks: [{wanIP: 2.1.1.1, nat: hard, ports: odd}]",
+			wantErr: `network 1: unknown port allocation "odd"`,
+		},
+		{
+			name:    "unknown-service",
+			conf:    "networks: [{services: [DHCP6]}]",
+			wantErr: `network 1: unknown service "DHCP6"`,
+		},
+		{
+			name:    "unknown-field",
+			conf:    "networks: [{wanIPv4: 2.1.1.1}]",
+			wantErr: `unknown field "wanIPv4"`,
+		},
+		{
+			name:    "missing-network",
+			conf:    "networks: [{}]\nnodes: [{network: 2}]",
+			wantErr: "node 1: network 2 doesn't exist",
+		},
+		{
+			name:    "bad-mac",
+			conf:    "networks: [{}]\nnodes: [{network: 1, mac: nope}]",
+			wantErr: `node 1: invalid MAC "nope"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.conf))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
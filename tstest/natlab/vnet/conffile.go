@@ -0,0 +1,154 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// configFile is the declarative form of a Config, as read by ParseConfigFile.
+type configFile struct {
+	BlendReality bool                `json:"blendReality,omitempty"`
+	DERPs        int                 `json:"derps,omitempty"` // or 0 for the default
+	PCAPFile     string              `json:"pcapFile,omitempty"`
+	LogDir       string              `json:"logDir,omitempty"` // see Config.SetLogDir
+	Networks     []configFileNetwork `json:"networks"`
+	Nodes        []configFileNode    `json:"nodes"`
+}
+
+type configFileNetwork struct {
+	WANIP    string           `json:"wanIP,omitempty"`  // IPv4 WAN IP, if any
+	LANIP    string           `json:"lanIP,omitempty"`  // router's LAN IPv4 + CIDR, if any
+	WANIP6   string           `json:"wanIP6,omitempty"` // router's WAN IPv6 + CIDR, if any
+	NAT      NAT              `json:"nat,omitempty"`    // or empty for the default
+	Ports    PortAllocation   `json:"ports,omitempty"`  // HardNAT port allocation, or empty for the default
+	Services []NetworkService `json:"services,omitempty"`
+}
+
+type configFileNode struct {
+	Network int          `json:"network"`         // 1-based index into networks
+	MAC     string       `json:"mac,omitempty"`   // or empty for the default
+	LANIP   string       `json:"lanIP,omitempty"` // or empty for the default
+	Options []NodeOption `json:"options,omitempty"`
+}
+
+// ParseConfigFile reads a Config from a JSON or YAML file describing the
+// networks, nodes, and global options of a virtual network, such as:
+//
+//	blendReality: false
+//	derps: 2
+//	networks:
+//	  - wanIP: 2.1.1.1
+//	    lanIP: 192.168.1.1/24
+//	    wanIP6: 2000:52::1/64
+//	    nat: easy
+//	    services: [NAT-PMP]
+//	nodes:
+//	  - network: 1
+//	    mac: 52:cc:cc:cc:cc:01
+//	    lanIP: 192.168.1.50
+//	    options: [HostFirewall]
+//
+// Networks and nodes are numbered from 1, in file order.
+func ParseConfigFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// parseConfig parses the contents of a config file. See ParseConfigFile.
+func parseConfig(b []byte) (*Config, error) {
+	var cf configFile
+	if err := yaml.UnmarshalStrict(b, &cf); err != nil {
+		return nil, err
+	}
+
+	c := new(Config)
+	c.SetBlendReality(cf.BlendReality)
+	c.SetNumDERPs(cf.DERPs)
+	c.SetPCAPFile(cf.PCAPFile)
+	c.SetLogDir(cf.LogDir)
+
+	for i, fn := range cf.Networks {
+		var opts []any
+		for _, ip := range []string{fn.WANIP, fn.LANIP, fn.WANIP6} {
+			if ip != "" {
+				opts = append(opts, ip)
+			}
+		}
+		if fn.NAT != "" {
+			if _, ok := natTypes[fn.NAT]; !ok {
+				return nil, fmt.Errorf("network %d: unknown NAT type %q; valid types are: %s", i+1, fn.NAT, validNATTypes())
+			}
+			opts = append(opts, fn.NAT)
+		}
+		if fn.Ports != "" {
+			opts = append(opts, fn.Ports)
+		}
+		for _, svc := range fn.Services {
+			switch svc {
+			case NATPMP, PCP, UPnP:
+				opts = append(opts, svc)
+			default:
+				return nil, fmt.Errorf("network %d: unknown service %q", i+1, svc)
+			}
+		}
+		if n := c.AddNetwork(opts...); n.err != nil {
+			return nil, fmt.Errorf("network %d: %w", i+1, n.err)
+		}
+	}
+
+	for i, fn := range cf.Nodes {
+		if fn.Network < 1 || fn.Network > len(c.networks) {
+			return nil, fmt.Errorf("node %d: network %d doesn't exist", i+1, fn.Network)
+		}
+		opts := []any{c.networks[fn.Network-1]}
+		for _, o := range fn.Options {
+			opts = append(opts, o)
+		}
+		n := c.AddNode(opts...)
+		if n.err != nil {
+			return nil, fmt.Errorf("node %d: %w", i+1, n.err)
+		}
+		if fn.MAC != "" {
+			hw, err := net.ParseMAC(fn.MAC)
+			if err != nil || len(hw) != len(MAC{}) {
+				return nil, fmt.Errorf("node %d: invalid MAC %q", i+1, fn.MAC)
+			}
+			n.SetMAC(MAC(hw))
+		}
+		if fn.LANIP != "" {
+			ip, err := netip.ParseAddr(fn.LANIP)
+			if err != nil {
+				return nil, fmt.Errorf("node %d: %w", i+1, err)
+			}
+			n.SetLANIP(ip)
+		}
+	}
+	return c, nil
+}
+
+// validNATTypes returns the names of the known NAT types, sorted and
+// comma-separated.
+func validNATTypes() string {
+	var names []string
+	for nt := range natTypes {
+		names = append(names, string(nt))
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
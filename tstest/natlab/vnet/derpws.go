@@ -0,0 +1,49 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bufio"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coder/websocket"
+	"tailscale.com/derp"
+	"tailscale.com/net/wsconn"
+)
+
+// derpWebSocketHandler returns a handler for the fake DERP servers' /derp
+// path that serves DERP-over-WebSocket, as cmd/derper does, passing other
+// requests to base. Clients fall back to it where their network blocks the
+// DERP protocol's own HTTP upgrade.
+func derpWebSocketHandler(s *derp.Server, base http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// As in cmd/derper, only clients asking for the "derp" subprotocol
+		// speak WebSockets; very old ones sent "Upgrade: WebSocket" but
+		// spoke DERP's own framing.
+		up := strings.ToLower(r.Header.Get("Upgrade"))
+		if up != "websocket" || !strings.Contains(r.Header.Get("Sec-Websocket-Protocol"), "derp") {
+			base.ServeHTTP(w, r)
+			return
+		}
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols:    []string{"derp"},
+			OriginPatterns:  []string{"*"},
+			CompressionMode: websocket.CompressionDisabled, // WireGuard packets don't compress
+		})
+		if err != nil {
+			log.Printf("vnet DERP websocket.Accept: %v", err)
+			return
+		}
+		defer c.Close(websocket.StatusInternalError, "closing")
+		if c.Subprotocol() != "derp" {
+			c.Close(websocket.StatusPolicyViolation, "client must speak the derp subprotocol")
+			return
+		}
+		wc := wsconn.NetConn(r.Context(), c, websocket.MessageBinary, r.RemoteAddr)
+		brw := bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+		s.Accept(r.Context(), wc, brw, r.RemoteAddr)
+	})
+}
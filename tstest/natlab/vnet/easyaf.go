@@ -5,7 +5,6 @@
 
 import (
 	"log"
-	"math/rand/v2"
 	"net/netip"
 	"time"
 
@@ -25,6 +24,7 @@ type easyAFNAT struct {
 	out     map[netip.Addr]portMappingAndTime
 	in      map[uint16]lanAddrAndTime
 	lastOut map[srcAPDstAddrTuple]time.Time // (lan:port, wan:port) => last packet out time
+	limit   mappingLimit
 }
 
 type srcAPDstAddrTuple struct {
@@ -34,7 +34,7 @@ type srcAPDstAddrTuple struct {
 
 func init() {
 	registerNATType(EasyAFNAT, func(p IPPool) (NATTable, error) {
-		return &easyAFNAT{pool: p, wanIP: p.WANIP()}, nil
+		return &easyAFNAT{pool: p, wanIP: p.WANIP(), limit: mappingLimitOf(p)}, nil
 	})
 }
 
@@ -46,6 +46,8 @@ func (n *easyAFNAT) IsPublicPortUsed(ap netip.AddrPort) bool {
 	return ok
 }
 
+func (n *easyAFNAT) setWANIP(ip netip.Addr) { n.wanIP = ip }
+
 func (n *easyAFNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
 	mak.Set(&n.lastOut, srcAPDstAddrTuple{src, dst.Addr()}, at)
 	if pm, ok := n.out[src.Addr()]; ok {
@@ -54,9 +56,13 @@ func (n *easyAFNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanS
 		return netip.AddrPortFrom(n.wanIP, pm.port)
 	}
 
+	if !makeRoom(n.limit, n.out, func(_ netip.Addr, pm portMappingAndTime) { delete(n.in, pm.port) }) {
+		return netip.AddrPort{} // table full
+	}
+
 	// Loop through all 32k high (ephemeral) ports, starting at a random
 	// position and looping back around to the start.
-	start := rand.N(uint16(32 << 10))
+	start := randOf(n.pool).Uint16N(32 << 10)
 	for off := range uint16(32 << 10) {
 		port := 32<<10 + (start+off)%(32<<10)
 		if _, ok := n.in[port]; !ok {
@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// This file implements the fake echo server at echo.tailscale, which serves
+// HTTP on port 80 and HTTPS on port 443, for connectivity checks that would
+// otherwise need the real internet. Its TLS certificates are issued by the
+// Server's CA; see tlsca.go.
+//
+// Requests for /generate_204 get a 204 No Content, and requests for
+// /status/N get an empty response with HTTP status N. Everything else gets
+// an EchoResponse describing the request.
+
+// EchoResponse is the JSON body of the fake echo server's responses,
+// describing the request as the server saw it.
+type EchoResponse struct {
+	// ClientIP is the client's IP address as seen from the internet:
+	// for a node behind NAT, its network's WAN IP.
+	ClientIP netip.Addr
+
+	Method string
+	Host   string
+	Path   string
+	TLS    bool // whether the request came over HTTPS
+	Header http.Header
+}
+
+// echoHandler returns the HTTP handler of the fake echo server for
+// connections from the LAN IP clientIP on n.
+func (n *network) echoHandler(clientIP netip.Addr) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate_204", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/status/", func(w http.ResponseWriter, r *http.Request) {
+		code, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+		if err != nil || code < 100 || code > 999 {
+			http.Error(w, "bad status code", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(code)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(EchoResponse{
+			ClientIP: n.wanAddrOf(clientIP),
+			Method:   r.Method,
+			Host:     r.Host,
+			Path:     r.URL.Path,
+			TLS:      r.TLS != nil,
+			Header:   r.Header,
+		})
+	})
+	return mux
+}
+
+// wanAddrOf returns the address that traffic from the LAN IP ip on n comes
+// from once through n's router: the network's WAN IP for NATed IPv4, the
+// translated address with NPTv6, or ip itself.
+func (n *network) wanAddrOf(ip netip.Addr) netip.Addr {
+	if _, ok := n.subnetRouter(ip); ok {
+		// Not NATed; see handleUDPPacketForRouter.
+		return ip
+	}
+	if ip.Is6() {
+		if n.npt6 && n.lanIP6.Contains(ip) {
+			return translatePrefix6(ip, n.wanIP6)
+		}
+		return ip
+	}
+	return n.WANIP()
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// This file implements the routers' firewalls, configured with
+// Network.AddFirewallRule. A firewall sits on the LAN side of the router's
+// NAT, so rules match LAN addresses of nodes in both directions. It filters
+// UDP and TCP forwarded between the LAN and the internet; traffic to the
+// router itself and to the fake DNS server is never filtered.
+
+// FirewallDirection is the direction of traffic a FirewallRule matches.
+type FirewallDirection int
+
+const (
+	FirewallAnyDirection FirewallDirection = iota // either direction
+	FirewallOutbound                              // from the LAN to the internet
+	FirewallInbound                               // from the internet to the LAN
+)
+
+// FirewallAction is what a firewall does with a packet matching a
+// FirewallRule.
+type FirewallAction int
+
+const (
+	FirewallAllow  FirewallAction = iota // let the packet through
+	FirewallDrop                         // silently discard the packet
+	FirewallReject                       // discard the packet, replying with an ICMP error
+)
+
+// PortRange is an inclusive range of ports. The zero value matches all ports.
+type PortRange struct {
+	First, Last uint16
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return r == PortRange{} || (port >= r.First && port <= r.Last)
+}
+
+// FirewallRule is a rule of a network's firewall. The zero values of its
+// match fields match everything.
+type FirewallRule struct {
+	Dir      FirewallDirection
+	Proto    string       // "UDP", "TCP", or empty for either
+	Src      netip.Prefix // or the zero value for any
+	Dst      netip.Prefix // or the zero value for any
+	SrcPorts PortRange
+	DstPorts PortRange
+	Action   FirewallAction
+}
+
+// validate reports whether r is a well-formed rule.
+func (r FirewallRule) validate() error {
+	switch r.Proto {
+	case "", "UDP", "TCP":
+	default:
+		return fmt.Errorf("unknown protocol %q", r.Proto)
+	}
+	if r.Dir < FirewallAnyDirection || r.Dir > FirewallInbound {
+		return fmt.Errorf("unknown direction %d", r.Dir)
+	}
+	if r.Action < FirewallAllow || r.Action > FirewallReject {
+		return fmt.Errorf("unknown action %d", r.Action)
+	}
+	for _, pr := range []PortRange{r.SrcPorts, r.DstPorts} {
+		if pr.First > pr.Last {
+			return fmt.Errorf("bad port range %d-%d", pr.First, pr.Last)
+		}
+	}
+	return nil
+}
+
+// match reports whether r matches a packet of protocol proto from src to dst
+// going in direction dir.
+func (r FirewallRule) match(dir FirewallDirection, proto string, src, dst netip.AddrPort) bool {
+	return (r.Dir == FirewallAnyDirection || r.Dir == dir) &&
+		(r.Proto == "" || r.Proto == proto) &&
+		(!r.Src.IsValid() || r.Src.Contains(src.Addr())) &&
+		(!r.Dst.IsValid() || r.Dst.Contains(dst.Addr())) &&
+		r.SrcPorts.contains(src.Port()) &&
+		r.DstPorts.contains(dst.Port())
+}
+
+// firewallAction returns the action of the network's first firewall rule
+// matching a packet of protocol proto ("UDP" or "TCP") from src to dst going
+// in direction dir. Packets that match no rule are allowed.
+func (n *network) firewallAction(dir FirewallDirection, proto string, src, dst netip.AddrPort) FirewallAction {
+	for _, r := range n.firewall {
+		if r.match(dir, proto, src, dst) {
+			return r.Action
+		}
+	}
+	return FirewallAllow
+}
+
+// firewallOutbound applies the network's firewall to the outbound packet ep
+// of protocol proto from src to dst, reporting whether it's allowed. Rejected
+// packets get an ICMP error from the router.
+func (n *network) firewallOutbound(ep EthernetPacket, proto string, src, dst netip.AddrPort) bool {
+	switch n.firewallAction(FirewallOutbound, proto, src, dst) {
+	case FirewallDrop:
+		n.s.obs.OnDrop(DropFirewall)
+		return false
+	case FirewallReject:
+		n.s.obs.OnDrop(DropFirewall)
+		routerIP := n.lanIP4.Addr()
+		if dst.Addr().Is6() {
+			routerIP = n.lanIP6.Addr()
+		}
+		n.sendICMPError(ep, routerIP, icmpAdminProhibited, 0)
+		return false
+	}
+	return true
+}
+
+// firewallInbound applies the network's firewall to the inbound packet of
+// protocol proto from src on the internet to dst on the LAN, reporting
+// whether it's allowed. As the internet side of the virtual network only
+// carries UDP and TCP, rejected packets are dropped without an ICMP error.
+func (n *network) firewallInbound(proto string, src, dst netip.AddrPort) bool {
+	if n.firewallAction(FirewallInbound, proto, src, dst) == FirewallAllow {
+		return true
+	}
+	n.s.obs.OnDrop(DropFirewall)
+	return false
+}
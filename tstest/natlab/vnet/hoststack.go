@@ -0,0 +1,307 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"tailscale.com/util/must"
+)
+
+// hostStack is the in-process network stack of a node with the HostStack
+// option, standing in for the VM that would otherwise be plugged into the
+// node's network.
+//
+// It has the node's static LAN IPs (the ones DHCP would hand out) and no
+// link address resolution: it addresses frames to other nodes on its LAN by
+// the MACs the network already knows, and everything else to the router.
+// The router answers ARP for the node on its behalf.
+type hostStack struct {
+	node   *node
+	ns     *stack.Stack
+	linkEP *channel.Endpoint
+
+	ctx    context.Context    // done when the Server shuts down or the node is removed
+	cancel context.CancelFunc // cancels ctx
+}
+
+// nodeClock is a tcpip.Clock telling the time as its node sees it, for the
+// host stack of a node with a clock skew. Its monotonic time and timers are
+// its embedded Clock's.
+type nodeClock struct {
+	tcpip.Clock
+	node *node
+}
+
+func (c nodeClock) Now() time.Time { return c.node.now() }
+
+func (h *hostStack) init() error {
+	n := h.node
+	h.ctx, h.cancel = context.WithCancel(n.net.s.shutdownCtx)
+	var clock tcpip.Clock // nil for the default
+	if n.clockSkew != 0 {
+		clock = nodeClock{tcpip.NewStdClock(), n}
+	}
+	h.ns = stack.New(stack.Options{
+		Clock: clock,
+		NetworkProtocols: []stack.NetworkProtocolFactory{
+			ipv4.NewProtocol,
+			ipv6.NewProtocol,
+		},
+		TransportProtocols: []stack.TransportProtocolFactory{
+			tcp.NewProtocol,
+			udp.NewProtocol,
+			icmp.NewProtocol4,
+			icmp.NewProtocol6,
+		},
+	})
+	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
+	if tcpipErr := h.ns.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt); tcpipErr != nil {
+		return fmt.Errorf("SetTransportProtocolOption SACK: %v", tcpipErr)
+	}
+	h.linkEP = channel.New(512, uint32(n.net.mtu), tcpip.LinkAddress(n.mac.HWAddr()))
+	if tcpipProblem := h.ns.CreateNIC(nicID, h.linkEP); tcpipProblem != nil {
+		return fmt.Errorf("CreateNIC: %v", tcpipProblem)
+	}
+	if len(n.subnetRoutes) > 0 {
+		// Stand in for the hosts behind the subnet router too.
+		h.ns.SetPromiscuousMode(nicID, true)
+		h.ns.SetSpoofing(nicID, true)
+	}
+
+	var routes []tcpip.Route
+	if n.lanIP.IsValid() {
+		prefix := tcpip.AddrFrom4(n.lanIP.As4()).WithPrefix()
+		prefix.PrefixLen = n.net.lanIP4.Bits()
+		if tcpProb := h.ns.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: prefix,
+		}, stack.AddressProperties{}); tcpProb != nil {
+			return errors.New(tcpProb.String())
+		}
+		routes = append(routes, tcpip.Route{
+			Destination: must.Get(tcpip.NewSubnet(tcpip.AddrFrom4([4]byte{}), tcpip.MaskFromBytes(make([]byte, 4)))),
+			NIC:         nicID,
+		})
+	}
+	if n.dhcp6IP.IsValid() {
+		prefix := tcpip.AddrFrom16(n.dhcp6IP.As16()).WithPrefix()
+		prefix.PrefixLen = n.net.lanIP6.Bits()
+		if tcpProb := h.ns.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: prefix,
+		}, stack.AddressProperties{}); tcpProb != nil {
+			return errors.New(tcpProb.String())
+		}
+		routes = append(routes, tcpip.Route{
+			Destination: must.Get(tcpip.NewSubnet(tcpip.AddrFrom16([16]byte{}), tcpip.MaskFromBytes(make([]byte, 16)))),
+			NIC:         nicID,
+		})
+		// There's no neighbor discovery for the router to learn the
+		// address from.
+		n.net.learnIPv6MAC(n.dhcp6IP, n.mac)
+	}
+	h.ns.SetRouteTable(routes)
+
+	n.net.writers.Store(n.mac, networkWriter{
+		writer:      h.writeEthernetFrame,
+		interfaceID: n.interfaceID,
+	})
+
+	go func() {
+		for {
+			pkt := h.linkEP.ReadContext(h.ctx)
+			if pkt == nil {
+				if h.ctx.Err() != nil {
+					// Return without logging.
+					return
+				}
+				continue
+			}
+			ipRaw := pkt.ToView().AsSlice()
+			pkt.DecRef()
+			h.handleIPPacketFromGvisor(ipRaw)
+		}
+	}()
+	return nil
+}
+
+// close shuts down the host stack of a node being removed.
+func (h *hostStack) close() {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	if h.ns != nil {
+		h.ns.Close()
+	}
+}
+
+// handleIPPacketFromGvisor sends the IP packet ipRaw from the host stack out
+// of the node's interface, as if the node's VM had written it.
+func (h *hostStack) handleIPPacketFromGvisor(ipRaw []byte) {
+	n := h.node
+	var (
+		dst     netip.Addr
+		ethType layers.EthernetType
+	)
+	switch ipRaw[0] >> 4 {
+	case 4:
+		dst = netip.AddrFrom4([4]byte(ipRaw[16:20]))
+		ethType = layers.EthernetTypeIPv4
+	case 6:
+		dst = netip.AddrFrom16([16]byte(ipRaw[24:40]))
+		ethType = layers.EthernetTypeIPv6
+	default:
+		return
+	}
+	if dst.IsMulticast() || dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		// The host stack only does unicast.
+		return
+	}
+	dstMAC := n.net.mac
+	if dst.Is4() {
+		if peer, ok := n.net.nodesByIP4.Load(dst); ok {
+			dstMAC = peer.mac
+		}
+	} else {
+		n.net.macMu.Lock()
+		if mac, ok := n.net.macOfIPv6[dst]; ok {
+			dstMAC = mac
+		}
+		n.net.macMu.Unlock()
+	}
+	frame, err := mkPacket(
+		&layers.Ethernet{
+			SrcMAC:       n.mac.HWAddr(),
+			DstMAC:       dstMAC.HWAddr(),
+			EthernetType: ethType,
+		},
+		gopacket.Payload(ipRaw),
+	)
+	if err != nil {
+		n.net.logf("host stack: serialize error: %v", err)
+		return
+	}
+	if err := n.net.s.handleEthernetFrameFromVM(frame); err != nil {
+		n.net.logf("host stack: %v", err)
+	}
+}
+
+// writeEthernetFrame is the host stack's writerFunc, delivering ethFrame to
+// the host stack.
+func (h *hostStack) writeEthernetFrame(_ vmClient, ethFrame []byte, interfaceID int) {
+	_, _, ethType, payload, ok := parseEthernet(ethFrame)
+	if !ok {
+		return
+	}
+	var proto tcpip.NetworkProtocolNumber
+	switch ethType {
+	case layers.EthernetTypeIPv4:
+		proto = ipv4.ProtocolNumber
+	case layers.EthernetTypeIPv6:
+		proto = ipv6.ProtocolNumber
+	default:
+		return
+	}
+	// Frames aren't ours to keep, so copy the payload.
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(slices.Clone(payload)),
+	})
+	h.linkEP.InjectInbound(proto, pkt)
+	pkt.DecRef()
+
+	must.Do(h.node.net.s.capture(gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  len(ethFrame),
+		Length:         len(ethFrame),
+		InterfaceIndex: interfaceID,
+	}, ethFrame, nil))
+}
+
+// dial connects to addr on the named network from the host stack. Host
+// names in addr are resolved with the Server's DNS records, as the fake DNS
+// server would.
+func (h *hostStack) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	var want4, want6 bool
+	switch network {
+	case "tcp", "udp":
+		want4, want6 = h.node.lanIP.IsValid(), h.node.dhcp6IP.IsValid()
+	case "tcp4", "udp4":
+		want4 = true
+	case "tcp6", "udp6":
+		want6 = true
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else if ips, _ = h.node.net.s.lookupDNS(host); len(ips) == 0 {
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+	i := slices.IndexFunc(ips, func(ip netip.Addr) bool {
+		return ip.Is4() && want4 || ip.Is6() && want6
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("no %s address for %q", network, host)
+	}
+	ip := ips[i]
+	proto := ipv4.ProtocolNumber
+	if ip.Is6() {
+		proto = ipv6.ProtocolNumber
+	}
+	raddr := tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFromSlice(ip.AsSlice()),
+		Port: uint16(port),
+	}
+	if strings.HasPrefix(network, "udp") {
+		return gonet.DialUDP(h.ns, nil, &raddr, proto)
+	}
+	return gonet.DialContextTCP(ctx, h.ns, raddr, proto)
+}
+
+// Dial connects to addr on the named network ("tcp", "tcp4", "tcp6", "udp",
+// "udp4" or "udp6") from the node's IP, through the virtual network. Host
+// names are resolved as the fake DNS server would resolve them.
+//
+// It requires the node to have the HostStack option and the Server to have
+// been created.
+func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if n.n == nil {
+		return nil, fmt.Errorf("%v: Server not created", n)
+	}
+	if n.n.hs == nil {
+		return nil, fmt.Errorf("%v doesn't have the %v option", n, HostStack)
+	}
+	return n.n.hs.dial(ctx, network, addr)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/gopacket/layers"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+// This file implements IGMP snooping, as LAN switches do: the network
+// tracks which nodes have joined which IPv4 multicast groups from the IGMP
+// membership reports they send, and delivers IPv4 multicast frames only to
+// the members of their group. Frames to the all-hosts group 224.0.0.1 go to
+// every node, as all hosts are members without reporting it.
+//
+// As with real snooping switches, groups are tracked by their multicast
+// MAC address, which is shared by the 32 groups mapping to it.
+
+// macAllHosts4 is the multicast MAC of the IPv4 all-hosts group, 224.0.0.1.
+var macAllHosts4 = MAC{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01}
+
+// multicastMAC returns the Ethernet MAC address of the IPv4 multicast group
+// ip, per RFC 1112 section 6.4.
+func multicastMAC(ip netip.Addr) MAC {
+	a := ip.As4()
+	return MAC{0x01, 0x00, 0x5e, a[1] & 0x7f, a[2], a[3]}
+}
+
+// handleIGMP updates the multicast group memberships of the node with MAC
+// src from igmp, an IGMP packet it sent.
+func (n *network) handleIGMP(src MAC, igmp any) {
+	switch igmp := igmp.(type) {
+	case *layers.IGMPv1or2:
+		switch igmp.Type {
+		case layers.IGMPMembershipReportV1, layers.IGMPMembershipReportV2:
+			n.setMulticastMember(igmp.GroupAddress, src, true)
+		case layers.IGMPLeaveGroup:
+			n.setMulticastMember(igmp.GroupAddress, src, false)
+		}
+	case *layers.IGMP:
+		if igmp.Type != layers.IGMPMembershipReportV3 {
+			return
+		}
+		for _, r := range igmp.GroupRecords {
+			switch r.Type {
+			case layers.IGMPIsEx, layers.IGMPToEx, layers.IGMPAllow:
+				n.setMulticastMember(r.MulticastAddress, src, true)
+			case layers.IGMPIsIn, layers.IGMPToIn:
+				// Including no sources is how IGMPv3 leaves a group.
+				n.setMulticastMember(r.MulticastAddress, src, len(r.SourceAddresses) > 0)
+			}
+		}
+	}
+}
+
+// setMulticastMember records whether the node with MAC mac is a member of
+// the IPv4 multicast group.
+func (n *network) setMulticastMember(group net.IP, mac MAC, member bool) {
+	ip, ok := netip.AddrFromSlice(group)
+	if !ok || !ip.Unmap().Is4() || !ip.IsMulticast() {
+		return
+	}
+	gmac := multicastMAC(ip.Unmap())
+
+	n.mcastMu.Lock()
+	defer n.mcastMu.Unlock()
+	if member {
+		if !n.mcastMembers[gmac].Contains(mac) {
+			n.logf("%v joined multicast group %v", mac, ip)
+		}
+		if n.mcastMembers[gmac] == nil {
+			mak.Set(&n.mcastMembers, gmac, set.Set[MAC]{})
+		}
+		n.mcastMembers[gmac].Add(mac)
+		return
+	}
+	if n.mcastMembers[gmac].Contains(mac) {
+		n.logf("%v left multicast group %v", mac, ip)
+	}
+	n.mcastMembers[gmac].Delete(mac)
+	if len(n.mcastMembers[gmac]) == 0 {
+		delete(n.mcastMembers, gmac)
+	}
+}
+
+// isMulticastMember reports whether frames to the IPv4 multicast MAC group
+// should be delivered to the node with MAC mac.
+func (n *network) isMulticastMember(group, mac MAC) bool {
+	if group == macAllHosts4 {
+		return true
+	}
+	n.mcastMu.Lock()
+	defer n.mcastMu.Unlock()
+	return n.mcastMembers[group].Contains(mac)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"slices"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"tailscale.com/tstime"
+)
+
+// This file implements the simulated faults of a network's link to the
+// internet that need state or reproducible randomness, such as reordering
+// duplication and corruption.
+
+// impairChance reports whether an event with probability p happens, drawing
+// from the network's random source for simulated faults.
+func (n *network) impairChance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	n.impairMu.Lock()
+	defer n.impairMu.Unlock()
+	return n.rng.Float64() < p
+}
+
+// reorderUDP implements Network.SetReordering for p, a UDP packet arriving
+// from the internet, calling deliver for p and any packet held back before
+// it in the order they're to arrive. A packet held back until its hold time
+// is up is delivered from a new goroutine.
+func (n *network) reorderUDP(p UDPPacket, deliver func(UDPPacket)) {
+	n.impairMu.Lock()
+	if n.reorderTimer != nil {
+		// Deliver the held packet after this one.
+		n.reorderTimer.Stop()
+		n.reorderTimer = nil
+		held := n.reorderHeld
+		n.reorderHeld = UDPPacket{}
+		n.impairMu.Unlock()
+		deliver(p)
+		deliver(held)
+		return
+	}
+	if n.rng.Float64() >= n.reorderRate {
+		n.impairMu.Unlock()
+		deliver(p)
+		return
+	}
+
+	// The packet's payload isn't ours to keep.
+	p.Payload = slices.Clone(p.Payload)
+	n.reorderHeld = p
+	var t tstime.TimerController
+	t = n.s.clock.AfterFunc(n.reorderHold, func() {
+		n.impairMu.Lock()
+		if n.reorderTimer != t {
+			// Delivered after another packet already.
+			n.impairMu.Unlock()
+			return
+		}
+		n.reorderTimer = nil
+		held := n.reorderHeld
+		n.reorderHeld = UDPPacket{}
+		n.impairMu.Unlock()
+		// Not from the timer's goroutine, which delivering would deadlock
+		// with a tstest.Clock by asking it the time.
+		go deliver(held)
+	})
+	n.reorderTimer = t
+	n.impairMu.Unlock()
+}
+
+// maybeCorrupt implements Network.SetCorruption for eth, an Ethernet frame
+// to be delivered to a node, returning either eth or a corrupted copy of it.
+func (n *network) maybeCorrupt(eth []byte) []byte {
+	pkt := gopacket.NewPacket(eth, layers.LayerTypeEthernet, gopacket.Lazy)
+	ipl := pkt.NetworkLayer()
+	if ipl == nil {
+		return eth
+	}
+	// The byte range of eth that may be flipped: the IP packet, less any
+	// Ethernet padding, or just its transport payload.
+	start := len(eth) - len(pkt.LinkLayer().LayerPayload())
+	end := start + len(ipl.LayerContents()) + len(ipl.LayerPayload())
+	if !n.corruptHdrs {
+		tl := pkt.TransportLayer()
+		if tl == nil {
+			return eth
+		}
+		start += len(ipl.LayerContents()) + len(tl.LayerContents())
+		end = start + len(tl.LayerPayload())
+	}
+	if start >= end || !n.impairChance(n.corruptRate) {
+		return eth
+	}
+
+	n.impairMu.Lock()
+	i := start + n.rng.IntN(end-start)
+	flip := byte(1 + n.rng.IntN(255))
+	n.impairMu.Unlock()
+
+	// The frame isn't ours to modify.
+	eth = slices.Clone(eth)
+	eth[i] ^= flip
+	return eth
+}
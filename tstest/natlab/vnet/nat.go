@@ -6,7 +6,6 @@
 import (
 	"errors"
 	"log"
-	"math/rand/v2"
 	"net/netip"
 	"time"
 
@@ -18,8 +17,86 @@
 	EasyNAT    NAT = "easy"   // address+port filtering
 	EasyAFNAT  NAT = "easyaf" // address filtering (not port)
 	HardNAT    NAT = "hard"
+
+	// RoundTripNAT is like EasyNAT, but only accepts a single reply to
+	// outgoing packets until the LAN side has replied to that, completing
+	// a round trip.
+	RoundTripNAT NAT = "roundtrip"
+
+	// PreservePortNAT is like EasyNAT, but keeps a flow's LAN source port as
+	// its WAN port when that's free, only picking another one when it's
+	// taken, as many consumer routers do.
+	PreservePortNAT NAT = "preserve"
+)
+
+// PortAllocation is how a HardNAT picks the WAN ports of new mappings, which
+// matters to peers predicting its ports when hole punching.
+type PortAllocation string
+
+const (
+	PortAllocRandom     PortAllocation = "random"     // a random ephemeral port; the default
+	PortAllocSequential PortAllocation = "sequential" // the port after the previous mapping's
+	PortAllocStep2      PortAllocation = "step2"      // two ports after the previous mapping's
+)
+
+func (a PortAllocation) valid() bool {
+	switch a {
+	case PortAllocRandom, PortAllocSequential, PortAllocStep2:
+		return true
+	}
+	return false
+}
+
+// NATFullPolicy is what a NAT whose table is full (see
+// Network.SetNATMappingLimit) does with a flow needing a new mapping.
+type NATFullPolicy int
+
+const (
+	NATFullDrop        NATFullPolicy = iota // drop the flow's packets
+	NATFullEvictOldest                      // evict the oldest mapping to make room
 )
 
+// mappingLimit is the cap on the number of mappings in a NAT table.
+type mappingLimit struct {
+	max    int // or 0 for no limit
+	policy NATFullPolicy
+}
+
+// mappingLimitOf returns the mapping limit of p's network, if it has one.
+func mappingLimitOf(p IPPool) mappingLimit {
+	if ml, ok := p.(interface{ natMappingLimit() mappingLimit }); ok {
+		return ml.natMappingLimit()
+	}
+	return mappingLimit{}
+}
+
+// makeRoom makes room for a new mapping in out, a NAT table's mappings, per
+// the limit l, reporting whether there's room. evict is called to clean up
+// the rest of the table's state for each mapping it evicts.
+func makeRoom[K comparable](l mappingLimit, out map[K]portMappingAndTime, evict func(K, portMappingAndTime)) bool {
+	if l.max <= 0 || len(out) < l.max {
+		return true
+	}
+	if l.policy != NATFullEvictOldest {
+		return false
+	}
+	for len(out) >= l.max {
+		var (
+			oldestKey K
+			oldest    portMappingAndTime
+			found     bool
+		)
+		for k, pm := range out {
+			if !found || pm.at.Before(oldest.at) {
+				oldestKey, oldest, found = k, pm, true
+			}
+		}
+		delete(out, oldestKey)
+		evict(oldestKey, oldest)
+	}
+	return true
+}
+
 // IPPool is the interface that a NAT implementation uses to get information
 // about a network.
 //
@@ -97,6 +174,12 @@ type NATTable interface {
 	IsPublicPortUsed(netip.AddrPort) bool
 }
 
+// wanIPSetter is implemented by NAT tables that can switch to a new WAN IP
+// while keeping their mappings, for Server.SetWANIP.
+type wanIPSetter interface {
+	setWANIP(netip.Addr)
+}
+
 // oneToOneNAT is a 1:1 NAT, like a typical EC2 VM.
 type oneToOneNAT struct {
 	lanIP netip.Addr
@@ -125,6 +208,8 @@ func (n *oneToOneNAT) IsPublicPortUsed(netip.AddrPort) bool {
 	return true // all ports are owned by the 1:1 NAT
 }
 
+func (n *oneToOneNAT) setWANIP(ip netip.Addr) { n.wanIP = ip }
+
 type srcDstTuple struct {
 	src netip.AddrPort
 	dst netip.AddrPort
@@ -145,12 +230,50 @@ type lanAddrAndTime struct {
 	at      time.Time
 }
 
+// portAllocator picks the WAN ports of a NAT's new mappings from the 32k high
+// (ephemeral) ports, per a PortAllocation.
+type portAllocator struct {
+	alloc PortAllocation
+	rng   *lockedRand
+	last  uint16 // the previous port picked, or 0 for none yet
+}
+
+// newPortAllocator returns a portAllocator using the PortAllocation of p's
+// network, if it has one, or else random ports.
+func newPortAllocator(p IPPool) portAllocator {
+	a := portAllocator{alloc: PortAllocRandom, rng: randOf(p)}
+	if pa, ok := p.(interface{ portAllocation() PortAllocation }); ok && pa.portAllocation() != "" {
+		a.alloc = pa.portAllocation()
+	}
+	return a
+}
+
+// next returns the next port to try. If it's in use, the caller calls next
+// again, so sequential allocations skip over used ports.
+func (a *portAllocator) next() uint16 {
+	var step uint16
+	switch a.alloc {
+	case PortAllocSequential:
+		step = 1
+	case PortAllocStep2:
+		step = 2
+	}
+	if step == 0 || a.last == 0 {
+		a.last = a.rng.Uint16N(32<<10) + 32<<10
+	} else {
+		a.last = 32<<10 + (a.last-32<<10+step)%(32<<10) // wrapping around
+	}
+	return a.last
+}
+
 // hardNAT is an "Endpoint Dependent" NAT, like FreeBSD/pfSense/OPNsense.
 // This is shown as "MappingVariesByDestIP: true" by netcheck, and what
 // Tailscale calls "Hard NAT".
 type hardNAT struct {
 	pool  IPPool
 	wanIP netip.Addr
+	ports portAllocator
+	limit mappingLimit
 
 	out map[srcDstTuple]portMappingAndTime
 	in  map[hardKeyIn]lanAddrAndTime
@@ -158,7 +281,7 @@ type hardNAT struct {
 
 func init() {
 	registerNATType(HardNAT, func(p IPPool) (NATTable, error) {
-		return &hardNAT{pool: p, wanIP: p.WANIP()}, nil
+		return &hardNAT{pool: p, wanIP: p.WANIP(), ports: newPortAllocator(p), limit: mappingLimitOf(p)}, nil
 	})
 }
 
@@ -174,6 +297,8 @@ func (n *hardNAT) IsPublicPortUsed(ap netip.AddrPort) bool {
 	return false
 }
 
+func (n *hardNAT) setWANIP(ip netip.Addr) { n.wanIP = ip }
+
 func (n *hardNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
 	ko := srcDstTuple{src, dst}
 	if pm, ok := n.out[ko]; ok {
@@ -185,12 +310,17 @@ func (n *hardNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc
 	// No existing mapping exists. Create one.
 
 	// TODO: clean up old expired mappings
+	if !makeRoom(n.limit, n.out, func(k srcDstTuple, pm portMappingAndTime) {
+		delete(n.in, hardKeyIn{wanPort: pm.port, src: k.dst})
+	}) {
+		return netip.AddrPort{} // table full
+	}
 
 	// Instead of proper data structures that would be efficient, we instead
 	// just loop a bunch and look for a free port. This project is only used
 	// by tests and doesn't care about performance, this is good enough.
 	for {
-		port := rand.N(uint16(32<<10)) + 32<<10 // pick some "ephemeral" port
+		port := n.ports.next()
 		if n.pool.IsPublicPortUsed(netip.AddrPortFrom(n.wanIP, port)) {
 			continue
 		}
@@ -232,11 +362,17 @@ type easyNAT struct {
 	out     map[netip.AddrPort]portMappingAndTime
 	in      map[uint16]lanAddrAndTime
 	lastOut map[srcDstTuple]time.Time // (lan:port, wan:port) => last packet out time
+	limit   mappingLimit
+
+	preservePort bool // try the LAN source port first; see PreservePortNAT
 }
 
 func init() {
 	registerNATType(EasyNAT, func(p IPPool) (NATTable, error) {
-		return &easyNAT{pool: p, wanIP: p.WANIP()}, nil
+		return &easyNAT{pool: p, wanIP: p.WANIP(), limit: mappingLimitOf(p)}, nil
+	})
+	registerNATType(PreservePortNAT, func(p IPPool) (NATTable, error) {
+		return &easyNAT{pool: p, wanIP: p.WANIP(), limit: mappingLimitOf(p), preservePort: true}, nil
 	})
 }
 
@@ -248,6 +384,8 @@ func (n *easyNAT) IsPublicPortUsed(ap netip.AddrPort) bool {
 	return ok
 }
 
+func (n *easyNAT) setWANIP(ip netip.Addr) { n.wanIP = ip }
+
 func (n *easyNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
 	mak.Set(&n.lastOut, srcDstTuple{src, dst}, at)
 	if pm, ok := n.out[src]; ok {
@@ -256,9 +394,23 @@ func (n *easyNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc
 		return netip.AddrPortFrom(n.wanIP, pm.port)
 	}
 
+	if !makeRoom(n.limit, n.out, func(_ netip.AddrPort, pm portMappingAndTime) { delete(n.in, pm.port) }) {
+		return netip.AddrPort{} // table full
+	}
+
+	if port := src.Port(); n.preservePort && port != 0 {
+		if _, ok := n.in[port]; !ok {
+			if wanAddr := netip.AddrPortFrom(n.wanIP, port); !n.pool.IsPublicPortUsed(wanAddr) {
+				mak.Set(&n.out, src, portMappingAndTime{port: port, at: at})
+				mak.Set(&n.in, port, lanAddrAndTime{lanAddr: src, at: at})
+				return wanAddr
+			}
+		}
+	}
+
 	// Loop through all 32k high (ephemeral) ports, starting at a random
 	// position and looping back around to the start.
-	start := rand.N(uint16(32 << 10))
+	start := randOf(n.pool).Uint16N(32 << 10)
 	for off := range uint16(32 << 10) {
 		port := 32<<10 + (start+off)%(32<<10)
 		if _, ok := n.in[port]; !ok {
@@ -0,0 +1,310 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/util/set"
+)
+
+// testPool is an IPPool for NAT table tests.
+type testPool struct {
+	wanIP     netip.Addr
+	portAlloc PortAllocation
+	used      set.Set[netip.AddrPort] // WAN ip:ports taken by something else
+	limit     mappingLimit
+}
+
+func (p testPool) WANIP() netip.Addr                       { return p.wanIP }
+func (p testPool) SoleLANIP() (netip.Addr, bool)           { return netip.Addr{}, false }
+func (p testPool) IsPublicPortUsed(ap netip.AddrPort) bool { return p.used.Contains(ap) }
+func (p testPool) portAllocation() PortAllocation          { return p.portAlloc }
+func (p testPool) natMappingLimit() mappingLimit           { return p.limit }
+
+func TestPoolNAT(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("2.1.1.1"),
+		netip.MustParseAddr("2.1.1.2"),
+		netip.MustParseAddr("2.1.1.3"),
+	}
+	lan := netip.MustParseAddrPort("192.168.0.101:41641")
+	peer := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{3, 3, 3, byte(i)}), 41641)
+	}
+	for _, policy := range []WANIPPolicy{WANIPPerHost, WANIPPerFlow, WANIPRoundRobin} {
+		t.Run(fmt.Sprint(policy), func(t *testing.T) {
+			nt, err := newPoolNAT(testPool{wanIP: ips[0]}, natTypes[EasyNAT], slices.Clone(ips), policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			for i := range 6 {
+				wan := nt.PickOutgoingSrc(lan, peer(i), now)
+				switch policy {
+				case WANIPPerHost:
+					if wan.Addr() != ips[0] {
+						t.Errorf("flow %d from %v; want %v", i, wan, ips[0])
+					}
+				case WANIPRoundRobin:
+					if want := ips[i%len(ips)]; wan.Addr() != want {
+						t.Errorf("flow %d from %v; want %v", i, wan, want)
+					}
+				}
+				if got := nt.PickOutgoingSrc(lan, peer(i), now); got != wan {
+					t.Errorf("flow %d moved from %v to %v", i, wan, got)
+				}
+				if got := nt.PickIncomingDst(peer(i), wan, now); got != lan {
+					t.Errorf("reply to flow %d went to %v; want %v", i, got, lan)
+				}
+			}
+			if got := nt.PickIncomingDst(peer(0), netip.MustParseAddrPort("2.1.1.4:1"), now); got.IsValid() {
+				t.Errorf("packet to an IP outside the pool went to %v", got)
+			}
+		})
+	}
+}
+
+func TestNATMappingLimit(t *testing.T) {
+	peer := netip.MustParseAddrPort("3.3.3.3:41641")
+	host := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 168, 0, byte(100 + i)}), 41641)
+	}
+	for _, natType := range []NAT{EasyNAT, EasyAFNAT, HardNAT, RoundTripNAT, PreservePortNAT} {
+		for _, policy := range []NATFullPolicy{NATFullDrop, NATFullEvictOldest} {
+			t.Run(fmt.Sprintf("%v/policy=%d", natType, policy), func(t *testing.T) {
+				nt, err := natTypes[natType](testPool{
+					wanIP: netip.MustParseAddr("2.1.1.1"),
+					limit: mappingLimit{max: 3, policy: policy},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				now := time.Now()
+				var wans []netip.AddrPort
+				for i := range 3 {
+					now = now.Add(time.Second)
+					wan := nt.PickOutgoingSrc(host(i), peer, now)
+					if !wan.IsValid() {
+						t.Fatalf("mapping %d not allocated", i)
+					}
+					wans = append(wans, wan)
+				}
+
+				now = now.Add(time.Second)
+				wan := nt.PickOutgoingSrc(host(3), peer, now)
+				if policy == NATFullDrop {
+					if wan.IsValid() {
+						t.Fatalf("mapping allocated in a full table: %v", wan)
+					}
+					if got := nt.PickOutgoingSrc(host(0), peer, now); got != wans[0] {
+						t.Errorf("existing mapping = %v; want %v", got, wans[0])
+					}
+					return
+				}
+				if !wan.IsValid() {
+					t.Fatal("mapping not allocated by evicting the oldest")
+				}
+				// (Its WAN port may have been reused for the new mapping.)
+				if got := nt.PickIncomingDst(peer, wans[0], now); got == host(0) {
+					t.Errorf("evicted mapping still delivers to %v", got)
+				}
+				if got := nt.PickIncomingDst(peer, wans[1], now); got != host(1) {
+					t.Errorf("second mapping delivers to %v; want %v", got, host(1))
+				}
+			})
+		}
+	}
+}
+
+func TestPreservePortNAT(t *testing.T) {
+	wanIP := netip.MustParseAddr("2.1.1.1")
+	nt, err := natTypes[PreservePortNAT](testPool{
+		wanIP: wanIP,
+		used:  set.Of(netip.AddrPortFrom(wanIP, 5000)), // say, a port mapping
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := netip.MustParseAddrPort("3.3.3.3:41641")
+	now := time.Now()
+	host1 := netip.MustParseAddrPort("192.168.0.101:41641")
+	host2 := netip.MustParseAddrPort("192.168.0.102:41641")
+
+	wan1 := nt.PickOutgoingSrc(host1, peer, now)
+	if want := netip.AddrPortFrom(wanIP, 41641); wan1 != want {
+		t.Errorf("first host mapped to %v; want its port preserved as %v", wan1, want)
+	}
+	wan2 := nt.PickOutgoingSrc(host2, peer, now)
+	if !wan2.IsValid() || wan2.Addr() != wanIP || wan2.Port() == 41641 {
+		t.Errorf("second host mapped to %v; want another port of %v", wan2, wanIP)
+	}
+	if got := nt.PickOutgoingSrc(host1, netip.MustParseAddrPort("4.4.4.4:1"), now); got != wan1 {
+		t.Errorf("first host's mapping to another peer = %v; want %v", got, wan1)
+	}
+	if got := nt.PickIncomingDst(peer, wan2, now); got != host2 {
+		t.Errorf("reply to second host went to %v", got)
+	}
+	if got := nt.PickOutgoingSrc(netip.MustParseAddrPort("192.168.0.103:5000"), peer, now); got.Port() == 5000 {
+		t.Errorf("port used by the pool was preserved: %v", got)
+	}
+}
+
+func TestHardNATPortAllocation(t *testing.T) {
+	lan := netip.MustParseAddrPort("192.168.0.101:41641")
+	for _, tt := range []struct {
+		alloc PortAllocation
+		step  uint16 // or 0 for random
+	}{
+		{"", 0},
+		{PortAllocRandom, 0},
+		{PortAllocSequential, 1},
+		{PortAllocStep2, 2},
+	} {
+		t.Run(cmp.Or(string(tt.alloc), "default"), func(t *testing.T) {
+			nt, err := natTypes[HardNAT](testPool{wanIP: netip.MustParseAddr("2.1.1.1"), portAlloc: tt.alloc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			var ports []uint16
+			for i := range 10 {
+				peer := netip.AddrPortFrom(netip.AddrFrom4([4]byte{3, 3, 3, byte(i)}), 41641)
+				ports = append(ports, nt.PickOutgoingSrc(lan, peer, now).Port())
+			}
+			patterned := true
+			for i := 1; i < len(ports); i++ {
+				if ports[i] < 32<<10 {
+					t.Fatalf("port %d not ephemeral", ports[i])
+				}
+				if tt.step != 0 && ports[i] != ports[i-1]+tt.step {
+					t.Fatalf("ports = %v; want each %d after the previous", ports, tt.step)
+				}
+				patterned = patterned && ports[i] == ports[i-1]+1
+			}
+			if tt.step == 0 && patterned {
+				t.Errorf("random ports = %v are sequential", ports)
+			}
+
+			if tt.step != 0 {
+				// Allocation wraps around to the bottom of the ephemeral ports.
+				nt.(*hardNAT).ports.last = 65535
+				got := nt.PickOutgoingSrc(lan, netip.MustParseAddrPort("4.4.4.4:1"), now).Port()
+				if want := 32<<10 + tt.step - 1; got != want {
+					t.Errorf("port after 65535 = %d; want %d", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTripNAT(t *testing.T) {
+	nt, err := natTypes[RoundTripNAT](testPool{wanIP: netip.MustParseAddr("2.1.1.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lan := netip.MustParseAddrPort("192.168.0.101:41641")
+	peer := netip.MustParseAddrPort("3.3.3.3:41641")
+	now := time.Now()
+
+	wan := nt.PickOutgoingSrc(lan, peer, now)
+	if !wan.IsValid() {
+		t.Fatal("no mapping allocated")
+	}
+	in := func(src netip.AddrPort) bool {
+		t.Helper()
+		dst := nt.PickIncomingDst(src, wan, now)
+		if dst.IsValid() && dst != lan {
+			t.Fatalf("incoming packet mapped to %v; want %v", dst, lan)
+		}
+		return dst.IsValid()
+	}
+
+	if in(netip.MustParseAddrPort("4.4.4.4:41641")) {
+		t.Error("packet from unrelated peer accepted")
+	}
+	if !in(peer) {
+		t.Error("reply to outgoing packet dropped")
+	}
+	if in(peer) {
+		t.Error("second incoming packet accepted before round trip")
+	}
+
+	if got := nt.PickOutgoingSrc(lan, peer, now); got != wan {
+		t.Errorf("outgoing mapping changed from %v to %v", wan, got)
+	}
+	for i := range 3 {
+		if !in(peer) {
+			t.Errorf("incoming packet %d dropped after round trip", i)
+		}
+	}
+
+	now = now.Add(301 * time.Second)
+	if in(peer) {
+		t.Error("incoming packet accepted after flow expired")
+	}
+}
+
+func TestRoundTripNATExpiresFlows(t *testing.T) {
+	nt, err := natTypes[RoundTripNAT](testPool{wanIP: netip.MustParseAddr("2.1.1.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := nt.(*roundTripNAT)
+	lan := netip.MustParseAddrPort("192.168.0.101:41641")
+	now := time.Now()
+
+	nt.PickOutgoingSrc(lan, netip.MustParseAddrPort("3.3.3.3:41641"), now)
+	if len(rt.flows) != 1 {
+		t.Fatalf("got %d flows; want 1", len(rt.flows))
+	}
+
+	// A packet on another flow after the first one has been idle longer
+	// than the timeout sweeps it away.
+	now = now.Add(roundTripFlowTimeout + time.Second)
+	nt.PickOutgoingSrc(lan, netip.MustParseAddrPort("4.4.4.4:41641"), now)
+	if _, ok := rt.flows[srcDstTuple{lan, netip.MustParseAddrPort("3.3.3.3:41641")}]; ok {
+		t.Error("idle flow not removed")
+	}
+	if len(rt.flows) != 1 {
+		t.Errorf("got %d flows; want 1", len(rt.flows))
+	}
+}
+
+func TestRoundTripNATExpiresMappings(t *testing.T) {
+	nt, err := natTypes[RoundTripNAT](testPool{wanIP: netip.MustParseAddr("2.1.1.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := nt.(*roundTripNAT)
+	active := netip.MustParseAddrPort("192.168.0.101:41641")
+	idle := netip.MustParseAddrPort("192.168.0.102:41641")
+	peer := netip.MustParseAddrPort("3.3.3.3:41641")
+	now := time.Now()
+
+	wan := nt.PickOutgoingSrc(active, peer, now)
+	nt.PickOutgoingSrc(idle, peer, now)
+	if len(rt.out) != 2 || len(rt.in) != 2 {
+		t.Fatalf("got %d out and %d in mappings; want 2 each", len(rt.out), len(rt.in))
+	}
+
+	// Outgoing packets keep a mapping alive.
+	now = now.Add(roundTripFlowTimeout / 2)
+	nt.PickOutgoingSrc(active, peer, now)
+	now = now.Add(roundTripFlowTimeout/2 + time.Second)
+	if got := nt.PickOutgoingSrc(active, peer, now); got != wan {
+		t.Errorf("active mapping changed from %v to %v", wan, got)
+	}
+	if _, ok := rt.out[idle]; ok {
+		t.Error("idle mapping not removed")
+	}
+	if len(rt.out) != 1 || len(rt.in) != 1 {
+		t.Errorf("got %d out and %d in mappings; want 1 each", len(rt.out), len(rt.in))
+	}
+}
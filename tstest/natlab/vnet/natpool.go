@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// WANIPPolicy is how a network with a pool of WAN IPs (see
+// Network.SetWANIPPool) picks the WAN IP of a new outgoing flow.
+type WANIPPolicy int
+
+const (
+	// WANIPPerHost uses the same WAN IP for all of a LAN host's flows
+	// ("paired" pooling, per RFC 4787), giving hosts their IPs in turn.
+	WANIPPerHost WANIPPolicy = iota
+
+	// WANIPPerFlow uses a random WAN IP for each flow, so a LAN host's
+	// mappings vary by destination like with HardNAT, even with EasyNAT.
+	WANIPPerFlow
+
+	// WANIPRoundRobin uses the WAN IPs in turn for each new flow.
+	WANIPRoundRobin
+)
+
+// poolNAT is the NAT table of a network with a pool of WAN IPs. It's made of
+// a table of the network's NAT type per WAN IP, passing each outgoing flow
+// to the table of the WAN IP picked for it by its WANIPPolicy, and each
+// incoming packet to the table of its destination IP.
+type poolNAT struct {
+	pool     IPPool
+	newTable newTableFunc
+	policy   WANIPPolicy
+	ips      []netip.Addr // the primary WAN IP first
+	tables   []NATTable   // parallel to ips
+
+	next   int                 // index of the next WAN IP to hand out in turn
+	byHost map[netip.Addr]int  // LAN IP => index of its WAN IP, for WANIPPerHost
+	byFlow map[srcDstTuple]int // (lan:port, wan:port) => index of its WAN IP, for the other policies
+}
+
+// newPoolNAT returns a poolNAT for the pool p with the WAN IPs ips, the
+// primary one first, making their tables with newTable.
+func newPoolNAT(p IPPool, newTable newTableFunc, ips []netip.Addr, policy WANIPPolicy) (*poolNAT, error) {
+	n := &poolNAT{
+		pool:     p,
+		newTable: newTable,
+		policy:   policy,
+		ips:      ips,
+	}
+	for _, ip := range ips {
+		t, err := newTable(poolMember{p, ip})
+		if err != nil {
+			return nil, err
+		}
+		n.tables = append(n.tables, t)
+	}
+	return n, nil
+}
+
+// poolMember is the IPPool of one of a poolNAT's tables: the network's, but
+// with one of its pool's WAN IPs.
+type poolMember struct {
+	IPPool
+	ip netip.Addr
+}
+
+func (p poolMember) WANIP() netip.Addr { return p.ip }
+
+// portAllocation, natMappingLimit and natRand pass through the network's
+// settings, which NAT constructors look for with type assertions. A mapping limit
+// applies to each WAN IP of the pool.
+func (p poolMember) portAllocation() PortAllocation { return newPortAllocator(p.IPPool).alloc }
+func (p poolMember) natMappingLimit() mappingLimit  { return mappingLimitOf(p.IPPool) }
+func (p poolMember) natRand() *lockedRand           { return randOf(p.IPPool) }
+
+// pick returns the index of the WAN IP to use for the flow from src to dst.
+func (n *poolNAT) pick(src, dst netip.AddrPort) int {
+	if n.policy == WANIPPerHost {
+		i, ok := n.byHost[src.Addr()]
+		if !ok {
+			i = n.nextIndex()
+			mak.Set(&n.byHost, src.Addr(), i)
+		}
+		return i
+	}
+	k := srcDstTuple{src, dst}
+	i, ok := n.byFlow[k]
+	if !ok {
+		if n.policy == WANIPPerFlow {
+			i = randOf(n.pool).IntN(len(n.ips))
+		} else {
+			i = n.nextIndex()
+		}
+		mak.Set(&n.byFlow, k, i)
+	}
+	return i
+}
+
+func (n *poolNAT) nextIndex() int {
+	i := n.next
+	n.next = (n.next + 1) % len(n.ips)
+	return i
+}
+
+func (n *poolNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
+	return n.tables[n.pick(src, dst)].PickOutgoingSrc(src, dst, at)
+}
+
+func (n *poolNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	i := slices.Index(n.ips, dst.Addr())
+	if i < 0 {
+		return netip.AddrPort{} // drop; not for us
+	}
+	return n.tables[i].PickIncomingDst(src, dst, at)
+}
+
+func (n *poolNAT) IsPublicPortUsed(ap netip.AddrPort) bool {
+	i := slices.Index(n.ips, ap.Addr())
+	return i >= 0 && n.tables[i].IsPublicPortUsed(ap)
+}
+
+// setWANIP changes the primary WAN IP of the pool.
+func (n *poolNAT) setWANIP(ip netip.Addr) {
+	n.ips[0] = ip
+	if ws, ok := n.tables[0].(wanIPSetter); ok {
+		ws.setWANIP(ip)
+	} else if t, err := n.newTable(poolMember{n.pool, ip}); err == nil {
+		n.tables[0] = t // without its mappings
+	}
+}
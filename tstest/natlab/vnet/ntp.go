@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// This file implements the fake NTP server. It answers SNTP (RFC 4330)
+// client requests sent to UDP port 123 of ntp.tailscale with the time of the
+// Server's clock, so guests can sync their clocks without the real internet.
+// The fake DNS server resolves the pool.ntp.org names that guests default to
+// to it.
+
+const (
+	ntpPort   = 123
+	ntpLen    = 48 // length of an NTP packet without extensions
+	ntpClient = 3  // client mode
+	ntpServer = 4  // server mode
+
+	// ntpEpochOffset is the number of seconds from the NTP epoch, 1900-01-01,
+	// to the Unix epoch.
+	ntpEpochOffset = 2208988800
+)
+
+// ntpTime returns t as a 64-bit NTP timestamp: seconds since the NTP epoch
+// in the high 32 bits and the fraction of a second in the low 32.
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// makeNTPReply returns the NTP server's response to the SNTP request req,
+// reporting whether req was a valid client request. A node is told its own
+// time, with its clock skew.
+func (s *Server) makeNTPReply(req UDPPacket) (res UDPPacket, ok bool) {
+	p := req.Payload
+	if len(p) < ntpLen {
+		return res, false
+	}
+	vn, mode := p[0]>>3&7, p[0]&7
+	if mode != ntpClient || vn < 1 || vn > 4 {
+		return res, false
+	}
+	t := s.clock.Now()
+	if req.srcNode != nil {
+		t = req.srcNode.now()
+	}
+	now := ntpTime(t)
+
+	b := make([]byte, ntpLen)
+	b[0] = vn<<3 | ntpServer // leap indicator 0: no warning
+	b[1] = 1                 // stratum: primary server
+	b[2] = p[2]              // poll interval, copied from the request
+	b[3] = 0xec              // precision: 2^-20 s, about a microsecond
+	// Root delay and dispersion (bytes 4 to 12) are zero: the clock is the
+	// reference.
+	copy(b[12:16], "LOCL")                  // reference ID
+	binary.BigEndian.PutUint64(b[16:], now) // reference timestamp
+	copy(b[24:32], p[40:48])                // originate: the request's transmit timestamp
+	binary.BigEndian.PutUint64(b[32:], now) // receive timestamp
+	binary.BigEndian.PutUint64(b[40:], now) // transmit timestamp
+	return UDPPacket{Src: req.Dst, Dst: req.Src, Payload: b}, true
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Observer is notified of the Server's packet handling decisions, so tests
+// can assert on them without scraping logs. Set one with Config.SetObserver.
+//
+// Methods are called synchronously from the packet handling path, possibly
+// concurrently and with internal locks held, so they must be cheap, must not
+// block, and must not call back into the Server.
+//
+// Embed NopObserver to implement only some of the methods.
+type Observer interface {
+	// OnNATOut is called when the router of a network translates the LAN
+	// source src of an outgoing UDP packet to dst into the WAN source newSrc.
+	OnNATOut(src, dst, newSrc netip.AddrPort)
+
+	// OnNATIn is called when the router of a network translates the WAN
+	// destination dst of an incoming UDP packet from src into the LAN
+	// destination newDst.
+	OnNATIn(src, dst, newDst netip.AddrPort)
+
+	// OnDrop is called when a packet is dropped for the given reason.
+	OnDrop(reason DropReason)
+
+	// OnPortMap is called when a port mapping (for proto "UDP" or "TCP") from
+	// the WAN ip:port wan to the LAN ip:port lan is created or renewed for
+	// lifetime, or deleted, in which case lifetime is zero.
+	OnPortMap(proto string, wan, lan netip.AddrPort, lifetime time.Duration)
+
+	// OnDHCPLease is called when the DHCP server acknowledges the lease of
+	// ip to the node with MAC mac.
+	OnDHCPLease(mac MAC, ip netip.Addr)
+}
+
+// DropReason is why a packet was dropped. See Observer.OnDrop.
+type DropReason string
+
+const (
+	DropNATOut          DropReason = "nat-out"           // no NAT mapping for an outgoing packet
+	DropNATIn           DropReason = "nat-in"            // no NAT mapping for an incoming packet
+	DropBlackhole       DropReason = "blackhole"         // WAN IPv4 blackholed; see Network.SetBlackholedIPv4
+	DropPacketLoss      DropReason = "packet-loss"       // see Network.SetPacketLoss
+	DropLargePacketLoss DropReason = "large-packet-loss" // see Network.SetLargePacketLoss
+	DropTooBig          DropReason = "too-big"           // bigger than the MTU and can't be fragmented
+	DropFirewall        DropReason = "firewall"          // see Network.AddFirewallRule
+	DropUDPBlocked      DropReason = "udp-blocked"       // see Network.SetUDPBlocked
+	DropDERPBlocked     DropReason = "derp-blocked"      // see Network.SetDERPBlocked
+)
+
+// NopObserver is an Observer that does nothing.
+type NopObserver struct{}
+
+func (NopObserver) OnNATOut(src, dst, newSrc netip.AddrPort)                                {}
+func (NopObserver) OnNATIn(src, dst, newDst netip.AddrPort)                                 {}
+func (NopObserver) OnDrop(reason DropReason)                                                {}
+func (NopObserver) OnPortMap(proto string, wan, lan netip.AddrPort, lifetime time.Duration) {}
+func (NopObserver) OnDHCPLease(mac MAC, ip netip.Addr)                                      {}
@@ -0,0 +1,215 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+// nodePair is a direction of traffic between two nodes.
+type nodePair struct {
+	from, to *node
+}
+
+// pathTracker records, over time, how pairs of nodes talk to each other:
+// which nodes have connected to a fake DERP server, and which pairs of nodes
+// have exchanged UDP directly through their networks' NATs.
+type pathTracker struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced when derp or direct change
+	derp    set.Set[*node]
+
+	// direct is the set of node pairs that have sent UDP directly to each
+	// other. The value is whether both nodes had already connected to DERP
+	// when the first such packet was delivered.
+	direct map[nodePair]bool
+}
+
+// noteDERP records that n has connected to a fake DERP server.
+func (pt *pathTracker) noteDERP(n *node) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.derp.Contains(n) {
+		return
+	}
+	pt.derp.Make()
+	pt.derp.Add(n)
+	pt.notifyLocked()
+}
+
+// noteDirect records that a UDP packet from one node was delivered directly
+// to another.
+func (pt *pathTracker) noteDirect(from, to *node) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	k := nodePair{from, to}
+	if _, ok := pt.direct[k]; ok {
+		return
+	}
+	mak.Set(&pt.direct, k, pt.derp.Contains(from) && pt.derp.Contains(to))
+	pt.notifyLocked()
+}
+
+// hasPathLocked reports whether n has connected to DERP or sent UDP directly
+// to another node.
+//
+// pt.mu must be held.
+func (pt *pathTracker) hasPathLocked(n *node) bool {
+	if pt.derp.Contains(n) {
+		return true
+	}
+	for k := range pt.direct {
+		if k.from == n {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitChangeLocked returns a channel that's closed when derp or direct
+// next change.
+//
+// pt.mu must be held.
+func (pt *pathTracker) awaitChangeLocked() <-chan struct{} {
+	if pt.changed == nil {
+		pt.changed = make(chan struct{})
+	}
+	return pt.changed
+}
+
+func (pt *pathTracker) notifyLocked() {
+	if pt.changed != nil {
+		close(pt.changed)
+		pt.changed = nil
+	}
+}
+
+// PathKind is how two nodes talk to each other, as reported by
+// [Server.PathKind].
+type PathKind string
+
+const (
+	PathDirect PathKind = "direct" // UDP delivered directly through the NATs
+	PathDERP   PathKind = "derp"   // both nodes connected to DERP, but no direct UDP
+	PathNone   PathKind = "none"   // neither
+)
+
+// PathKind reports how nodes a and b have talked to each other so far:
+// PathDirect if any UDP datagram from one was delivered directly to the
+// other, through their networks' NATs and firewalls; else PathDERP if both
+// have connected to a fake DERP server; else PathNone.
+//
+// It's cheaper for test assertions than inspecting packet captures, but
+// can't tell whether the nodes still talk directly.
+func (s *Server) PathKind(a, b *Node) PathKind {
+	na, nb := a.n, b.n
+	pt := &s.paths
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	_, okAB := pt.direct[nodePair{na, nb}]
+	_, okBA := pt.direct[nodePair{nb, na}]
+	switch {
+	case okAB || okBA:
+		return PathDirect
+	case pt.derp.Contains(na) && pt.derp.Contains(nb):
+		return PathDERP
+	}
+	return PathNone
+}
+
+// AwaitDirectUpgrade waits for nodes a and b to go from talking via DERP to
+// talking directly, as Tailscale nodes are expected to.
+//
+// The upgrade is complete once UDP has been delivered directly between the
+// nodes in both directions. It's an error if that happened before both nodes
+// had connected to DERP, or if ctx is done before the upgrade completes.
+func (s *Server) AwaitDirectUpgrade(ctx context.Context, a, b *Node) error {
+	na, nb := a.n, b.n
+	pt := &s.paths
+	for {
+		pt.mu.Lock()
+		viaDERPAB, okAB := pt.direct[nodePair{na, nb}]
+		viaDERPBA, okBA := pt.direct[nodePair{nb, na}]
+		if okAB && okBA {
+			pt.mu.Unlock()
+			if !viaDERPAB || !viaDERPBA {
+				return fmt.Errorf("%v and %v talked directly before both connected to DERP", na, nb)
+			}
+			return nil
+		}
+		changed := pt.awaitChangeLocked()
+		usedDERP := pt.derp.Contains(na) && pt.derp.Contains(nb)
+		pt.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			if !usedDERP {
+				return fmt.Errorf("%v and %v never both connected to DERP: %w", na, nb, ctx.Err())
+			}
+			return fmt.Errorf("%v and %v never upgraded from DERP to direct: %w", na, nb, ctx.Err())
+		}
+	}
+}
+
+// controlPollInterval is how often WaitNodeOnline checks the fake control
+// server, which has no way to notify it of changes.
+const controlPollInterval = 50 * time.Millisecond
+
+// WaitNodeOnline waits for node n to be online: registered with the fake
+// control server, which it's found in by its LAN address among the endpoints
+// each node reports, and connected to DERP or sending UDP directly to
+// another node. It returns an error if ctx is done first.
+func (s *Server) WaitNodeOnline(ctx context.Context, n *Node) error {
+	nn := n.n
+	pt := &s.paths
+	poll := time.NewTicker(controlPollInterval)
+	defer poll.Stop()
+	for {
+		registered := s.controlNodeOf(nn) != nil
+		pt.mu.Lock()
+		hasPath := pt.hasPathLocked(nn)
+		changed := pt.awaitChangeLocked()
+		pt.mu.Unlock()
+		if registered && hasPath {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-poll.C:
+		case <-ctx.Done():
+			if !registered {
+				return fmt.Errorf("%v never registered with control: %w", nn, ctx.Err())
+			}
+			return fmt.Errorf("%v never connected to DERP or a peer: %w", nn, ctx.Err())
+		}
+	}
+}
+
+// controlNodeOf returns the fake control server's authorized node reporting
+// one of n's LAN addresses as an endpoint, or nil if there's none yet.
+func (s *Server) controlNodeOf(n *node) *tailcfg.Node {
+	for _, cn := range s.control.AllNodes() {
+		if !cn.MachineAuthorized {
+			continue
+		}
+		if slices.ContainsFunc(cn.Endpoints, func(ap netip.AddrPort) bool {
+			ip := ap.Addr()
+			return ip == n.lanIP || (n.dhcp6IP.IsValid() && ip == n.dhcp6IP)
+		}) {
+			return cn
+		}
+	}
+	return nil
+}
@@ -4,21 +4,124 @@
 package vnet
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"tailscale.com/tstime"
 )
 
-// pcapWriter is a pcapgo.NgWriter that writes to a file.
+// pcapWriter is a pcapgo.NgWriter that writes to a file, or to a sequence of
+// files if rotation is enabled with Config.SetPCAPRotation.
 // It is safe for concurrent use. The nil value is a no-op.
 type pcapWriter struct {
-	f *os.File
+	name    string        // file name, or the pattern of segment names if rotating
+	maxSize int64         // rotate once a segment is this big, or 0
+	maxAge  time.Duration // rotate once a segment is this old, or 0
+	clock   tstime.Clock
 
-	mu sync.Mutex
-	w  *pcapgo.NgWriter
+	mu      sync.Mutex
+	f       *os.File
+	cw      *countingWriter // wraps f
+	w       *pcapgo.NgWriter
+	ifaces  []pcapgo.NgInterface // added with AddInterface; replicated into each segment
+	seq     int                  // index of the current segment
+	opened  time.Time            // when the current segment was created
+	packets int                  // packets in the current segment
+}
+
+// newPCAPWriter returns a pcapWriter writing to the file name. If either of
+// maxSize or maxAge is non-zero, it writes to numbered segments of name
+// instead, per pcapSegmentName, starting a new one when the current one
+// reaches maxSize bytes or maxAge age.
+func newPCAPWriter(name string, maxSize int64, maxAge time.Duration, clock tstime.Clock) (*pcapWriter, error) {
+	p := &pcapWriter{
+		name:    name,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		clock:   clock,
+	}
+	if err := p.openLocked(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// rotating reports whether p writes to a sequence of segments.
+func (p *pcapWriter) rotating() bool {
+	return p.maxSize > 0 || p.maxAge > 0
+}
+
+// pcapSegmentName returns the name of segment seq of the rotated pcap file
+// name, numbering it before the extension: "foo.pcapng" becomes
+// "foo.000.pcapng", "foo.001.pcapng" and so on.
+func pcapSegmentName(name string, seq int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.%03d%s", strings.TrimSuffix(name, ext), seq, ext)
+}
+
+// openLocked creates the file for the current segment and writes its
+// section header and the interface description blocks of all interfaces
+// added so far, so that each segment is a valid pcapng file by itself.
+func (p *pcapWriter) openLocked() error {
+	name := p.name
+	if p.rotating() {
+		name = pcapSegmentName(p.name, p.seq)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: f}
+	w, err := pcapgo.NewNgWriter(cw, layers.LinkTypeEthernet)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, i := range p.ifaces {
+		if _, err := w.AddInterface(i); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	p.f, p.cw, p.w = f, cw, w
+	p.opened = p.clock.Now()
+	p.packets = 0
+	return nil
+}
+
+// closeLocked finalizes and closes the current segment.
+func (p *pcapWriter) closeLocked() error {
+	if p.w == nil {
+		return nil
+	}
+	err := p.w.Flush()
+	p.w = nil
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// shouldRotateLocked reports whether the next packet should start a new
+// segment. Segments always hold at least one packet.
+func (p *pcapWriter) shouldRotateLocked() bool {
+	if !p.rotating() || p.packets == 0 {
+		return false
+	}
+	return (p.maxSize > 0 && p.cw.n >= p.maxSize) ||
+		(p.maxAge > 0 && p.clock.Since(p.opened) >= p.maxAge)
 }
 
 func do(fs ...func() error) error {
@@ -39,6 +142,16 @@ func (p *pcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
 	if p.w == nil {
 		return io.ErrClosedPipe
 	}
+	if p.shouldRotateLocked() {
+		if err := p.closeLocked(); err != nil {
+			return err
+		}
+		p.seq++
+		if err := p.openLocked(); err != nil {
+			return err
+		}
+	}
+	p.packets++
 	return do(
 		func() error { return p.w.WritePacket(ci, data) },
 		p.w.Flush,
@@ -52,7 +165,11 @@ func (p *pcapWriter) AddInterface(i pcapgo.NgInterface) (int, error) {
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	return p.w.AddInterface(i)
+	id, err := p.w.AddInterface(i)
+	if err == nil {
+		p.ifaces = append(p.ifaces, i)
+	}
+	return id, err
 }
 
 func (p *pcapWriter) Close() error {
@@ -61,9 +178,185 @@ func (p *pcapWriter) Close() error {
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if p.w != nil {
-		p.w.Flush()
-		p.w = nil
+	return p.closeLocked()
+}
+
+// countingWriter is an io.Writer that counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// joinValid returns the valid ones of addrs (netip.Addrs and netip.Prefixes),
+// comma-separated, for pcapng interface descriptions.
+func joinValid(addrs ...interface {
+	IsValid() bool
+	String() string
+}) string {
+	var ss []string
+	for _, a := range addrs {
+		if a.IsValid() {
+			ss = append(ss, a.String())
+		}
+	}
+	return strings.Join(ss, ", ")
+}
+
+// addCaptureInterface adds the capture interface i to the pcap file, if any,
+// and returns its ID.
+func (s *Server) addCaptureInterface(i pcapgo.NgInterface) (int, error) {
+	// The pcapWriter's IDs are the same, counting from its default
+	// interface 0.
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if _, err := s.pcapWriter.AddInterface(i); err != nil {
+		return 0, err
+	}
+	s.captureIfaces = append(s.captureIfaces, i)
+	return len(s.captureIfaces), nil
+}
+
+// CaptureInterfaceName returns the name of the capture interface with ID
+// id, the InterfaceIndex of the packets passed to packet sinks, such as
+// "node1", "net1-lan" or "net1-wan". It returns the empty string for unknown
+// IDs.
+func (s *Server) CaptureInterfaceName(id int) string {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if id < 1 || id > len(s.captureIfaces) {
+		return ""
+	}
+	return s.captureIfaces[id-1].Name
+}
+
+// RegisterPacketSink registers f to be called with every packet that the
+// Server captures, as written to the pcap file set by Config.SetPCAPFile,
+// whether or not there is one. Config.SetPCAPFilter doesn't apply to sinks.
+// f is called synchronously as packets flow through the virtual network, so
+// it should be quick, and it must not retain or modify data. The returned
+// func unregisters f.
+func (s *Server) RegisterPacketSink(f func(ci gopacket.CaptureInfo, data []byte)) (unregister func()) {
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	h := s.sinks.Add(f)
+	s.updateSinkFsLocked()
+	return func() {
+		s.sinkMu.Lock()
+		defer s.sinkMu.Unlock()
+		delete(s.sinks, h)
+		s.updateSinkFsLocked()
+	}
+}
+
+func (s *Server) updateSinkFsLocked() {
+	s.sinkFs = slices.Collect(maps.Values(s.sinks))
+}
+
+// capture records the packet data, passing through the capture interface
+// ci.InterfaceIndex, to the pcap file and packet sinks. pkt is data already
+// decoded, if the caller has it, or nil.
+func (s *Server) capture(ci gopacket.CaptureInfo, data []byte, pkt gopacket.Packet) error {
+	s.sinkMu.Lock()
+	sinks := s.sinkFs
+	s.sinkMu.Unlock()
+	for _, f := range sinks {
+		f(ci, data)
+	}
+	if s.pcapWriter == nil {
+		return nil
+	}
+	if s.pcapFilter != nil {
+		if pkt == nil {
+			pkt = s.decodeCaptured(ci.InterfaceIndex, data)
+		}
+		if !s.pcapFilter.match(pkt) {
+			return nil
+		}
+	}
+	return s.pcapWriter.WritePacket(ci, data)
+}
+
+// decodeCaptured lazily decodes the packet data captured on the interface
+// with ID id.
+func (s *Server) decodeCaptured(id int, data []byte) gopacket.Packet {
+	s.captureMu.Lock()
+	ethernet := id < 1 || id > len(s.captureIfaces) || s.captureIfaces[id-1].LinkType == layers.LinkTypeEthernet
+	s.captureMu.Unlock()
+	first := gopacket.Decoder(layers.LayerTypeEthernet)
+	if !ethernet {
+		// The routers' LAN and WAN interfaces carry bare IP packets.
+		first = layers.LayerTypeIPv4
+		if len(data) > 0 && data[0]>>4 == 6 {
+			first = layers.LayerTypeIPv6
+		}
+	}
+	return gopacket.NewPacket(data, first, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+}
+
+// CaptureFilter selects the packets written to the pcap file, per
+// Config.SetPCAPFilter. A packet must match all of its non-empty fields.
+// Non-IP packets, such as ARP, match only the zero CaptureFilter.
+type CaptureFilter struct {
+	Proto string         // "UDP", "TCP", "ICMP" (v4 or v6), or empty for any
+	Ports []uint16       // source or destination port, or empty for any
+	IPs   []netip.Prefix // containing the source or destination IP, or empty for any
+}
+
+func (f *CaptureFilter) validate() error {
+	switch f.Proto {
+	case "", "UDP", "TCP", "ICMP":
+	default:
+		return fmt.Errorf("pcap filter: unknown protocol %q", f.Proto)
+	}
+	if len(f.Ports) > 0 && f.Proto == "ICMP" {
+		return errors.New("pcap filter: ports with ICMP")
+	}
+	for _, p := range f.IPs {
+		if !p.IsValid() {
+			return fmt.Errorf("pcap filter: invalid prefix %v", p)
+		}
+	}
+	return nil
+}
+
+// match reports whether pkt matches f.
+func (f *CaptureFilter) match(pkt gopacket.Packet) bool {
+	if f.Proto == "" && len(f.Ports) == 0 && len(f.IPs) == 0 {
+		return true
+	}
+	fl, ok := flow(pkt)
+	if !ok {
+		return false
+	}
+	if len(f.IPs) > 0 && !slices.ContainsFunc(f.IPs, func(p netip.Prefix) bool {
+		return p.Contains(fl.src) || p.Contains(fl.dst)
+	}) {
+		return false
+	}
+	var proto string
+	var sport, dport uint16
+	switch tl := pkt.TransportLayer().(type) {
+	case *layers.UDP:
+		proto, sport, dport = "UDP", uint16(tl.SrcPort), uint16(tl.DstPort)
+	case *layers.TCP:
+		proto, sport, dport = "TCP", uint16(tl.SrcPort), uint16(tl.DstPort)
+	default:
+		if pkt.Layer(layers.LayerTypeICMPv4) != nil || pkt.Layer(layers.LayerTypeICMPv6) != nil {
+			proto = "ICMP"
+		}
+	}
+	if f.Proto != "" && f.Proto != proto {
+		return false
+	}
+	if len(f.Ports) > 0 && (proto == "" || proto == "ICMP" ||
+		!slices.ContainsFunc(f.Ports, func(p uint16) bool { return p == sport || p == dport })) {
+		return false
 	}
-	return p.f.Close()
+	return true
 }
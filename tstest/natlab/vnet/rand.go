@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// This file implements the Server's random source, which all its randomized
+// behavior draws from, such as NAT and port mapping port selection and
+// simulated packet loss, so that a Config seeded with SetRandSeed gives
+// reproducible runs.
+
+// newRand returns a random source seeded with seed if seeded, else randomly.
+func newRand(seed uint64, seeded bool) *rand.Rand {
+	if !seeded {
+		seed = rand.Uint64()
+	}
+	return rand.New(rand.NewPCG(seed, seed))
+}
+
+// lockedRand is a random source that's safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Float64()
+}
+
+func (r *lockedRand) Uint64() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Uint64()
+}
+
+// IntN returns a random int in [0, n). It panics if n <= 0.
+func (r *lockedRand) IntN(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.IntN(n)
+}
+
+// Uint16N returns a random uint16 in [0, n). It panics if n == 0.
+func (r *lockedRand) Uint16N(n uint16) uint16 {
+	return uint16(r.IntN(int(n)))
+}
+
+// unseededRand is the random source of NAT tables outside a Server, as in
+// tests.
+var unseededRand = &lockedRand{r: newRand(0, false)}
+
+// randOf returns the random source of p's network's Server, if it has one.
+func randOf(p IPPool) *lockedRand {
+	if r, ok := p.(interface{ natRand() *lockedRand }); ok {
+		return r.natRand()
+	}
+	return unseededRand
+}
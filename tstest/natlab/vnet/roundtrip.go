@@ -0,0 +1,147 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"log"
+	"net/netip"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// roundTripNAT is an "Endpoint Independent" NAT like easyNAT, but with
+// connection-oriented filtering for UDP: an outgoing packet only opens the
+// pinhole to its destination for a single reply. Further incoming packets
+// from that destination are dropped until the LAN side has sent another
+// packet after that reply, completing a round trip in both directions.
+type roundTripNAT struct {
+	pool  IPPool
+	wanIP netip.Addr
+	out   map[netip.AddrPort]portMappingAndTime
+	in    map[uint16]lanAddrAndTime
+	flows map[srcDstTuple]*roundTripFlow // (lan:port, wan:port) => flow state
+	limit mappingLimit
+
+	lastSweep time.Time // when flows and mappings were last swept of expired ones
+}
+
+// roundTripFlowTimeout is how long a roundTripNAT flow or port mapping lasts
+// without an outgoing packet, the same as the other NATs' stateful firewall
+// timeout.
+const roundTripFlowTimeout = 300 * time.Second
+
+// roundTripFlow is the filtering state of a flow through a roundTripNAT.
+type roundTripFlow struct {
+	lastOut     time.Time // last packet out
+	replied     bool      // whether a reply came in after the first packet out
+	established bool      // whether a packet went out after the reply
+}
+
+func init() {
+	registerNATType(RoundTripNAT, func(p IPPool) (NATTable, error) {
+		return &roundTripNAT{pool: p, wanIP: p.WANIP(), limit: mappingLimitOf(p)}, nil
+	})
+}
+
+func (n *roundTripNAT) IsPublicPortUsed(ap netip.AddrPort) bool {
+	if ap.Addr() != n.wanIP {
+		return false
+	}
+	_, ok := n.in[ap.Port()]
+	return ok
+}
+
+func (n *roundTripNAT) setWANIP(ip netip.Addr) { n.wanIP = ip }
+
+func (n *roundTripNAT) PickOutgoingSrc(src, dst netip.AddrPort, at time.Time) (wanSrc netip.AddrPort) {
+	n.expireIdle(at)
+	k := srcDstTuple{src, dst}
+	f, ok := n.flows[k]
+	if !ok || at.Sub(f.lastOut) > roundTripFlowTimeout {
+		f = &roundTripFlow{}
+		mak.Set(&n.flows, k, f)
+	}
+	f.lastOut = at
+	if f.replied {
+		f.established = true
+	}
+
+	if pm, ok := n.out[src]; ok {
+		if at.Sub(pm.at) <= roundTripFlowTimeout {
+			// Existing mapping, kept alive by this packet.
+			n.out[src] = portMappingAndTime{port: pm.port, at: at}
+			n.in[pm.port] = lanAddrAndTime{lanAddr: src, at: at}
+			return netip.AddrPortFrom(n.wanIP, pm.port)
+		}
+		// Expired, but not yet swept.
+		delete(n.out, src)
+		delete(n.in, pm.port)
+	}
+
+	if !makeRoom(n.limit, n.out, func(_ netip.AddrPort, pm portMappingAndTime) { delete(n.in, pm.port) }) {
+		return netip.AddrPort{} // table full
+	}
+
+	// Loop through all 32k high (ephemeral) ports, starting at a random
+	// position and looping back around to the start.
+	start := randOf(n.pool).Uint16N(32 << 10)
+	for off := range uint16(32 << 10) {
+		port := 32<<10 + (start+off)%(32<<10)
+		if _, ok := n.in[port]; !ok {
+			wanAddr := netip.AddrPortFrom(n.wanIP, port)
+			if n.pool.IsPublicPortUsed(wanAddr) {
+				continue
+			}
+
+			// Found a free port.
+			mak.Set(&n.out, src, portMappingAndTime{port: port, at: at})
+			mak.Set(&n.in, port, lanAddrAndTime{lanAddr: src, at: at})
+			return wanAddr
+		}
+	}
+	return netip.AddrPort{} // failed to allocate a mapping; TODO: fire an alert?
+}
+
+func (n *roundTripNAT) PickIncomingDst(src, dst netip.AddrPort, at time.Time) (lanDst netip.AddrPort) {
+	if dst.Addr() != n.wanIP {
+		return netip.AddrPort{} // drop; not for us. shouldn't happen if natlabd routing isn't broken.
+	}
+	lanDst = n.in[dst.Port()].lanAddr
+
+	f, ok := n.flows[srcDstTuple{lanDst, src}]
+	if !ok || at.Sub(f.lastOut) > roundTripFlowTimeout {
+		log.Printf("Drop incoming packet from %v to %v; no recent outgoing packet", src, dst)
+		return netip.AddrPort{}
+	}
+	switch {
+	case f.established:
+	case !f.replied:
+		f.replied = true
+	default:
+		log.Printf("Drop incoming packet from %v to %v; awaiting round trip", src, dst)
+		return netip.AddrPort{}
+	}
+	return lanDst
+}
+
+// expireIdle removes flows and port mappings that have timed out as of at, so
+// they don't grow without bound. It only sweeps once per roundTripFlowTimeout.
+func (n *roundTripNAT) expireIdle(at time.Time) {
+	if at.Sub(n.lastSweep) < roundTripFlowTimeout {
+		return
+	}
+	n.lastSweep = at
+	for k, f := range n.flows {
+		if at.Sub(f.lastOut) > roundTripFlowTimeout {
+			delete(n.flows, k)
+		}
+	}
+	for src, pm := range n.out {
+		if at.Sub(pm.at) > roundTripFlowTimeout {
+			delete(n.out, src)
+			delete(n.in, pm.port)
+		}
+	}
+}
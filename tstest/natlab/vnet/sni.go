@@ -0,0 +1,100 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// tlsServiceKey is the key of a service registered with RegisterTLSService.
+type tlsServiceKey struct {
+	ip         netip.Addr
+	serverName string // lowercase
+}
+
+// RegisterTLSService registers h to serve HTTPS on TCP port 443 of ip for
+// clients asking for serverName with TLS SNI, so several virtual TLS services
+// can share an IP, as they would behind a real load balancer. TLS is
+// terminated with a certificate for serverName from the Server's CA; see
+// CACert.
+//
+// ip may be one of the built-in fakes' virtual IPs; connections to it whose
+// server name matches no registered service then get the fake's own port
+// 443 service, if any. Elsewhere they're closed. ip must not be a network's
+// WAN IP.
+func (s *Server) RegisterTLSService(ip netip.Addr, serverName string, h http.Handler) error {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	ip = ip.Unmap()
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if !ip.IsValid() || ip.IsUnspecified() || serverName == "" {
+		return errors.New("invalid TLS service address or server name")
+	}
+	if _, ok := s.networkByWAN.Load().Lookup(ip); ok {
+		return fmt.Errorf("TLS service IP %v is a network's WAN IP", ip)
+	}
+	if _, loaded := s.tlsServices.LoadOrStore(tlsServiceKey{ip, serverName}, h); loaded {
+		return fmt.Errorf("TLS service %q at %v already registered", serverName, ip)
+	}
+	return nil
+}
+
+// hasTLSServices reports whether any service from RegisterTLSService is at
+// ip.
+func (s *Server) hasTLSServices(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for k := range s.tlsServices.Keys() {
+		if k.ip == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// errSNIPeeked aborts the TLS handshake peekSNI uses to parse a ClientHello.
+var errSNIPeeked = errors.New("peeked at SNI")
+
+// peekSNI reads the TLS ClientHello from c, returning the server name it asks
+// for, or empty if none, and a conn that reads what peekSNI read before the
+// rest of c, for the real TLS server to read the ClientHello from.
+func peekSNI(c net.Conn) (_ net.Conn, serverName string) {
+	var buf bytes.Buffer
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	tls.Server(sniPeekConn{c, io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSNIPeeked
+		},
+	}).Handshake()
+	c.SetReadDeadline(time.Time{})
+	return replayConn{c, io.MultiReader(&buf, c)}, strings.ToLower(serverName)
+}
+
+// sniPeekConn is the conn peekSNI's aborted TLS handshake uses: it reads
+// from r, a tee of its Conn's reads, and writes, such as the alert about the
+// abort, go nowhere.
+type sniPeekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniPeekConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c sniPeekConn) Write(p []byte) (int, error) { return 0, errSNIPeeked }
+
+// replayConn is a net.Conn that reads from r rather than its Conn.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import "sync/atomic"
+
+// Stats is a snapshot of a Server's traffic counters, as returned by
+// Server.Stats.
+type Stats struct {
+	Nodes    map[MAC]NodeStats    // keyed by node MAC
+	Networks map[int]NetworkStats // keyed by 1-based network number
+}
+
+// NodeStats are the traffic counters of a node.
+type NodeStats struct {
+	TxPackets int64 // Ethernet frames sent by the node
+	TxBytes   int64
+	RxPackets int64 // Ethernet frames delivered to the node
+	RxBytes   int64
+
+	LANDelivered int64 // frames from the node delivered to other nodes on its LAN
+	WANForwarded int64 // UDP packets from the node forwarded to the internet
+	NATDropped   int64 // UDP packets from the node dropped by its network's NAT
+}
+
+// NetworkStats are the traffic counters of a network.
+type NetworkStats struct {
+	// NATDropped is the number of UDP packets from the internet dropped by
+	// the network's NAT. They're counted here rather than against a node,
+	// as without a NAT mapping there's no node they were for.
+	NATDropped int64
+
+	// UDPBlocked is the number of UDP packets, in either direction, dropped
+	// because of Network.SetUDPBlocked.
+	UDPBlocked int64
+}
+
+// nodeStats are the counters behind NodeStats.
+type nodeStats struct {
+	txPackets    atomic.Int64
+	txBytes      atomic.Int64
+	rxPackets    atomic.Int64
+	rxBytes      atomic.Int64
+	lanDelivered atomic.Int64
+	wanForwarded atomic.Int64
+	natDropped   atomic.Int64
+}
+
+// countRx counts a frame of size bytes delivered to the node with MAC mac,
+// if it's a known node.
+func (n *network) countRx(mac MAC, size int) {
+	if node, ok := n.nodesByMAC.Load(mac); ok {
+		node.stats.rxPackets.Add(1)
+		node.stats.rxBytes.Add(int64(size))
+	}
+}
+
+// Stats returns a snapshot of s's traffic counters.
+func (s *Server) Stats() Stats {
+	nodes, networks := s.allNodes(), s.allNetworks()
+	st := Stats{
+		Nodes:    make(map[MAC]NodeStats, len(nodes)),
+		Networks: make(map[int]NetworkStats, len(networks)),
+	}
+	for _, n := range nodes {
+		st.Nodes[n.mac] = NodeStats{
+			TxPackets:    n.stats.txPackets.Load(),
+			TxBytes:      n.stats.txBytes.Load(),
+			RxPackets:    n.stats.rxPackets.Load(),
+			RxBytes:      n.stats.rxBytes.Load(),
+			LANDelivered: n.stats.lanDelivered.Load(),
+			WANForwarded: n.stats.wanForwarded.Load(),
+			NATDropped:   n.stats.natDropped.Load(),
+		}
+	}
+	for _, n := range networks {
+		st.Networks[n.num] = NetworkStats{
+			NATDropped: n.natDropped.Load(),
+			UDPBlocked: n.udpDropped.Load(),
+		}
+	}
+	return st
+}
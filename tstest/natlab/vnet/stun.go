@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+
+	"tailscale.com/net/stun"
+)
+
+// This file implements the fake STUN server. It answers binding requests
+// sent to UDP port 3478 of any IP address, as well as the RFC 5780 NAT
+// behavior discovery extensions: its responses say where its alternate
+// address is, and a CHANGE-REQUEST makes it respond from that address.
+//
+// The alternate address of a request's destination ip:3478 is
+// stun-alt.tailscale:3479. For requests to stun-alt.tailscale itself, the
+// first DERP server's IP stands in for the primary IP.
+//
+// Binding requests are also answered over TCP (RFC 5389 section 7.2.2) at
+// the DERP servers' and stun-alt.tailscale's IPs.
+
+// STUN attributes and flags used for RFC 5780 NAT behavior discovery.
+const (
+	stunAttrChangeRequest  = 0x0003 // RFC 5780 section 7.2
+	stunAttrChangedAddress = 0x0005 // RFC 3489 section 11.2.3
+	stunAttrResponseOrigin = 0x802b // RFC 5780 section 7.3
+	stunAttrOtherAddress   = 0x802c // RFC 5780 section 7.4
+
+	stunChangeIP   = 0x4
+	stunChangePort = 0x2
+
+	stunHeaderLen = 20
+)
+
+// makeSTUNReply returns the STUN server's response to the binding request
+// req, reporting whether req was a valid binding request.
+func (s *Server) makeSTUNReply(req UDPPacket) (res UDPPacket, ok bool) {
+	txid, err := stun.ParseBindingRequest(req.Payload)
+	if err != nil {
+		log.Printf("invalid STUN request: %v", err)
+		return res, false
+	}
+	other := s.stunOtherAddr(req.Dst)
+	src := req.Dst
+	change := stunChangeRequest(req.Payload)
+	if change&stunChangeIP != 0 {
+		src = netip.AddrPortFrom(other.Addr(), src.Port())
+	}
+	if change&stunChangePort != 0 {
+		src = netip.AddrPortFrom(src.Addr(), other.Port())
+	}
+
+	b := stun.Response(txid, req.Src)
+	b = appendSTUNAddr(b, stunAttrResponseOrigin, src)
+	b = appendSTUNAddr(b, stunAttrOtherAddress, other)
+	b = appendSTUNAddr(b, stunAttrChangedAddress, other)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-stunHeaderLen))
+	return UDPPacket{
+		Src:     src,
+		Dst:     req.Src,
+		Payload: b,
+	}, true
+}
+
+// stunOtherAddr returns the STUN server's alternate address (OTHER-ADDRESS,
+// in RFC 5780 terms) for requests sent to dst.
+func (s *Server) stunOtherAddr(dst netip.AddrPort) netip.AddrPort {
+	port := uint16(stunAltPort)
+	if dst.Port() == stunAltPort {
+		port = stunPort
+	}
+	alt := s.vip(fakeSTUNAlt)
+	if alt.Match(dst.Addr()) {
+		alt = s.vip(fakeDERPs[0])
+	}
+	ip := alt.v4
+	if dst.Addr().Is6() {
+		ip = alt.v6
+	}
+	return netip.AddrPortFrom(ip, port)
+}
+
+// stunChangeRequest returns the flags of the CHANGE-REQUEST attribute of the
+// STUN message b, or 0 if it has none.
+func stunChangeRequest(b []byte) uint32 {
+	if len(b) < stunHeaderLen {
+		return 0
+	}
+	b = b[stunHeaderLen:]
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b[0:2])
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		b = b[4:]
+		if n > len(b) {
+			return 0
+		}
+		if typ == stunAttrChangeRequest && n == 4 {
+			return binary.BigEndian.Uint32(b[:4])
+		}
+		b = b[min((n+3)&^3, len(b)):]
+	}
+	return 0
+}
+
+// appendSTUNAddr appends to b a STUN attribute of type typ holding ap in the
+// (non-XORed) MAPPED-ADDRESS format.
+func appendSTUNAddr(b []byte, typ uint16, ap netip.AddrPort) []byte {
+	fam := byte(1)
+	if ap.Addr().Is6() {
+		fam = 2
+	}
+	ip := ap.Addr().AsSlice()
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(ip)))
+	b = append(b, 0, fam)
+	b = binary.BigEndian.AppendUint16(b, ap.Port())
+	return append(b, ip...)
+}
+
+// isSTUNServer reports whether dst is one of the STUN server's addresses that
+// it answers TCP on, and that Network.SetUDPBlockedAllowSTUN lets UDP through
+// to.
+func (s *Server) isSTUNServer(dst netip.AddrPort) bool {
+	if dst.Port() != stunPort && dst.Port() != stunAltPort {
+		return false
+	}
+	_, isDERP := s.derpServerFor(dst.Addr())
+	return isDERP || s.vip(fakeSTUNAlt).Match(dst.Addr())
+}
+
+// serveSTUNTCPConn serves STUN binding requests that client sends over c, a
+// TCP connection to the STUN server at server.
+//
+// The reflexive address in the responses is where client's connection
+// appears to come from on the internet: the network's WAN IP and client's
+// port for IPv4, as the router terminates the connection rather than NATing
+// it, and client itself for IPv6. CHANGE-REQUEST can't be honored over TCP,
+// so requests with one get no response.
+func (n *network) serveSTUNTCPConn(c net.Conn, client, server netip.AddrPort) {
+	defer c.Close()
+	if client.Addr().Is4() {
+		client = netip.AddrPortFrom(n.WANIP(), client.Port())
+	}
+	br := bufio.NewReader(c)
+	for {
+		msg := make([]byte, stunHeaderLen)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return
+		}
+		msg = append(msg, make([]byte, binary.BigEndian.Uint16(msg[2:4]))...)
+		if _, err := io.ReadFull(br, msg[stunHeaderLen:]); err != nil {
+			return
+		}
+		if stunChangeRequest(msg) != 0 {
+			n.logf("STUN over TCP: ignoring CHANGE-REQUEST from %v", client)
+			continue
+		}
+		res, ok := n.s.makeSTUNReply(UDPPacket{Src: client, Dst: server, Payload: msg})
+		if !ok {
+			return
+		}
+		if _, err := c.Write(res.Payload); err != nil {
+			return
+		}
+	}
+}
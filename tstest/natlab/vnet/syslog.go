@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements the fake syslog server's parsing of the datagrams
+// nodes send it, which it keeps per node for Node.Syslogs.
+
+// SyslogEntry is a syslog message a node sent to the fake syslog server.
+type SyslogEntry struct {
+	Facility int
+	Severity int       // 0 (emergency) to 7 (debug)
+	Time     time.Time // from the message, or the zero value if it had none
+	Hostname string    // or empty if the message had none
+	Tag      string    // the program, such as "tailscaled", or empty if none
+	PID      string    // the process ID, or empty if none
+	Message  string
+}
+
+// String returns e as a line of a log file, without a trailing newline.
+func (e SyslogEntry) String() string {
+	t := "-"
+	if !e.Time.IsZero() {
+		t = e.Time.Format(time.RFC3339Nano)
+	}
+	tag := e.Tag
+	if e.PID != "" {
+		tag += "[" + e.PID + "]"
+	}
+	if tag == "" {
+		return fmt.Sprintf("[%s] <%d.%d> %s", t, e.Facility, e.Severity, e.Message)
+	}
+	return fmt.Sprintf("[%s] <%d.%d> %s: %s", t, e.Facility, e.Severity, tag, e.Message)
+}
+
+// parseSyslog parses msg, an RFC 5424 or RFC 3164 syslog message, as sent
+// by a node at now. As RFC 3164 says of relays, what doesn't parse is kept:
+// a message without a priority gets the default one (user.notice) and one
+// without a header is all message.
+func parseSyslog(msg []byte, now time.Time) SyslogEntry {
+	s := strings.TrimRight(string(msg), "\r\n\x00")
+	e := SyslogEntry{Facility: 1, Severity: 5}
+	if rest, ok := strings.CutPrefix(s, "<"); ok {
+		if i := strings.IndexByte(rest, '>'); i >= 1 && i <= 3 {
+			if pri, err := strconv.Atoi(rest[:i]); err == nil && pri >= 0 && pri <= 191 {
+				e.Facility, e.Severity = pri/8, pri%8
+				s = rest[i+1:]
+			}
+		}
+	}
+	if rest, ok := strings.CutPrefix(s, "1 "); ok {
+		parseSyslog5424(&e, rest)
+	} else {
+		parseSyslog3164(&e, s, now)
+	}
+	return e
+}
+
+// parseSyslog5424 parses s, the rest of an RFC 5424 message after its
+// priority and version, into e.
+//
+// https://www.rfc-editor.org/rfc/rfc5424#section-6
+func parseSyslog5424(e *SyslogEntry, s string) {
+	f := strings.SplitN(s, " ", 6) // TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD+MSG
+	if len(f) < 6 {
+		e.Message = s
+		return
+	}
+	nilDash := func(v string) string {
+		if v == "-" {
+			return ""
+		}
+		return v
+	}
+	e.Time, _ = time.Parse(time.RFC3339Nano, f[0])
+	e.Hostname, e.Tag, e.PID = nilDash(f[1]), nilDash(f[2]), nilDash(f[3])
+	msg := skipStructuredData(f[5])
+	msg = strings.TrimPrefix(msg, " ")
+	e.Message = strings.TrimPrefix(msg, "\ufeff") // UTF-8 BOM
+}
+
+// skipStructuredData returns s, an RFC 5424 STRUCTURED-DATA field and what
+// follows it, without the field.
+func skipStructuredData(s string) string {
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		return rest
+	}
+	for strings.HasPrefix(s, "[") {
+		// Find the end of the element, skipping escaped ']' in its
+		// parameter values.
+		i := 1
+		for i < len(s) && s[i] != ']' {
+			if s[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(s) {
+			return ""
+		}
+		s = s[i+1:]
+	}
+	return s
+}
+
+// parseSyslog3164 parses s, the rest of an RFC 3164 message after its
+// priority, into e. Besides the RFC's timestamps, it accepts RFC 3339 ones,
+// as rsyslog and others send.
+//
+// https://www.rfc-editor.org/rfc/rfc3164#section-4.1.2
+func parseSyslog3164(e *SyslogEntry, s string, now time.Time) {
+	e.Message = s
+	var rest string
+	if ts, after, ok := strings.Cut(s, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			e.Time, rest = t, after
+		}
+	}
+	if e.Time.IsZero() && len(s) > len(time.Stamp) && s[len(time.Stamp)] == ' ' {
+		t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], now.Location())
+		if err != nil {
+			return
+		}
+		// The timestamp has no year, so pick the one that puts it
+		// closest to now.
+		e.Time = slices.MinFunc([]time.Time{
+			t.AddDate(now.Year()-1, 0, 0),
+			t.AddDate(now.Year(), 0, 0),
+			t.AddDate(now.Year()+1, 0, 0),
+		}, func(a, b time.Time) int {
+			return int(a.Sub(now).Abs() - b.Sub(now).Abs())
+		})
+		rest = s[len(time.Stamp)+1:]
+	}
+	if e.Time.IsZero() {
+		return
+	}
+
+	e.Hostname, rest, _ = strings.Cut(rest, " ")
+	e.Message = rest
+
+	// The TAG, optionally with a "[pid]", ends with a colon.
+	i := strings.IndexAny(rest, "[: ")
+	if i <= 0 || rest[i] == ' ' {
+		return
+	}
+	tag, pid := rest[:i], ""
+	rest = rest[i:]
+	if after, ok := strings.CutPrefix(rest, "["); ok {
+		j := strings.IndexByte(after, ']')
+		if j < 0 {
+			return
+		}
+		pid, rest = after[:j], after[j+1:]
+	}
+	rest, ok := strings.CutPrefix(rest, ":")
+	if !ok {
+		return
+	}
+	e.Tag, e.PID = tag, pid
+	e.Message = strings.TrimPrefix(rest, " ")
+}
+
+// Syslogs returns the syslog messages the node has sent the fake syslog
+// server, oldest first, or nil if the Server isn't running.
+func (n *Node) Syslogs() []SyslogEntry {
+	if n.n == nil {
+		return nil
+	}
+	n.n.logMu.Lock()
+	defer n.n.logMu.Unlock()
+	return slices.Clone(n.n.syslogs)
+}
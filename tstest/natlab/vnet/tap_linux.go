@@ -0,0 +1,35 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenTAP creates the Linux TAP device name, or attaches to it if it's a
+// persistent one, and returns it for use with Server.ServeTAP. Creating a
+// device requires CAP_NET_ADMIN. A non-persistent device goes away when the
+// returned file is closed.
+func OpenTAP(name string) (*os.File, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("TUNSETIFF %q: %w", name, err)
+	}
+	// The fd is non-blocking, so the file uses the runtime poller and
+	// supports deadlines.
+	return os.NewFile(uintptr(fd), name), nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"tailscale.com/util/must"
+)
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+func TestServeTAP(t *testing.T) {
+	const name = "vnettest0"
+	tap, err := OpenTAP(name)
+	if err != nil {
+		t.Skipf("can't create TAP device: %v", err)
+	}
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+	go s.ServeTAP(tap)
+
+	// Bring the device up and play the part of the kernel side's node with
+	// a packet socket, ARPing for the router.
+	sock := must.Get(unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0))
+	defer unix.Close(sock)
+	ifr := must.Get(unix.NewIfreq(name))
+	ifr.SetUint16(unix.IFF_UP)
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFFLAGS, ifr); err != nil {
+		t.Fatalf("bringing up %s: %v", name, err)
+	}
+	ifi := must.Get(net.InterfaceByName(name))
+	ps, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		t.Skipf("can't open packet socket: %v", err)
+	}
+	defer unix.Close(ps)
+	must.Do(unix.Bind(ps, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}))
+	tv := unix.NsecToTimeval(int64(100 * time.Millisecond))
+	must.Do(unix.SetsockoptTimeval(ps, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv))
+
+	routerIP := netip.MustParseAddr("192.168.0.1")
+	req := mustPacket(
+		&layers.Ethernet{
+			SrcMAC:       nodeMac(1).HWAddr(),
+			DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   nodeMac(1).HWAddr(),
+			SourceProtAddress: clientIPv4(1).AsSlice(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    routerIP.AsSlice(),
+		},
+	)
+	buf := make([]byte, 2048)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := unix.Write(ps, req); err != nil {
+			t.Fatalf("writing to %s: %v", name, err)
+		}
+		for {
+			n, _, err := unix.Recvfrom(ps, buf, 0)
+			if err != nil {
+				break // timeout; resend
+			}
+			pkt := gopacket.NewPacket(buf[:n], layers.LayerTypeEthernet, gopacket.Default)
+			arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+			if ok && arp.Operation == layers.ARPReply && MAC(arp.SourceHwAddress) == routerMac(1) {
+				if got := s.RegisteredWritersForTest(); got != 1 {
+					t.Errorf("registered writers = %d; want 1", got)
+				}
+				return
+			}
+		}
+	}
+	t.Fatal("no ARP reply from the router")
+}
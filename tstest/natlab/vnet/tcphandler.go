@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// TCPHandler handles a TCP connection from a node intercepted by a handler
+// added with Config.AddTCPHandler. The connection's LocalAddr is the address
+// the node connected to and its RemoteAddr the node's LAN address, as the
+// connection is intercepted by the node's network's router before NAT. The connection is closed when the handler returns.
+type TCPHandler func(c *gonet.TCPConn)
+
+// tcpHandler is a custom TCP handler added with Config.AddTCPHandler.
+type tcpHandler struct {
+	match func(netip.Addr) bool
+	port  uint16
+	h     TCPHandler
+}
+
+// AddTCPHandler adds h to handle nodes' TCP connections to port port of any
+// IP address for which match reports true, standing up a virtual TCP service
+// without editing the router's built-in ones. Handlers are consulted in the
+// order added, before the built-in services, so they can also stand in for
+// those.
+//
+// Like the router's TCP proxies, handlers are waited for by Server.Shutdown,
+// and have their connections closed if its context is done first.
+func (c *Config) AddTCPHandler(match func(netip.Addr) bool, port uint16, h TCPHandler) {
+	c.tcpHandlers = append(c.tcpHandlers, tcpHandler{match, port, h})
+}
+
+// tcpHandlerFor returns the first custom TCP handler for connections to dst,
+// if any.
+func (s *Server) tcpHandlerFor(dst netip.AddrPort) (_ TCPHandler, ok bool) {
+	ip := dst.Addr().Unmap()
+	for _, th := range s.tcpHandlers {
+		if th.port == dst.Port() && th.match(ip) {
+			return th.h, true
+		}
+	}
+	return nil, false
+}
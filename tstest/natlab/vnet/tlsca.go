@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// This file implements the certificate authority that issues the TLS
+// certificates of the fake HTTPS servers: the DERP servers, the logcatcher,
+// the echo server and the services from Server.RegisterTLSService. Each
+// connection gets a certificate for the server name it asks for with SNI, or
+// for the IP it connected to if none, so clients trusting the CA's
+// certificate (see Server.CACert) can verify the fakes like real servers.
+// The CA is generated by New unless a Config supplies one with SetTLSCA.
+
+// certValidity is the validity period of the CA's certificates. It's fixed,
+// rather than relative to the Server's clock, so they're valid whatever
+// clock the Server and its clients use.
+var certValidity = struct{ notBefore, notAfter time.Time }{
+	time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// SetTLSCA sets the certificate authority that issues the fake HTTPS
+// servers' certificates. ca's Certificate must be a CA certificate and its
+// PrivateKey a crypto.Signer. By default, New generates a CA.
+func (c *Config) SetTLSCA(ca tls.Certificate) {
+	c.tlsCA = &ca
+}
+
+// CACert returns the certificate of the certificate authority that issues
+// the fake HTTPS servers' certificates, for clients to verify them with.
+// See Config.SetTLSCA.
+func (s *Server) CACert() *x509.Certificate {
+	return s.ca.cert
+}
+
+type certAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate // server name or IP => certificate for it
+}
+
+// newCertAuthority returns a certAuthority for the CA ca, or for a newly
+// generated CA if ca is nil.
+func newCertAuthority(ca *tls.Certificate) (*certAuthority, error) {
+	if ca == nil {
+		return generateCertAuthority()
+	}
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("TLS CA has no certificate")
+	}
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing TLS CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, errors.New("TLS CA certificate is not a CA's")
+	}
+	key, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("TLS CA private key of type %T can't sign", ca.PrivateKey)
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+func generateCertAuthority() (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vnet test CA"},
+		NotBefore:             certValidity.notBefore,
+		NotAfter:              certValidity.notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// tlsConfig returns the TLS config of the fake HTTPS servers, whose
+// certificates ca issues.
+func (ca *certAuthority) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: ca.getCertificate}
+}
+
+// getCertificate returns the certificate for the connection hello starts:
+// for its SNI server name, or for the IP it's to if it has none.
+func (ca *certAuthority) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		ap, err := netip.ParseAddrPort(hello.Conn.LocalAddr().String())
+		if err != nil {
+			return nil, fmt.Errorf("no server name or IP to issue certificate for: %w", err)
+		}
+		name = ap.Addr().Unmap().String()
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if c, ok := ca.leaves[name]; ok {
+		return c, nil
+	}
+	c, err := ca.issue(name)
+	if err != nil {
+		return nil, err
+	}
+	if ca.leaves == nil {
+		ca.leaves = map[string]*tls.Certificate{}
+	}
+	ca.leaves[name] = c
+	return c, nil
+}
+
+// issue returns a new certificate for name, a DNS name or IP address.
+func (ca *certAuthority) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    certValidity.notBefore,
+		NotAfter:     certValidity.notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip, err := netip.ParseAddr(name); err == nil {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip.AsSlice())
+	} else {
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("issuing certificate for %q: %w", name, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
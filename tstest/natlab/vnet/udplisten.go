@@ -0,0 +1,159 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// udpListenerQueueLen is how many packets a listener from ListenUDP queues
+// for reading before dropping more, as a full socket buffer would.
+const udpListenerQueueLen = 512
+
+// ListenUDP returns a net.PacketConn that receives the UDP packets nodes send
+// to port port of ip and sends packets from there, for in-process servers of
+// UDP-based protocols, such as QUIC for DERP-over-QUIC or HTTP/3. It's the
+// UDP counterpart of the TCP interception that the fake servers use: the
+// packets it reads come from the nodes' addresses as seen on the internet,
+// after NAT, and the packets it writes are routed back through the nodes'
+// networks.
+//
+// ip may be one of the built-in fakes' virtual IPs, but not a network's WAN
+// IP or the address of a service from RegisterUDPService or
+// RegisterWANUDPService. Closing the conn stops the interception.
+func (s *Server) ListenUDP(ip netip.Addr, port uint16) (net.PacketConn, error) {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || port == 0 {
+		return nil, errors.New("invalid UDP listen address")
+	}
+	if _, ok := s.networkByWAN.Load().Lookup(ip); ok {
+		return nil, fmt.Errorf("UDP listen IP %v is a network's WAN IP", ip)
+	}
+	ap := netip.AddrPortFrom(ip, port)
+	_, isSvc := s.udpServices.Load(ap)
+	_, isWANSvc := s.wanUDPServices.Load(ap)
+	if isSvc || isWANSvc {
+		return nil, fmt.Errorf("UDP service %v already registered", ap)
+	}
+	l := &udpListener{
+		s:               s,
+		addr:            ap,
+		in:              make(chan UDPPacket, udpListenerQueueLen),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	if _, loaded := s.udpListeners.LoadOrStore(ap, l); loaded {
+		return nil, fmt.Errorf("UDP address %v already in use", ap)
+	}
+	return l, nil
+}
+
+// shouldInterceptUDP reports whether up is to a listener from ListenUDP,
+// returning it.
+func (s *Server) shouldInterceptUDP(up UDPPacket) (*udpListener, bool) {
+	return s.udpListeners.Load(netip.AddrPortFrom(up.Dst.Addr().Unmap(), up.Dst.Port()))
+}
+
+// udpListener is a net.PacketConn from Server.ListenUDP.
+type udpListener struct {
+	s         *Server
+	addr      netip.AddrPort
+	in        chan UDPPacket // packets to read
+	closed    chan struct{}  // closed by Close
+	closeOnce sync.Once
+
+	mu              sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{} // closed and replaced when readDeadline changes
+}
+
+// deliver queues up for reading from l, dropping it if the queue is full.
+func (l *udpListener) deliver(up UDPPacket) {
+	up.Payload = bytes.Clone(up.Payload)
+	select {
+	case l.in <- up:
+	default:
+		l.s.logf("UDP listener %v: queue full; dropping packet from %v", l.addr, up.Src)
+	}
+}
+
+func (l *udpListener) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		l.mu.Lock()
+		deadline, changed := l.readDeadline, l.deadlineChanged
+		l.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case up := <-l.in:
+			return copy(p, up.Payload), net.UDPAddrFromAddrPort(up.Src), nil
+		case <-l.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			// Start over with the new deadline.
+		}
+	}
+}
+
+func (l *udpListener) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-l.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported address type %T", addr)
+	}
+	l.s.routeUDPPacket(UDPPacket{
+		Src:     l.addr,
+		Dst:     ua.AddrPort(),
+		Payload: bytes.Clone(p),
+	})
+	return len(p), nil
+}
+
+func (l *udpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.s.udpListeners.Delete(l.addr)
+	})
+	return nil
+}
+
+func (l *udpListener) LocalAddr() net.Addr { return net.UDPAddrFromAddrPort(l.addr) }
+
+func (l *udpListener) SetDeadline(t time.Time) error { return l.SetReadDeadline(t) }
+
+func (l *udpListener) SetReadDeadline(t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readDeadline = t
+	close(l.deadlineChanged)
+	l.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block.
+func (l *udpListener) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,364 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// This file implements a minimal UPnP Internet Gateway Device: enough SSDP
+// to be discovered and enough of WANIPConnection:1 to add and delete port
+// mappings. Mappings share the NAT-PMP and PCP ones' state via doPortMap.
+
+// upnpPort is the TCP port of the router's UPnP HTTP server, as advertised in
+// its SSDP responses.
+const upnpPort = 5000
+
+// ssdpMulticastIP is the IPv4 multicast group that SSDP searches are sent to.
+var ssdpMulticastIP = netip.MustParseAddr("239.255.255.250")
+
+const (
+	upnpIGDType   = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpWANIPConn = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+	upnpControlPath = "/ctl/IPConn"
+	upnpSCPDPath    = "/WANIPCn.xml"
+
+	// upnpPermanentLeaseSec is the mapping lifetime used for a requested
+	// lease duration of 0, which UPnP defines as permanent.
+	upnpPermanentLeaseSec = 365 * 24 * 60 * 60
+)
+
+// isSSDPSearch reports whether udp is an SSDP M-SEARCH request.
+func isSSDPSearch(udp *layers.UDP) bool {
+	return udp.DstPort == ssdpPort && bytes.HasPrefix(udp.Payload, []byte("M-SEARCH "))
+}
+
+// upnpUUID returns the UUID of the network's UPnP root device.
+func (n *network) upnpUUID() string {
+	return fmt.Sprintf("00000000-0000-0000-0000-%x", n.mac[:])
+}
+
+// handleSSDPRequest handles an SSDP M-SEARCH request sent to either the
+// router or the SSDP multicast group, replying with the location of the
+// router's root device description if the search matches it.
+func (n *network) handleSSDPRequest(req UDPPacket) {
+	if !n.upnp {
+		return
+	}
+	hreq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.Payload)))
+	if err != nil {
+		n.logf("bad SSDP request from %v: %v", req.Src, err)
+		return
+	}
+	st := hreq.Header.Get("St")
+	switch st {
+	case "ssdp:all":
+		st = upnpIGDType
+	case "upnp:rootdevice", upnpIGDType:
+	default:
+		return
+	}
+	gw := n.lanIP4.Addr()
+	res := fmt.Appendf(nil, "HTTP/1.1 200 OK\r\n"+
+		"CACHE-CONTROL: max-age=120\r\n"+
+		"ST: %s\r\n"+
+		"USN: uuid:%s::%s\r\n"+
+		"EXT:\r\n"+
+		"SERVER: Linux UPnP/1.1 vnet/1.0\r\n"+
+		"LOCATION: http://%s/rootDesc.xml\r\n"+
+		"\r\n",
+		st, n.upnpUUID(), st, netip.AddrPortFrom(gw, upnpPort))
+	n.WriteUDPPacketNoNAT(UDPPacket{
+		Src:     netip.AddrPortFrom(gw, ssdpPort),
+		Dst:     req.Src,
+		Payload: res,
+	})
+}
+
+// upnpHandler returns the handler for the router's UPnP HTTP server, for
+// requests from the LAN IP clientIP.
+func (n *network) upnpHandler(clientIP netip.Addr) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		fmt.Fprintf(w, upnpRootDesc, n.upnpUUID(), upnpSCPDPath, upnpControlPath)
+	})
+	mux.HandleFunc("GET "+upnpSCPDPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, upnpWANIPConnSCPD)
+	})
+	mux.HandleFunc("POST "+upnpControlPath, func(w http.ResponseWriter, r *http.Request) {
+		n.serveUPnPControl(w, r, clientIP)
+	})
+	return mux
+}
+
+// upnpRootDesc is the router's root device description. It takes the root
+// device's UUID and the WANIPConnection service description and control URLs.
+const upnpRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>vnet router</friendlyName>
+<manufacturer>Tailscale</manufacturer>
+<modelName>vnet</modelName>
+<UDN>uuid:%[1]s</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<friendlyName>WANDevice</friendlyName>
+<manufacturer>Tailscale</manufacturer>
+<modelName>vnet</modelName>
+<UDN>uuid:%[1]s-wan</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<friendlyName>WANConnectionDevice</friendlyName>
+<manufacturer>Tailscale</manufacturer>
+<modelName>vnet</modelName>
+<UDN>uuid:%[1]s-conn</UDN>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<SCPDURL>%[2]s</SCPDURL>
+<controlURL>%[3]s</controlURL>
+<eventSubURL>/evt/IPConn</eventSubURL>
+</service>
+</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>
+`
+
+// upnpWANIPConnSCPD is the service description of the router's
+// WANIPConnection:1 service, listing only the actions serveUPnPControl
+// implements.
+const upnpWANIPConnSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetExternalIPAddress</name><argumentList>
+<argument><name>NewExternalIPAddress</name><direction>out</direction><relatedStateVariable>ExternalIPAddress</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetStatusInfo</name><argumentList>
+<argument><name>NewConnectionStatus</name><direction>out</direction><relatedStateVariable>ConnectionStatus</relatedStateVariable></argument>
+<argument><name>NewLastConnectionError</name><direction>out</direction><relatedStateVariable>LastConnectionError</relatedStateVariable></argument>
+<argument><name>NewUptime</name><direction>out</direction><relatedStateVariable>Uptime</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>AddPortMapping</name><argumentList>
+<argument><name>NewRemoteHost</name><direction>in</direction><relatedStateVariable>RemoteHost</relatedStateVariable></argument>
+<argument><name>NewExternalPort</name><direction>in</direction><relatedStateVariable>ExternalPort</relatedStateVariable></argument>
+<argument><name>NewProtocol</name><direction>in</direction><relatedStateVariable>PortMappingProtocol</relatedStateVariable></argument>
+<argument><name>NewInternalPort</name><direction>in</direction><relatedStateVariable>InternalPort</relatedStateVariable></argument>
+<argument><name>NewInternalClient</name><direction>in</direction><relatedStateVariable>InternalClient</relatedStateVariable></argument>
+<argument><name>NewEnabled</name><direction>in</direction><relatedStateVariable>PortMappingEnabled</relatedStateVariable></argument>
+<argument><name>NewPortMappingDescription</name><direction>in</direction><relatedStateVariable>PortMappingDescription</relatedStateVariable></argument>
+<argument><name>NewLeaseDuration</name><direction>in</direction><relatedStateVariable>PortMappingLeaseDuration</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>DeletePortMapping</name><argumentList>
+<argument><name>NewRemoteHost</name><direction>in</direction><relatedStateVariable>RemoteHost</relatedStateVariable></argument>
+<argument><name>NewExternalPort</name><direction>in</direction><relatedStateVariable>ExternalPort</relatedStateVariable></argument>
+<argument><name>NewProtocol</name><direction>in</direction><relatedStateVariable>PortMappingProtocol</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="no"><name>ConnectionStatus</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>LastConnectionError</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>Uptime</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>ExternalIPAddress</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>RemoteHost</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>ExternalPort</name><dataType>ui2</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>InternalPort</name><dataType>ui2</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingProtocol</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>InternalClient</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingEnabled</name><dataType>boolean</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingDescription</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>PortMappingLeaseDuration</name><dataType>ui4</dataType></stateVariable>
+</serviceStateTable>
+</scpd>
+`
+
+// UPnP error codes, from the WANIPConnection:1 service spec.
+const (
+	upnpErrInvalidAction   = 401
+	upnpErrInvalidArgs     = 402 // also used for unsupported protocols, like miniupnpd
+	upnpErrNotAuthorized   = 606
+	upnpErrNoSuchEntry     = 714
+	upnpErrWildCardExtPort = 716
+	upnpErrConflict        = 718
+)
+
+// serveUPnPControl handles a SOAP request to the WANIPConnection:1 service
+// from the LAN IP clientIP.
+func (n *network) serveUPnPControl(w http.ResponseWriter, r *http.Request, clientIP netip.Addr) {
+	ns, action, ok := strings.Cut(strings.Trim(r.Header.Get("Soapaction"), `"`), "#")
+	if !ok || ns != upnpWANIPConn {
+		writeUPnPFault(w, upnpErrInvalidAction, "Invalid Action")
+		return
+	}
+	args, err := parseSOAPArgs(r.Body)
+	if err != nil {
+		writeUPnPFault(w, upnpErrInvalidArgs, "Invalid Args")
+		return
+	}
+
+	switch action {
+	case "GetExternalIPAddress":
+		writeUPnPResponse(w, action, "NewExternalIPAddress", n.WANIP().String())
+	case "GetStatusInfo":
+		writeUPnPResponse(w, action,
+			"NewConnectionStatus", "Connected",
+			"NewLastConnectionError", "ERROR_NONE",
+			"NewUptime", "1")
+	case "AddPortMapping":
+		proto, ok := upnpProtocol(args["NewProtocol"])
+		if !ok {
+			writeUPnPFault(w, upnpErrInvalidArgs, "Invalid Args")
+			return
+		}
+		extPort, err1 := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		intPort, err2 := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+		lease, err3 := strconv.ParseUint(args["NewLeaseDuration"], 10, 32)
+		intClient, err4 := netip.ParseAddr(args["NewInternalClient"])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || intPort == 0 {
+			writeUPnPFault(w, upnpErrInvalidArgs, "Invalid Args")
+			return
+		}
+		if intClient != clientIP {
+			writeUPnPFault(w, upnpErrNotAuthorized, "Action not authorized")
+			return
+		}
+		if extPort == 0 {
+			writeUPnPFault(w, upnpErrWildCardExtPort, "WildCardNotPermittedInExtPort")
+			return
+		}
+		if lease == 0 {
+			lease = upnpPermanentLeaseSec
+		}
+		// AddPortMapping can't return a different port than the one asked
+		// for, so if it's taken, report a conflict and let the client pick
+		// another.
+		if !n.doExactPortMap(proto, clientIP, uint16(intPort), uint16(extPort), int(lease)) {
+			writeUPnPFault(w, upnpErrConflict, "ConflictInMappingEntry")
+			return
+		}
+		writeUPnPResponse(w, action)
+	case "DeletePortMapping":
+		proto, ok := upnpProtocol(args["NewProtocol"])
+		if !ok {
+			writeUPnPFault(w, upnpErrInvalidArgs, "Invalid Args")
+			return
+		}
+		extPort, err := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		if err != nil {
+			writeUPnPFault(w, upnpErrInvalidArgs, "Invalid Args")
+			return
+		}
+		if !n.deletePortMapping(proto, clientIP, uint16(extPort)) {
+			writeUPnPFault(w, upnpErrNoSuchEntry, "NoSuchEntryInArray")
+			return
+		}
+		writeUPnPResponse(w, action)
+	default:
+		writeUPnPFault(w, upnpErrInvalidAction, "Invalid Action")
+	}
+}
+
+// upnpProtocol parses a UPnP port mapping protocol name.
+func upnpProtocol(s string) (_ layers.IPProtocol, ok bool) {
+	switch s {
+	case "UDP":
+		return layers.IPProtocolUDP, true
+	case "TCP":
+		return layers.IPProtocolTCP, true
+	}
+	return 0, false
+}
+
+// deletePortMapping removes the proto port mapping from the WAN port wanPort
+// to the LAN IP src, reporting whether there was one. Unlike NAT-PMP and PCP
+// deletions, UPnP ones are keyed by the external port.
+func (n *network) deletePortMapping(proto layers.IPProtocol, src netip.Addr, wanPort uint16) bool {
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+	wanAP := netip.AddrPortFrom(n.WANIP(), wanPort)
+	k := portMapKey{proto, wanAP}
+	pm, ok := n.portMap[k]
+	if !ok || pm.expiry == noExpiry || !n.s.clock.Now().Before(pm.expiry) || pm.dst.Addr() != src {
+		return false
+	}
+	delete(n.portMap, k)
+	n.s.obs.OnPortMap(proto.String(), wanAP, pm.dst, 0)
+	return true
+}
+
+// parseSOAPArgs parses the arguments of the action in a SOAP request body.
+func parseSOAPArgs(r io.Reader) (map[string]string, error) {
+	var env struct {
+		Body struct {
+			Action struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r, 64<<10)).Decode(&env); err != nil {
+		return nil, err
+	}
+	args := map[string]string{}
+	for _, a := range env.Body.Action.Args {
+		args[a.XMLName.Local] = strings.TrimSpace(a.Value)
+	}
+	return args, nil
+}
+
+// writeUPnPResponse writes a successful SOAP response to action, with the
+// given alternating output argument names and values.
+func writeUPnPResponse(w http.ResponseWriter, action string, kv ...string) {
+	var args bytes.Buffer
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&args, "<%s>", kv[i])
+		xml.EscapeText(&args, []byte(kv[i+1]))
+		fmt.Fprintf(&args, "</%s>", kv[i])
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%[1]sResponse xmlns:u="%[2]s">%[3]s</u:%[1]sResponse></s:Body>
+</s:Envelope>
+`, action, upnpWANIPConn, args.Bytes())
+}
+
+// writeUPnPFault writes a SOAP fault with the given UPnP error code.
+func writeUPnPFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault>
+<faultcode>s:Client</faultcode>
+<faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail>
+</s:Fault></s:Body>
+</s:Envelope>
+`, code, desc)
+}
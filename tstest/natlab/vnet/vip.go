@@ -5,9 +5,12 @@
 
 import (
 	"fmt"
+	"maps"
 	"net/netip"
 )
 
+// vips are the default virtual IPs of the built-in fakes, which a Config
+// can override with SetVIP. See Server.vip.
 var vips = map[string]virtualIP{} // DNS name => details
 
 var (
@@ -15,12 +18,42 @@
 	fakeProxyControlplane = newVIP("controlplane.tailscale.com", 1)
 	fakeTestAgent         = newVIP("test-driver.tailscale", 2)
 	fakeControl           = newVIP("control.tailscale", 3)
-	fakeDERP1             = newVIP("derp1.tailscale", "33.4.0.1") // 3340=DERP; 1=derp 1
-	fakeDERP2             = newVIP("derp2.tailscale", "33.4.0.2") // 3340=DERP; 2=derp 2
 	fakeLogCatcher        = newVIP("log.tailscale.com", 4)
 	fakeSyslog            = newVIP("syslog.tailscale", 9)
+	fakeSTUNAlt           = newVIP("stun-alt.tailscale", 10) // STUN server's RFC 5780 alternate IP
+	fakeNTP               = newVIP("ntp.tailscale", 123)
+	fakeEcho              = newVIP("echo.tailscale", 11)
 )
 
+// fakeDERPs are the virtual IPs of the fake DERP servers, one per possible
+// DERP region: derp1.tailscale at 33.4.0.1 (3340=DERP; 1=derp 1), and so on.
+var fakeDERPs = func() []virtualIP {
+	var vs []virtualIP
+	for i := range derpRegions {
+		vs = append(vs, newVIP(fmt.Sprintf("derp%d.tailscale", i+1), fmt.Sprintf("33.4.0.%d", i+1)))
+	}
+	return vs
+}()
+
+// maxDERPNodes is the most fake DERP servers a region can have; see
+// Config.SetNumDERPNodes.
+const maxDERPNodes = 4
+
+// extraDERPs are the virtual IPs of the fake DERP servers after the first of
+// each region: extraDERPs[r-1][i-1] is that of region r's server i (0-based),
+// derp1b.tailscale at 33.4.1.1 for region 1's second server, and so on.
+var extraDERPs = func() [][]virtualIP {
+	var vs [][]virtualIP
+	for r := range derpRegions {
+		var region []virtualIP
+		for i := 1; i < maxDERPNodes; i++ {
+			region = append(region, newVIP(fmt.Sprintf("derp%d%c.tailscale", r+1, 'a'+i), fmt.Sprintf("33.4.%d.%d", i, r+1)))
+		}
+		vs = append(vs, region)
+	}
+	return vs
+}()
+
 type virtualIP struct {
 	name string // for DNS
 	v4   netip.Addr
@@ -31,18 +64,74 @@ func (v virtualIP) Match(a netip.Addr) bool {
 	return v.v4 == a.Unmap() || v.v6 == a
 }
 
-// FakeDNSIPv4 returns the fake DNS IPv4 address.
+// FakeDNSIPv4 returns the fake DNS server's default IPv4 address. A Config
+// can move it with SetVIP; see Server.FakeDNSIPv4.
 func FakeDNSIPv4() netip.Addr { return fakeDNS.v4 }
 
-// FakeDNSIPv6 returns the fake DNS IPv6 address.
+// FakeDNSIPv6 returns the fake DNS server's default IPv6 address. A Config
+// can move it with SetVIP; see Server.FakeDNSIPv6.
 func FakeDNSIPv6() netip.Addr { return fakeDNS.v6 }
 
-// FakeSyslogIPv4 returns the fake syslog IPv4 address.
+// FakeSyslogIPv4 returns the fake syslog server's default IPv4 address. A
+// Config can move it with SetVIP; see Server.FakeSyslogIPv4.
 func FakeSyslogIPv4() netip.Addr { return fakeSyslog.v4 }
 
-// FakeSyslogIPv6 returns the fake syslog IPv6 address.
+// FakeSyslogIPv6 returns the fake syslog server's default IPv6 address. A
+// Config can move it with SetVIP; see Server.FakeSyslogIPv6.
 func FakeSyslogIPv6() netip.Addr { return fakeSyslog.v6 }
 
+// FakeDNSIPv4 returns the fake DNS server's IPv4 address on s, taking
+// Config.SetVIP into account.
+func (s *Server) FakeDNSIPv4() netip.Addr { return s.vip(fakeDNS).v4 }
+
+// FakeDNSIPv6 returns the fake DNS server's IPv6 address on s, taking
+// Config.SetVIP into account.
+func (s *Server) FakeDNSIPv6() netip.Addr { return s.vip(fakeDNS).v6 }
+
+// FakeSyslogIPv4 returns the fake syslog server's IPv4 address on s, taking
+// Config.SetVIP into account.
+func (s *Server) FakeSyslogIPv4() netip.Addr { return s.vip(fakeSyslog).v4 }
+
+// FakeSyslogIPv6 returns the fake syslog server's IPv6 address on s, taking
+// Config.SetVIP into account.
+func (s *Server) FakeSyslogIPv6() netip.Addr { return s.vip(fakeSyslog).v6 }
+
+// VIP returns the IPv4 and IPv6 addresses of the built-in fake service with
+// DNS name name (as used by Config.SetVIP) on s, reporting whether there's
+// such a fake.
+func (s *Server) VIP(name string) (v4, v6 netip.Addr, ok bool) {
+	v, ok := s.vips[name]
+	return v.v4, v.v6, ok
+}
+
+// newVIPs returns the default virtual IPs with the IPs in overrides (keyed by
+// DNS name) replacing theirs.
+func newVIPs(overrides map[string][]netip.Addr) (map[string]virtualIP, error) {
+	m := maps.Clone(vips)
+	for name, ips := range overrides {
+		v, ok := m[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown VIP %q", name)
+		}
+		for _, ip := range ips {
+			if ip.Is4() {
+				v.v4 = ip
+			} else {
+				v.v6 = ip
+			}
+		}
+		m[name] = v
+	}
+	for name, v := range m {
+		for name2, v2 := range m {
+			if name < name2 && (v2.Match(v.v4) || v2.Match(v.v6)) {
+				return nil, fmt.Errorf("VIP %q collides with %q", name, name2)
+			}
+		}
+	}
+	return m, nil
+}
+
 // newVIP returns a new virtual IP.
 //
 // opts may be an IPv4 an IPv6 (in string form) or an int (bounded by uint8) to
@@ -12,7 +12,9 @@
 // - [ ] tests for NAT tables
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -23,13 +25,17 @@
 	"iter"
 	"log"
 	"maps"
+	"math"
 	"math/rand/v2"
 	"net"
 	"net/http"
-	"net/http/httptest"
 	"net/netip"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -37,7 +43,9 @@
 	"github.com/gaissmai/bart"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"go4.org/mem"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/time/rate"
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -53,11 +61,12 @@
 	"tailscale.com/client/local"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netutil"
-	"tailscale.com/net/stun"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/tstime"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/mak"
@@ -69,9 +78,10 @@
 const nicID = 1
 
 const (
-	stunPort = 3478
-	pcpPort  = 5351
-	ssdpPort = 1900
+	stunPort    = 3478
+	stunAltPort = 3479 // the STUN server's RFC 5780 alternate port
+	pcpPort     = 5351
+	ssdpPort    = 1900
 )
 
 func (s *Server) PopulateDERPMapIPs() error {
@@ -94,19 +104,99 @@ func (s *Server) PopulateDERPMapIPs() error {
 }
 
 func (n *network) InitNAT(natType NAT) error {
-	ctor, ok := natTypes[natType]
-	if !ok {
+	if _, ok := natTypes[natType]; !ok {
 		return fmt.Errorf("unknown NAT type %q", natType)
 	}
-	t, err := ctor(n)
+	t, err := n.newNATTable(natType)
 	if err != nil {
-		return fmt.Errorf("error creating NAT type %q for network %v: %w", natType, n.wanIP4, err)
+		return fmt.Errorf("error creating NAT type %q for network %v: %w", natType, n.WANIP(), err)
 	}
 	n.setNATTable(t)
 	n.natStyle.Store(natType)
 	return nil
 }
 
+// newNATTable returns a new NAT table of the known NAT type natType for the
+// network, spanning its WAN IP pool if it has one.
+func (n *network) newNATTable(natType NAT) (NATTable, error) {
+	ctor := natTypes[natType]
+	if len(n.wanPool) == 0 {
+		return ctor(n)
+	}
+	ips := append([]netip.Addr{n.WANIP()}, n.wanPool...)
+	return newPoolNAT(n, ctor, ips, n.wanPoolPolicy)
+}
+
+// setWANIP switches the network's WAN IPv4 to ip. If keepMappings, its NAT
+// and port mappings are moved over to it; otherwise they're dropped, except
+// for port forwards.
+func (n *network) setWANIP(ip netip.Addr, keepMappings bool) error {
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+	old := n.WANIP()
+	n.wanIP4.Store(ip)
+	if ws, ok := n.natTable.(wanIPSetter); ok && keepMappings {
+		ws.setWANIP(ip)
+	} else if err := n.resetNATTableLocked(); err != nil {
+		return err
+	}
+
+	moveAP := func(ap netip.AddrPort) netip.AddrPort {
+		if ap.Addr() == old {
+			return netip.AddrPortFrom(ip, ap.Port())
+		}
+		return ap
+	}
+	portMap := make(map[portMapKey]portMapping, len(n.portMap))
+	for k, v := range n.portMap {
+		if !keepMappings && v.expiry != noExpiry {
+			continue
+		}
+		k.wanAP = moveAP(k.wanAP)
+		portMap[k] = v
+	}
+	n.portMap = portMap
+	for k, v := range n.portMapFlow {
+		if keepMappings {
+			n.portMapFlow[k] = moveAP(v)
+		} else {
+			delete(n.portMapFlow, k)
+		}
+	}
+	return nil
+}
+
+// resetNATTableLocked replaces the network's NAT table, if any, with a fresh
+// one without mappings. n.natMu must be held.
+func (n *network) resetNATTableLocked() error {
+	if n.natTable == nil {
+		return nil
+	}
+	natType := n.natStyle.Load()
+	t, err := n.newNATTable(natType)
+	if err != nil {
+		return fmt.Errorf("error recreating NAT type %q: %w", natType, err)
+	}
+	n.natTable = t
+	return nil
+}
+
+// flushNAT drops all of the network's NAT mappings and port mappings, as
+// documented at Server.FlushNAT.
+func (n *network) flushNAT() error {
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+	if err := n.resetNATTableLocked(); err != nil {
+		return err
+	}
+	maps.DeleteFunc(n.portMap, func(_ portMapKey, v portMapping) bool {
+		return v.expiry != noExpiry
+	})
+	clear(n.portMapFlow)
+	n.logf("NAT flushed")
+	return nil
+}
+
 func (n *network) setNATTable(nt NATTable) {
 	n.natMu.Lock()
 	defer n.natMu.Unlock()
@@ -115,17 +205,31 @@ func (n *network) setNATTable(nt NATTable) {
 
 // SoleLANIP implements [IPPool].
 func (n *network) SoleLANIP() (netip.Addr, bool) {
-	if len(n.nodesByIP4) != 1 {
+	if n.nodesByIP4.Len() != 1 {
 		return netip.Addr{}, false
 	}
-	for ip := range n.nodesByIP4 {
+	for ip := range n.nodesByIP4.Keys() {
 		return ip, true
 	}
 	return netip.Addr{}, false
 }
 
+// portAllocation returns the PortAllocation of the network's HardNAT, or
+// empty for the default. NAT constructors find it with a type assertion on
+// their IPPool.
+func (n *network) portAllocation() PortAllocation { return n.portAlloc }
+
+// natMappingLimit returns the cap on the mappings of the network's NAT
+// table. Like portAllocation, NAT constructors find it with a type
+// assertion.
+func (n *network) natMappingLimit() mappingLimit { return n.natLimit }
+
+// natRand returns the Server's random source, which NAT tables find with
+// randOf.
+func (n *network) natRand() *lockedRand { return n.s.rng }
+
 // WANIP implements [IPPool].
-func (n *network) WANIP() netip.Addr { return n.wanIP4 }
+func (n *network) WANIP() netip.Addr { return n.wanIP4.Load() }
 
 func (n *network) initStack() error {
 	n.ns = stack.New(stack.Options{
@@ -144,7 +248,7 @@ func (n *network) initStack() error {
 	if tcpipErr != nil {
 		return fmt.Errorf("SetTransportProtocolOption SACK: %v", tcpipErr)
 	}
-	n.linkEP = channel.New(512, 1500, tcpip.LinkAddress(n.mac.HWAddr()))
+	n.linkEP = channel.New(512, uint32(n.mtu), tcpip.LinkAddress(n.mac.HWAddr()))
 	if tcpipProblem := n.ns.CreateNIC(nicID, n.linkEP); tcpipProblem != nil {
 		return fmt.Errorf("CreateNIC: %v", tcpipProblem)
 	}
@@ -173,8 +277,8 @@ func (n *network) initStack() error {
 		})
 	}
 	if n.v6 {
-		prefix := tcpip.AddrFrom16(n.wanIP6.Addr().As16()).WithPrefix()
-		prefix.PrefixLen = n.wanIP6.Bits()
+		prefix := tcpip.AddrFrom16(n.lanIP6.Addr().As16()).WithPrefix()
+		prefix.PrefixLen = n.lanIP6.Bits()
 		if tcpProb := n.ns.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
 			Protocol:          ipv6.ProtocolNumber,
 			AddressWithPrefix: prefix,
@@ -203,9 +307,9 @@ func (n *network) initStack() error {
 
 	go func() {
 		for {
-			pkt := n.linkEP.ReadContext(n.s.shutdownCtx)
+			pkt := n.linkEP.ReadContext(n.ctx)
 			if pkt == nil {
-				if n.s.shutdownCtx.Err() != nil {
+				if n.ctx.Err() != nil {
 					// Return without logging.
 					return
 				}
@@ -217,6 +321,15 @@ func (n *network) initStack() error {
 	return nil
 }
 
+// close stops n's goroutines and shuts down its network stack, for a network
+// being removed.
+func (n *network) close() {
+	n.cancel()
+	if n.ns != nil {
+		n.ns.Close()
+	}
+}
+
 func (n *network) handleIPPacketFromGvisor(ipRaw []byte) {
 	if len(ipRaw) == 0 {
 		panic("empty packet from gvisor")
@@ -240,10 +353,17 @@ func (n *network) handleIPPacketFromGvisor(ipRaw []byte) {
 		panic("unexpected gvisor packet")
 	}
 	node, ok := n.nodeByIP(flow.dst)
+	if !ok {
+		node, ok = n.subnetRouter(flow.dst)
+	}
 	if !ok {
 		n.logf("no node for netstack dest IP %v", flow.dst)
 		return
 	}
+	if !n.isRouterIP(flow.src) && n.isLargePacketLost(len(ipRaw)) {
+		n.s.obs.OnDrop(DropLargePacketLoss)
+		return
+	}
 	eth := &layers.Ethernet{
 		SrcMAC: n.mac.HWAddr(),
 		DstMAC: node.mac.HWAddr(),
@@ -265,6 +385,7 @@ func (n *network) handleIPPacketFromGvisor(ipRaw []byte) {
 		return
 	}
 	if nw, ok := n.writers.Load(node.mac); ok {
+		n.countRx(node.mac, len(resPkt))
 		nw.write(resPkt)
 	} else {
 		n.logf("gvisor write: no writeFunc for %v", node.mac)
@@ -297,9 +418,56 @@ func (n *network) acceptTCP(r *tcp.ForwarderRequest) {
 		r.Complete(true) // sends a RST
 		return
 	}
+	if n.s.isDraining() {
+		n.logf("refusing connection from %v to %v: shutting down", clientRemoteIP, destIP)
+		r.Complete(true) // sends a RST
+		return
+	}
 
 	log.Printf("vnet-AcceptTCP: %v", stringifyTEI(reqDetails))
 
+	if h, ok := n.s.tcpHandlerFor(netip.AddrPortFrom(destIP, destPort)); ok {
+		var wq waiter.Queue
+		ep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			log.Printf("CreateEndpoint error for %s: %v", stringifyTEI(reqDetails), err)
+			r.Complete(true) // sends a RST
+			return
+		}
+		r.Complete(false)
+		tc := gonet.NewTCPConn(&wq, ep)
+		defer tc.Close()
+		done, ok := n.s.trackProxy(tc)
+		if !ok {
+			return
+		}
+		defer done()
+		h(tc)
+		return
+	}
+	if dstNet, lanAP, ok := n.s.tcpPortMapDst(netip.AddrPortFrom(destIP, destPort)); ok {
+		n.forwardTCP(r, dstNet, lanAP)
+		return
+	}
+	if rn, ok := n.s.subnetRoutes.Lookup(destIP); ok {
+		n.forwardTCP(r, rn.net, netip.AddrPortFrom(destIP, destPort))
+		return
+	}
+
+	if n.isDERPBlocked(netip.AddrPortFrom(destIP, destPort)) {
+		// Normally dropped before reaching netstack; see
+		// HandleEthernetPacketForRouter.
+		n.logf("refusing connection from %v to blocked DERP server %v", clientRemoteIP, destIP)
+		r.Complete(true) // sends a RST
+		return
+	}
+
+	if ds, ok := n.s.derpServerFor(destIP); ok && ds.down.Load() && (destPort == 443 || destPort == 80) {
+		n.logf("refusing connection from %v to downed DERP server %v", clientRemoteIP, destIP)
+		r.Complete(true) // sends a RST
+		return
+	}
+
 	var wq waiter.Queue
 	ep, err := r.CreateEndpoint(&wq)
 	if err != nil {
@@ -309,15 +477,15 @@ func (n *network) acceptTCP(r *tcp.ForwarderRequest) {
 	}
 	ep.SocketOptions().SetKeepAlive(true)
 
-	if destPort == 123 {
+	if destPort == 80 && (n.isCaptivePortalDst(destIP) || (n.captivePortal && destIP == n.lanIP4.Addr())) {
 		r.Complete(false)
 		tc := gonet.NewTCPConn(&wq, ep)
-		io.WriteString(tc, "Hello from Go\nGoodbye.\n")
-		tc.Close()
+		hs := &http.Server{Handler: n.captivePortalHandler()}
+		go hs.Serve(netutil.NewOneConnListener(tc, nil))
 		return
 	}
 
-	if destPort == 8008 && fakeTestAgent.Match(destIP) {
+	if destPort == 8008 && n.s.vip(fakeTestAgent).Match(destIP) {
 		node, ok := n.nodeByIP(clientRemoteIP)
 		if !ok {
 			n.logf("unknown client IP %v trying to connect to test driver", clientRemoteIP)
@@ -331,47 +499,116 @@ func (n *network) acceptTCP(r *tcp.ForwarderRequest) {
 		return
 	}
 
-	if destPort == 80 && fakeControl.Match(destIP) {
+	if destPort == upnpPort && n.upnp && destIP == n.lanIP4.Addr() {
+		r.Complete(false)
+		tc := gonet.NewTCPConn(&wq, ep)
+		hs := &http.Server{Handler: n.upnpHandler(clientRemoteIP)}
+		go hs.Serve(netutil.NewOneConnListener(tc, nil))
+		return
+	}
+
+	if destPort == 53 && n.s.vip(fakeDNS).Match(destIP) {
+		r.Complete(false)
+		tc := gonet.NewTCPConn(&wq, ep)
+		go n.s.serveDNSTCPConn(tc)
+		return
+	}
+
+	if n.s.isSTUNServer(netip.AddrPortFrom(destIP, destPort)) {
+		r.Complete(false)
+		tc := gonet.NewTCPConn(&wq, ep)
+		go n.serveSTUNTCPConn(tc, netip.AddrPortFrom(clientRemoteIP, reqDetails.RemotePort), netip.AddrPortFrom(destIP, destPort))
+		return
+	}
+
+	if destPort == 80 && n.s.vip(fakeControl).Match(destIP) {
+		r.Complete(false)
+		tc := gonet.NewTCPConn(&wq, ep)
+		go n.s.newControlHTTPServer().Serve(netutil.NewOneConnListener(tc, nil))
+		return
+	}
+
+	if h, ok := n.s.wanTCPServices.Load(netip.AddrPortFrom(destIP, destPort)); ok {
 		r.Complete(false)
 		tc := gonet.NewTCPConn(&wq, ep)
-		hs := &http.Server{Handler: n.s.control}
+		hs := &http.Server{Handler: h}
 		go hs.Serve(netutil.NewOneConnListener(tc, nil))
 		return
 	}
 
-	if fakeDERP1.Match(destIP) || fakeDERP2.Match(destIP) {
+	// newConn completes the connection and returns it, or, once its TLS
+	// ClientHello has been peeked at for a RegisterTLSService server name,
+	// the conn replaying it.
+	var peeked net.Conn
+	newConn := func() net.Conn {
+		if peeked != nil {
+			return peeked
+		}
+		r.Complete(false)
+		return gonet.NewTCPConn(&wq, ep)
+	}
+	if destPort == 443 && n.s.hasTLSServices(destIP) {
+		c, serverName := peekSNI(newConn())
+		if h, ok := n.s.tlsServices.Load(tlsServiceKey{destIP.Unmap(), serverName}); ok {
+			hs := &http.Server{Handler: h}
+			go hs.Serve(netutil.NewOneConnListener(tls.Server(c, n.s.tlsConfig), nil))
+			return
+		}
+		peeked = c
+	}
+
+	if destPort == 443 && n.s.vip(fakeControl).Match(destIP) {
+		tlsConfig := n.s.tlsConfig.Clone()
+		if n.s.controlHTTP2 {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		go n.s.newControlHTTPServer().Serve(netutil.NewOneConnListener(tls.Server(newConn(), tlsConfig), nil))
+		return
+	}
+
+	if (destPort == 80 || destPort == 443) && n.s.vip(fakeEcho).Match(destIP) {
+		c := newConn()
 		if destPort == 443 {
-			ds := n.s.derps[0]
-			if fakeDERP2.Match(destIP) {
-				ds = n.s.derps[1]
-			}
+			c = tls.Server(c, n.s.tlsConfig)
+		}
+		hs := &http.Server{Handler: n.echoHandler(clientRemoteIP)}
+		go hs.Serve(netutil.NewOneConnListener(c, nil))
+		return
+	}
 
-			r.Complete(false)
-			tc := gonet.NewTCPConn(&wq, ep)
-			tlsConn := tls.Server(tc, ds.tlsConfig)
+	if ds, ok := n.s.derpServerFor(destIP); ok {
+		if node, ok := n.nodeByIP(clientRemoteIP); ok && (destPort == 443 || destPort == 80) {
+			n.s.paths.noteDERP(node)
+		}
+		if destPort == 443 {
+			tc := ds.track(newConn())
+			tlsConn := tls.Server(tc, n.s.tlsConfig)
 			hs := &http.Server{Handler: ds.handler}
 			go hs.Serve(netutil.NewOneConnListener(tlsConn, nil))
 			return
 		}
 		if destPort == 80 {
-			r.Complete(false)
-			tc := gonet.NewTCPConn(&wq, ep)
-			hs := &http.Server{Handler: n.s.derps[0].handler}
+			tc := ds.track(newConn())
+			hs := &http.Server{Handler: ds.handler}
 			go hs.Serve(netutil.NewOneConnListener(tc, nil))
 			return
 		}
 	}
-	if destPort == 443 && fakeLogCatcher.Match(destIP) {
-		r.Complete(false)
-		tc := gonet.NewTCPConn(&wq, ep)
-		go n.serveLogCatcherConn(clientRemoteIP, tc)
+	if destPort == 443 && n.s.vip(fakeLogCatcher).Match(destIP) {
+		go n.serveLogCatcherConn(clientRemoteIP, newConn())
+		return
+	}
+
+	if peeked != nil {
+		// No service for the requested server name.
+		peeked.Close()
 		return
 	}
 
 	var targetDial string
 	if n.s.derpIPs.Contains(destIP) {
 		targetDial = destIP.String() + ":" + strconv.Itoa(int(destPort))
-	} else if fakeProxyControlplane.Match(destIP) {
+	} else if n.s.vip(fakeProxyControlplane).Match(destIP) {
 		targetDial = "controlplane.tailscale.com:" + strconv.Itoa(int(destPort))
 	}
 	if targetDial != "" {
@@ -385,6 +622,11 @@ func (n *network) acceptTCP(r *tcp.ForwarderRequest) {
 		tc := gonet.NewTCPConn(&wq, ep)
 		defer tc.Close()
 		r.Complete(false)
+		done, ok := n.s.trackProxy(c, tc)
+		if !ok {
+			return
+		}
+		defer done()
 		errc := make(chan error, 2)
 		go func() { _, err := io.Copy(tc, c); errc <- err }()
 		go func() { _, err := io.Copy(c, tc); errc <- err }()
@@ -394,20 +636,74 @@ func (n *network) acceptTCP(r *tcp.ForwarderRequest) {
 	}
 }
 
+// forwardTCP forwards the TCP connection request r to ip:port lanAP, as
+// reached from dstNet's router: the LAN address on dstNet that r's
+// destination is port mapped to, or r's destination in a subnet routed by a
+// node on dstNet.
+//
+// Unlike other intercepted connections, the LAN side is connected before the
+// client's handshake completes, so a client connecting to a mapped port with
+// nothing listening gets a reset, as it would through a real NAT.
+func (n *network) forwardTCP(r *tcp.ForwarderRequest, dstNet *network, lanAP netip.AddrPort) {
+	ctx, cancel := context.WithTimeout(n.s.shutdownCtx, 10*time.Second)
+	defer cancel()
+	c, err := dstNet.dialLANTCP(ctx, lanAP)
+	if err != nil {
+		log.Printf("Dial forwarded %v: %v", lanAP, err)
+		r.Complete(true) // sends a RST
+		return
+	}
+	defer c.Close()
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		log.Printf("CreateEndpoint error for %s: %v", stringifyTEI(r.ID()), tcpErr)
+		r.Complete(true) // sends a RST
+		return
+	}
+	ep.SocketOptions().SetKeepAlive(true)
+	r.Complete(false)
+	tc := gonet.NewTCPConn(&wq, ep)
+	defer tc.Close()
+	done, ok := n.s.trackProxy(c, tc)
+	if !ok {
+		return
+	}
+	defer done()
+	errc := make(chan error, 2)
+	go func() { _, err := io.Copy(tc, c); errc <- err }()
+	go func() { _, err := io.Copy(c, tc); errc <- err }()
+	<-errc
+}
+
+// defaultLogUploadMax is the default of Config.SetLogUploadMaxSize.
+const defaultLogUploadMax = 16 << 20
+
 // serveLogCatchConn serves a TCP connection to "log.tailscale.com", speaking the
 // logtail/logcatcher protocol.
 //
-// We terminate TLS with an arbitrary cert; the client is configured to not
-// validate TLS certs for this hostname when running under these integration
-// tests.
+// We terminate TLS with a cert from the Server's CA (see Config.SetTLSCA); the
+// client is configured to not validate TLS certs for this hostname when
+// running under these integration tests.
 func (n *network) serveLogCatcherConn(clientRemoteIP netip.Addr, c net.Conn) {
-	tlsConfig := n.s.derps[0].tlsConfig // self-signed (stealing DERP's); test client configure to not check
-	tlsConn := tls.Server(c, tlsConfig)
+	tlsConn := tls.Server(c, n.s.tlsConfig)
 	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		all, _ := io.ReadAll(r.Body)
+		// Neither the upload nor what it decompresses to may be larger
+		// than the limit, lest a client exhaust the Server's memory.
+		all, err := io.ReadAll(http.MaxBytesReader(w, r.Body, n.s.logUploadMax))
+		if err != nil {
+			log.Printf("Logs upload from %v: %v", clientRemoteIP, err)
+			http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		if r.Header.Get("Content-Encoding") == "zstd" {
-			var err error
-			all, err = zstdframe.AppendDecode(nil, all)
+			all, err = zstdframe.AppendDecode(nil, all, zstdframe.MaxDecodedSize(uint64(n.s.logUploadMax)))
+			if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+				log.Printf("Logs upload from %v: decoded size over %d bytes", clientRemoteIP, n.s.logUploadMax)
+				http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
 				log.Printf("LOGS DECODE ERROR zstd decode: %v", err)
 				http.Error(w, "zstd decode error", http.StatusBadRequest)
@@ -424,7 +720,7 @@ func (n *network) serveLogCatcherConn(clientRemoteIP netip.Addr, c net.Conn) {
 			log.Printf("Logs decode error: %v", err)
 			return
 		}
-		node := n.nodesByIP4[clientRemoteIP]
+		node, _ := n.nodesByIP4.Load(clientRemoteIP)
 		if node != nil {
 			node.logMu.Lock()
 			defer node.logMu.Unlock()
@@ -439,6 +735,18 @@ func (n *network) serveLogCatcherConn(clientRemoteIP netip.Addr, c net.Conn) {
 	hs.Serve(netutil.NewOneConnListener(tlsConn, nil))
 }
 
+// Logs returns the logs the node has uploaded to the fake logcatcher, one
+// "[client time] text" line per log entry, and the number of uploads they
+// came in. It returns the zero values if the Server isn't running.
+func (n *Node) Logs() (text string, uploads int) {
+	if n.n == nil {
+		return "", 0
+	}
+	n.n.logMu.Lock()
+	defer n.n.logMu.Unlock()
+	return n.n.logBuf.String(), n.n.logCatcherWrites
+}
+
 type EthernetPacket struct {
 	le *layers.Ethernet
 	gp gopacket.Packet
@@ -458,6 +766,12 @@ func (m MAC) IsBroadcast() bool {
 	return m == MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 }
 
+// IsIPv4Multicast reports whether m is an IPv4 multicast MAC address,
+// such as the one for SSDP's 239.255.255.250.
+func (m MAC) IsIPv4Multicast() bool {
+	return m[0] == 0x01 && m[1] == 0x00 && m[2] == 0x5e
+}
+
 // IsIPv6Multicast reports whether m is an IPv6 multicast MAC address,
 // typically one containing a solicited-node multicast address.
 func (m MAC) IsIPv6Multicast() bool {
@@ -479,11 +793,20 @@ func (m MAC) String() string {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
 }
 
+// portMapKey is the key of a network's port mappings.
+type portMapKey struct {
+	proto layers.IPProtocol // UDP or TCP
+	wanAP netip.AddrPort
+}
+
 type portMapping struct {
 	dst    netip.AddrPort // LAN IP:port
-	expiry time.Time
+	expiry time.Time      // or noExpiry for static port forwards
 }
 
+// noExpiry is the expiry of port mappings that never expire.
+var noExpiry = time.Unix(1<<62, 0)
+
 // writerFunc is a function that writes an Ethernet frame to a connected client.
 //
 // ethFrame is the Ethernet frame to write.
@@ -495,7 +818,8 @@ type writerFunc func(dst vmClient, ethFrame []byte, interface
 type networkWriter struct {
 	writer      writerFunc // Function to write packets to the network
 	c           vmClient
-	interfaceID int // The interface ID of the src node (for writing pcaps)
+	interfaceID int    // The interface ID of the src node (for writing pcaps)
+	gen         uint64 // from registerWriter, to tell registrations apart; 0 if not from it
 }
 
 func (nw networkWriter) write(b []byte) {
@@ -504,54 +828,125 @@ func (nw networkWriter) write(b []byte) {
 
 type network struct {
 	s              *Server
-	num            int // 1-based
-	mac            MAC // of router
-	portmap        bool
+	num            int  // 1-based
+	mac            MAC  // of router
+	portmap        bool // whether NAT-PMP is enabled
+	pcp            bool // whether PCP is enabled
+	upnp           bool // whether UPnP IGD is enabled
 	lanInterfaceID int
 	wanInterfaceID int
-	v4             bool                 // network supports IPv4
-	v6             bool                 // network support IPv6
-	wanIP6         netip.Prefix         // router's WAN IPv6, if any, as a /64.
-	wanIP4         netip.Addr           // router's LAN IPv4, if any
-	lanIP4         netip.Prefix         // router's LAN IP + CIDR (e.g. 192.168.2.1/24)
-	breakWAN4      bool                 // break WAN IPv4 connectivity
-	latency        time.Duration        // latency applied to interface writes
-	lossRate       float64              // probability of dropping a packet (0.0 to 1.0)
-	nodesByIP4     map[netip.Addr]*node // by LAN IPv4
-	nodesByMAC     map[MAC]*node
+	v4             bool                         // network supports IPv4
+	v6             bool                         // network support IPv6
+	wanIP6         netip.Prefix                 // router's WAN IPv6, if any, as a /64.
+	lanIP6         netip.Prefix                 // router's LAN IPv6; differs from wanIP6 only with NPTv6
+	npt6           bool                         // translate between lanIP6 and wanIP6 prefixes (NPTv6)
+	lanIP4         netip.Prefix                 // router's LAN IP + CIDR (e.g. 192.168.2.1/24)
+	breakWAN4      bool                         // break WAN IPv4 connectivity
+	portAlloc      PortAllocation               // HardNAT's port allocation; see portAllocation
+	natLimit       mappingLimit                 // NAT tables' mapping limit; see natMappingLimit
+	wanPool        []netip.Addr                 // WAN IPv4s besides wanIP4 for the NAT to use, if any
+	wanPoolPolicy  WANIPPolicy                  // how the NAT picks from wanPool
+	captivePortal  bool                         // intercept HTTP with a captive portal
+	captiveDsts    []netip.Prefix               // captive portal destinations, or nil for all
+	firewall       []FirewallRule               // in order; first match wins
+	udpBlocked     bool                         // drop all forwarded UDP
+	udpAllowSTUN   bool                         // but not STUN, if udpBlocked
+	udpBlockedLog  bool                         // log UDP dropped because of udpBlocked
+	derpBlocked    bool                         // drop TCP to DERP servers' HTTP(S) ports
+	mtu            int                          // MTU of the network's link to the internet
+	latency        time.Duration                // latency applied to interface writes
+	lossRate       float64                      // probability of dropping a packet (0.0 to 1.0)
+	largeLossSize  int                          // IP packets bigger than this are subject to largeLossRate
+	largeLossRate  float64                      // probability of dropping a large packet (0.0 to 1.0)
+	reorderRate    float64                      // probability of holding back a packet from the internet
+	reorderHold    time.Duration                // longest a packet is held back
+	dupRate        float64                      // probability of duplicating a packet from the internet
+	natFlushEvery  time.Duration                // how often to flush the NAT, or 0 for never
+	arpTimeout     time.Duration                // how long learned ARP entries last, or 0 for forever
+	proxyARP       bool                         // answer ARP for off-LAN IPv4s with the router's MAC
+	corruptRate    float64                      // probability of corrupting a packet delivered to a node
+	corruptHdrs    bool                         // whether corruption may hit IP and transport headers
+	icmpErrLimit   *rate.Limiter                // limits ICMP errors sent by the router; nil means no limit
+	dhcpLeaseSec   uint32                       // DHCP lease time, in seconds
+	dhcpDNS        []netip.Addr                 // IPv4 DNS servers handed out by DHCP
+	dhcpRoutes     []byte                       // DHCP option 121 data, or nil for none
+	nodesByIP4     syncs.Map[netip.Addr, *node] // by LAN IPv4
+	nodesByMAC     syncs.Map[MAC, *node]
 	logf           func(format string, args ...any)
 
 	ns     *stack.Stack
 	linkEP *channel.Endpoint
 
+	ctx    context.Context    // done when the Server shuts down or the network is removed
+	cancel context.CancelFunc // cancels ctx
+
+	// wanIP4 is the router's WAN IPv4, if any, as returned by WANIP. It
+	// can change with Server.SetWANIP.
+	wanIP4 syncs.AtomicValue[netip.Addr]
+
 	natStyle    syncs.AtomicValue[NAT]
 	natMu       sync.Mutex // held while using + changing natTable
 	natTable    NATTable
-	portMap     map[netip.AddrPort]portMapping    // WAN ip:port -> LAN ip:port
-	portMapFlow map[portmapFlowKey]netip.AddrPort // (lanAP, peerWANAP) -> portmapped wanAP
+	portMap     map[portMapKey]portMapping        // (proto, WAN ip:port) -> LAN ip:port
+	portMapFlow map[portmapFlowKey]netip.AddrPort // (proto, lanAP, peerWANAP) -> portmapped wanAP
+
+	// inboundTCPPeers are the internet ip:ports of connections made with
+	// Server.DialTCPFromInternet to this network. The LAN side of their
+	// traffic is handled by the router's netstack.
+	inboundTCPPeers syncs.Map[netip.AddrPort, bool]
+
+	// impairMu guards rng and the reordering state.
+	impairMu     sync.Mutex
+	rng          *rand.Rand             // random source for simulated faults; see Network.SetImpairmentSeed
+	reorderHeld  UDPPacket              // packet held back by reorderUDP, if reorderTimer is non-nil
+	reorderTimer tstime.TimerController // delivers reorderHeld; nil if none
+
+	natDropped atomic.Int64 // inbound UDP packets dropped by the NAT
+	udpDropped atomic.Int64 // UDP packets dropped because of udpBlocked
+
+	mcastMu      sync.Mutex
+	mcastMembers map[MAC]set.Set[MAC] // IPv4 multicast group MAC -> member node MACs; see igmp.go
 
 	macMu     sync.Mutex
-	macOfIPv6 map[netip.Addr]MAC // IPv6 source IP -> MAC
+	macOfIPv4 map[netip.Addr]arpEntry // IPv4 -> MAC learned from ARP; see learnARP
+	macOfIPv6 map[netip.Addr]MAC      // IPv6 source IP -> MAC; many IPs per MAC
 
 	// writers is a map of MAC -> networkWriters to write packets to that MAC.
 	// It contains entries for connected nodes only.
 	writers syncs.Map[MAC, networkWriter] // MAC -> to networkWriter for that MAC
 }
 
-// registerWriter registers a client address with a MAC address.
-func (n *network) registerWriter(mac MAC, c vmClient) {
+// arpEntry is an entry of a network's ARP cache.
+type arpEntry struct {
+	mac     MAC
+	expires time.Time // or zero for never
+}
+
+// registerWriter registers a client address with a MAC address, replacing
+// any previous registration. It returns the registration's generation, for
+// unregisterWriter.
+func (n *network) registerWriter(mac MAC, c vmClient) (gen uint64) {
 	nw := networkWriter{
 		writer: n.s.writeEthernetFrameToVM,
 		c:      c,
+		gen:    n.s.writerGen.Add(1),
 	}
-	if node, ok := n.s.nodeByMAC[mac]; ok {
+	if node, ok := n.s.nodeByMAC.Load(mac); ok {
 		nw.interfaceID = node.interfaceID
 	}
 	n.writers.Store(mac, nw)
+	return nw.gen
 }
 
-func (n *network) unregisterWriter(mac MAC) {
-	n.writers.Delete(mac)
+// unregisterWriter removes the writer for mac registered by registerWriter
+// as generation gen, unless it has since been replaced, as when a VM
+// reconnects before its old connection is torn down.
+func (n *network) unregisterWriter(mac MAC, gen uint64) {
+	n.writers.WithLock(func(m map[MAC]networkWriter) {
+		if nw, ok := m[mac]; ok && nw.gen == gen {
+			delete(m, mac)
+		}
+	})
 }
 
 // RegisteredWritersForTest returns the number of registered connections (VM
@@ -559,17 +954,20 @@ func (n *network) unregisterWriter(mac MAC) {
 // server. It exists for testing.
 func (s *Server) RegisteredWritersForTest() int {
 	num := 0
-	for n := range s.networks {
+	for _, n := range s.allNetworks() {
 		num += n.writers.Len()
 	}
 	return num
 }
 
 func (n *network) MACOfIP(ip netip.Addr) (_ MAC, ok bool) {
-	if n.lanIP4.Addr() == ip {
+	if n.v4 && n.lanIP4.Addr() == ip {
 		return n.mac, true
 	}
-	if n, ok := n.nodesByIP4[ip]; ok {
+	if mac, ok := n.learnedIPv4MAC(ip); ok {
+		return mac, true
+	}
+	if n, ok := n.nodesByIP4.Load(ip); ok {
 		return n.mac, true
 	}
 	return MAC{}, false
@@ -581,14 +979,23 @@ type node struct {
 	interfaceID   int
 	net           *network
 	lanIP         netip.Addr // must be in net.lanIP prefix + unique in net
+	dhcp6IP       netip.Addr // IPv6 address assigned by DHCPv6, if net.v6
 	verboseSyslog bool
+	hs            *hostStack     // in-process network stack, if the node has the HostStack option
+	subnetRoutes  []netip.Prefix // prefixes the node routes; see Node.SetSubnetRoutes
+	clockSkew     time.Duration  // see Node.SetClockSkew
+
+	hostname syncs.AtomicValue[string] // from DHCP option 12, if any
 
-	// logMu guards logBuf.
-	// TODO(bradfitz): conditionally write these out to separate files at the end?
-	// Currently they only hold logcatcher logs.
+	// logMu guards logBuf, logCatcherWrites and syslogs, which Server.Close
+	// writes out to files if Config.SetLogDir was called.
+	// logBuf only holds logcatcher logs.
 	logMu            sync.Mutex
 	logBuf           bytes.Buffer
 	logCatcherWrites int
+	syslogs          []SyslogEntry // from the fake syslog server
+
+	stats nodeStats
 }
 
 // String returns the string "nodeN" where N is the 1-based node number.
@@ -596,59 +1003,219 @@ func (n *node) String() string {
 	return fmt.Sprintf("node%d", n.num)
 }
 
+// now returns the current time as the node sees it, with its clock skew.
+func (n *node) now() time.Time {
+	return n.net.s.clock.Now().Add(n.clockSkew)
+}
+
 type derpServer struct {
-	srv       *derp.Server
-	handler   http.Handler
-	tlsConfig *tls.Config
+	name    string        // its DERP node name, such as "1a"
+	region  int           // its DERP region ID
+	vip     virtualIP     // where it's served
+	latency time.Duration // see Config.SetDERPLatency
+	srv     *derp.Server
+	handler http.Handler
+
+	down atomic.Bool // whether new connections are refused; see Server.SetDERPUp
+
+	mu    sync.Mutex
+	conns set.Set[*derpConn] // open connections
+}
+
+// derpConn is a connection to a derpServer, tracked so it can be closed
+// when the server goes down.
+type derpConn struct {
+	net.Conn
+	ds *derpServer
+}
+
+// track returns c wrapped to be tracked by ds until it's closed.
+func (ds *derpServer) track(c net.Conn) net.Conn {
+	dc := &derpConn{c, ds}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	mak.Set(&ds.conns, dc, struct{}{})
+	return dc
+}
+
+func (c *derpConn) Close() error {
+	c.ds.mu.Lock()
+	delete(c.ds.conns, c)
+	c.ds.mu.Unlock()
+	return c.Conn.Close()
 }
 
-func newDERPServer() *derpServer {
-	// Just to get a self-signed TLS cert:
-	ts := httptest.NewTLSServer(nil)
-	ts.Close()
+// closeConns closes all of ds's open connections.
+func (ds *derpServer) closeConns() {
+	ds.mu.Lock()
+	conns := slices.Collect(maps.Keys(ds.conns))
+	ds.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
 
-	ds := &derpServer{
-		srv:       derp.NewServer(key.NewNode(), logger.Discard),
-		tlsConfig: ts.TLS, // self-signed; test client configure to not check
+// newDERPServer returns a fake DERP server serving srv, or a new DERP server
+// if nil. The fake DERP servers of a region share one, as if they were
+// meshed, so clients on different ones can reach each other.
+func newDERPServer(srv *derp.Server) *derpServer {
+	if srv == nil {
+		srv = derp.NewServer(key.NewNode(), logger.Discard)
 	}
+	ds := &derpServer{srv: srv}
 	var mux http.ServeMux
-	mux.Handle("/derp", derphttp.Handler(ds.srv))
+	mux.Handle("/derp", derpWebSocketHandler(ds.srv, derphttp.Handler(ds.srv)))
 	mux.HandleFunc("/generate_204", derphttp.ServeNoContent)
 
 	ds.handler = &mux
 	return ds
 }
 
+// newControlHTTPServer returns an HTTP server for a connection to the fake
+// control server, speaking HTTP/2 as well as HTTP/1.1 if so configured; see
+// Config.SetControlHTTP2.
+func (s *Server) newControlHTTPServer() *http.Server {
+	hs := &http.Server{Handler: s.control}
+	if s.controlHTTP2 {
+		hs.Protocols = new(http.Protocols)
+		hs.Protocols.SetHTTP1(true)
+		hs.Protocols.SetHTTP2(true)
+		hs.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return hs
+}
+
+// delayHandler returns a handler that waits d, as measured by s's clock,
+// before passing each request to h. Requests still waiting when s shuts down
+// or the client goes away are dropped.
+func (s *Server) delayHandler(d time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, timerC := s.clock.NewTimer(d)
+		defer tc.Stop()
+		select {
+		case <-timerC:
+		case <-s.shutdownCtx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 type Server struct {
 	shutdownCtx    context.Context
 	shutdownCancel context.CancelFunc
 	shuttingDown   atomic.Bool
 	wg             sync.WaitGroup
-	blendReality   bool
+
+	// proxyMu guards draining and proxyConns, the connections of the TCP
+	// proxies in flight, which proxyWG counts; see Shutdown.
+	proxyMu      sync.Mutex
+	draining     bool
+	proxyConns   set.Set[io.Closer]
+	proxyWG      sync.WaitGroup
+	blendReality bool
+	clock        tstime.Clock // for NAT and port mapping times; never nil
+	obs          Observer     // never nil
 
 	optLogf func(format string, args ...any) // or nil to use log.Printf
+	logDir  string                           // or empty; see Config.SetLogDir
+
+	logUploadMax int64 // max decompressed logcatcher upload size; see Config.SetLogUploadMaxSize
+
+	ca        *certAuthority // issues the fake HTTPS servers' certs; see Config.SetTLSCA
+	tlsConfig *tls.Config    // of the fake HTTPS servers, with certs from ca
+
+	derpIPs             set.Set[netip.Addr]
+	derpDownClosesConns bool                 // see Config.SetDERPDownClosesConns
+	vips                map[string]virtualIP // DNS name => details; see vip
 
-	derpIPs set.Set[netip.Addr]
+	dnsRecords map[string][]netip.Addr // from Config.AddDNSRecord; keyed by dnsNameKey
+	dnsCNAMEs  map[string]string       // from Config.AddDNSCNAME; keyed by dnsNameKey
+	dnsLatency time.Duration           // delay before DNS replies
+	dnsLoss    float64                 // probability of ignoring a UDP DNS query (0.0 to 1.0)
 
+	// dnsTimersMu guards dnsTimers, the timers of UDP DNS replies delayed by
+	// dnsLatency, which Close stops.
+	dnsTimersMu sync.Mutex
+	dnsTimers   set.Set[*dnsTimer]
+
+	controlHTTP2 bool // see Config.SetControlHTTP2
+
+	rng *lockedRand // see Config.SetRandSeed
+
+	nodesMu      sync.Mutex // guards nodes and lastNodeNum; serializes adding and removing nodes
 	nodes        []*node
-	nodeByMAC    map[MAC]*node
+	lastNodeNum  int // highest node number in use so far
+	nodeByMAC    syncs.Map[MAC, *node]
+	networksMu   sync.Mutex // guards networks
 	networks     set.Set[*network]
-	networkByWAN *bart.Table[*network]
+	lastNetNum   int                                  // highest network number in use so far; guarded by wanMu
+	networkByWAN atomic.Pointer[bart.Table[*network]] // replaced, not modified, once running; see SetWANIP
+	wanMu        sync.Mutex                           // serializes SetWANIP, WAN service registration, and adding and removing networks
 
 	control    *testcontrol.Server
-	derps      []*derpServer
+	derps      []*derpServer // each region's first fake DERP server, in region order
+	derpNodes  []*derpServer // all the fake DERP servers, in DERP map order
 	pcapWriter *pcapWriter
 
+	// captureIfaces are the names of the capture interfaces, indexed by
+	// their pcapng interface ID minus one, as ID 0 is the pcapng writer's
+	// default interface. They're assigned whether or not a pcap file is
+	// being written. Nodes added with AddNode add to them, under captureMu.
+	captureMu     sync.Mutex
+	captureIfaces []pcapgo.NgInterface
+	pcapFilter    *CaptureFilter // or nil to write all packets to the pcap file
+
+	sinkMu sync.Mutex
+	sinks  set.HandleSet[func(gopacket.CaptureInfo, []byte)]
+	sinkFs []func(gopacket.CaptureInfo, []byte) // values of sinks; replaced, never modified
+
+	dhcpLeaseHook syncs.AtomicValue[func(MAC, netip.Addr)]
+
+	subnetRoutes bart.Table[*node] // routed prefix => node routing it; see Node.SetSubnetRoutes
+
+	tcpHandlers    []tcpHandler                                 // from Config.AddTCPHandler; never modified
+	wanTCPServices syncs.Map[netip.AddrPort, http.Handler]      // from RegisterWANService
+	wanUDPServices syncs.Map[netip.AddrPort, WANUDPHandler]     // from RegisterWANUDPService
+	udpServices    syncs.Map[netip.AddrPort, UDPServiceHandler] // from RegisterUDPService
+	tlsServices    syncs.Map[tlsServiceKey, http.Handler]       // from RegisterTLSService
+	udpListeners   syncs.Map[netip.AddrPort, *udpListener]      // from ListenUDP
+
+	paths pathTracker
+
+	writerGen atomic.Uint64 // last generation returned by network.registerWriter
+
 	// writeMu serializes all writes to VM clients.
 	writeMu sync.Mutex
 	scratch []byte
 
+	agentPollInterval time.Duration // see Config.SetAgentConnPollInterval
+	agentConnTimeout  time.Duration // see Config.SetAgentConnTimeout
+
 	mu              sync.Mutex
-	agentConnWaiter map[*node]chan<- struct{} // signaled after added to set
-	agentConns      set.Set[*agentConn]       //  not keyed by node; should be small/cheap enough to scan all
+	agentConnWaiter map[*node]chan struct{} // closed and removed after a node's conn is added to the set
+	agentConns      set.Set[*agentConn]     //  not keyed by node; should be small/cheap enough to scan all
 	agentDialer     map[*node]DialFunc
 }
 
+// vip returns the server's virtual IP for the built-in fake whose default is
+// def, which differs from def if the Config overrode it.
+func (s *Server) vip(def virtualIP) virtualIP {
+	return s.vips[def.name]
+}
+
+// derpServerFor returns the fake DERP server with the virtual IP ip, if any.
+func (s *Server) derpServerFor(ip netip.Addr) (_ *derpServer, ok bool) {
+	for _, ds := range s.derpNodes {
+		if ds.vip.Match(ip) {
+			return ds, true
+		}
+	}
+	return nil, false
+}
+
 func (s *Server) logf(format string, args ...any) {
 	if s.optLogf != nil {
 		s.optLogf(format, args...)
@@ -661,93 +1228,750 @@ func (s *Server) SetLoggerForTest(logf func(format string, args ...any)) {
 	s.optLogf = logf
 }
 
-type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+// SetDHCPLeaseHook sets a func to be called whenever the DHCP server
+// acknowledges a node's lease request, with the node's MAC address and the
+// IPv4 address it was assigned (or, for DHCPv6, its IPv6 address). It can be
+// used to wait for a node's networking to be up.
+//
+// The hook is called from the packet handling path and must not block.
+func (s *Server) SetDHCPLeaseHook(fn func(mac MAC, ip netip.Addr)) {
+	s.dhcpLeaseHook.Store(fn)
+}
 
-var derpMap = &tailcfg.DERPMap{
-	Regions: map[int]*tailcfg.DERPRegion{
-		1: {
-			RegionID:   1,
-			RegionCode: "atlantis",
-			RegionName: "Atlantis",
-			Nodes: []*tailcfg.DERPNode{
-				{
-					Name:             "1a",
-					RegionID:         1,
-					HostName:         "derp1.tailscale",
-					IPv4:             fakeDERP1.v4.String(),
-					IPv6:             fakeDERP1.v6.String(),
-					InsecureForTests: true,
-					CanPort80:        true,
-				},
-			},
-		},
-		2: {
-			RegionID:   2,
-			RegionCode: "northpole",
-			RegionName: "North Pole",
-			Nodes: []*tailcfg.DERPNode{
-				{
-					Name:             "2a",
-					RegionID:         2,
-					HostName:         "derp2.tailscale",
-					IPv4:             fakeDERP2.v4.String(),
-					IPv6:             fakeDERP2.v6.String(),
-					InsecureForTests: true,
-					CanPort80:        true,
-				},
-			},
-		},
-	},
+// SetDERPUp sets whether the fake DERP server of the given region (1 for the
+// first) is up. While it's down, new TCP connections to it are refused with a
+// RST. Taking it down also closes its existing connections if the Config
+// enabled SetDERPDownClosesConns; otherwise they're left as is.
+//
+// A region with several fake DERP servers goes up or down as a whole; use
+// SetDERPNodeUp for one of them.
+func (s *Server) SetDERPUp(region int, up bool) error {
+	if region < 1 || region > len(s.derps) {
+		return fmt.Errorf("no DERP region %d", region)
+	}
+	for _, ds := range s.derpNodes {
+		if ds.region == region {
+			s.setDERPServerUp(ds, up)
+		}
+	}
+	return nil
 }
 
-func New(c *Config) (*Server, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	s := &Server{
-		shutdownCtx:    ctx,
-		shutdownCancel: cancel,
+// SetDERPNodeUp is like SetDERPUp, but for the one fake DERP server with the
+// DERP node name name, such as "1b" for the second one of region 1; see
+// Config.SetNumDERPNodes.
+func (s *Server) SetDERPNodeUp(name string, up bool) error {
+	for _, ds := range s.derpNodes {
+		if ds.name == name {
+			s.setDERPServerUp(ds, up)
+			return nil
+		}
+	}
+	return fmt.Errorf("no DERP node %q", name)
+}
 
-		control: &testcontrol.Server{
-			DERPMap:         derpMap,
-			ExplicitBaseURL: "http://control.tailscale",
-		},
+func (s *Server) setDERPServerUp(ds *derpServer, up bool) {
+	ds.down.Store(!up)
+	if !up && s.derpDownClosesConns {
+		ds.closeConns()
+	}
+}
 
-		blendReality: c.blendReality,
-		derpIPs:      set.Of[netip.Addr](),
+// Control returns the fake control server, for tests to change what it
+// tells nodes mid-test, such as their peers' subnet routes. Use SetDERPMap
+// rather than its DERPMap field to change the DERP map.
+func (s *Server) Control() *testcontrol.Server {
+	return s.control
+}
 
-		nodeByMAC:    map[MAC]*node{},
-		networkByWAN: &bart.Table[*network]{},
-		networks:     set.Of[*network](),
-	}
-	for range 2 {
-		s.derps = append(s.derps, newDERPServer())
+// SetDERPMap changes the DERP map the fake control server sends nodes to dm,
+// pushing it to the nodes connected to it.
+func (s *Server) SetDERPMap(dm *tailcfg.DERPMap) {
+	s.control.SetDERPMap(dm.Clone())
+}
+
+// SetWANIP changes the WAN IPv4 of the network nw to ip, as if its ISP had
+// given it a new address. Inbound traffic to the old address stops routing.
+//
+// The network's NAT mappings and port mappings are kept, moved over to the
+// new address. If the network does port mapping, the router announces the
+// change on the LAN as NAT-PMP routers do, multicasting the new address to
+// 224.0.0.1:5350.
+func (s *Server) SetWANIP(nw *Network, ip netip.Addr) error {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	n, err := s.wanNetwork(nw)
+	if err != nil {
+		return err
 	}
-	if err := s.initFromConfig(c); err != nil {
-		return nil, err
+	if ip == n.WANIP() {
+		return nil
 	}
-	for n := range s.networks {
-		if err := n.initStack(); err != nil {
-			return nil, fmt.Errorf("newServer: initStack: %v", err)
-		}
+	if err := s.checkNewWANIP(ip); err != nil {
+		return fmt.Errorf("network %d: %w", nw.num, err)
 	}
-
-	return s, nil
+	return s.changeWANIP(n, ip, true)
 }
 
-func (s *Server) Close() {
-	if shutdown := s.shuttingDown.Swap(true); !shutdown {
-		s.shutdownCancel()
-		s.pcapWriter.Close()
+// RotateWANIP moves the network nw to a new WAN IPv4, the next free address
+// after its current one, and returns it. It's like SetWANIP, but as with a
+// real change of address (say, a new DHCP lease on the WAN side), the
+// network's NAT mappings and port mappings are lost, so flows through the
+// NAT start over with new mappings. Port forwards are kept, moved over to the
+// new address.
+func (s *Server) RotateWANIP(nw *Network) (netip.Addr, error) {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	n, err := s.wanNetwork(nw)
+	if err != nil {
+		return netip.Addr{}, err
 	}
-	s.wg.Wait()
+	old := n.WANIP()
+	for ip := old.Next(); ip.Is4(); ip = ip.Next() {
+		if s.checkNewWANIP(ip) == nil {
+			return ip, s.changeWANIP(n, ip, false)
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("network %d: no free WAN IP after %v", nw.num, old)
 }
 
-// MACs returns the MAC addresses of the configured nodes.
-func (s *Server) MACs() iter.Seq[MAC] {
-	return maps.Keys(s.nodeByMAC)
+// wanNetwork returns the runtime network of nw, which must be one of s's with
+// a WAN IPv4. s.wanMu must be held.
+func (s *Server) wanNetwork(nw *Network) (*network, error) {
+	n := nw.n
+	if n == nil || n.s != s {
+		return nil, fmt.Errorf("network %d isn't part of this Server", nw.num)
+	}
+	if !n.WANIP().IsValid() {
+		return nil, fmt.Errorf("network %d has no WAN IPv4", nw.num)
+	}
+	return n, nil
+}
+
+// checkNewWANIP reports whether ip is free to become a network's WAN IPv4.
+// s.wanMu must be held.
+func (s *Server) checkNewWANIP(ip netip.Addr) error {
+	if !ip.Is4() || !ip.IsGlobalUnicast() {
+		return fmt.Errorf("invalid WAN IP %v", ip)
+	}
+	if _, ok := s.networkByWAN.Load().Lookup(ip); ok {
+		return fmt.Errorf("WAN IP %v is already in use", ip)
+	}
+	for _, v := range s.vips {
+		if v.Match(ip) {
+			return fmt.Errorf("WAN IP %v is %s's", ip, v.name)
+		}
+	}
+	if s.derpIPs.Contains(ip) {
+		return fmt.Errorf("WAN IP %v is a DERP server's", ip)
+	}
+	if s.isWANServiceIP(ip) {
+		return fmt.Errorf("WAN IP %v has WAN services", ip)
+	}
+	return nil
+}
+
+// changeWANIP switches n to the WAN IPv4 ip, keeping its mappings or not.
+// s.wanMu must be held.
+func (s *Server) changeWANIP(n *network, ip netip.Addr, keepMappings bool) error {
+	old := n.WANIP()
+	byWAN := s.networkByWAN.Load()
+	s.networkByWAN.Store(byWAN.DeletePersist(netip.PrefixFrom(old, 32)).InsertPersist(netip.PrefixFrom(ip, 32), n))
+	if err := n.setWANIP(ip, keepMappings); err != nil {
+		return err
+	}
+	n.logf("WAN IP changed from %v to %v", old, ip)
+	n.announceNATPMPExternalAddress()
+	return nil
+}
+
+// FlushNAT drops all of the NAT mappings and port mappings of the network
+// nw at once, as if its router had rebooted, so inbound traffic through them
+// stops reaching its nodes until they make new ones. Static port forwards are
+// kept. See also Network.SetNATFlushInterval.
+func (s *Server) FlushNAT(nw *Network) error {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	n, err := s.wanNetwork(nw)
+	if err != nil {
+		return err
+	}
+	return n.flushNAT()
+}
+
+// flushNATEvery flushes n's NAT on every tick of tc, until s shuts down or
+// n is removed.
+func (s *Server) flushNATEvery(n *network, tc tstime.TickerController, tickC <-chan time.Time) {
+	defer s.wg.Done()
+	defer tc.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-tickC:
+		}
+		s.wanMu.Lock()
+		err := n.flushNAT()
+		s.wanMu.Unlock()
+		if err != nil {
+			n.logf("flushing NAT: %v", err)
+		}
+	}
+}
+
+// NodeHostname returns the hostname that the node with MAC mac sent in its
+// most recent DHCP request (option 12), reporting whether there's such a node
+// and it has sent one.
+func (s *Server) NodeHostname(mac MAC) (hostname string, ok bool) {
+	n, ok := s.nodeByMAC.Load(mac)
+	if !ok {
+		return "", false
+	}
+	hostname = n.hostname.Load()
+	return hostname, hostname != ""
+}
+
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// derpRegions are the names of the fake DERP servers' regions. Its length is
+// the most DERP servers a Config can have.
+var derpRegions = []struct{ code, name string }{
+	{"atlantis", "Atlantis"},
+	{"northpole", "North Pole"},
+	{"avalon", "Avalon"},
+	{"eldorado", "El Dorado"},
+	{"shangrila", "Shangri-La"},
+	{"lemuria", "Lemuria"},
+	{"hyperborea", "Hyperborea"},
+	{"camelot", "Camelot"},
+}
+
+// newDERPMap returns the DERP map of the fake DERP servers with the given
+// virtual IPs, one list per region, in region order.
+func newDERPMap(regions ...[]virtualIP) *tailcfg.DERPMap {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}}
+	for i, vs := range regions {
+		id := i + 1
+		r := &tailcfg.DERPRegion{
+			RegionID:   id,
+			RegionCode: derpRegions[i].code,
+			RegionName: derpRegions[i].name,
+		}
+		for j, v := range vs {
+			r.Nodes = append(r.Nodes, &tailcfg.DERPNode{
+				Name:             derpNodeName(id, j),
+				RegionID:         id,
+				HostName:         v.name,
+				IPv4:             v.v4.String(),
+				IPv6:             v.v6.String(),
+				InsecureForTests: true,
+				CanPort80:        true,
+			})
+		}
+		dm.Regions[id] = r
+	}
+	return dm
+}
+
+// derpNodeName returns the DERP node name of the fake DERP server of region
+// with the 0-based index i: "1a" for region 1's first, and so on.
+func derpNodeName(region, i int) string {
+	return fmt.Sprintf("%d%c", region, 'a'+i)
+}
+
+func New(c *Config) (*Server, error) {
+	if err := ValidateConfig(c); err != nil {
+		return nil, err
+	}
+	vips, err := newVIPs(c.vips)
+	if err != nil {
+		return nil, err
+	}
+	numDERPs := cmp.Or(c.numDERPs, 2)
+	if numDERPs < 1 || numDERPs > len(derpRegions) {
+		return nil, fmt.Errorf("unsupported number of DERP servers %d; must be 1 to %d", numDERPs, len(derpRegions))
+	}
+	for region, n := range c.derpNodes {
+		if region < 1 || region > numDERPs {
+			return nil, fmt.Errorf("DERP node count set for region %d; want 1 to %d", region, numDERPs)
+		}
+		if n < 1 || n > maxDERPNodes {
+			return nil, fmt.Errorf("unsupported number of DERP servers %d in region %d; must be 1 to %d", n, region, maxDERPNodes)
+		}
+	}
+	var derpVIPs [][]virtualIP // by region
+	for i, v := range fakeDERPs[:numDERPs] {
+		region := []virtualIP{vips[v.name]}
+		for _, v := range extraDERPs[i][:cmp.Or(c.derpNodes[i+1], 1)-1] {
+			region = append(region, vips[v.name])
+		}
+		derpVIPs = append(derpVIPs, region)
+	}
+	for name := range c.dnsRecords {
+		if _, ok := vips[name]; ok {
+			return nil, fmt.Errorf("DNS record %q conflicts with a built-in name", name)
+		}
+	}
+	for name := range c.dnsCNAMEs {
+		if _, ok := vips[name]; ok {
+			return nil, fmt.Errorf("DNS CNAME %q conflicts with a built-in name", name)
+		}
+		if _, ok := c.dnsRecords[name]; ok {
+			return nil, fmt.Errorf("DNS CNAME %q conflicts with its other records", name)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		shutdownCtx:    ctx,
+		shutdownCancel: cancel,
+		vips:           vips,
+		dnsRecords:     maps.Clone(c.dnsRecords),
+		dnsCNAMEs:      maps.Clone(c.dnsCNAMEs),
+		dnsLatency:     c.dnsLatency,
+		dnsLoss:        c.dnsLossRate,
+		controlHTTP2:   c.controlHTTP2,
+		rng:            &lockedRand{r: newRand(c.randSeed, c.randSeeded)},
+		tcpHandlers:    slices.Clone(c.tcpHandlers),
+
+		agentPollInterval: cmp.Or(c.agentPollInterval, time.Second),
+		agentConnTimeout:  c.agentConnTimeout,
+
+		control: &testcontrol.Server{
+			DERPMap:         newDERPMap(derpVIPs...),
+			ExplicitBaseURL: "http://control.tailscale",
+		},
+
+		blendReality: c.blendReality,
+		clock:        c.clock,
+		obs:          c.observer,
+		derpIPs:      set.Of[netip.Addr](),
+
+		derpDownClosesConns: c.derpDownClosesConns,
+		logUploadMax:        c.logUploadMax,
+
+		networks: set.Of[*network](),
+	}
+	if s.clock == nil {
+		s.clock = tstime.StdClock{}
+	}
+	if s.obs == nil {
+		s.obs = NopObserver{}
+	}
+	if s.logUploadMax <= 0 {
+		s.logUploadMax = defaultLogUploadMax
+	}
+	ca, err := newCertAuthority(c.tlsCA)
+	if err != nil {
+		return nil, err
+	}
+	s.ca = ca
+	s.tlsConfig = ca.tlsConfig()
+	if c.derpMapHook != nil {
+		c.derpMapHook(s.control.DERPMap)
+	}
+	for region := range c.derpLatency {
+		if region < 1 || region > numDERPs {
+			return nil, fmt.Errorf("DERP latency set for region %d; want 1 to %d", region, numDERPs)
+		}
+	}
+	for i, vs := range derpVIPs {
+		var srv *derp.Server // shared by the region's servers
+		for j, v := range vs {
+			ds := newDERPServer(srv)
+			srv = ds.srv
+			ds.name, ds.region, ds.vip = derpNodeName(i+1, j), i+1, v
+			if d := c.derpLatency[i+1]; d > 0 {
+				ds.latency = d
+				ds.handler = s.delayHandler(d, ds.handler)
+			}
+			if j == 0 {
+				s.derps = append(s.derps, ds)
+			}
+			s.derpNodes = append(s.derpNodes, ds)
+		}
+	}
+	if err := s.initFromConfig(c); err != nil {
+		return nil, err
+	}
+	for _, n := range s.allNetworks() {
+		if err := n.initStack(); err != nil {
+			return nil, fmt.Errorf("newServer: initStack: %v", err)
+		}
+	}
+	for _, n := range s.allNodes() {
+		if n.hs != nil {
+			if err := n.hs.init(); err != nil {
+				return nil, fmt.Errorf("newServer: %v host stack: %v", n, err)
+			}
+		}
+	}
+	for _, n := range s.allNetworks() {
+		if n.natFlushEvery > 0 {
+			// Start ticking now rather than from the goroutine, so the
+			// first flush is due one interval after New.
+			tc, tickC := s.clock.NewTicker(n.natFlushEvery)
+			s.wg.Add(1)
+			go s.flushNATEvery(n, tc, tickC)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Server) Close() {
+	shutdown := s.shuttingDown.Swap(true)
+	if !shutdown {
+		s.shutdownCancel()
+		s.stopDNSTimers()
+		s.closeProxies()
+		for l := range s.udpListeners.Values() {
+			l.Close()
+		}
+		s.pcapWriter.Close()
+	}
+	s.wg.Wait()
+	if !shutdown && s.logDir != "" {
+		if err := s.writeNodeLogs(s.logDir); err != nil {
+			s.logf("writing node logs: %v", err)
+		}
+	}
+}
+
+// Shutdown closes s gracefully. It stops s's routers from accepting new TCP
+// connections, waits for the TCP connections they're proxying, such as those
+// through port forwards and subnet routers, to finish, and then closes s as
+// Close does. If ctx is done first, the remaining connections are cut and
+// Shutdown returns ctx's error once s is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.proxyMu.Lock()
+	s.draining = true
+	s.proxyMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.proxyWG.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.logf("shutdown: cutting TCP connections short: %v", err)
+		s.closeProxies()
+		<-drained
+	}
+	s.Close()
+	return err
+}
+
+// isDraining reports whether Shutdown has been called, so new TCP
+// connections should be refused.
+func (s *Server) isDraining() bool {
+	s.proxyMu.Lock()
+	defer s.proxyMu.Unlock()
+	return s.draining
+}
+
+// trackProxy records that a TCP proxy between the connections conns is in
+// flight, for Shutdown to wait for, and returns a func to call once it's
+// done. It reports false, tracking nothing, if s is draining, in which case
+// the proxy shouldn't start.
+func (s *Server) trackProxy(conns ...io.Closer) (done func(), ok bool) {
+	s.proxyMu.Lock()
+	defer s.proxyMu.Unlock()
+	if s.draining || s.shuttingDown.Load() {
+		return nil, false
+	}
+	for _, c := range conns {
+		mak.Set(&s.proxyConns, c, struct{}{})
+	}
+	s.proxyWG.Add(1)
+	return func() {
+		s.proxyMu.Lock()
+		for _, c := range conns {
+			delete(s.proxyConns, c)
+		}
+		s.proxyMu.Unlock()
+		s.proxyWG.Done()
+	}, true
+}
+
+// closeProxies closes the connections of the TCP proxies in flight, ending
+// them.
+func (s *Server) closeProxies() {
+	s.proxyMu.Lock()
+	conns := slices.Collect(maps.Keys(s.proxyConns))
+	s.proxyMu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// writeNodeLogs writes each node's logs to dir, as documented at
+// Config.SetLogDir.
+func (s *Server) writeNodeLogs(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var errs []error
+	for _, n := range s.allNodes() {
+		n.logMu.Lock()
+		logs := bytes.Clone(n.logBuf.Bytes())
+		var syslogs []byte
+		for _, e := range n.syslogs {
+			syslogs = fmt.Appendf(syslogs, "%v\n", e)
+		}
+		n.logMu.Unlock()
+
+		base := filepath.Join(dir, fmt.Sprintf("node%d-%x", n.num, n.mac[:]))
+		errs = append(errs, os.WriteFile(base+".log", logs, 0644))
+		if len(syslogs) > 0 {
+			errs = append(errs, os.WriteFile(base+".syslog", syslogs, 0644))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AddNode adds a node to the network nw while s is running, as if a new VM
+// had been plugged into it, and returns it. The opts are as for
+// Config.AddNode, other than *Network. The node gets the next node number,
+// with the MAC, LAN IPs and capture interface that number implies unless
+// opts say otherwise, and gets DHCP leases like the nodes s started with.
+// Subnet routers can't be added once s is running.
+func (s *Server) AddNode(nw *Network, opts ...any) (*Node, error) {
+	n := nw.n
+	if n == nil || n.s != s {
+		return nil, fmt.Errorf("network %d isn't part of this Server", nw.num)
+	}
+	if s.shuttingDown.Load() {
+		return nil, errors.New("server is shutting down")
+	}
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+	if n.ctx.Err() != nil {
+		return nil, fmt.Errorf("network %d was removed", nw.num)
+	}
+
+	conf := newNode(s.lastNodeNum+1, opts...)
+	if len(conf.nets) > 0 {
+		return nil, errors.New("AddNode opts can't include networks")
+	}
+	if conf.err != nil {
+		return nil, conf.err
+	}
+	conf.nets = []*Network{nw}
+	if err := s.addNodeLocked(conf, n); err != nil {
+		return nil, err
+	}
+	node := conf.n
+	if node.hs != nil {
+		if err := node.hs.init(); err != nil {
+			s.removeNodeLocked(node)
+			return nil, fmt.Errorf("%v host stack: %w", node, err)
+		}
+	}
+	s.lastNodeNum = conf.num
+	nw.nodes = append(nw.nodes, conf)
+	n.logf("added %v (MAC %v)", node, node.mac)
+	return conf, nil
+}
+
+// RemoveNode removes the node nd from s while s is running, as if its VM had
+// been unplugged. Frames from its MAC are dropped from then on, and s forgets
+// its ARP entries, multicast memberships and host stack, if any. Subnet
+// routers can't be removed.
+func (s *Server) RemoveNode(nd *Node) error {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+	n := nd.n
+	if n == nil || !slices.Contains(s.nodes, n) {
+		return fmt.Errorf("%v isn't part of this Server", nd)
+	}
+	if len(n.subnetRoutes) > 0 {
+		return fmt.Errorf("%v is a subnet router", n)
+	}
+	s.removeNodeLocked(n)
+	if nw := nd.Network(); nw != nil {
+		nw.nodes = slices.DeleteFunc(nw.nodes, func(o *Node) bool { return o == nd })
+	}
+	n.net.logf("removed %v (MAC %v)", n, n.mac)
+	return nil
+}
+
+// removeNodeLocked undoes addNodeLocked for the node n, which has no subnet
+// routes. s.nodesMu must be held.
+func (s *Server) removeNodeLocked(n *node) {
+	net := n.net
+	s.nodes = slices.DeleteFunc(s.nodes, func(o *node) bool { return o == n })
+	s.nodeByMAC.Delete(n.mac)
+	net.nodesByMAC.Delete(n.mac)
+	net.nodesByIP4.WithLock(func(m map[netip.Addr]*node) {
+		if m[n.lanIP] == n {
+			delete(m, n.lanIP)
+		}
+	})
+	net.writers.Delete(n.mac)
+	if n.hs != nil {
+		n.hs.close()
+	}
+
+	net.macMu.Lock()
+	maps.DeleteFunc(net.macOfIPv4, func(_ netip.Addr, e arpEntry) bool { return e.mac == n.mac })
+	maps.DeleteFunc(net.macOfIPv6, func(_ netip.Addr, mac MAC) bool { return mac == n.mac })
+	net.macMu.Unlock()
+
+	net.mcastMu.Lock()
+	for group, members := range net.mcastMembers {
+		members.Delete(n.mac)
+		if len(members) == 0 {
+			delete(net.mcastMembers, group)
+		}
+	}
+	net.mcastMu.Unlock()
+}
+
+// AddNetwork adds a network to s while it's running, as if a new site had
+// come online, and returns it. The opts are as for Config.AddNetwork. The
+// network gets the next network number, and the router MAC and capture
+// interfaces that number implies. Its WAN addresses and LAN prefix must not
+// clash with those of s's other networks, and it can't use One2OneNAT. Add
+// nodes to it with AddNode.
+func (s *Server) AddNetwork(opts ...any) (*Network, error) {
+	if s.shuttingDown.Load() {
+		return nil, errors.New("server is shutting down")
+	}
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+
+	conf := newNetwork(s.lastNetNum+1, opts...)
+	if err := ValidateConfig(&Config{networks: []*Network{conf}}); err != nil {
+		return nil, err
+	}
+	if conf.natType == One2OneNAT {
+		// Its NAT table is made for the network's sole node, which isn't
+		// there yet.
+		return nil, fmt.Errorf("network %d: %v NAT networks can't be added at runtime", conf.num, One2OneNAT)
+	}
+	lan4 := conf.lanPrefix4()
+	for _, other := range s.allNetworks() {
+		if lan4.IsValid() && other.v4 && lan4.Overlaps(other.lanIP4) {
+			return nil, fmt.Errorf("network %d: LAN prefix %v overlaps network %d's %v", conf.num, lan4.Masked(), other.num, other.lanIP4.Masked())
+		}
+		if other.v4 && conf.wanIP4.IsValid() && other.lanIP4.Contains(conf.wanIP4) {
+			return nil, fmt.Errorf("network %d: WAN IP %v is inside network %d's LAN prefix %v", conf.num, conf.wanIP4, other.num, other.lanIP4.Masked())
+		}
+		if lan4.IsValid() && lan4.Contains(other.WANIP()) {
+			return nil, fmt.Errorf("network %d: LAN prefix %v contains network %d's WAN IP %v", conf.num, lan4.Masked(), other.num, other.WANIP())
+		}
+	}
+	for _, ip := range append([]netip.Addr{conf.wanIP4}, conf.wanPool...) {
+		if !ip.IsValid() {
+			continue
+		}
+		if err := s.checkNewWANIP(ip); err != nil {
+			return nil, fmt.Errorf("network %d: %w", conf.num, err)
+		}
+	}
+
+	byWAN := s.networkByWAN.Load().Clone()
+	n, err := s.initNetwork(conf, byWAN)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.initStack(); err != nil {
+		n.close()
+		return nil, fmt.Errorf("network %d: initStack: %v", conf.num, err)
+	}
+	if err := n.InitNAT(cmp.Or(conf.natType, EasyNAT)); err != nil {
+		n.close()
+		return nil, err
+	}
+	s.networkByWAN.Store(byWAN)
+	s.networksMu.Lock()
+	s.networks.Add(n)
+	s.networksMu.Unlock()
+	s.lastNetNum = conf.num
+	n.logf("added network %d", conf.num)
+	return conf, nil
+}
+
+// RemoveNetwork removes the network nw from s while s is running, as if its
+// site had gone offline. Its nodes are removed along with it, as with
+// RemoveNode, and inbound traffic to its WAN addresses goes nowhere from then
+// on. Networks with subnet routers can't be removed.
+func (s *Server) RemoveNetwork(nw *Network) error {
+	n := nw.n
+	if n == nil || n.s != s {
+		return fmt.Errorf("network %d isn't part of this Server", nw.num)
+	}
+
+	if s.shuttingDown.Load() {
+		return errors.New("server is shutting down")
+	}
+
+	s.nodesMu.Lock()
+	if n.ctx.Err() != nil {
+		s.nodesMu.Unlock()
+		return fmt.Errorf("network %d was already removed", nw.num)
+	}
+	var nodes []*node
+	for _, nd := range s.nodes {
+		if nd.net != n {
+			continue
+		}
+		if len(nd.subnetRoutes) > 0 {
+			s.nodesMu.Unlock()
+			return fmt.Errorf("network %d: %v is a subnet router", nw.num, nd)
+		}
+		nodes = append(nodes, nd)
+	}
+	for _, nd := range nodes {
+		s.removeNodeLocked(nd)
+	}
+	nw.nodes = nil
+	// Closing n with nodesMu held keeps AddNode from adding to it.
+	n.close()
+	s.nodesMu.Unlock()
+
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	byWAN := s.networkByWAN.Load().Clone()
+	for pfx, other := range s.networkByWAN.Load().All() {
+		if other == n {
+			byWAN.Delete(pfx)
+		}
+	}
+	s.networkByWAN.Store(byWAN)
+	s.networksMu.Lock()
+	s.networks.Delete(n)
+	s.networksMu.Unlock()
+	n.logf("removed network %d", nw.num)
+	return nil
+}
+
+// allNetworks returns s's networks, in no particular order.
+func (s *Server) allNetworks() []*network {
+	s.networksMu.Lock()
+	defer s.networksMu.Unlock()
+	return slices.Collect(maps.Keys(s.networks))
+}
+
+// allNodes returns s's nodes, in the order they were added.
+func (s *Server) allNodes() []*node {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+	return slices.Clone(s.nodes)
+}
+
+// MACs returns the MAC addresses of the nodes, including any added with
+// AddNode.
+func (s *Server) MACs() iter.Seq[MAC] {
+	return s.nodeByMAC.Keys()
 }
 
 func (s *Server) RegisterSinkForTest(mac MAC, fn func(eth []byte)) {
-	n, ok := s.nodeByMAC[mac]
+	n, ok := s.nodeByMAC.Load(mac)
 	if !ok {
 		log.Fatalf("RegisterSinkForTest: unknown MAC %v", mac)
 	}
@@ -768,6 +1992,7 @@ func (s *Server) HWAddr(mac MAC) net.HardwareAddr {
 const (
 	ProtocolQEMU      = Protocol(iota + 1)
 	ProtocolUnixDGRAM // for macOS Virtualization.Framework and VZFileHandleNetworkDeviceAttachment
+	ProtocolTAP       // for Linux TAP devices; see Server.ServeTAP
 )
 
 func (s *Server) writeEthernetFrameToVM(c vmClient, ethPkt []byte, interfaceID int) {
@@ -790,42 +2015,71 @@ func (s *Server) writeEthernetFrameToVM(c vmClient, ethPkt []byte, interfaceID i
 			s.logf("Write pkt : %v", err)
 			return
 		}
+
+	case ProtocolTAP:
+		if _, err := c.tap.Write(ethPkt); err != nil {
+			s.logf("Write pkt to TAP: %v", err)
+			return
+		}
 	}
 
-	must.Do(s.pcapWriter.WritePacket(gopacket.CaptureInfo{
+	must.Do(s.capture(gopacket.CaptureInfo{
 		Timestamp:      time.Now(),
 		CaptureLength:  len(ethPkt),
 		Length:         len(ethPkt),
 		InterfaceIndex: interfaceID,
-	}, ethPkt))
+	}, ethPkt, nil))
 }
 
 // vmClient is a comparable value representing a connection from a VM, either a
-// QEMU-style client (with streams over a Unix socket) or a datagram based
-// client (such as macOS Virtualization.framework clients).
+// QEMU-style client (with streams over a Unix socket), a datagram based
+// client (such as macOS Virtualization.framework clients), or a Linux TAP
+// device.
 type vmClient struct {
 	uc    *net.UnixConn
 	raddr *net.UnixAddr // nil for QEMU-style clients using streams; else datagram source
+	tap   *os.File      // non-nil for TAP devices, in which case uc is nil
 }
 
 func (c vmClient) proto() Protocol {
+	if c.tap != nil {
+		return ProtocolTAP
+	}
 	if c.raddr == nil {
 		return ProtocolQEMU
 	}
 	return ProtocolUnixDGRAM
 }
 
+// sameClient reports whether c and o are the same client. Datagram source
+// addresses are compared by name, as each read returns a new one.
+func (c vmClient) sameClient(o vmClient) bool {
+	if c.raddr == nil || o.raddr == nil {
+		return c == o
+	}
+	return c.uc == o.uc && c.raddr.Name == o.raddr.Name
+}
+
+// String returns a description of c for logging.
+func (c vmClient) String() string {
+	if c.tap != nil {
+		return c.tap.Name()
+	}
+	return fmt.Sprintf("%p", c.uc)
+}
+
+// ethHeaderLen is the length of an Ethernet header:
+// 6 bytes of destination MAC, 6 bytes of source MAC, 2 bytes of EtherType.
+const ethHeaderLen = 14
+
 func parseEthernet(pkt []byte) (dst, src MAC, ethType layers.EthernetType, payload []byte, ok bool) {
-	// headerLen is the length of an Ethernet header:
-	// 6 bytes of destination MAC, 6 bytes of source MAC, 2 bytes of EtherType.
-	const headerLen = 14
-	if len(pkt) < headerLen {
+	if len(pkt) < ethHeaderLen {
 		return
 	}
 	dst = MAC(pkt[0:6])
 	src = MAC(pkt[6:12])
 	ethType = layers.EthernetType(binary.BigEndian.Uint16(pkt[12:14]))
-	payload = pkt[headerLen:]
+	payload = pkt[ethHeaderLen:]
 	ok = true
 	return
 }
@@ -844,7 +2098,14 @@ func (s *Server) ServeUnixConn(uc *net.UnixConn, proto Protocol) {
 	defer uc.Close()
 
 	buf := make([]byte, 16<<10)
-	didReg := map[MAC]bool{}
+	registered := map[MAC]clientWriter{}
+	defer func() {
+		for mac, cw := range registered {
+			if n, ok := s.nodeByMAC.Load(mac); ok {
+				n.net.unregisterWriter(mac, cw.gen)
+			}
+		}
+	}()
 	for {
 		var packetRaw []byte
 		var raddr *net.UnixAddr
@@ -883,29 +2144,96 @@ func (s *Server) ServeUnixConn(uc *net.UnixConn, proto Protocol) {
 			}
 			packetRaw = buf[4 : 4+n] // raw ethernet frame
 		}
-		c := vmClient{uc, raddr}
+		s.handleFrameFromClient(vmClient{uc: uc, raddr: raddr}, packetRaw, registered)
+	}
+}
 
-		// For the first packet from a MAC, register a writerFunc to write to the VM.
-		_, srcMAC, _, _, ok := parseEthernet(packetRaw)
-		if !ok {
-			continue
-		}
-		srcNode, ok := s.nodeByMAC[srcMAC]
-		if !ok {
-			s.logf("[conn %p] got frame from unknown MAC %v", c.uc, srcMAC)
-			continue
+// ServeTAP handles the Ethernet frames of a Linux TAP device, such as one
+// opened with OpenTAP, as if they came from a VM, until the Server is
+// closed or reading from tap fails. This attaches whatever is on the
+// kernel's side of the device (say, an unmodified process in a network
+// namespace) to the network of the node whose MAC address it uses.
+//
+// tap must be opened without packet information headers (IFF_NO_PI), so
+// that each read returns one bare Ethernet frame, and must support
+// deadlines, as OpenTAP's devices do. ServeTAP closes it when done.
+func (s *Server) ServeTAP(tap *os.File) {
+	if s.shuttingDown.Load() {
+		return
+	}
+	s.wg.Add(1)
+	defer s.wg.Done()
+	context.AfterFunc(s.shutdownCtx, func() {
+		tap.SetDeadline(time.Now())
+	})
+	s.logf("Got TAP %v", tap.Name())
+	defer tap.Close()
+
+	buf := make([]byte, 16<<10)
+	registered := map[MAC]clientWriter{}
+	c := vmClient{tap: tap}
+	defer func() {
+		for mac, cw := range registered {
+			if n, ok := s.nodeByMAC.Load(mac); ok {
+				n.net.unregisterWriter(mac, cw.gen)
+			}
 		}
-		if !didReg[srcMAC] {
-			didReg[srcMAC] = true
-			s.logf("[conn %p] Registering writer for MAC %v, node %v", c.uc, srcMAC, srcNode.lanIP)
-			srcNode.net.registerWriter(srcMAC, c)
-			defer srcNode.net.unregisterWriter(srcMAC)
+	}()
+	for {
+		n, err := tap.Read(buf)
+		if err != nil {
+			if s.shutdownCtx.Err() != nil {
+				// Return without logging.
+				return
+			}
+			s.logf("Read TAP: %v", err)
+			return
 		}
+		s.handleFrameFromClient(c, buf[:n], registered)
+	}
+}
 
-		if err := s.handleEthernetFrameFromVM(packetRaw); err != nil {
-			srcNode.net.logf("handleEthernetFrameFromVM: [conn %p], %v", c.uc, err)
+// clientWriter is a writer registration made for a client by
+// handleFrameFromClient.
+type clientWriter struct {
+	c   vmClient
+	gen uint64 // from network.registerWriter
+}
+
+// handleFrameFromClient handles the Ethernet frame packetRaw read from c.
+// Unless registered records that c is already the writer for the frame's
+// source MAC, it registers c as that MAC's writer; the caller unregisters
+// those when c goes away.
+//
+// A datagram socket may be shared by several VMs (as with muxd), each with
+// its own source address, so frames to each MAC go back to the address the
+// MAC last sent from.
+func (s *Server) handleFrameFromClient(c vmClient, packetRaw []byte, registered map[MAC]clientWriter) {
+	_, srcMAC, _, _, ok := parseEthernet(packetRaw)
+	if !ok {
+		return
+	}
+	srcNode, ok := s.nodeByMAC.Load(srcMAC)
+	if !ok {
+		s.logf("[conn %v] got frame from unknown MAC %v", c, srcMAC)
+		return
+	}
+	if prev, ok := registered[srcMAC]; !ok || !prev.c.sameClient(c) {
+		if c.proto() == ProtocolUnixDGRAM && c.raddr.Name == "" {
+			// Replies to an unbound socket have nowhere to go.
+			s.logf("[conn %v] got frame from MAC %v on an unbound socket", c, srcMAC)
+		} else {
+			s.logf("[conn %v] Registering writer for MAC %v, node %v", c, srcMAC, srcNode.lanIP)
+			registered[srcMAC] = clientWriter{c, srcNode.net.registerWriter(srcMAC, c)}
+			if srcNode.clockSkew != 0 {
+				s.logf("[conn %v] %v should have clock skew %v; its VM's clock is its own", c, srcNode, srcNode.clockSkew)
+			}
 		}
 	}
+
+	if err := s.handleEthernetFrameFromVM(packetRaw); err != nil {
+		srcNode.net.logf("handleEthernetFrameFromVM: [conn %v], %v", c, err)
+	}
 }
 
 func (s *Server) handleEthernetFrameFromVM(packetRaw []byte) error {
@@ -917,17 +2245,17 @@ func (s *Server) handleEthernetFrameFromVM(packetRaw []byte) error {
 	ep := EthernetPacket{le, packet}
 
 	srcMAC := ep.SrcMAC()
-	srcNode, ok := s.nodeByMAC[srcMAC]
+	srcNode, ok := s.nodeByMAC.Load(srcMAC)
 	if !ok {
 		return fmt.Errorf("got frame from unknown MAC %v", srcMAC)
 	}
 
-	must.Do(s.pcapWriter.WritePacket(gopacket.CaptureInfo{
+	must.Do(s.capture(gopacket.CaptureInfo{
 		Timestamp:      time.Now(),
 		CaptureLength:  len(packetRaw),
 		Length:         len(packetRaw),
 		InterfaceIndex: srcNode.interfaceID,
-	}, packetRaw))
+	}, packetRaw, packet))
 	srcNode.net.HandleEthernetPacket(ep)
 	return nil
 }
@@ -937,20 +2265,53 @@ func (s *Server) routeUDPPacket(up UDPPacket) {
 	// and all the known networks' wan IPs.
 
 	// But certain things (like STUN) we do in-process.
-	if up.Dst.Port() == stunPort {
-		// TODO(bradfitz): fake latency; time.AfterFunc the response
-		if res, ok := makeSTUNReply(up); ok {
-			//log.Printf("STUN reply: %+v", res)
-			s.routeUDPPacket(res)
-		} else {
+	if l, ok := s.shouldInterceptUDP(up); ok {
+		l.deliver(up)
+		return
+	}
+	if s.handleUDPService(up) {
+		return
+	}
+	if s.isSTUNServer(up.Dst) || (up.Dst.Port() == stunPort && s.derpIPs.Contains(up.Dst.Addr())) {
+		// Like real DERP nodes, each fake DERP server answers STUN at its
+		// own IP, after its region's latency.
+		res, ok := s.makeSTUNReply(up)
+		if !ok {
 			log.Printf("weird: STUN packet not handled")
+			return
+		}
+		if ds, ok := s.derpServerFor(up.Dst.Addr()); ok && ds.latency > 0 {
+			tc, timerC := s.clock.NewTimer(ds.latency)
+			go func() {
+				defer tc.Stop()
+				select {
+				case <-timerC:
+					s.routeUDPPacket(res)
+				case <-s.shutdownCtx.Done():
+				}
+			}()
+			return
+		}
+		s.routeUDPPacket(res)
+		return
+	}
+	if up.Dst.Port() == ntpPort && s.vip(fakeNTP).Match(up.Dst.Addr()) {
+		if res, ok := s.makeNTPReply(up); ok {
+			s.routeUDPPacket(res)
 		}
 		return
 	}
+	if s.handleWANUDPService(up) {
+		return
+	}
 
 	dstIP := up.Dst.Addr()
-	netw, ok := s.networkByWAN.Lookup(dstIP)
+	netw, ok := s.networkByWAN.Load().Lookup(dstIP)
 	if !ok {
+		if rn, ok := s.subnetRoutes.Lookup(dstIP); ok {
+			rn.net.writeUDPPacketToNode(rn, up)
+			return
+		}
 		if dstIP.IsPrivate() {
 			// Not worth spamming logs. RFC 1918 space doesn't route.
 			return
@@ -974,12 +2335,12 @@ func (n *network) writeEth(res []byte) bool {
 		return false
 	}
 
-	if dstMAC.IsBroadcast() || (n.v6 && etherType == layers.EthernetTypeIPv6 && dstMAC == macAllNodes) {
+	if dstMAC.IsBroadcast() || dstMAC.IsIPv4Multicast() || (n.v6 && etherType == layers.EthernetTypeIPv6 && (dstMAC == macAllNodes || dstMAC == macMDNS6)) {
 		num := 0
 		for mac, nw := range n.writers.All() {
-			if mac != srcMAC {
+			if mac != srcMAC && (!dstMAC.IsIPv4Multicast() || n.isMulticastMember(dstMAC, mac)) {
 				num++
-				n.conditionedWrite(nw, res)
+				n.conditionedWrite(nw, mac, res)
 			}
 		}
 		return num > 0
@@ -989,7 +2350,7 @@ func (n *network) writeEth(res []byte) bool {
 		return false
 	}
 	if nw, ok := n.writers.Load(dstMAC); ok {
-		n.conditionedWrite(nw, res)
+		n.conditionedWrite(nw, dstMAC, res)
 		return true
 	}
 
@@ -1002,11 +2363,18 @@ func (n *network) writeEth(res []byte) bool {
 	return false
 }
 
-func (n *network) conditionedWrite(nw networkWriter, packet []byte) {
-	if n.lossRate > 0 && rand.Float64() < n.lossRate {
+// conditionedWrite writes packet to the node with MAC dst via nw, subject
+// to the network's packet loss, corruption and latency.
+func (n *network) conditionedWrite(nw networkWriter, dst MAC, packet []byte) {
+	if n.lossRate > 0 && n.s.rng.Float64() < n.lossRate {
 		// packet lost
+		n.s.obs.OnDrop(DropPacketLoss)
 		return
 	}
+	n.countRx(dst, len(packet))
+	if n.corruptRate > 0 {
+		packet = n.maybeCorrupt(packet)
+	}
 	if n.latency > 0 {
 		// copy the packet as there's no guarantee packet is owned long enough.
 		// TODO(raggi): this could be optimized substantially if necessary,
@@ -1019,8 +2387,16 @@ func (n *network) conditionedWrite(nw networkWriter, packet []byte) {
 	}
 }
 
+// isLargePacketLost reports whether an IP packet of size bytes forwarded
+// between the network and the internet should be dropped, per the network's
+// large packet loss configuration.
+func (n *network) isLargePacketLost(size int) bool {
+	return n.largeLossRate > 0 && size > n.largeLossSize && n.s.rng.Float64() < n.largeLossRate
+}
+
 var (
 	macAllNodes   = MAC{0: 0x33, 1: 0x33, 5: 0x01}
+	macMDNS6      = MAC{0: 0x33, 1: 0x33, 5: 0xfb} // of ff02::fb
 	macAllRouters = MAC{0: 0x33, 1: 0x33, 5: 0x02}
 	macBroadcast  = MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 )
@@ -1032,12 +2408,17 @@ func (n *network) conditionedWrite(nw networkWriter, packet []byte) {
 func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 	packet := ep.gp
 	dstMAC := ep.DstMAC()
+	srcNode, _ := n.nodesByMAC.Load(ep.SrcMAC())
+	if srcNode != nil {
+		srcNode.stats.txPackets.Add(1)
+		srcNode.stats.txBytes.Add(int64(len(packet.Data())))
+	}
 	isBroadcast := dstMAC.IsBroadcast() || (n.v6 && ep.le.EthernetType == layers.EthernetTypeIPv6 && dstMAC == macAllNodes)
 	isV6SpecialMAC := dstMAC[0] == 0x33 && dstMAC[1] == 0x33
 
 	// forRouter is whether the packet is destined for the router itself
 	// or if it's a special thing (like V6 NDP) that the router should handle.
-	forRouter := dstMAC == n.mac || isBroadcast || isV6SpecialMAC
+	forRouter := dstMAC == n.mac || isBroadcast || isV6SpecialMAC || dstMAC.IsIPv4Multicast()
 
 	const debug = false
 	if debug {
@@ -1051,6 +2432,11 @@ func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 	case 0x1234:
 		// Permitted for testing. Not a real ethertype.
 	case layers.EthernetTypeARP:
+		if n.learnARP(ep) {
+			// Gratuitous ARP announces an address; there's nothing to
+			// answer.
+			return
+		}
 		res, err := n.createARPResponse(packet)
 		if err != nil {
 			n.logf("createARPResponse: %v", err)
@@ -1077,12 +2463,28 @@ func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 				n.handleIPv6NeighborSolicitation(ep, ns)
 				return
 			}
+			if isDHCPv6Request(ep.gp) {
+				n.handleDHCPv6Request(ep)
+				return
+			}
+			if n.isIPv6EchoRequestForRouter(ep.gp) {
+				n.handleIPv6EchoRequest(ep)
+				return
+			}
 			if ep.gp.Layer(layers.LayerTypeMLDv2MulticastListenerReport) != nil {
 				// We don't care about these (yet?) and Linux spams a bunch
 				// a bunch of them out, so explicitly ignore them to prevent
 				// log spam when verbose logging is enabled.
 				return
 			}
+			if dstMAC == macMDNS6 && isMDNS(ep.gp) {
+				// Relay mDNS to the other nodes. Without MLD snooping,
+				// they all get it.
+				if n.writeEth(ep.gp.Data()) && srcNode != nil {
+					srcNode.stats.lanDelivered.Add(1)
+				}
+				return
+			}
 			if isMcast && !isBroadcast {
 				return
 			}
@@ -1092,14 +2494,19 @@ func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 		// and don't fall through to the router below.
 
 	case layers.EthernetTypeIPv4:
-		// Below
+		if igmp := packet.Layer(layers.LayerTypeIGMP); igmp != nil {
+			n.handleIGMP(ep.SrcMAC(), igmp)
+			return
+		}
 	}
 
-	// Send ethernet broadcasts and unicast ethernet frames to peers
-	// on the same network. This is all LAN traffic that isn't meant
-	// for the router/gw itself:
-	if isBroadcast || !forRouter {
-		n.writeEth(ep.gp.Data())
+	// Send ethernet broadcasts, IPv4 multicasts (to the group's members)
+	// and unicast ethernet frames to peers on the same network. This is all
+	// LAN traffic that isn't meant only for the router/gw itself:
+	if isBroadcast || dstMAC.IsIPv4Multicast() || !forRouter {
+		if n.writeEth(ep.gp.Data()) && srcNode != nil {
+			srcNode.stats.lanDelivered.Add(1)
+		}
 	}
 
 	if forRouter {
@@ -1112,44 +2519,148 @@ func (n *network) HandleEthernetPacket(ep EthernetPacket) {
 // LAN IP here and wrapped in an ethernet layer and delivered
 // to the network.
 func (n *network) HandleUDPPacket(p UDPPacket) {
+	if n.reorderRate > 0 {
+		n.reorderUDP(p, n.deliverUDPPacket)
+		return
+	}
+	n.deliverUDPPacket(p)
+}
+
+// deliverUDPPacket is HandleUDPPacket after any reordering. It delivers p,
+// twice if the network duplicates it.
+func (n *network) deliverUDPPacket(p UDPPacket) {
+	n.handleUDPPacket(p)
+	if n.impairChance(n.dupRate) {
+		n.handleUDPPacket(p)
+	}
+}
+
+// handleUDPPacket delivers p, a packet arriving from the internet.
+func (n *network) handleUDPPacket(p UDPPacket) {
 	buf, err := n.serializedUDPPacket(p.Src, p.Dst, p.Payload, nil)
 	if err != nil {
 		n.logf("serializing UDP packet: %v", err)
 		return
 	}
-	n.s.pcapWriter.WritePacket(gopacket.CaptureInfo{
+	n.s.capture(gopacket.CaptureInfo{
 		Timestamp:      time.Now(),
 		CaptureLength:  len(buf),
 		Length:         len(buf),
 		InterfaceIndex: n.wanInterfaceID,
-	}, buf)
+	}, buf, nil)
 	if p.Dst.Addr().Is4() && n.breakWAN4 {
 		// Blackhole the packet.
+		n.s.obs.OnDrop(DropBlackhole)
+		return
+	}
+	if n.isUDPBlocked(p.Src, p.Dst, p.Src) {
 		return
 	}
 	dst := n.doNATIn(p.Src, p.Dst)
 	if !dst.IsValid() {
+		n.natDropped.Add(1)
+		n.s.obs.OnDrop(DropNATIn)
 		n.logf("Warning: NAT dropped packet; no mapping for %v=>%v", p.Src, p.Dst)
 		return
 	}
+	n.s.obs.OnNATIn(p.Src, p.Dst, dst)
+	if !n.firewallInbound("UDP", p.Src, dst) {
+		return
+	}
 	p.Dst = dst
+	if p.srcNode != nil {
+		if dstNode, ok := n.nodeByIP(dst.Addr()); ok {
+			n.s.paths.noteDirect(p.srcNode, dstNode)
+		}
+	}
 	buf, err = n.serializedUDPPacket(p.Src, p.Dst, p.Payload, nil)
 	if err != nil {
 		n.logf("serializing UDP packet: %v", err)
 		return
 	}
-	n.s.pcapWriter.WritePacket(gopacket.CaptureInfo{
+	if n.isLargePacketLost(len(buf)) {
+		n.s.obs.OnDrop(DropLargePacketLoss)
+		return
+	}
+	n.s.capture(gopacket.CaptureInfo{
 		Timestamp:      time.Now(),
 		CaptureLength:  len(buf),
 		Length:         len(buf),
 		InterfaceIndex: n.lanInterfaceID,
-	}, buf)
+	}, buf, nil)
 	n.WriteUDPPacketNoNAT(p)
 }
 
+// learnIPv6MAC records that the LAN IPv6 address ip belongs to mac. A MAC
+// may have any number of addresses: link-local, SLAAC, DHCPv6 and temporary
+// ones.
+func (n *network) learnIPv6MAC(ip netip.Addr, mac MAC) {
+	n.macMu.Lock()
+	defer n.macMu.Unlock()
+	mak.Set(&n.macOfIPv6, ip, mac)
+}
+
+// learnARP records the sender's IPv4 address and MAC of ep, an ARP packet
+// from a node on the LAN, as the router's ARP cache would, so packets to the
+// address go to that MAC from then on, until it ages out per
+// Network.SetARPTimeout. It reports whether ep is a gratuitous ARP, which
+// announces the sender's own address rather than asking for another's.
+func (n *network) learnARP(ep EthernetPacket) (gratuitous bool) {
+	a, ok := ep.gp.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok ||
+		a.AddrType != layers.LinkTypeEthernet ||
+		a.Protocol != layers.EthernetTypeIPv4 ||
+		len(a.SourceHwAddress) != 6 ||
+		len(a.SourceProtAddress) != 4 ||
+		len(a.DstProtAddress) != 4 {
+		return false
+	}
+	ip := netip.AddrFrom4([4]byte(a.SourceProtAddress))
+	mac := MAC(a.SourceHwAddress)
+	gratuitous = bytes.Equal(a.SourceProtAddress, a.DstProtAddress)
+	if !n.v4 || !n.lanIP4.Contains(ip) || ip == n.lanIP4.Addr() || mac != ep.SrcMAC() {
+		return gratuitous
+	}
+	if _, ok := n.nodesByMAC.Load(mac); !ok {
+		return gratuitous
+	}
+
+	e := arpEntry{mac: mac}
+	if n.arpTimeout > 0 {
+		e.expires = n.s.clock.Now().Add(n.arpTimeout)
+	}
+	n.macMu.Lock()
+	defer n.macMu.Unlock()
+	if old, ok := n.macOfIPv4[ip]; gratuitous && (!ok || old.mac != mac) {
+		n.logf("gratuitous ARP: %v is at %v", ip, mac)
+	}
+	mak.Set(&n.macOfIPv4, ip, e)
+	return gratuitous
+}
+
+// learnedIPv4MAC returns the MAC that learnARP last learned for the LAN IPv4
+// ip, if it hasn't aged out.
+func (n *network) learnedIPv4MAC(ip netip.Addr) (_ MAC, ok bool) {
+	n.macMu.Lock()
+	defer n.macMu.Unlock()
+	e, ok := n.macOfIPv4[ip]
+	if !ok {
+		return MAC{}, false
+	}
+	if !e.expires.IsZero() && !n.s.clock.Now().Before(e.expires) {
+		delete(n.macOfIPv4, ip)
+		return MAC{}, false
+	}
+	return e.mac, true
+}
+
 func (n *network) nodeByIP(ip netip.Addr) (node *node, ok bool) {
 	if ip.Is4() {
-		node, ok = n.nodesByIP4[ip]
+		if mac, learned := n.learnedIPv4MAC(ip); learned {
+			node, ok = n.nodesByMAC.Load(mac)
+		} else {
+			node, ok = n.nodesByIP4.Load(ip)
+		}
 	}
 	if !ok && ip.Is6() {
 		var mac MAC
@@ -1160,7 +2671,7 @@ func (n *network) nodeByIP(ip netip.Addr) (node *node, ok bool) {
 			log.Printf("warning: no known MAC for IPv6 %v", ip)
 			return nil, false
 		}
-		node, ok = n.nodesByMAC[mac]
+		node, ok = n.nodesByMAC.Load(mac)
 		if !ok {
 			log.Printf("warning: no known node for MAC %v (IP %v)", mac, ip)
 		}
@@ -1175,23 +2686,66 @@ func (n *network) nodeByIP(ip netip.Addr) (node *node, ok bool) {
 // so this should not be used for packets between clients on the
 // same ethernet segment.
 func (n *network) WriteUDPPacketNoNAT(p UDPPacket) {
-	src, dst := p.Src, p.Dst
-	node, ok := n.nodeByIP(dst.Addr())
+	node, ok := n.nodeByIP(p.Dst.Addr())
 	if !ok {
-		n.logf("no node for dest IP %v in UDP packet %v=>%v", dst.Addr(), p.Src, p.Dst)
+		n.logf("no node for dest IP %v in UDP packet %v=>%v", p.Dst.Addr(), p.Src, p.Dst)
 		return
 	}
+	n.writeUDPPacketToNode(node, p)
+}
 
+// writeUDPPacketToNode writes p to node on the network, which is usually
+// its destination but may be a subnet router for it.
+func (n *network) writeUDPPacketToNode(node *node, p UDPPacket) {
+	src, dst := p.Src, p.Dst
 	eth := &layers.Ethernet{
 		SrcMAC: n.mac.HWAddr(), // of gateway
 		DstMAC: node.mac.HWAddr(),
 	}
-	ethRaw, err := n.serializedUDPPacket(src, dst, p.Payload, eth)
+	ipRaw, err := n.serializedUDPPacket(src, dst, p.Payload, nil)
 	if err != nil {
 		n.logf("serializing UDP packet: %v", err)
 		return
 	}
-	n.writeEth(ethRaw)
+	if len(ipRaw) <= n.mtu {
+		ethRaw, err := n.serializedUDPPacket(src, dst, p.Payload, eth)
+		if err != nil {
+			n.logf("serializing UDP packet: %v", err)
+			return
+		}
+		n.writeEth(ethRaw)
+		return
+	}
+
+	// The packet is too big for this network. UDPPackets arriving from the
+	// virtual internet don't say whether the Don't Fragment bit was set, so
+	// IPv4 packets are fragmented (as if it wasn't) and IPv6 packets, which
+	// routers never fragment, are dropped.
+	if dst.Addr().Is6() {
+		n.logf("dropping %d byte IPv6 packet %v=>%v; exceeds MTU %d", len(ipRaw), src, dst, n.mtu)
+		return
+	}
+	frags, err := fragmentIPv4(ipRaw, n.mtu, n.s.rng)
+	if err != nil {
+		n.logf("fragmenting UDP packet: %v", err)
+		return
+	}
+	eth.EthernetType = layers.EthernetTypeIPv4
+	for _, frag := range frags {
+		ethRaw, err := mkPacket(eth, gopacket.Payload(frag))
+		if err != nil {
+			n.logf("serializing IPv4 fragment: %v", err)
+			return
+		}
+		n.writeEth(ethRaw)
+	}
+}
+
+// canFragment reports whether a router may fragment pkt if it's too big for
+// the next hop: that is, whether it's IPv4 without the Don't Fragment bit.
+func canFragment(pkt gopacket.Packet) bool {
+	ip, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	return ok && ip.Flags&layers.IPv4DontFragment == 0
 }
 
 type serializableNetworkLayer interface {
@@ -1247,13 +2801,11 @@ func (n *network) HandleEthernetPacketForRouter(ep EthernetPacket) {
 		return
 	}
 	dstIP := flow.dst
-	toForward := dstIP != n.lanIP4.Addr() && dstIP != netip.IPv4Unspecified() && !dstIP.IsLinkLocalUnicast()
+	toForward := !n.isRouterIP(dstIP) && dstIP != netip.IPv4Unspecified() && !dstIP.IsLinkLocalUnicast() && !dstIP.IsMulticast()
 
 	// Pre-NAT mapping, for DNS/etc responses:
 	if flow.src.Is6() {
-		n.macMu.Lock()
-		mak.Set(&n.macOfIPv6, flow.src, ep.SrcMAC())
-		n.macMu.Unlock()
+		n.learnIPv6MAC(flow.src, ep.SrcMAC())
 	}
 
 	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
@@ -1261,11 +2813,28 @@ func (n *network) HandleEthernetPacketForRouter(ep EthernetPacket) {
 		return
 	}
 
-	if toForward && n.s.shouldInterceptTCP(packet) {
-		if flow.dst.Is4() && n.breakWAN4 {
+	if (toForward && (n.s.shouldInterceptTCP(packet) || n.isInboundTCPReply(packet, dstIP) || n.isCaptivePortalTCP(packet, dstIP))) || n.isTCPToRouter(packet, dstIP) {
+		if toForward && flow.dst.Is4() && n.breakWAN4 {
 			// Blackhole the packet.
+			n.s.obs.OnDrop(DropBlackhole)
 			return
 		}
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && toForward && !n.isInboundTCPReply(packet, dstIP) {
+			src := netip.AddrPortFrom(flow.src, uint16(tcp.SrcPort))
+			dst := netip.AddrPortFrom(flow.dst, uint16(tcp.DstPort))
+			if n.isDERPBlocked(dst) {
+				n.s.obs.OnDrop(DropDERPBlocked)
+				return
+			}
+			if !n.firewallOutbound(ep, "TCP", src, dst) {
+				return
+			}
+			// Connections to another network's port mapped TCP service go
+			// through its firewall too, coming from our WAN IP.
+			if dstNet, lanAP, ok := n.s.tcpPortMapDst(dst); ok && !dstNet.firewallInbound("TCP", netip.AddrPortFrom(n.WANIP(), src.Port()), lanAP) {
+				return
+			}
+		}
 		var base *layers.BaseLayer
 		proto := header.IPv4ProtocolNumber
 		if v4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
@@ -1279,6 +2848,10 @@ func (n *network) HandleEthernetPacketForRouter(ep EthernetPacket) {
 		pktCopy := make([]byte, 0, len(base.Contents)+len(base.Payload))
 		pktCopy = append(pktCopy, base.Contents...)
 		pktCopy = append(pktCopy, base.Payload...)
+		if toForward && n.isLargePacketLost(len(pktCopy)) {
+			n.s.obs.OnDrop(DropLargePacketLoss)
+			return
+		}
 		packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
 			Payload: buffer.MakeWithData(pktCopy),
 		})
@@ -1291,6 +2864,10 @@ func (n *network) HandleEthernetPacketForRouter(ep EthernetPacket) {
 		// Don't log.
 		return
 	}
+	if dstIP.IsMulticast() {
+		// IGMP and such. Don't log.
+		return
+	}
 
 	n.logf("router got unknown packet: %v", packet)
 }
@@ -1310,32 +2887,51 @@ func (n *network) handleUDPPacketForRouter(ep EthernetPacket, udp *layers.UDP, t
 			return
 		}
 		n.writeEth(res)
+		if dhcp, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok && dhcpMsgType(dhcp) == layers.DHCPMsgTypeRequest {
+			if node, ok := n.s.nodeByMAC.Load(ep.SrcMAC()); ok {
+				if hook := n.s.dhcpLeaseHook.Load(); hook != nil {
+					hook(node.mac, node.lanIP)
+				}
+				n.s.obs.OnDHCPLease(node.mac, node.lanIP)
+			}
+		}
 		return
 	}
 
-	if isMDNSQuery(packet) || isIGMP(packet) {
-		// Don't log. Spammy for now.
+	if isMDNS(packet) {
+		// Already relayed to the group's members on the LAN by
+		// HandleEthernetPacket. The router has no mDNS responder.
 		return
 	}
 
-	if isDNSRequest(packet) {
+	if n.s.isDNSRequest(packet) {
+		if n.s.dnsLoss > 0 && n.s.rng.Float64() < n.s.dnsLoss {
+			// Query lost.
+			return
+		}
 		res, err := n.s.createDNSResponse(packet)
 		if err != nil {
 			n.logf("createDNSResponse: %v", err)
 			return
 		}
+		if n.s.dnsLatency > 0 {
+			n.writeEthAfterDNSLatency(res)
+			return
+		}
 		n.writeEth(res)
 		return
 	}
 
-	if fakeSyslog.Match(dstIP) {
+	if n.s.vip(fakeSyslog).Match(dstIP) {
 		node, ok := n.nodeByIP(srcIP)
 		if !ok {
 			return
 		}
+		e := parseSyslog(udp.Payload, node.now())
+		node.logMu.Lock()
+		node.syslogs = append(node.syslogs, e)
+		node.logMu.Unlock()
 		if node.verboseSyslog {
-			// TODO(bradfitz): parse this and capture it, structured, into
-			// node's log buffer.
 			n.logf("syslog from %v: %s", node, udp.Payload)
 		}
 		return
@@ -1350,67 +2946,346 @@ func (n *network) handleUDPPacketForRouter(ep EthernetPacket, udp *layers.UDP, t
 		return
 	}
 
+	if dstIP == n.lanIP4.Addr() && isPCP(udp) {
+		n.handlePCPRequest(UDPPacket{
+			Src:     netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)),
+			Dst:     netip.AddrPortFrom(dstIP, uint16(udp.DstPort)),
+			Payload: udp.Payload,
+		})
+		return
+	}
+
+	if (dstIP == n.lanIP4.Addr() || dstIP == ssdpMulticastIP) && isSSDPSearch(udp) {
+		n.handleSSDPRequest(UDPPacket{
+			Src:     netip.AddrPortFrom(srcIP, uint16(udp.SrcPort)),
+			Dst:     netip.AddrPortFrom(dstIP, uint16(udp.DstPort)),
+			Payload: udp.Payload,
+		})
+		return
+	}
+
 	if toForward {
 		if dstIP.Is4() && n.breakWAN4 {
 			// Blackhole the packet.
+			n.s.obs.OnDrop(DropBlackhole)
 			return
 		}
 		src := netip.AddrPortFrom(srcIP, uint16(udp.SrcPort))
 		dst := netip.AddrPortFrom(dstIP, uint16(udp.DstPort))
+		if n.isUDPBlocked(src, dst, dst) {
+			return
+		}
+		if !n.firewallOutbound(ep, "UDP", src, dst) {
+			return
+		}
 		buf, err := n.serializedUDPPacket(src, dst, udp.Payload, nil)
 		if err != nil {
 			n.logf("serializing UDP packet: %v", err)
 			return
 		}
-		n.s.pcapWriter.WritePacket(gopacket.CaptureInfo{
+		n.s.capture(gopacket.CaptureInfo{
 			Timestamp:      time.Now(),
 			CaptureLength:  len(buf),
 			Length:         len(buf),
 			InterfaceIndex: n.lanInterfaceID,
-		}, buf)
+		}, buf, nil)
+
+		if len(buf) > n.mtu && !canFragment(packet) {
+			routerIP := n.lanIP4.Addr()
+			if dstIP.Is6() {
+				routerIP = n.lanIP6.Addr()
+			}
+			n.s.obs.OnDrop(DropTooBig)
+			n.sendICMPError(ep, routerIP, icmpPacketTooBig, n.mtu)
+			return
+		}
+
+		if n.isLargePacketLost(len(buf)) {
+			n.s.obs.OnDrop(DropLargePacketLoss)
+			return
+		}
 
 		lanSrc := src // the original src, before NAT (for logging only)
-		src = n.doNATOut(src, dst)
+		// Traffic from a routed subnet isn't NATed; the virtual internet
+		// routes the replies back to its router.
+		if rn, ok := n.subnetRouter(src.Addr()); !ok || rn.mac != ep.SrcMAC() {
+			src = n.doNATOut(src, dst)
+		}
 		if !src.IsValid() {
+			if node, ok := n.nodesByMAC.Load(ep.SrcMAC()); ok {
+				node.stats.natDropped.Add(1)
+			}
+			n.s.obs.OnDrop(DropNATOut)
 			n.logf("warning: NAT dropped packet; no NAT out mapping for %v=>%v", lanSrc, dst)
 			return
 		}
+		n.s.obs.OnNATOut(lanSrc, dst, src)
 		buf, err = n.serializedUDPPacket(src, dst, udp.Payload, nil)
 		if err != nil {
 			n.logf("serializing UDP packet: %v", err)
 			return
 		}
-		n.s.pcapWriter.WritePacket(gopacket.CaptureInfo{
-			Timestamp:      time.Now(),
-			CaptureLength:  len(buf),
-			Length:         len(buf),
-			InterfaceIndex: n.wanInterfaceID,
-		}, buf)
+		frags := [][]byte{buf}
+		if src.Addr().Is4() {
+			frags, err = fragmentIPv4(buf, n.mtu, n.s.rng)
+			if err != nil {
+				n.logf("fragmenting UDP packet: %v", err)
+				return
+			}
+		}
+		for _, frag := range frags {
+			n.s.capture(gopacket.CaptureInfo{
+				Timestamp:      time.Now(),
+				CaptureLength:  len(frag),
+				Length:         len(frag),
+				InterfaceIndex: n.wanInterfaceID,
+			}, frag, nil)
+		}
 
 		if src.Addr().Is6() {
-			n.macMu.Lock()
-			mak.Set(&n.macOfIPv6, src.Addr(), ep.SrcMAC())
-			n.macMu.Unlock()
+			n.learnIPv6MAC(src.Addr(), ep.SrcMAC())
 		}
 
+		srcNode, _ := n.nodesByMAC.Load(ep.SrcMAC())
+		if srcNode != nil {
+			srcNode.stats.wanForwarded.Add(1)
+		}
 		n.s.routeUDPPacket(UDPPacket{
 			Src:     src,
 			Dst:     dst,
 			Payload: udp.Payload,
+			srcNode: srcNode,
 		})
 		return
 	}
 
 	if udp.DstPort == pcpPort || udp.DstPort == ssdpPort {
-		// We handle NAT-PMP, but not these yet.
-		// TODO(bradfitz): handle? marginal utility so far.
+		// NAT-PMP, PCP or SSDP on a network without them enabled.
 		// Don't log about them being unknown.
 		return
 	}
 
+	if dstIP.IsMulticast() {
+		// Nobody on the router is listening.
+		return
+	}
+
+	if n.isRouterIP(dstIP) {
+		// Nothing on the router listens on this port. Tell the sender, like
+		// a real router's kernel would, so it can give up quickly.
+		n.sendICMPError(ep, dstIP, icmpPortUnreachable, 0)
+		return
+	}
+
 	n.logf("router got unknown UDP packet: %v", packet)
 }
 
+// isTCPToRouter reports whether pkt is TCP to the router's own LAN IPv4
+// address, which the router's netstack handles: either its UPnP server or
+// the LAN side of connections it forwards for port mappings.
+func (n *network) isTCPToRouter(pkt gopacket.Packet, dstIP netip.Addr) bool {
+	return n.v4 && dstIP == n.lanIP4.Addr() && pkt.Layer(layers.LayerTypeTCP) != nil
+}
+
+// isInboundTCPReply reports whether pkt is TCP to the internet side of a
+// connection made with Server.DialTCPFromInternet.
+func (n *network) isInboundTCPReply(pkt gopacket.Packet, dstIP netip.Addr) bool {
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	_, ok = n.inboundTCPPeers.Load(netip.AddrPortFrom(dstIP, uint16(tcp.DstPort)))
+	return ok
+}
+
+// subnetRouter returns the node on the network that routes ip as one of its
+// subnet routes, if any.
+func (n *network) subnetRouter(ip netip.Addr) (*node, bool) {
+	rn, ok := n.s.subnetRoutes.Lookup(ip)
+	return rn, ok && rn.net == n
+}
+
+// isDERPBlocked reports whether TCP to dst is dropped because of
+// Network.SetDERPBlocked.
+func (n *network) isDERPBlocked(dst netip.AddrPort) bool {
+	if !n.derpBlocked || (dst.Port() != 80 && dst.Port() != 443) {
+		return false
+	}
+	_, isFake := n.s.derpServerFor(dst.Addr())
+	return isFake || n.s.derpIPs.Contains(dst.Addr())
+}
+
+// isUDPBlocked reports whether the UDP packet from src to dst, forwarded
+// between the LAN and the internet, is dropped because of
+// Network.SetUDPBlocked, counting and logging it if so. The remote is the
+// packet's internet side.
+func (n *network) isUDPBlocked(src, dst, remote netip.AddrPort) bool {
+	if !n.udpBlocked || (n.udpAllowSTUN && n.s.isSTUNServer(remote)) {
+		return false
+	}
+	n.udpDropped.Add(1)
+	n.s.obs.OnDrop(DropUDPBlocked)
+	if n.udpBlockedLog {
+		n.logf("UDP blocked: %v => %v", src, dst)
+	}
+	return true
+}
+
+// icmpv6OptRDNSS is the NDP Recursive DNS Server option type, from RFC 8106.
+const icmpv6OptRDNSS layers.ICMPv6Opt = 25
+
+// routerLinkLocalIP6 is the router's IPv6 link-local address, as advertised
+// in its router advertisements.
+var routerLinkLocalIP6 = netip.MustParseAddr("fe80::1")
+
+// isRouterIP reports whether ip is one of the router's own LAN-facing
+// addresses, as opposed to an address the router forwards traffic to.
+func (n *network) isRouterIP(ip netip.Addr) bool {
+	if n.v4 && ip == n.lanIP4.Addr() {
+		return true
+	}
+	return n.v6 && (ip == n.lanIP6.Addr() || ip == routerLinkLocalIP6)
+}
+
+// icmpError is a type of ICMP error that the router can send.
+type icmpError int
+
+const (
+	// icmpPortUnreachable is a destination unreachable error for a port with
+	// no listener.
+	icmpPortUnreachable icmpError = iota + 1
+
+	// icmpPacketTooBig is a destination unreachable, fragmentation needed
+	// error for IPv4, or a packet too big error for IPv6. Either way, it
+	// carries the next hop MTU.
+	icmpPacketTooBig
+
+	// icmpAdminProhibited is a destination unreachable error for a packet
+	// rejected by a firewall.
+	icmpAdminProhibited
+)
+
+// newICMPErrorLimiter returns a limiter for ICMP errors sent at perSec per
+// second with bursts of burst, or nil if perSec is zero (no limit).
+func newICMPErrorLimiter(perSec float64, burst int) *rate.Limiter {
+	if perSec == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSec), max(burst, 1))
+}
+
+// sendICMPError sends an ICMP error of type typ from the router's IP src back
+// to the sender of the IP packet in ep, unless the network's ICMP error rate
+// limit has been reached. See createICMPError for the meaning of mtu.
+func (n *network) sendICMPError(ep EthernetPacket, src netip.Addr, typ icmpError, mtu int) {
+	if n.icmpErrLimit != nil && !n.icmpErrLimit.AllowN(n.s.clock.Now(), 1) {
+		// Like real routers, drop the error silently.
+		return
+	}
+	res, err := n.createICMPError(ep, src, typ, mtu)
+	if err != nil {
+		n.logf("createICMPError: %v", err)
+		return
+	}
+	n.writeEth(res)
+}
+
+// createICMPError creates an ICMPv4 or ICMPv6 error of type typ from the
+// router's IP src in reply to the IP packet in ep. The mtu is the next-hop
+// MTU for icmpPacketTooBig errors and ignored otherwise.
+//
+// As much of the original packet is quoted as fits in the minimum MTU,
+// per RFC 1812 section 4.3.2.3 and RFC 4443 section 2.4(c).
+func (n *network) createICMPError(ep EthernetPacket, src netip.Addr, typ icmpError, mtu int) ([]byte, error) {
+	flow, ok := flow(ep.gp)
+	if !ok {
+		return nil, errors.New("not an IP packet")
+	}
+	nl := ep.gp.NetworkLayer()
+	orig := slices.Concat(nl.LayerContents(), nl.LayerPayload())
+
+	eth := &layers.Ethernet{
+		SrcMAC: n.mac.HWAddr(),
+		DstMAC: ep.SrcMAC().HWAddr(),
+	}
+	if flow.src.Is4() {
+		const maxQuote = 576 - header.IPv4MinimumSize - header.ICMPv4MinimumSize
+		ip := mkIPLayer(layers.IPProtocolICMPv4, src, flow.src)
+		icmp := &layers.ICMPv4{}
+		switch typ {
+		case icmpPortUnreachable:
+			icmp.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)
+		case icmpPacketTooBig:
+			icmp.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded)
+			icmp.Seq = uint16(mtu) // RFC 1191: the low 16 bits are the next-hop MTU
+		case icmpAdminProhibited:
+			icmp.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeCommAdminProhibited)
+		default:
+			return nil, fmt.Errorf("unknown ICMP error type %v", typ)
+		}
+		return mkPacket(eth, ip, icmp, gopacket.Payload(orig[:min(len(orig), maxQuote)]))
+	}
+	const maxQuote = header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6MinimumSize
+	ip := mkIPLayer(layers.IPProtocolICMPv6, src, flow.src)
+	icmp := &layers.ICMPv6{}
+	// The four bytes after the ICMPv6 type, code, and checksum are the MTU
+	// for packet too big errors and unused for destination unreachable.
+	payload := make([]byte, 4, 4+min(len(orig), maxQuote))
+	switch typ {
+	case icmpPortUnreachable:
+		icmp.TypeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)
+	case icmpPacketTooBig:
+		icmp.TypeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0)
+		binary.BigEndian.PutUint32(payload, uint32(mtu))
+	case icmpAdminProhibited:
+		icmp.TypeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAdminProhibited)
+	default:
+		return nil, fmt.Errorf("unknown ICMP error type %v", typ)
+	}
+	payload = append(payload, orig[:min(len(orig), maxQuote)]...)
+	return mkPacket(eth, ip, icmp, gopacket.Payload(payload))
+}
+
+// fragmentIPv4 splits the raw IPv4 packet ipRaw into fragments of at most mtu
+// bytes each, as a router does when forwarding a packet without the Don't
+// Fragment bit set onto a link with a smaller MTU.
+//
+// If ipRaw already fits in mtu, it's returned as the sole fragment.
+func fragmentIPv4(ipRaw []byte, mtu int, rng *lockedRand) ([][]byte, error) {
+	if len(ipRaw) <= mtu {
+		return [][]byte{ipRaw}, nil
+	}
+	ip, ok := gopacket.NewPacket(ipRaw, layers.LayerTypeIPv4, gopacket.Lazy).NetworkLayer().(*layers.IPv4)
+	if !ok {
+		return nil, errors.New("not an IPv4 packet")
+	}
+	hdrLen := len(ip.Contents)
+	// All but the last fragment must carry a multiple of 8 bytes of payload.
+	chunk := (mtu - hdrLen) &^ 7
+	if chunk <= 0 {
+		return nil, fmt.Errorf("MTU %d too small for IPv4 header of %d bytes", mtu, hdrLen)
+	}
+	if ip.Id == 0 {
+		ip.Id = rng.Uint16N(1<<16-1) + 1
+	}
+	payload := ip.Payload
+	var frags [][]byte
+	for off := 0; off < len(payload); off += chunk {
+		end := min(off+chunk, len(payload))
+		frag := *ip
+		frag.FragOffset = ip.FragOffset + uint16(off/8)
+		if end < len(payload) {
+			frag.Flags |= layers.IPv4MoreFragments
+		}
+		b, err := mkPacket(&frag, gopacket.Payload(payload[off:end]))
+		if err != nil {
+			return nil, err
+		}
+		frags = append(frags, b)
+	}
+	return frags, nil
+}
+
 func (n *network) handleIPv6RouterSolicitation(ep EthernetPacket, rs *layers.ICMPv6RouterSolicitation) {
 	v6 := ep.gp.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
 
@@ -1436,8 +3311,15 @@ func (n *network) handleIPv6RouterSolicitation(ep EthernetPacket, rs *layers.ICM
 	pfx = binary.BigEndian.AppendUint32(pfx, 86400) // valid lifetime
 	pfx = binary.BigEndian.AppendUint32(pfx, 14400) // preferred lifetime
 	pfx = binary.BigEndian.AppendUint32(pfx, 0)     // reserved
-	wanIP := n.wanIP6.Addr().As16()
-	pfx = append(pfx, wanIP[:]...)
+	lanIP := n.lanIP6.Addr().As16()
+	pfx = append(pfx, lanIP[:]...)
+
+	// Recursive DNS Server option (RFC 8106), so hosts that only do SLAAC,
+	// as on IPv6-only networks without DHCPv6, can find the fake DNS server.
+	rdnss := make([]byte, 0, 22)
+	rdnss = append(rdnss, 0, 0)                        // reserved
+	rdnss = binary.BigEndian.AppendUint32(rdnss, 3600) // lifetime
+	rdnss = append(rdnss, n.s.vip(fakeDNS).v6.AsSlice()...)
 
 	ra := &layers.ICMPv6RouterAdvertisement{
 		RouterLifetime: 1800,
@@ -1446,6 +3328,10 @@ func (n *network) handleIPv6RouterSolicitation(ep EthernetPacket, rs *layers.ICM
 				Type: layers.ICMPv6OptPrefixInfo,
 				Data: pfx,
 			},
+			{
+				Type: icmpv6OptRDNSS,
+				Data: rdnss,
+			},
 		},
 	}
 	pkt, err := mkPacket(eth, ip, icmp, ra)
@@ -1456,6 +3342,44 @@ func (n *network) handleIPv6RouterSolicitation(ep EthernetPacket, rs *layers.ICM
 	n.writeEth(pkt)
 }
 
+// isIPv6EchoRequestForRouter reports whether pkt is an ICMPv6 echo request
+// (a ping) to one of the router's own IPv6 addresses.
+func (n *network) isIPv6EchoRequestForRouter(pkt gopacket.Packet) bool {
+	icmp, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	if !ok || icmp.TypeCode.Type() != layers.ICMPv6TypeEchoRequest {
+		return false
+	}
+	f, ok := flow(pkt)
+	return ok && (n.isRouterIP(f.dst) || f.dst == n.wanIP6.Addr())
+}
+
+// handleIPv6EchoRequest replies to the ICMPv6 echo request in ep, which is to
+// one of the router's addresses.
+func (n *network) handleIPv6EchoRequest(ep EthernetPacket) {
+	v6 := ep.gp.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	req := ep.gp.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	eth := &layers.Ethernet{
+		SrcMAC: n.mac.HWAddr(),
+		DstMAC: ep.SrcMAC().HWAddr(),
+	}
+	ip := &layers.IPv6{
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      v6.DstIP,
+		DstIP:      v6.SrcIP,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0),
+	}
+	// The reply carries the request's identifier, sequence number, and
+	// data unchanged.
+	pkt, err := mkPacket(eth, ip, icmp, gopacket.Payload(req.Payload))
+	if err != nil {
+		n.logf("serializing ICMPv6 echo reply: %v", err)
+		return
+	}
+	n.writeEth(pkt)
+}
+
 func (n *network) handleIPv6NeighborSolicitation(ep EthernetPacket, ns *layers.ICMPv6NeighborSolicitation) {
 	v6 := ep.gp.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
 
@@ -1463,8 +3387,21 @@ func (n *network) handleIPv6NeighborSolicitation(ep EthernetPacket, ns *layers.I
 	if !ok {
 		return
 	}
+	srcIP, _ := netip.AddrFromSlice(v6.SrcIP)
+	if srcIP.IsUnspecified() {
+		// Duplicate Address Detection (RFC 4862, 5.4.2): the sender is
+		// about to start using targetIP, perhaps as a new temporary
+		// address (RFC 8981). Learn it now so that replies to its first
+		// packets from that address can be delivered.
+		if !n.isRouterIP(targetIP) {
+			n.learnIPv6MAC(targetIP, ep.SrcMAC())
+		}
+		return
+	}
+	n.learnIPv6MAC(srcIP, ep.SrcMAC())
+
 	var srcMAC MAC
-	if targetIP == netip.MustParseAddr("fe80::1") {
+	if targetIP == routerLinkLocalIP6 {
 		srcMAC = n.mac
 	} else {
 		n.logf("Ignoring IPv6 NS request from %v for target %v", ep.SrcMAC(), targetIP)
@@ -1517,7 +3454,7 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 	if !ok {
 		return nil, nil
 	}
-	node, ok := s.nodeByMAC[srcMAC]
+	node, ok := s.nodeByMAC.Load(srcMAC)
 	if !ok {
 		log.Printf("DHCP request from unknown node %v; ignoring", srcMAC)
 		return nil, nil
@@ -1528,6 +3465,12 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 	udpLayer := request.Layer(layers.LayerTypeUDP).(*layers.UDP)
 	dhcpLayer := request.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
 
+	for _, opt := range dhcpLayer.Options {
+		if opt.Type == layers.DHCPOptHostname && len(opt.Data) > 0 {
+			node.hostname.Store(string(opt.Data))
+		}
+	}
+
 	response := &layers.DHCPv4{
 		Operation:    layers.DHCPOpReply,
 		HardwareType: layers.LinkTypeEthernet,
@@ -1545,13 +3488,7 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 		},
 	}
 
-	var msgType layers.DHCPMsgType
-	for _, opt := range dhcpLayer.Options {
-		if opt.Type == layers.DHCPOptMessageType && opt.Length > 0 {
-			msgType = layers.DHCPMsgType(opt.Data[0])
-		}
-	}
-	switch msgType {
+	switch dhcpMsgType(dhcpLayer) {
 	case layers.DHCPMsgTypeDiscover:
 		response.Options = append(response.Options, layers.DHCPOption{
 			Type:   layers.DHCPOptMessageType,
@@ -1559,6 +3496,10 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 			Length: 1,
 		})
 	case layers.DHCPMsgTypeRequest:
+		var dnsServers []byte
+		for _, ip := range node.net.dhcpDNS {
+			dnsServers = append(dnsServers, ip.AsSlice()...)
+		}
 		response.Options = append(response.Options,
 			layers.DHCPOption{
 				Type:   layers.DHCPOptMessageType,
@@ -1567,7 +3508,7 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 			},
 			layers.DHCPOption{
 				Type:   layers.DHCPOptLeaseTime,
-				Data:   binary.BigEndian.AppendUint32(nil, 3600), // hour? sure.
+				Data:   binary.BigEndian.AppendUint32(nil, node.net.dhcpLeaseSec),
 				Length: 4,
 			},
 			layers.DHCPOption{
@@ -1577,8 +3518,8 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 			},
 			layers.DHCPOption{
 				Type:   layers.DHCPOptDNS,
-				Data:   fakeDNS.v4.AsSlice(),
-				Length: 4,
+				Data:   dnsServers,
+				Length: uint8(len(dnsServers)),
 			},
 			layers.DHCPOption{
 				Type:   layers.DHCPOptSubnetMask,
@@ -1586,6 +3527,13 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 				Length: 4,
 			},
 		)
+		if routes := node.net.dhcpRoutes; routes != nil {
+			response.Options = append(response.Options, layers.DHCPOption{
+				Type:   layers.DHCPOptClasslessStaticRoute,
+				Data:   routes,
+				Length: uint8(len(routes)),
+			})
+		}
 	}
 
 	eth := &layers.Ethernet{
@@ -1605,6 +3553,152 @@ func (s *Server) createDHCPResponse(request gopacket.Packet) ([]byte, error) {
 	return mkPacket(eth, ip, udp, response)
 }
 
+// dhcpMsgType returns the DHCP message type option of dhcp, or zero if
+// absent.
+func dhcpMsgType(dhcp *layers.DHCPv4) layers.DHCPMsgType {
+	var msgType layers.DHCPMsgType
+	for _, opt := range dhcp.Options {
+		if opt.Type == layers.DHCPOptMessageType && opt.Length > 0 {
+			msgType = layers.DHCPMsgType(opt.Data[0])
+		}
+	}
+	return msgType
+}
+
+// encodeDHCPRoutes encodes routes as the data of a DHCP classless static
+// route option (RFC 3442), adding a default route via router if routes don't
+// have one. It returns nil if there are no routes.
+func encodeDHCPRoutes(routes []dhcpRoute, router netip.Addr) ([]byte, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	if !slices.ContainsFunc(routes, func(r dhcpRoute) bool { return r.prefix.Bits() == 0 }) {
+		routes = append(routes[:len(routes):len(routes)], dhcpRoute{netip.PrefixFrom(netip.IPv4Unspecified(), 0), router})
+	}
+	var b []byte
+	for _, r := range routes {
+		if !r.prefix.Addr().Is4() || !r.gateway.Is4() {
+			return nil, fmt.Errorf("DHCP route to %v via %v isn't IPv4", r.prefix, r.gateway)
+		}
+		// The prefix length, then only its significant octets.
+		b = append(b, byte(r.prefix.Bits()))
+		b = append(b, r.prefix.Addr().AsSlice()[:(r.prefix.Bits()+7)/8]...)
+		b = append(b, r.gateway.AsSlice()...)
+	}
+	if len(b) > math.MaxUint8 {
+		return nil, errors.New("too many DHCP routes")
+	}
+	return b, nil
+}
+
+// isDHCPv6Request reports whether pkt is a DHCPv6 message from a client to
+// servers.
+func isDHCPv6Request(pkt gopacket.Packet) bool {
+	if pkt.Layer(layers.LayerTypeIPv6) == nil {
+		return false
+	}
+	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	return ok && udp.SrcPort == 546 && udp.DstPort == 547
+}
+
+// handleDHCPv6Request handles a DHCPv6 Solicit, Request, Renew, Rebind, or
+// Information-request from a node, replying with the node's dhcp6IP and the
+// fake DNS server.
+func (n *network) handleDHCPv6Request(ep EthernetPacket) {
+	req, ok := ep.gp.Layer(layers.LayerTypeDHCPv6).(*layers.DHCPv6)
+	if !ok {
+		return
+	}
+	node, ok := n.nodesByMAC.Load(ep.SrcMAC())
+	if !ok {
+		n.logf("DHCPv6 request from unknown node %v; ignoring", ep.SrcMAC())
+		return
+	}
+	res, err := n.createDHCPv6Response(ep, node, req)
+	if err != nil {
+		n.logf("createDHCPv6Response: %v", err)
+		return
+	}
+	if res == nil {
+		return
+	}
+	n.writeEth(res)
+	if req.MsgType == layers.DHCPv6MsgTypeRequest {
+		if hook := n.s.dhcpLeaseHook.Load(); hook != nil {
+			hook(node.mac, node.dhcp6IP)
+		}
+		n.s.obs.OnDHCPLease(node.mac, node.dhcp6IP)
+	}
+}
+
+// createDHCPv6Response creates the DHCPv6 Advertise or Reply for req from
+// node. It returns nil if req is a message type that gets no response.
+func (n *network) createDHCPv6Response(ep EthernetPacket, node *node, req *layers.DHCPv6) ([]byte, error) {
+	var msgType layers.DHCPv6MsgType
+	switch req.MsgType {
+	case layers.DHCPv6MsgTypeSolicit:
+		msgType = layers.DHCPv6MsgTypeAdverstise
+	case layers.DHCPv6MsgTypeRequest, layers.DHCPv6MsgTypeRenew, layers.DHCPv6MsgTypeRebind, layers.DHCPv6MsgTypeInformationRequest:
+		msgType = layers.DHCPv6MsgTypeReply
+	default:
+		n.logf("ignoring DHCPv6 %v from %v", req.MsgType, node)
+		return nil, nil
+	}
+
+	serverID := &layers.DHCPv6DUID{
+		Type:             layers.DHCPv6DUIDTypeLL,
+		HardwareType:     []byte{0, 1}, // Ethernet
+		LinkLayerAddress: n.mac.HWAddr(),
+	}
+	res := &layers.DHCPv6{
+		MsgType:       msgType,
+		TransactionID: req.TransactionID,
+		Options: layers.DHCPv6Options{
+			layers.NewDHCPv6Option(layers.DHCPv6OptServerID, serverID.Encode()),
+		},
+	}
+	for _, opt := range req.Options {
+		switch opt.Code {
+		case layers.DHCPv6OptClientID:
+			res.Options = append(res.Options, layers.NewDHCPv6Option(layers.DHCPv6OptClientID, opt.Data))
+		case layers.DHCPv6OptIANA:
+			if len(opt.Data) < 4 || req.MsgType == layers.DHCPv6MsgTypeInformationRequest {
+				continue
+			}
+			lease := n.dhcpLeaseSec
+			iaAddr := node.dhcp6IP.AsSlice()
+			iaAddr = binary.BigEndian.AppendUint32(iaAddr, lease) // preferred lifetime
+			iaAddr = binary.BigEndian.AppendUint32(iaAddr, lease) // valid lifetime
+
+			iana := slices.Clone(opt.Data[:4])                                    // IAID
+			iana = binary.BigEndian.AppendUint32(iana, lease/2)                   // T1
+			iana = binary.BigEndian.AppendUint32(iana, uint32(uint64(lease)*4/5)) // T2
+			iana = binary.BigEndian.AppendUint16(iana, uint16(layers.DHCPv6OptIAAddr))
+			iana = binary.BigEndian.AppendUint16(iana, uint16(len(iaAddr)))
+			iana = append(iana, iaAddr...)
+			res.Options = append(res.Options, layers.NewDHCPv6Option(layers.DHCPv6OptIANA, iana))
+		}
+	}
+	res.Options = append(res.Options, layers.NewDHCPv6Option(layers.DHCPv6OptDNSServers, n.s.vip(fakeDNS).v6.AsSlice()))
+
+	v6 := ep.gp.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	eth := &layers.Ethernet{
+		SrcMAC:       n.mac.HWAddr(),
+		DstMAC:       ep.SrcMAC().HWAddr(),
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      routerLinkLocalIP6.AsSlice(),
+		DstIP:      v6.SrcIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: 547,
+		DstPort: 546,
+	}
+	return mkPacket(eth, ip, udp, res)
+}
+
 // isDHCPRequest reports whether pkt is a DHCPv4 request.
 func isDHCPRequest(pkt gopacket.Packet) bool {
 	v4, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
@@ -1615,14 +3709,20 @@ func isDHCPRequest(pkt gopacket.Packet) bool {
 	return ok && udp.DstPort == 67 && udp.SrcPort == 68
 }
 
-func isIGMP(pkt gopacket.Packet) bool {
-	return pkt.Layer(layers.LayerTypeIGMP) != nil
-}
+var (
+	mdnsGroup4 = netip.MustParseAddr("224.0.0.251")
+	mdnsGroup6 = netip.MustParseAddr("ff02::fb")
+)
 
-func isMDNSQuery(pkt gopacket.Packet) bool {
+// isMDNS reports whether pkt is an mDNS query or response to the mDNS
+// multicast group.
+func isMDNS(pkt gopacket.Packet) bool {
 	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
-	// TODO(bradfitz): also check IPv4 DstIP=224.0.0.251 (or whatever)
-	return ok && udp.SrcPort == 5353 && udp.DstPort == 5353
+	if !ok || udp.SrcPort != 5353 || udp.DstPort != 5353 {
+		return false
+	}
+	f, ok := flow(pkt)
+	return ok && (f.dst == mdnsGroup4 || f.dst == mdnsGroup6)
 }
 
 func (s *Server) shouldInterceptTCP(pkt gopacket.Packet) bool {
@@ -1630,11 +3730,6 @@ func (s *Server) shouldInterceptTCP(pkt gopacket.Packet) bool {
 	if !ok {
 		return false
 	}
-	if tcp.DstPort == 123 {
-		// Test port for TCP interception. Not really useful, but cute for
-		// demos.
-		return true
-	}
 	flow, ok := flow(pkt)
 	if !ok {
 		return false
@@ -1642,24 +3737,55 @@ func (s *Server) shouldInterceptTCP(pkt gopacket.Packet) bool {
 	if flow.src.Is6() && flow.src.IsLinkLocalUnicast() {
 		return false
 	}
+	if _, ok := s.tcpHandlerFor(netip.AddrPortFrom(flow.dst, uint16(tcp.DstPort))); ok {
+		// Connection to a handler from Config.AddTCPHandler.
+		return true
+	}
 
 	if tcp.DstPort == 80 || tcp.DstPort == 443 {
-		for _, v := range []virtualIP{fakeControl, fakeDERP1, fakeDERP2, fakeLogCatcher} {
-			if v.Match(flow.dst) {
+		for _, v := range []virtualIP{fakeControl, fakeLogCatcher, fakeEcho} {
+			if s.vip(v).Match(flow.dst) {
 				return true
 			}
 		}
-		if fakeProxyControlplane.Match(flow.dst) {
+		if _, ok := s.derpServerFor(flow.dst); ok {
+			return true
+		}
+		if s.vip(fakeProxyControlplane).Match(flow.dst) {
 			return s.blendReality
 		}
 		if s.derpIPs.Contains(flow.dst) {
 			return true
 		}
 	}
-	if tcp.DstPort == 8008 && fakeTestAgent.Match(flow.dst) {
+	if tcp.DstPort == 443 && s.hasTLSServices(flow.dst) {
+		// Connection to a service from RegisterTLSService.
+		return true
+	}
+	if tcp.DstPort == 53 && s.vip(fakeDNS).Match(flow.dst) {
+		// DNS over TCP.
+		return true
+	}
+	if s.isSTUNServer(netip.AddrPortFrom(flow.dst, uint16(tcp.DstPort))) {
+		// STUN over TCP.
+		return true
+	}
+	if tcp.DstPort == 8008 && s.vip(fakeTestAgent).Match(flow.dst) {
 		// Connection from cmd/tta.
 		return true
 	}
+	if _, _, ok := s.tcpPortMapDst(netip.AddrPortFrom(flow.dst, uint16(tcp.DstPort))); ok {
+		// Connection to another network's port mapped TCP service.
+		return true
+	}
+	if _, ok := s.wanTCPServices.Load(netip.AddrPortFrom(flow.dst.Unmap(), uint16(tcp.DstPort))); ok {
+		// Connection to a service from RegisterWANService.
+		return true
+	}
+	if _, ok := s.subnetRoutes.Lookup(flow.dst); ok {
+		// Connection to a subnet routed by a node.
+		return true
+	}
 	return false
 }
 
@@ -1682,8 +3808,88 @@ func flow(gp gopacket.Packet) (f ipSrcDst, ok bool) {
 	return ipSrcDst{src: src, dst: dst}, src.IsValid() && dst.IsValid()
 }
 
+// dnsNameKey returns the canonical form of a DNS name: lowercase, without
+// a trailing dot.
+func dnsNameKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// lookupDNS returns the IPs of the DNS name, from either the built-in fakes or
+// the records added with Config.AddDNSRecord, with the pool.ntp.org names
+// otherwise resolving to the fake NTP server. It reports whether name exists.
+func (s *Server) lookupDNS(name string) (ips []netip.Addr, ok bool) {
+	name = dnsNameKey(name)
+	if v, ok := s.vips[name]; ok {
+		for _, ip := range []netip.Addr{v.v4, v.v6} {
+			if ip.IsValid() {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, true
+	}
+	if ips, ok := s.dnsRecords[name]; ok {
+		return ips, true
+	}
+	if name == "pool.ntp.org" || strings.HasSuffix(name, ".pool.ntp.org") {
+		// Guests' default NTP servers, such as 0.debian.pool.ntp.org, are
+		// the fake NTP server.
+		return s.lookupDNS(fakeNTP.name)
+	}
+	return nil, false
+}
+
+// lookupPTR returns the DNS name of ip, from either the built-in fakes or the
+// records added with Config.AddDNSRecord. If several names have ip, the
+// built-in fakes win, then the alphabetically first name.
+func (s *Server) lookupPTR(ip netip.Addr) (name string, ok bool) {
+	for _, name := range slices.Sorted(maps.Keys(s.vips)) {
+		if s.vips[name].Match(ip) {
+			return name, true
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.dnsRecords)) {
+		if slices.Contains(s.dnsRecords[name], ip) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// reverseDNSAddr returns the IP address that the reverse DNS name (such as
+// "3.0.52.52.in-addr.arpa" or "[...].ip6.arpa") is for, reporting whether name
+// is a valid reverse DNS name.
+func reverseDNSAddr(name string) (_ netip.Addr, ok bool) {
+	name = dnsNameKey(name)
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(rest, ".")
+		if len(octets) != 4 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(octets)
+		ip, err := netip.ParseAddr(strings.Join(octets, "."))
+		return ip, err == nil && ip.Is4()
+	}
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(rest, ".") // least significant first
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var a [16]byte
+		for i, nib := range nibbles {
+			v, err := strconv.ParseUint(nib, 16, 8)
+			if err != nil || len(nib) != 1 {
+				return netip.Addr{}, false
+			}
+			pos := 31 - i // nibble position, most significant first
+			a[pos/2] |= byte(v) << (4 * (1 - pos%2))
+		}
+		return netip.AddrFrom16(a), true
+	}
+	return netip.Addr{}, false
+}
+
 // isDNSRequest reports whether pkt is a DNS request to the fake DNS server.
-func isDNSRequest(pkt gopacket.Packet) bool {
+func (s *Server) isDNSRequest(pkt gopacket.Packet) bool {
 	udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
 	if !ok || udp.DstPort != 53 {
 		return false
@@ -1692,7 +3898,7 @@ func isDNSRequest(pkt gopacket.Packet) bool {
 	if !ok {
 		return false
 	}
-	if !fakeDNS.Match(f.dst) {
+	if !s.vip(fakeDNS).Match(f.dst) {
 		// TODO(bradfitz): maybe support configs where DNS is local in the LAN
 		return false
 	}
@@ -1704,19 +3910,12 @@ func isNATPMP(udp *layers.UDP) bool {
 	return udp.DstPort == 5351 && len(udp.Payload) > 0 && udp.Payload[0] == 0 // version 0, not 2 for PCP
 }
 
-func makeSTUNReply(req UDPPacket) (res UDPPacket, ok bool) {
-	txid, err := stun.ParseBindingRequest(req.Payload)
-	if err != nil {
-		log.Printf("invalid STUN request: %v", err)
-		return res, false
-	}
-	return UDPPacket{
-		Src:     req.Dst,
-		Dst:     req.Src,
-		Payload: stun.Response(txid, req.Src),
-	}, true
+func isPCP(udp *layers.UDP) bool {
+	return udp.DstPort == pcpPort && len(udp.Payload) > 0 && udp.Payload[0] == pcpVersion
 }
 
+// createDNSResponse creates the fake DNS server's response to the DNS query in
+// pkt, or nil if it shouldn't be answered.
 func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 	flow, ok := flow(pkt)
 	if !ok {
@@ -1726,47 +3925,142 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 	udpLayer := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
 	dnsLayer := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
 
-	if dnsLayer.OpCode != layers.DNSOpCodeQuery || dnsLayer.QR || len(dnsLayer.Questions) == 0 {
-		return nil, nil
+	response := s.dnsReply(dnsLayer)
+	if response == nil {
+		return nil, nil
+	}
+
+	// Make reply layers, all reversed.
+	eth2 := &layers.Ethernet{
+		SrcMAC: ethLayer.DstMAC,
+		DstMAC: ethLayer.SrcMAC,
+	}
+	ip2 := mkIPLayer(layers.IPProtocolUDP, flow.dst, flow.src)
+	udp2 := &layers.UDP{
+		SrcPort: udpLayer.DstPort,
+		DstPort: udpLayer.SrcPort,
+	}
+
+	resPkt, err := mkPacket(eth2, ip2, udp2, response)
+	if err != nil {
+		return nil, err
+	}
+
+	const debugDNS = false
+	if debugDNS {
+		if len(response.Answers) > 0 {
+			back := gopacket.NewPacket(resPkt, layers.LayerTypeEthernet, gopacket.Lazy)
+			log.Printf("createDNSResponse generated answers: %v", back)
+		} else {
+			log.Printf("made empty response for %v", response.Questions)
+		}
+	}
+
+	return resPkt, nil
+}
+
+// dnsReply returns the fake DNS server's reply to query, or nil if it
+// shouldn't be answered. It's shared by DNS over UDP and TCP.
+//
+// Names that don't exist get an NXDOMAIN response. Names that exist but have no
+// records of the queried type (such as AAAA for an IPv4-only name) get a
+// NOERROR response without answers, so resolvers don't cache the name as
+// nonexistent. Reverse DNS names of known IPs get PTR answers. CNAMEs are
+// followed, with each one in the answers, and loops get SERVFAIL.
+func (s *Server) dnsReply(query *layers.DNS) *layers.DNS {
+	if query.OpCode != layers.DNSOpCodeQuery || query.QR || len(query.Questions) == 0 {
+		return nil
 	}
 
 	response := &layers.DNS{
-		ID:           dnsLayer.ID,
+		ID:           query.ID,
 		QR:           true,
 		AA:           true,
 		TC:           false,
-		RD:           dnsLayer.RD,
+		RD:           query.RD,
 		RA:           true,
 		OpCode:       layers.DNSOpCodeQuery,
 		ResponseCode: layers.DNSResponseCodeNoErr,
 	}
 
-	var names []string
-	for _, q := range dnsLayer.Questions {
+	for _, q := range query.Questions {
 		response.QDCount++
 		response.Questions = append(response.Questions, q)
 
-		if mem.HasSuffix(mem.B(q.Name), mem.S(".pool.ntp.org")) {
-			// Just drop DNS queries for NTP servers. For Debian/etc guests used
-			// during development. Not needed. Assume VM guests get correct time
-			// via their hypervisor.
-			return nil, nil
+		if q.Class != layers.DNSClassIN {
+			continue
 		}
 
-		names = append(names, q.Type.String()+"/"+string(q.Name))
-		if q.Class != layers.DNSClassIN {
+		if ip, ok := reverseDNSAddr(string(q.Name)); ok {
+			host, ok := s.lookupPTR(ip)
+			if !ok {
+				response.ResponseCode = layers.DNSResponseCodeNXDomain
+				continue
+			}
+			if q.Type == layers.DNSTypePTR {
+				response.ANCount++
+				response.Answers = append(response.Answers, layers.DNSResourceRecord{
+					Name:  q.Name,
+					Type:  q.Type,
+					Class: q.Class,
+					PTR:   []byte(host),
+					TTL:   60,
+				})
+			}
 			continue
 		}
 
+		// Follow any CNAMEs, answering with each, unless the CNAME itself
+		// was asked for.
+		name := q.Name
+		for hops := 0; q.Type != layers.DNSTypeCNAME; hops++ {
+			target, ok := s.dnsCNAMEs[dnsNameKey(string(name))]
+			if !ok {
+				break
+			}
+			if hops == maxCNAMEChain {
+				// Too long, or a loop. Don't return the partial chain.
+				response.ResponseCode = layers.DNSResponseCodeServFail
+				response.Answers = nil
+				response.ANCount = 0
+				return response
+			}
+			response.ANCount++
+			response.Answers = append(response.Answers, layers.DNSResourceRecord{
+				Name:  name,
+				Type:  layers.DNSTypeCNAME,
+				Class: q.Class,
+				CNAME: []byte(target),
+				TTL:   60,
+			})
+			name = []byte(target)
+		}
+
+		if target, ok := s.dnsCNAMEs[dnsNameKey(string(name))]; ok {
+			// A CNAME query.
+			response.ANCount++
+			response.Answers = append(response.Answers, layers.DNSResourceRecord{
+				Name:  name,
+				Type:  q.Type,
+				Class: q.Class,
+				CNAME: []byte(target),
+				TTL:   60,
+			})
+			continue
+		}
+		ips, ok := s.lookupDNS(string(name))
+		if !ok {
+			response.ResponseCode = layers.DNSResponseCodeNXDomain
+			continue
+		}
 		if q.Type == layers.DNSTypeA || q.Type == layers.DNSTypeAAAA {
-			if v, ok := vips[string(q.Name)]; ok {
-				ip := v.v4
-				if q.Type == layers.DNSTypeAAAA {
-					ip = v.v6
+			for _, ip := range ips {
+				if ip.Is4() != (q.Type == layers.DNSTypeA) {
+					continue
 				}
 				response.ANCount++
 				response.Answers = append(response.Answers, layers.DNSResourceRecord{
-					Name:  q.Name,
+					Name:  name,
 					Type:  q.Type,
 					Class: q.Class,
 					IP:    ip.AsSlice(),
@@ -1775,34 +4069,96 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 			}
 		}
 	}
+	return response
+}
 
-	// Make reply layers, all reversed.
-	eth2 := &layers.Ethernet{
-		SrcMAC: ethLayer.DstMAC,
-		DstMAC: ethLayer.SrcMAC,
-	}
-	ip2 := mkIPLayer(layers.IPProtocolUDP, flow.dst, flow.src)
-	udp2 := &layers.UDP{
-		SrcPort: udpLayer.DstPort,
-		DstPort: udpLayer.SrcPort,
+// maxCNAMEChain is the most CNAMEs the fake DNS server follows to answer a
+// query before giving up with SERVFAIL.
+const maxCNAMEChain = 8
+
+// dnsTimer is a pending UDP DNS reply; see network.writeEthAfterDNSLatency.
+type dnsTimer struct {
+	tc tstime.TimerController
+}
+
+// writeEthAfterDNSLatency writes the DNS reply res after the Server's DNS
+// latency, unless the Server is closed first.
+func (n *network) writeEthAfterDNSLatency(res []byte) {
+	s := n.s
+	s.dnsTimersMu.Lock()
+	defer s.dnsTimersMu.Unlock()
+	if s.shuttingDown.Load() {
+		return
 	}
+	t := new(dnsTimer)
+	t.tc = s.clock.AfterFunc(s.dnsLatency, func() {
+		s.dnsTimersMu.Lock()
+		pending := s.dnsTimers.Contains(t)
+		s.dnsTimers.Delete(t)
+		s.dnsTimersMu.Unlock()
+		if pending {
+			n.writeEth(res)
+		}
+	})
+	s.dnsTimers.Make()
+	s.dnsTimers.Add(t)
+}
 
-	resPkt, err := mkPacket(eth2, ip2, udp2, response)
-	if err != nil {
-		return nil, err
+// stopDNSTimers stops the timers of all pending UDP DNS replies.
+func (s *Server) stopDNSTimers() {
+	s.dnsTimersMu.Lock()
+	timers := s.dnsTimers
+	s.dnsTimers = nil
+	s.dnsTimersMu.Unlock()
+	// Stopped outside of dnsTimersMu, as a fake clock may hold its own
+	// lock while running a timer's func, which takes dnsTimersMu.
+	for t := range timers {
+		t.tc.Stop()
 	}
+}
 
-	const debugDNS = false
-	if debugDNS {
-		if len(response.Answers) > 0 {
-			back := gopacket.NewPacket(resPkt, layers.LayerTypeEthernet, gopacket.Lazy)
-			log.Printf("createDNSResponse generated answers: %v", back)
-		} else {
-			log.Printf("made empty response for %q", names)
+// serveDNSTCPConn serves DNS over TCP (RFC 7766) on c, answering each 2-byte
+// length-prefixed query like DNS over UDP, until c is closed.
+func (s *Server) serveDNSTCPConn(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		var size uint16
+		if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return
+		}
+		var query layers.DNS
+		if err := query.DecodeFromBytes(msg, gopacket.NilDecodeFeedback); err != nil {
+			s.logf("DNS over TCP: bad query: %v", err)
+			return
+		}
+		response := s.dnsReply(&query)
+		if response == nil {
+			continue
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := response.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			s.logf("DNS over TCP: serializing response: %v", err)
+			return
+		}
+		if s.dnsLatency > 0 {
+			tc, timerC := s.clock.NewTimer(s.dnsLatency)
+			select {
+			case <-timerC:
+			case <-s.shutdownCtx.Done():
+				tc.Stop()
+				return
+			}
+		}
+		res := binary.BigEndian.AppendUint16(nil, uint16(len(buf.Bytes())))
+		if _, err := c.Write(append(res, buf.Bytes()...)); err != nil {
+			return
 		}
 	}
-
-	return resPkt, nil
 }
 
 // doNATOut performs NAT on an outgoing packet from src to dst, where
@@ -1813,7 +4169,9 @@ func (s *Server) createDNSResponse(pkt gopacket.Packet) ([]byte, error) {
 // If newSrc is invalid, the packet should be dropped.
 func (n *network) doNATOut(src, dst netip.AddrPort) (newSrc netip.AddrPort) {
 	if src.Addr().Is6() {
-		// TODO(bradfitz): IPv6 NAT? For now, normal IPv6 only.
+		if n.npt6 && n.lanIP6.Contains(src.Addr()) {
+			return netip.AddrPortFrom(translatePrefix6(src.Addr(), n.wanIP6), src.Port())
+		}
 		return src
 	}
 
@@ -1822,16 +4180,29 @@ func (n *network) doNATOut(src, dst netip.AddrPort) (newSrc netip.AddrPort) {
 
 	// First see if there's a port mapping, before doing NAT.
 	if wanAP, ok := n.portMapFlow[portmapFlowKey{
+		proto:   layers.IPProtocolUDP,
 		peerWAN: dst,
 		lanAP:   src,
 	}]; ok {
 		return wanAP
 	}
 
-	return n.natTable.PickOutgoingSrc(src, dst, time.Now())
+	return n.natTable.PickOutgoingSrc(src, dst, n.s.clock.Now())
+}
+
+// translatePrefix6 returns ip with its /64 network prefix replaced by that of
+// pfx, keeping its interface identifier, as NPTv6 (RFC 6296) does. Unlike
+// RFC 6296's checksum-neutral mapping, the rest of the address is unchanged;
+// the router recomputes checksums anyway.
+func translatePrefix6(ip netip.Addr, pfx netip.Prefix) netip.Addr {
+	a := ip.As16()
+	p := pfx.Addr().As16()
+	copy(a[:8], p[:8])
+	return netip.AddrFrom16(a)
 }
 
 type portmapFlowKey struct {
+	proto   layers.IPProtocol
 	peerWAN netip.AddrPort // the peer's WAN ip:port
 	lanAP   netip.AddrPort
 }
@@ -1842,19 +4213,23 @@ type portmapFlowKey struct {
 // If newDst is invalid, the packet should be dropped.
 func (n *network) doNATIn(src, dst netip.AddrPort) (newDst netip.AddrPort) {
 	if dst.Addr().Is6() {
-		// TODO(bradfitz): IPv6 NAT? For now, normal IPv6 only.
+		if n.npt6 && n.wanIP6.Contains(dst.Addr()) {
+			return netip.AddrPortFrom(translatePrefix6(dst.Addr(), n.lanIP6), dst.Port())
+		}
 		return dst
 	}
 
 	n.natMu.Lock()
 	defer n.natMu.Unlock()
 
-	now := time.Now()
+	now := n.s.clock.Now()
 
 	// First see if there's a port mapping, before doing NAT.
-	if lanAP, ok := n.portMap[dst]; ok {
+	pmk := portMapKey{layers.IPProtocolUDP, dst}
+	if lanAP, ok := n.portMap[pmk]; ok {
 		if now.Before(lanAP.expiry) {
 			mak.Set(&n.portMapFlow, portmapFlowKey{
+				proto:   layers.IPProtocolUDP,
 				peerWAN: src,
 				lanAP:   lanAP.dst,
 			}, dst)
@@ -1862,67 +4237,236 @@ func (n *network) doNATIn(src, dst netip.AddrPort) (newDst netip.AddrPort) {
 			return lanAP.dst
 		}
 		n.logf("NAT: doNatIn: port mapping EXPIRED for %v=>%v", dst, lanAP.dst)
-		delete(n.portMap, dst)
+		delete(n.portMap, pmk)
 		return netip.AddrPort{}
 	}
 
 	return n.natTable.PickIncomingDst(src, dst, now)
 }
 
-// IsPublicPortUsed reports whether the given public port is currently in use.
+// IsPublicPortUsed reports whether the given public UDP port is currently in
+// use.
 //
 // n.natMu must be held by the caller. (It's only called by nat implementations
 // which are always called with natMu held))
 func (n *network) IsPublicPortUsed(ap netip.AddrPort) bool {
-	_, ok := n.portMap[ap]
+	_, ok := n.portMap[portMapKey{layers.IPProtocolUDP, ap}]
 	return ok
 }
 
-func (n *network) doPortMap(src netip.Addr, dstLANPort, wantExtPort uint16, sec int) (gotPort uint16, ok bool) {
+// isPublicPortUsedLocked reports whether the given public port is in use for
+// proto, either by the NAT (for UDP) or by an unexpired port mapping or
+// static port forward.
+//
+// n.natMu must be held.
+func (n *network) isPublicPortUsedLocked(proto layers.IPProtocol, ap netip.AddrPort) bool {
+	if proto == layers.IPProtocolUDP && n.natTable.IsPublicPortUsed(ap) {
+		return true
+	}
+	pm, ok := n.portMap[portMapKey{proto, ap}]
+	return ok && n.s.clock.Now().Before(pm.expiry)
+}
+
+// doPortMap creates, extends or (if sec is 0) deletes a port mapping for
+// proto (UDP or TCP) from the router's WAN IP to the LAN ip:port
+// src:dstLANPort. Deletions ignore wantExtPort, as NAT-PMP and PCP clients
+// identify the mapping to delete by its internal port and protocol alone
+// (RFC 6886, section 3.4; RFC 6887, section 15).
+func (n *network) doPortMap(proto layers.IPProtocol, src netip.Addr, dstLANPort, wantExtPort uint16, sec int) (gotPort uint16, ok bool) {
 	n.natMu.Lock()
 	defer n.natMu.Unlock()
 
-	if !n.portmap {
+	if !n.portmap && !n.pcp && !n.upnp {
 		return 0, false
 	}
 
-	wanAP := netip.AddrPortFrom(n.wanIP4, wantExtPort)
+	wanAP := netip.AddrPortFrom(n.WANIP(), wantExtPort)
 	dst := netip.AddrPortFrom(src, dstLANPort)
 
 	if sec == 0 {
-		lanAP, ok := n.portMap[wanAP]
-		if ok && lanAP.dst.Addr() == src {
-			delete(n.portMap, wanAP)
+		for k, v := range n.portMap {
+			if k.proto == proto && v.dst == dst && v.expiry != noExpiry {
+				delete(n.portMap, k)
+				n.s.obs.OnPortMap(proto.String(), k.wanAP, v.dst, 0)
+			}
 		}
 		return 0, false
 	}
 
 	// See if they already have a mapping and extend expiry if so.
 	for k, v := range n.portMap {
-		if v.dst == dst {
+		if k.proto == proto && v.dst == dst {
+			if v.expiry == noExpiry {
+				// A static port forward already covers it.
+				return k.wanAP.Port(), true
+			}
 			n.portMap[k] = portMapping{
 				dst:    dst,
-				expiry: time.Now().Add(time.Duration(sec) * time.Second),
+				expiry: n.s.clock.Now().Add(time.Duration(sec) * time.Second),
 			}
-			return k.Port(), true
+			n.s.obs.OnPortMap(proto.String(), k.wanAP, dst, time.Duration(sec)*time.Second)
+			return k.wanAP.Port(), true
 		}
 	}
 
 	for try := 0; try < 20_000; try++ {
-		if wanAP.Port() > 0 && !n.natTable.IsPublicPortUsed(wanAP) {
-			mak.Set(&n.portMap, wanAP, portMapping{
+		if wanAP.Port() > 0 && !n.isPublicPortUsedLocked(proto, wanAP) {
+			mak.Set(&n.portMap, portMapKey{proto, wanAP}, portMapping{
 				dst:    dst,
-				expiry: time.Now().Add(time.Duration(sec) * time.Second),
+				expiry: n.s.clock.Now().Add(time.Duration(sec) * time.Second),
 			})
-			n.logf("vnet: allocated NAT mapping from %v to %v", wanAP, dst)
+			n.logf("vnet: allocated %v NAT mapping from %v to %v", proto, wanAP, dst)
+			n.s.obs.OnPortMap(proto.String(), wanAP, dst, time.Duration(sec)*time.Second)
 			return wanAP.Port(), true
 		}
-		wantExtPort = rand.N(uint16(32<<10)) + 32<<10
-		wanAP = netip.AddrPortFrom(n.wanIP4, wantExtPort)
+		wantExtPort = n.s.rng.Uint16N(32<<10) + 32<<10
+		wanAP = netip.AddrPortFrom(n.WANIP(), wantExtPort)
 	}
 	return 0, false
 }
 
+// doExactPortMap creates or extends a port mapping for proto from the
+// router's WAN IP and port extPort to the LAN ip:port src:dstLANPort, as
+// doPortMap does, but fails rather than picking another port if extPort is
+// used by anything other than an existing mapping to the same LAN ip:port.
+//
+// As with doPortMap, a LAN ip:port has at most one mapping per protocol, so
+// a mapping on another port to src:dstLANPort is replaced. It fails if that
+// mapping is a static port forward.
+func (n *network) doExactPortMap(proto layers.IPProtocol, src netip.Addr, dstLANPort, extPort uint16, sec int) (ok bool) {
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+
+	if !n.portmap && !n.pcp && !n.upnp {
+		return false
+	}
+
+	wanAP := netip.AddrPortFrom(n.WANIP(), extPort)
+	dst := netip.AddrPortFrom(src, dstLANPort)
+	k := portMapKey{proto, wanAP}
+	if pm, ok := n.portMap[k]; ok && n.s.clock.Now().Before(pm.expiry) {
+		if pm.dst != dst || pm.expiry == noExpiry {
+			return false
+		}
+	} else if n.isPublicPortUsedLocked(proto, wanAP) {
+		return false
+	}
+	var replaced []portMapKey
+	for ek, v := range n.portMap {
+		if ek.proto == proto && v.dst == dst && ek != k {
+			if v.expiry == noExpiry {
+				return false
+			}
+			replaced = append(replaced, ek)
+		}
+	}
+	for _, ek := range replaced {
+		delete(n.portMap, ek)
+		n.s.obs.OnPortMap(proto.String(), ek.wanAP, dst, 0)
+	}
+	mak.Set(&n.portMap, k, portMapping{
+		dst:    dst,
+		expiry: n.s.clock.Now().Add(time.Duration(sec) * time.Second),
+	})
+	n.logf("vnet: allocated %v NAT mapping from %v to %v", proto, wanAP, dst)
+	n.s.obs.OnPortMap(proto.String(), wanAP, dst, time.Duration(sec)*time.Second)
+	return true
+}
+
+// lookupPortMap returns the LAN ip:port that the unexpired proto port
+// mapping on the WAN ip:port wanAP points to, if any.
+func (n *network) lookupPortMap(proto layers.IPProtocol, wanAP netip.AddrPort) (lanAP netip.AddrPort, ok bool) {
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+	pm, ok := n.portMap[portMapKey{proto, wanAP}]
+	if !ok || !n.s.clock.Now().Before(pm.expiry) {
+		return netip.AddrPort{}, false
+	}
+	return pm.dst, true
+}
+
+// tcpPortMapDst returns the network and LAN ip:port that a TCP connection to
+// the WAN ip:port dst should be forwarded to, if dst is a network's WAN
+// address with a TCP port mapping.
+func (s *Server) tcpPortMapDst(dst netip.AddrPort) (_ *network, lanAP netip.AddrPort, ok bool) {
+	netw, ok := s.networkByWAN.Load().Lookup(dst.Addr())
+	if !ok || netw.WANIP() != dst.Addr() {
+		return nil, netip.AddrPort{}, false
+	}
+	lanAP, ok = netw.lookupPortMap(layers.IPProtocolTCP, dst)
+	return netw, lanAP, ok
+}
+
+// DialTCPFromInternet makes a TCP connection from the internet ip:port src
+// to the ip:port dst, which must be a network's WAN IPv4 and a port with a TCP
+// port forward or port mapping. The connection is DNATed to the LAN service
+// the port points at, which sees it as coming from src.
+//
+// If src's port is zero, a random one is used.
+func (s *Server) DialTCPFromInternet(ctx context.Context, src, dst netip.AddrPort) (net.Conn, error) {
+	if !src.Addr().Is4() {
+		return nil, fmt.Errorf("source %v is not IPv4", src)
+	}
+	netw, lanAP, ok := s.tcpPortMapDst(dst)
+	if !ok {
+		return nil, fmt.Errorf("no TCP port forward or mapping for %v", dst)
+	}
+	if netw.breakWAN4 {
+		return nil, fmt.Errorf("network %d has broken WAN IPv4", netw.num)
+	}
+	if src.Port() == 0 {
+		src = netip.AddrPortFrom(src.Addr(), s.rng.Uint16N(16<<10)+49152)
+	}
+	if !netw.firewallInbound("TCP", src, lanAP) {
+		return nil, fmt.Errorf("network %d's firewall blocks %v => %v", netw.num, src, lanAP)
+	}
+	if _, loaded := netw.inboundTCPPeers.LoadOrStore(src, true); loaded {
+		return nil, fmt.Errorf("connection from %v already in use", src)
+	}
+	forget := sync.OnceFunc(func() {
+		// Give the LAN side time to finish closing before its packets to
+		// src stop being handled.
+		s.clock.AfterFunc(time.Minute, func() { netw.inboundTCPPeers.Delete(src) })
+	})
+
+	// The router's netstack allows spoofing, so bind to src so the LAN
+	// service sees the internet address.
+	c, err := gonet.DialTCPWithBind(ctx, netw.ns, tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFrom4(src.Addr().As4()),
+		Port: src.Port(),
+	}, tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFrom4(lanAP.Addr().As4()),
+		Port: lanAP.Port(),
+	}, ipv4.ProtocolNumber)
+	if err != nil {
+		forget()
+		return nil, err
+	}
+	return &closeFuncConn{Conn: c, onClose: forget}, nil
+}
+
+// closeFuncConn is a net.Conn that calls onClose when closed.
+type closeFuncConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *closeFuncConn) Close() error {
+	c.onClose()
+	return c.Conn.Close()
+}
+
+// dialLANTCP dials the LAN ip:port lanAP from the router's netstack.
+func (n *network) dialLANTCP(ctx context.Context, lanAP netip.AddrPort) (net.Conn, error) {
+	return gonet.DialContextTCP(ctx, n.ns, tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFrom4(lanAP.Addr().As4()),
+		Port: lanAP.Port(),
+	}, ipv4.ProtocolNumber)
+}
+
 func (n *network) createARPResponse(pkt gopacket.Packet) ([]byte, error) {
 	ethLayer, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
 	if !ok {
@@ -1941,6 +4485,9 @@ func (n *network) createARPResponse(pkt gopacket.Packet) ([]byte, error) {
 
 	wantIP := netip.AddrFrom4([4]byte(arpLayer.DstProtAddress))
 	foundMAC, ok := n.MACOfIP(wantIP)
+	if !ok && n.proxyARP && n.routesOffLink(wantIP) {
+		foundMAC, ok = n.mac, true
+	}
 	if !ok {
 		return nil, nil
 	}
@@ -1972,36 +4519,31 @@ func (n *network) createARPResponse(pkt gopacket.Packet) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// routesOffLink reports whether ip is an IPv4 address off the LAN that the
+// router would route packets to, for proxy ARP.
+func (n *network) routesOffLink(ip netip.Addr) bool {
+	return n.v4 && ip.Is4() && ip.IsGlobalUnicast() && !n.lanIP4.Contains(ip)
+}
+
 func (n *network) handleNATPMPRequest(req UDPPacket) {
 	if !n.portmap {
 		return
 	}
 	if string(req.Payload) == "\x00\x00" {
-		// https://www.rfc-editor.org/rfc/rfc6886#section-3.2
-
-		res := make([]byte, 0, 12)
-		res = append(res,
-			0,    // version 0 (NAT-PMP)
-			128,  // response to op 0 (128+0)
-			0, 0, // result code success
-		)
-		res = binary.BigEndian.AppendUint32(res, uint32(time.Now().Unix()))
-		wan4 := n.wanIP4.As4()
-		res = append(res, wan4[:]...)
 		n.WriteUDPPacketNoNAT(UDPPacket{
 			Src:     req.Dst,
 			Dst:     req.Src,
-			Payload: res,
+			Payload: n.natPMPExternalAddressResponse(),
 		})
 		return
 	}
 
-	// Map UDP request
-	if len(req.Payload) == 12 && req.Payload[0] == 0 && req.Payload[1] == 1 {
+	// Map UDP or TCP request
+	if len(req.Payload) == 12 && req.Payload[0] == 0 && (req.Payload[1] == 1 || req.Payload[1] == 2) {
 		// https://www.rfc-editor.org/rfc/rfc6886#section-3.3
 		// "00 01 00 00 ed 40 00 00 00 00 1c 20" =>
 		//   00 ver
-		//   01 op=map UDP
+		//   01 op=map UDP (02 for TCP)
 		//   00 00 reserved  (0 in request; in response, this is the result code)
 		//   ed 40 internal port 60736
 		//   00 00 suggested external port
@@ -2009,18 +4551,23 @@ func (n *network) handleNATPMPRequest(req UDPPacket) {
 		internalPort := binary.BigEndian.Uint16(req.Payload[4:6])
 		wantExtPort := binary.BigEndian.Uint16(req.Payload[6:8])
 		lifetimeSec := binary.BigEndian.Uint32(req.Payload[8:12])
-		gotPort, ok := n.doPortMap(req.Src.Addr(), internalPort, wantExtPort, int(lifetimeSec))
+		op := req.Payload[1]
+		proto := layers.IPProtocolUDP
+		if op == 2 {
+			proto = layers.IPProtocolTCP
+		}
+		gotPort, ok := n.doPortMap(proto, req.Src.Addr(), internalPort, wantExtPort, int(lifetimeSec))
 		if !ok {
-			n.logf("NAT-PMP map request for %v:%d failed", req.Src.Addr(), internalPort)
+			n.logf("NAT-PMP map request for %v %v:%d failed", proto, req.Src.Addr(), internalPort)
 			return
 		}
 		res := make([]byte, 0, 16)
 		res = append(res,
-			0,     // version 0 (NAT-PMP)
-			1+128, // response to op 1
-			0, 0,  // result code success
+			0,      // version 0 (NAT-PMP)
+			op+128, // response to op 1 or 2
+			0, 0,   // result code success
 		)
-		res = binary.BigEndian.AppendUint32(res, uint32(time.Now().Unix()))
+		res = binary.BigEndian.AppendUint32(res, uint32(n.s.clock.Now().Unix()))
 		res = binary.BigEndian.AppendUint16(res, internalPort)
 		res = binary.BigEndian.AppendUint16(res, gotPort)
 		res = binary.BigEndian.AppendUint32(res, lifetimeSec)
@@ -2035,6 +4582,164 @@ func (n *network) handleNATPMPRequest(req UDPPacket) {
 	n.logf("TODO: handle NAT-PMP packet % 02x", req.Payload)
 }
 
+// natPMPExternalAddressResponse returns the NAT-PMP response to an external
+// address request, which is also what the router multicasts when the address
+// changes.
+//
+// https://www.rfc-editor.org/rfc/rfc6886#section-3.2
+func (n *network) natPMPExternalAddressResponse() []byte {
+	res := make([]byte, 0, 12)
+	res = append(res,
+		0,    // version 0 (NAT-PMP)
+		128,  // response to op 0 (128+0)
+		0, 0, // result code success
+	)
+	res = binary.BigEndian.AppendUint32(res, uint32(n.s.clock.Now().Unix()))
+	wan4 := n.WANIP().As4()
+	return append(res, wan4[:]...)
+}
+
+// announceNATPMPExternalAddress multicasts the router's external address to
+// the all-hosts group on the LAN, as a NAT-PMP router does when the address
+// changes, if the network does port mapping.
+//
+// https://www.rfc-editor.org/rfc/rfc6886#section-3.2.1
+func (n *network) announceNATPMPExternalAddress() {
+	if !n.portmap || !n.v4 {
+		return
+	}
+	pkt, err := n.serializedUDPPacket(
+		netip.AddrPortFrom(n.lanIP4.Addr(), pcpPort),
+		netip.AddrPortFrom(netip.AddrFrom4([4]byte{224, 0, 0, 1}), 5350),
+		n.natPMPExternalAddressResponse(),
+		&layers.Ethernet{
+			SrcMAC:       n.mac.HWAddr(),
+			DstMAC:       net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01},
+			EthernetType: layers.EthernetTypeIPv4,
+		})
+	if err != nil {
+		n.logf("serializing NAT-PMP announcement: %v", err)
+		return
+	}
+	n.writeEth(pkt)
+}
+
+// PCP (RFC 6887) constants.
+const (
+	pcpVersion   = 2
+	pcpHeaderLen = 24 // common request and response header
+	pcpMapLen    = 36 // MAP opcode-specific request and response data
+
+	pcpOpReply    = 0x80 // OR'd into the request's opcode in responses
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pcpCodeOK               = 0
+	pcpCodeMalformedRequest = 3
+	pcpCodeUnsuppOpcode     = 4
+	pcpCodeNoResources      = 8
+	pcpCodeUnsuppProtocol   = 9
+	pcpCodeAddressMismatch  = 12
+
+	// pcpErrorLifetimeSec is how long clients should consider our error
+	// responses valid for.
+	pcpErrorLifetimeSec = 30
+)
+
+// handlePCPRequest handles a PCP request to the router.
+//
+// Only the ANNOUNCE and MAP opcodes are supported, and MAP only for UDP and
+// TCP.
+// PCP options are ignored.
+func (n *network) handlePCPRequest(req UDPPacket) {
+	if !n.pcp {
+		return
+	}
+	p := req.Payload
+	if len(p) < 2 || p[1]&pcpOpReply != 0 {
+		// Too short to reply to, or a response, which isn't for us.
+		return
+	}
+	reply := func(code uint8, lifetimeSec uint32, opData []byte) {
+		// https://www.rfc-editor.org/rfc/rfc6887#section-7.2
+		res := make([]byte, pcpHeaderLen, pcpHeaderLen+len(opData))
+		res[0] = pcpVersion
+		res[1] = p[1] | pcpOpReply
+		res[3] = code
+		binary.BigEndian.PutUint32(res[4:], lifetimeSec)
+		binary.BigEndian.PutUint32(res[8:], uint32(n.s.clock.Now().Unix()))
+		res = append(res, opData...)
+		n.WriteUDPPacketNoNAT(UDPPacket{
+			Src:     req.Dst,
+			Dst:     req.Src,
+			Payload: res,
+		})
+	}
+	if len(p) < pcpHeaderLen || len(p)%4 != 0 {
+		reply(pcpCodeMalformedRequest, pcpErrorLifetimeSec, nil)
+		return
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc6887#section-7.1
+	//   00    version (2)
+	//   01    R bit (0 for requests) and opcode
+	//   02-03 reserved
+	//   04-07 requested lifetime in seconds
+	//   08-23 PCP client's IP address, IPv4-mapped for IPv4
+	//   24-   opcode-specific data, then options
+	op := p[1]
+	lifetimeSec := binary.BigEndian.Uint32(p[4:8])
+	clientIP := netip.AddrFrom16([16]byte(p[8:24])).Unmap()
+	if clientIP != req.Src.Addr() {
+		reply(pcpCodeAddressMismatch, pcpErrorLifetimeSec, p[pcpHeaderLen:])
+		return
+	}
+
+	switch op {
+	case pcpOpAnnounce:
+		reply(pcpCodeOK, 0, nil)
+	case pcpOpMap:
+		if len(p) < pcpHeaderLen+pcpMapLen {
+			reply(pcpCodeMalformedRequest, pcpErrorLifetimeSec, nil)
+			return
+		}
+		// https://www.rfc-editor.org/rfc/rfc6887#section-11.1
+		//   00-11 mapping nonce
+		//   12    protocol (17 for UDP, 6 for TCP)
+		//   13-15 reserved
+		//   16-17 internal port
+		//   18-19 suggested external port (assigned external port in response)
+		//   20-35 suggested external IP (assigned external IP in response)
+		//
+		// The response echoes the nonce, protocol, and internal port.
+		opData := slices.Clone(p[pcpHeaderLen : pcpHeaderLen+pcpMapLen])
+		proto := layers.IPProtocol(opData[12])
+		internalPort := binary.BigEndian.Uint16(opData[16:18])
+		wantExtPort := binary.BigEndian.Uint16(opData[18:20])
+		if proto != layers.IPProtocolUDP && proto != layers.IPProtocolTCP {
+			reply(pcpCodeUnsuppProtocol, pcpErrorLifetimeSec, opData)
+			return
+		}
+		gotPort, ok := n.doPortMap(proto, req.Src.Addr(), internalPort, wantExtPort, int(lifetimeSec))
+		if lifetimeSec == 0 {
+			// Mapping deleted.
+			reply(pcpCodeOK, 0, opData)
+			return
+		}
+		if !ok {
+			n.logf("PCP map request for %v:%d failed", req.Src.Addr(), internalPort)
+			reply(pcpCodeNoResources, pcpErrorLifetimeSec, opData)
+			return
+		}
+		binary.BigEndian.PutUint16(opData[18:20], gotPort)
+		wan16 := n.WANIP().As16() // IPv4-mapped
+		copy(opData[20:36], wan16[:])
+		reply(pcpCodeOK, lifetimeSec, opData)
+	default:
+		reply(pcpCodeUnsuppOpcode, pcpErrorLifetimeSec, p[pcpHeaderLen:])
+	}
+}
+
 // UDPPacket is a UDP packet.
 //
 // For the purposes of this project, a UDP packet
@@ -2044,14 +4749,87 @@ type UDPPacket struct {
 	Src     netip.AddrPort
 	Dst     netip.AddrPort
 	Payload []byte // everything after UDP header
+
+	srcNode *node // the node that sent it, if it came from one
 }
 
 func (s *Server) WriteStartingBanner(w io.Writer) {
 	fmt.Fprintf(w, "vnet serving clients:\n")
 
-	for _, n := range s.nodes {
-		fmt.Fprintf(w, "  %v %15v (%v, %v)\n", n.mac, n.lanIP, n.net.wanIP4, n.net.natStyle.Load())
+	top := s.Topology()
+	for _, n := range top.Nodes {
+		nw, _ := top.Network(n.Network)
+		fmt.Fprintf(w, "  %v %15v (%v, %v)", n.MAC, n.LANIP, nw.WANIP4, nw.NAT)
+		if n.Hostname != "" {
+			fmt.Fprintf(w, " %s", n.Hostname)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// TopologyInfo describes the networks and nodes of a Server. It's the
+// structured form of what WriteStartingBanner prints.
+type TopologyInfo struct {
+	Networks []NetworkInfo // ordered by network number
+	Nodes    []NodeInfo    // ordered by node number
+}
+
+// Network returns the network numbered num. Networks are numbered in the
+// order they're added, and removing one doesn't renumber the others, so num
+// isn't necessarily an index into t.Networks.
+func (t TopologyInfo) Network(num int) (_ NetworkInfo, ok bool) {
+	i, ok := slices.BinarySearchFunc(t.Networks, num, func(ni NetworkInfo, num int) int {
+		return cmp.Compare(ni.Num, num)
+	})
+	if !ok {
+		return NetworkInfo{}, false
+	}
+	return t.Networks[i], true
+}
+
+// NetworkInfo describes a network in a TopologyInfo.
+type NetworkInfo struct {
+	Num    int          // 1-based network number
+	MAC    MAC          // of the router
+	LANIP4 netip.Prefix // router's LAN IPv4 + CIDR, if any
+	WANIP4 netip.Addr   // router's WAN IPv4, if any
+	WANIP6 netip.Prefix // router's WAN IPv6 /64, if any
+	NAT    NAT          // current NAT style
+}
+
+// NodeInfo describes a node in a TopologyInfo.
+type NodeInfo struct {
+	Num      int        // 1-based node number
+	MAC      MAC        // of the node
+	LANIP    netip.Addr // LAN IPv4, if any
+	Network  int        // number of the node's network; see TopologyInfo.Network
+	Hostname string     // hostname the node sent via DHCP, if any yet
+}
+
+// Topology returns a description of s's networks and nodes.
+func (s *Server) Topology() TopologyInfo {
+	var top TopologyInfo
+	for _, n := range s.allNetworks() {
+		top.Networks = append(top.Networks, NetworkInfo{
+			Num:    n.num,
+			MAC:    n.mac,
+			LANIP4: n.lanIP4,
+			WANIP4: n.WANIP(),
+			WANIP6: n.wanIP6,
+			NAT:    n.natStyle.Load(),
+		})
 	}
+	slices.SortFunc(top.Networks, func(a, b NetworkInfo) int { return cmp.Compare(a.Num, b.Num) })
+	for _, n := range s.allNodes() {
+		top.Nodes = append(top.Nodes, NodeInfo{
+			Num:      n.num,
+			MAC:      n.mac,
+			LANIP:    n.lanIP,
+			Network:  n.net.num,
+			Hostname: n.hostname.Load(),
+		})
+	}
+	return top
 }
 
 type agentConn struct {
@@ -2067,47 +4845,70 @@ func (s *Server) addIdleAgentConn(ac *agentConn) {
 	s.agentConns.Make()
 	s.agentConns.Add(ac)
 
-	if waiter, ok := s.agentConnWaiter[ac.node]; ok {
-		select {
-		case waiter <- struct{}{}:
-		default:
-		}
+	if ready, ok := s.agentConnWaiter[ac.node]; ok {
+		close(ready)
+		delete(s.agentConnWaiter, ac.node)
 	}
 }
 
-func (s *Server) takeAgentConn(ctx context.Context, n *node) (_ *agentConn, ok bool) {
+// takeAgentConn waits for an idle agent connection from n and takes it.
+//
+// Any number of callers may wait for n's connections at once. They're woken
+// when a connection arrives, and also check every Config's agent connection
+// poll interval anyway. It's an error if ctx is done, or the Config's agent
+// connection timeout passes, before one of them gets a connection.
+func (s *Server) takeAgentConn(ctx context.Context, n *node) (*agentConn, error) {
 	const debug = false
+	if s.agentConnTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.agentConnTimeout)
+		defer cancel()
+	}
+	var poll <-chan time.Time
+	if s.agentPollInterval > 0 {
+		t := time.NewTicker(s.agentPollInterval)
+		defer t.Stop()
+		poll = t.C
+	}
 	for {
-		ac, ok := s.takeAgentConnOne(n)
-		if ok {
+		// Checking for a conn and registering to be woken by the next one
+		// are done together, so one arriving in between isn't missed.
+		s.mu.Lock()
+		ac, ok := s.takeAgentConnLocked(n)
+		var ready chan struct{}
+		if !ok {
+			ready, ok = s.agentConnWaiter[n]
+			if !ok {
+				ready = make(chan struct{})
+				mak.Set(&s.agentConnWaiter, n, ready)
+			}
+		}
+		s.mu.Unlock()
+		if ac != nil {
 			if debug {
 				log.Printf("takeAgentConn: got agent conn for %v", n.mac)
 			}
-			return ac, true
+			return ac, nil
 		}
-		s.mu.Lock()
-		ready := make(chan struct{})
-		mak.Set(&s.agentConnWaiter, n, ready)
-		s.mu.Unlock()
 
 		if debug {
 			log.Printf("takeAgentConn: waiting for agent conn for %v", n.mac)
 		}
 		select {
 		case <-ctx.Done():
-			return nil, false
+			return nil, fmt.Errorf("waiting for agent connection from %v: %w", n, ctx.Err())
 		case <-ready:
-		case <-time.After(time.Second):
-			// Try again regularly anyway, in case we have multiple clients
-			// trying to hit the same node, or if a race means we weren't in the
-			// select by the time addIdleAgentConn tried to signal us.
+		case <-poll:
+			// Check again regularly anyway, as a safety net.
 		}
 	}
 }
 
-func (s *Server) takeAgentConnOne(n *node) (_ *agentConn, ok bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// takeAgentConnLocked removes and returns an idle agent connection from n,
+// if there is one.
+//
+// s.mu must be held.
+func (s *Server) takeAgentConnLocked(n *node) (_ *agentConn, ok bool) {
 	miss := 0
 	for ac := range s.agentConns {
 		if ac.node == n {
@@ -2117,11 +4918,16 @@ func (s *Server) takeAgentConnOne(n *node) (_ *agentConn, ok bool) {
 		miss++
 	}
 	if miss > 0 {
-		log.Printf("takeAgentConnOne: missed %d times for %v", miss, n.mac)
+		log.Printf("takeAgentConnLocked: missed %d times for %v", miss, n.mac)
 	}
 	return nil, false
 }
 
+// NodeAgentClient is a client of the test agent (cmd/tta) on a node.
+//
+// Its embedded local.Client talks to the node's tailscaled through the
+// agent, for its status (Status), pings to peers with their path (Ping and
+// PingWithOpts) and so on. HTTPClient makes requests of the agent itself.
 type NodeAgentClient struct {
 	*local.Client
 	HTTPClient *http.Client
@@ -2135,9 +4941,9 @@ func (s *Server) NodeAgentDialer(n *Node) DialFunc {
 		return d
 	}
 	d := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		ac, ok := s.takeAgentConn(ctx, n.n)
-		if !ok {
-			return nil, ctx.Err()
+		ac, err := s.takeAgentConn(ctx, n.n)
+		if err != nil {
+			return nil, err
 		}
 		return ac.tc, nil
 	}
@@ -2161,22 +4967,66 @@ func (s *Server) NodeAgentClient(n *Node) *NodeAgentClient {
 	}
 }
 
-// EnableHostFirewall enables the host's stateful firewall.
-func (c *NodeAgentClient) EnableHostFirewall(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", "http://unused/fw", nil)
+// get does a GET request of the agent for path, returning the response body.
+// It's an error if the response status isn't 200.
+func (c *NodeAgentClient) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://unused"+path, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	res, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
 	all, _ := io.ReadAll(res.Body)
 	if res.StatusCode != 200 {
-		return fmt.Errorf("unexpected status code %v: %s", res.Status, all)
+		return nil, fmt.Errorf("unexpected status code %v: %s", res.Status, all)
 	}
-	return nil
+	return all, nil
+}
+
+// EnableHostFirewall enables the host's stateful firewall.
+func (c *NodeAgentClient) EnableHostFirewall(ctx context.Context) error {
+	_, err := c.get(ctx, "/fw")
+	return err
+}
+
+// DisableHostFirewall disables the host's stateful firewall enabled by
+// EnableHostFirewall, if it is.
+func (c *NodeAgentClient) DisableHostFirewall(ctx context.Context) error {
+	_, err := c.get(ctx, "/fw/disable")
+	return err
+}
+
+// FirewallState reports whether the host's stateful firewall is enabled.
+func (c *NodeAgentClient) FirewallState(ctx context.Context) (enabled bool, err error) {
+	all, err := c.get(ctx, "/fw/state")
+	if err != nil {
+		return false, err
+	}
+	switch state := strings.TrimSpace(string(all)); state {
+	case "enabled":
+		return true, nil
+	case "disabled":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected firewall state %q", state)
+	}
+}
+
+// NetCheck returns the report of a netcheck run on the node, as run by
+// "tailscale netcheck".
+func (c *NodeAgentClient) NetCheck(ctx context.Context) (*netcheck.Report, error) {
+	all, err := c.get(ctx, "/netcheck")
+	if err != nil {
+		return nil, err
+	}
+	report := new(netcheck.Report)
+	if err := json.Unmarshal(all, report); err != nil {
+		return nil, fmt.Errorf("parsing netcheck report: %w", err)
+	}
+	return report, nil
 }
 
 // mkPacket is a serializes a number of layers into a packet.
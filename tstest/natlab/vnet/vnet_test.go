@@ -4,21 +4,65 @@
 package vnet
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"net/url"
+	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/coder/websocket"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/tailscale/goupnp/dcps/internetgateway2"
+	"golang.org/x/net/http2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/control/controlhttp"
+	"tailscale.com/derp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/netutil"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/stun"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/net/wsconn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
 	"tailscale.com/util/must"
+	"tailscale.com/util/set"
+	"tailscale.com/util/zstdframe"
+	"tailscale.com/wgengine/netstack/gro"
 )
 
 const (
@@ -100,6 +144,17 @@ type netTest struct {
 						logSubstr("some-message"),
 					),
 				},
+				{
+					name: "udp-to-router-closed-port-v6",
+					pkt:  mkUDPPacket(nodeMac(1), netip.MustParseAddrPort("[2052::50cc:ccff:fecc:cc01]:12345"), netip.MustParseAddrPort("[2052::1]:9999"), "closed-port-v6"),
+					check: all(
+						numPkts(1),
+						pktSubstr("SrcMAC=52:ee:ee:ee:ee:01 DstMAC=52:cc:cc:cc:cc:01 EthernetType=IPv6"),
+						pktSubstr("TypeCode=DestinationUnreachable(PortUnreachable)"),
+						pktSubstr("SrcIP=2052::1 DstIP=2052::50cc:ccff:fecc:cc01"),
+						pktQuotes(mkUDPPacket(nodeMac(1), netip.MustParseAddrPort("[2052::50cc:ccff:fecc:cc01]:12345"), netip.MustParseAddrPort("[2052::1]:9999"), "closed-port-v6")),
+					),
+				},
 			},
 		},
 		{
@@ -133,6 +188,87 @@ type netTest struct {
 						pktSubstr("Options=[Option(ServerID:192.168.0.1), Option(MessageType:Ack), Option(LeaseTime:3600), Option(Router:[192 168 0 1]), Option(DNS:[4 11 4 11]), Option(SubnetMask:255.255.255.0)]}"),
 					),
 				},
+				{
+					name: "udp-to-router-closed-port",
+					pkt:  mkUDPPacket(nodeMac(1), netip.AddrPortFrom(clientIPv4(1), 12345), netip.MustParseAddrPort("192.168.0.1:9999"), "closed-port"),
+					check: all(
+						numPkts(1),
+						pktSubstr("SrcMAC=52:ee:ee:ee:ee:01 DstMAC=52:cc:cc:cc:cc:01 EthernetType=IPv4"),
+						pktSubstr("TypeCode=DestinationUnreachable(Port)"),
+						pktSubstr("SrcIP=192.168.0.1 DstIP=192.168.0.101"),
+						pktQuotes(mkUDPPacket(nodeMac(1), netip.AddrPortFrom(clientIPv4(1), 12345), netip.MustParseAddrPort("192.168.0.1:9999"), "closed-port")),
+					),
+				},
+				{
+					name: "udp-forwarded-no-icmp",
+					pkt:  mkUDPPacket(nodeMac(1), netip.AddrPortFrom(clientIPv4(1), 12345), netip.MustParseAddrPort("8.8.8.8:9999"), "forwarded"),
+					check: all(
+						numPkts(0),
+						logSubstr("NAT dropped packet; no NAT out mapping for 192.168.0.101:12345=>8.8.8.8:9999"),
+					),
+				},
+			},
+		},
+		{
+			netName: "pcp",
+			setup: func() (*Server, error) {
+				var c Config
+				c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT, PCP))
+				return New(&c)
+			},
+			tests: []netTest{
+				{
+					name: "announce",
+					pkt:  mkPCPRequest(clientIPv4(1), pcpOpAnnounce, 0, nil),
+					check: all(
+						numPkts(1),
+						pktSubstr("SrcIP=192.168.0.1 DstIP=192.168.0.101"),
+						udpPayload(pcpResult(pcpOpAnnounce, pcpCodeOK)),
+					),
+				},
+				{
+					name: "map-udp",
+					pkt:  mkPCPRequest(clientIPv4(1), pcpOpMap, 7200, mkPCPMap(layers.IPProtocolUDP, 41641, 50000)),
+					check: all(
+						numPkts(1),
+						udpPayload(pcpResult(pcpOpMap, pcpCodeOK)),
+						udpPayload(func(res []byte) error {
+							if got := binary.BigEndian.Uint32(res[4:8]); got != 7200 {
+								return fmt.Errorf("lifetime = %d; want 7200", got)
+							}
+							want := mkPCPMap(layers.IPProtocolUDP, 41641, 50000)
+							want = append(want[:20], netip.MustParseAddr("::ffff:2.1.1.1").AsSlice()...)
+							if got := res[pcpHeaderLen:]; !bytes.Equal(got, want) {
+								return fmt.Errorf("MAP response data\n got: % 02x\nwant: % 02x", got, want)
+							}
+							return nil
+						}),
+					),
+				},
+				{
+					name: "map-unsupported-protocol",
+					pkt:  mkPCPRequest(clientIPv4(1), pcpOpMap, 7200, mkPCPMap(layers.IPProtocolSCTP, 41641, 0)),
+					check: all(
+						numPkts(1),
+						udpPayload(pcpResult(pcpOpMap, pcpCodeUnsuppProtocol)),
+					),
+				},
+				{
+					name: "address-mismatch",
+					pkt:  mkPCPRequest(clientIPv4(2), pcpOpMap, 7200, mkPCPMap(layers.IPProtocolUDP, 41641, 0)),
+					check: all(
+						numPkts(1),
+						udpPayload(pcpResult(pcpOpMap, pcpCodeAddressMismatch)),
+					),
+				},
+				{
+					name: "unsupported-opcode",
+					pkt:  mkPCPRequest(clientIPv4(1), 2 /* PEER */, 7200, mkPCPMap(layers.IPProtocolUDP, 41641, 0)),
+					check: all(
+						numPkts(1),
+						udpPayload(pcpResult(2, pcpCodeUnsuppOpcode)),
+					),
+				},
 			},
 		},
 		{
@@ -223,6 +359,15 @@ type netTest struct {
 
 }
 
+// mustNode returns s's node with MAC mac, panicking if there's none.
+func mustNode(s *Server, mac MAC) *node {
+	n, ok := s.nodeByMAC.Load(mac)
+	if !ok {
+		panic(fmt.Sprintf("no node with MAC %v", mac))
+	}
+	return n
+}
+
 // mustPacket is like mkPacket but panics on error.
 func mustPacket(layers ...gopacket.SerializableLayer) []byte {
 	return must.Get(mkPacket(layers...))
@@ -389,6 +534,106 @@ func mkSyslogPacket(srcIP netip.Addr, msg string) []byte {
 	return mustPacket(eth, ip, udp, gopacket.Payload([]byte(msg)))
 }
 
+// mkUDPPacket makes a UDP packet ethernet frame from srcMAC to the router.
+func mkUDPPacket(srcMAC MAC, src, dst netip.AddrPort, payload string) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC: srcMAC.HWAddr(),
+		DstMAC: routerMac(1).HWAddr(),
+	}
+	ip := mkIPLayer(layers.IPProtocolUDP, src.Addr(), dst.Addr())
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port()),
+		DstPort: layers.UDPPort(dst.Port()),
+	}
+	return mustPacket(eth, ip, udp, gopacket.Payload([]byte(payload)))
+}
+
+// mkDFUDPPacket is like mkUDPPacket, but for IPv4 only and with the Don't
+// Fragment bit set.
+func mkDFUDPPacket(srcMAC MAC, src, dst netip.AddrPort, payload string) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC: srcMAC.HWAddr(),
+		DstMAC: routerMac(1).HWAddr(),
+	}
+	ip := &layers.IPv4{
+		Protocol: layers.IPProtocolUDP,
+		Flags:    layers.IPv4DontFragment,
+		SrcIP:    src.Addr().AsSlice(),
+		DstIP:    dst.Addr().AsSlice(),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port()),
+		DstPort: layers.UDPPort(dst.Port()),
+	}
+	return mustPacket(eth, ip, udp, gopacket.Payload([]byte(payload)))
+}
+
+// mkPCPRequest makes a PCP request ethernet frame from node 1 to the router,
+// claiming to be from PCP client IP clientIP.
+func mkPCPRequest(clientIP netip.Addr, op uint8, lifetimeSec uint32, opData []byte) []byte {
+	req := make([]byte, pcpHeaderLen, pcpHeaderLen+len(opData))
+	req[0] = pcpVersion
+	req[1] = op
+	binary.BigEndian.PutUint32(req[4:8], lifetimeSec)
+	ip16 := clientIP.As16()
+	copy(req[8:24], ip16[:])
+	req = append(req, opData...)
+	return mkUDPPacket(nodeMac(1), netip.AddrPortFrom(clientIPv4(1), 5350), netip.MustParseAddrPort("192.168.0.1:5351"), string(req))
+}
+
+// mkPCPMap makes the opcode-specific data of a PCP MAP request with a fixed
+// nonce.
+func mkPCPMap(proto layers.IPProtocol, internalPort, wantExtPort uint16) []byte {
+	m := make([]byte, pcpMapLen)
+	copy(m, "fixed-nonce!")
+	m[12] = byte(proto)
+	binary.BigEndian.PutUint16(m[16:18], internalPort)
+	binary.BigEndian.PutUint16(m[18:20], wantExtPort)
+	return m
+}
+
+func TestPCPDelete(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT, PCP))
+	s := must.Get(New(&c))
+	defer s.Close()
+	n, _ := s.networkByWAN.Load().Lookup(netip.MustParseAddr("2.1.1.1"))
+	wanAP := netip.MustParseAddrPort("2.1.1.1:50000")
+
+	must.Do(s.handleEthernetFrameFromVM(mkPCPRequest(clientIPv4(1), pcpOpMap, 7200, mkPCPMap(layers.IPProtocolUDP, 41641, 50000))))
+	if _, ok := n.lookupPortMap(layers.IPProtocolUDP, wanAP); !ok {
+		t.Fatalf("no mapping at %v after MAP", wanAP)
+	}
+	// Other protocols' mappings of the internal port are left alone.
+	must.Do(s.handleEthernetFrameFromVM(mkPCPRequest(clientIPv4(1), pcpOpMap, 0, mkPCPMap(layers.IPProtocolTCP, 41641, 0))))
+	if _, ok := n.lookupPortMap(layers.IPProtocolUDP, wanAP); !ok {
+		t.Fatal("deleting a TCP mapping deleted the UDP one")
+	}
+	// A delete needn't know the external port.
+	se := newSideEffects(s)
+	must.Do(s.handleEthernetFrameFromVM(mkPCPRequest(clientIPv4(1), pcpOpMap, 0, mkPCPMap(layers.IPProtocolUDP, 41641, 0))))
+	if err := all(numPkts(1), udpPayload(pcpResult(pcpOpMap, pcpCodeOK)))(se); err != nil {
+		t.Error(err)
+	}
+	if lanAP, ok := n.lookupPortMap(layers.IPProtocolUDP, wanAP); ok {
+		t.Errorf("mapping at %v to %v left after delete", wanAP, lanAP)
+	}
+}
+
+// pcpResult returns a func for udpPayload that checks that a UDP payload is
+// a PCP response to opcode op with result code code.
+func pcpResult(op, code uint8) func([]byte) error {
+	return func(res []byte) error {
+		if len(res) < pcpHeaderLen || res[0] != pcpVersion {
+			return fmt.Errorf("not a PCP response: % 02x", res)
+		}
+		if res[1] != op|pcpOpReply || res[3] != code {
+			return fmt.Errorf("got opcode %#x, result %d; want %#x, %d", res[1], res[3], op|pcpOpReply, code)
+		}
+		return nil
+	}
+}
+
 // matchingIP returns ip4 if toMatch is an IPv4 address, otherwise ip6.
 func matchingIP(toMatch, if4, if6 netip.Addr) netip.Addr {
 	if toMatch.Is4() {
@@ -471,6 +716,55 @@ func pktSubstr(sub string) func(*sideEffects) error {
 	}
 }
 
+// pktQuotes returns a side effect checker func that checks whether an
+// ICMP or ICMPv6 error was received that quotes the IP packet within the
+// ethernet frame eth, possibly truncated but including at least the IP header
+// and the first 8 bytes of its payload.
+func pktQuotes(eth []byte) func(*sideEffects) error {
+	return func(se *sideEffects) error {
+		nl := gopacket.NewPacket(eth, layers.LayerTypeEthernet, gopacket.Lazy).NetworkLayer()
+		orig := slices.Concat(nl.LayerContents(), nl.LayerPayload()) // without ethernet header or padding
+		minQuote := min(len(orig), len(nl.LayerContents())+8)
+		quotes := func(q []byte) bool {
+			return len(q) >= minQuote && bytes.HasPrefix(orig, q)
+		}
+		for _, pkt := range se.got {
+			pkt := gopacket.NewPacket(pkt.eth, layers.LayerTypeEthernet, gopacket.Lazy)
+			if icmp, ok := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok && quotes(icmp.Payload) {
+				return nil
+			}
+			if icmp, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok && len(icmp.Payload) >= 4 && quotes(icmp.Payload[4:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no ICMP error quoting packet % 02x", orig[:minQuote])
+	}
+}
+
+// udpPayload returns a side effect checker func that checks whether a UDP
+// packet was received whose payload passes check.
+func udpPayload(check func([]byte) error) func(*sideEffects) error {
+	return func(se *sideEffects) error {
+		var errs []error
+		for _, pkt := range se.got {
+			pkt := gopacket.NewPacket(pkt.eth, layers.LayerTypeEthernet, gopacket.Lazy)
+			udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if !ok {
+				continue
+			}
+			err := check(udp.Payload)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return errors.New("no UDP packet received")
+		}
+		return errors.Join(errs...)
+	}
+}
+
 // numPkts returns a side effect checker func that checks whether
 // the received number of ethernet packets was the given number.
 func numPkts(want int) func(*sideEffects) error {
@@ -561,6 +855,68 @@ func TestProtocolQEMU(t *testing.T) {
 	sendBetweenClients(t, clientc, s, mkLenPrefixed)
 }
 
+// TestProtocolQEMUReconnect tests that when a VM reconnects, the frame that
+// registers its new connection is delivered and tearing down the old
+// connection doesn't unregister the new one.
+func TestProtocolQEMUReconnect(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("skipping on %s", runtime.GOOS)
+	}
+	s := must.Get(newTwoNodesSameNetwork())
+	defer s.Close()
+	s.SetLoggerForTest(t.Logf)
+
+	ln := must.Get(net.Listen("unix", filepath.Join(t.TempDir(), "vnet.sock")))
+	defer ln.Close()
+	connect := func() *net.UnixConn {
+		t.Helper()
+		c := must.Get(net.Dial("unix", ln.Addr().String()))
+		t.Cleanup(func() { c.Close() })
+		sc := must.Get(ln.Accept())
+		go s.ServeUnixConn(sc.(*net.UnixConn), ProtocolQEMU)
+		return c.(*net.UnixConn)
+	}
+	recv := func(c *net.UnixConn, want []byte) {
+		t.Helper()
+		buf := make([]byte, len(want))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, want) {
+			t.Fatalf("got % 02x; want % 02x", buf, want)
+		}
+	}
+
+	vm2 := connect()
+	must.Get(vm2.Write(mkLenPrefixed(mkEth(nodeMac(3), nodeMac(2), testingEthertype, []byte("hello")))))
+	old1 := connect()
+	must.Get(old1.Write(mkLenPrefixed(mkEth(nodeMac(3), nodeMac(1), testingEthertype, []byte("hello")))))
+	awaitCond(t, 5*time.Second, func() error {
+		if n := s.RegisteredWritersForTest(); n != 2 {
+			return fmt.Errorf("got %d registered writers, want 2", n)
+		}
+		return nil
+	})
+
+	// Node 1 reconnects. The first frame on its new connection reaches
+	// node 2.
+	new1 := connect()
+	first := mkLenPrefixed(mkEth(nodeMac(2), nodeMac(1), testingEthertype, []byte("first")))
+	must.Get(new1.Write(first))
+	recv(vm2, first)
+
+	// Closing the old connection leaves the new one registered.
+	old1.Close()
+	time.Sleep(100 * time.Millisecond) // for the old connection's teardown
+	if n := s.RegisteredWritersForTest(); n != 2 {
+		t.Errorf("got %d registered writers after closing the old connection, want 2", n)
+	}
+	reply := mkLenPrefixed(mkEth(nodeMac(1), nodeMac(2), testingEthertype, []byte("reply")))
+	must.Get(vm2.Write(reply))
+	recv(new1, reply)
+}
+
 // TestProtocolUnixDgram tests the protocol that macOS Virtualization.framework
 // uses to connect to vnet. (unix datagram sockets)
 //
@@ -604,6 +960,82 @@ func TestProtocolUnixDgram(t *testing.T) {
 	sendBetweenClients(t, clientc, s, nil)
 }
 
+// TestProtocolUnixDgramMux tests that VMs sharing one datagram socket each
+// get their frames at their own address, including after a VM moves to a
+// new one.
+func TestProtocolUnixDgramMux(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("skipping on %s", runtime.GOOS)
+	}
+	s := must.Get(newTwoNodesSameNetwork())
+	defer s.Close()
+	s.SetLoggerForTest(t.Logf)
+
+	td := t.TempDir()
+	serverAddr := must.Get(net.ResolveUnixAddr("unixgram", filepath.Join(td, "vnet.sock")))
+	uc := must.Get(net.ListenUnixgram("unixgram", serverAddr))
+	go s.ServeUnixConn(uc, ProtocolUnixDGRAM)
+
+	dial := func(name string) *net.UnixConn {
+		t.Helper()
+		c := must.Get(net.DialUnix("unixgram",
+			must.Get(net.ResolveUnixAddr("unixgram", filepath.Join(td, name))),
+			serverAddr))
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	// recv returns the next frame c gets, or nil if none arrives soon.
+	recv := func(c *net.UnixConn) []byte {
+		buf := make([]byte, 1500)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+
+	vm1, vm2 := dial("vm1.sock"), dial("vm2.sock")
+	for _, step := range []struct {
+		c   *net.UnixConn
+		mac MAC
+	}{{vm1, nodeMac(1)}, {vm2, nodeMac(2)}} {
+		must.Get(step.c.Write(mkEth(nodeMac(3), step.mac, testingEthertype, []byte("hello"))))
+	}
+	awaitCond(t, 5*time.Second, func() error {
+		if n := s.RegisteredWritersForTest(); n != 2 {
+			return fmt.Errorf("got %d registered writers, want 2", n)
+		}
+		return nil
+	})
+	for _, tt := range []struct {
+		from, to *net.UnixConn
+		src, dst MAC
+	}{
+		{vm1, vm2, nodeMac(1), nodeMac(2)},
+		{vm2, vm1, nodeMac(2), nodeMac(1)},
+	} {
+		pkt := mkEth(tt.dst, tt.src, testingEthertype, []byte("test-msg"))
+		must.Get(tt.from.Write(pkt))
+		if got := recv(tt.to); !bytes.Equal(got, pkt) {
+			t.Errorf("frame %v => %v: got % 02x; want % 02x", tt.src, tt.dst, got, pkt)
+		}
+	}
+
+	// Node 1's VM restarts with a new socket address.
+	vm1.Close()
+	vm1b := dial("vm1b.sock")
+	must.Get(vm1b.Write(mkEth(nodeMac(3), nodeMac(1), testingEthertype, []byte("hello again"))))
+	pkt := mkEth(nodeMac(1), nodeMac(2), testingEthertype, []byte("to new vm1"))
+	awaitCond(t, 5*time.Second, func() error {
+		must.Get(vm2.Write(pkt))
+		if got := recv(vm1b); !bytes.Equal(got, pkt) {
+			return fmt.Errorf("got % 02x", got)
+		}
+		return nil
+	})
+}
+
 // sendBetweenClients is a test helper that tries to send an ethernet frame from
 // one client to another.
 //
@@ -662,3 +1094,4772 @@ func awaitCond(t testing.TB, timeout time.Duration, cond func() error) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+func TestMTU(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", One2OneNAT)
+	nw.SetMTU(576)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	src := netip.AddrPortFrom(clientIPv4(1), 12345)
+	dst := netip.MustParseAddrPort("8.8.8.8:9999")
+	big := strings.Repeat("x", 1000)
+
+	t.Run("df-frag-needed", func(t *testing.T) {
+		se := newSideEffects(s)
+		pkt := mkDFUDPPacket(nodeMac(1), src, dst, big)
+		must.Do(s.handleEthernetFrameFromVM(pkt))
+		if err := all(
+			numPkts(1),
+			pktSubstr("TypeCode=DestinationUnreachable(FragmentationNeeded) Checksum="),
+			pktSubstr("Seq=576"), // next-hop MTU
+			pktSubstr("SrcIP=192.168.0.1 DstIP=192.168.0.101"),
+			pktQuotes(pkt),
+		)(se); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("no-df-no-error", func(t *testing.T) {
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, dst, big)))
+		if err := numPkts(0)(se); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("inbound-fragmented", func(t *testing.T) {
+		se := newSideEffects(s)
+		s.routeUDPPacket(UDPPacket{
+			Src:     dst,
+			Dst:     netip.MustParseAddrPort("2.1.1.1:12345"),
+			Payload: []byte(big),
+		})
+		// 8 byte UDP header + 1000 byte payload, split into a first fragment
+		// of (576-20)&^7 = 552 bytes and a second one of 456 bytes.
+		if err := all(
+			numPkts(2),
+			pktSubstr("Length=572 Id="),
+			pktSubstr("Flags=MF FragOffset=0 "),
+			pktSubstr("Length=476 Id="),
+			pktSubstr("Flags= FragOffset=69 "),
+		)(se); err != nil {
+			t.Error(err)
+		}
+		if t.Failed() {
+			for _, rp := range se.got {
+				t.Logf("got: %v", gopacket.NewPacket(rp.eth, layers.LayerTypeEthernet, gopacket.Lazy))
+			}
+		}
+	})
+}
+
+func TestICMPErrorRateLimit(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	var c Config
+	c.SetClock(clock)
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", One2OneNAT)
+	nw.SetMTU(576)
+	nw.SetICMPErrorRateLimit(1, 2)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	pkt := mkDFUDPPacket(nodeMac(1),
+		netip.AddrPortFrom(clientIPv4(1), 12345),
+		netip.MustParseAddrPort("8.8.8.8:9999"),
+		strings.Repeat("x", 1000))
+	sendBurst := func() *sideEffects {
+		se := newSideEffects(s)
+		for range 5 {
+			must.Do(s.handleEthernetFrameFromVM(pkt))
+		}
+		return se
+	}
+
+	if err := all(
+		numPkts(2), // the burst
+		pktSubstr("TypeCode=DestinationUnreachable(FragmentationNeeded)"),
+	)(sendBurst()); err != nil {
+		t.Errorf("first burst: %v", err)
+	}
+	if err := numPkts(0)(sendBurst()); err != nil {
+		t.Errorf("throttled burst: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := numPkts(1)(sendBurst()); err != nil {
+		t.Errorf("after 1s: %v", err)
+	}
+}
+
+func TestLargePacketLoss(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", One2OneNAT)
+	nw.SetLargePacketLoss(1000, 0.5)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	const numSent = 200
+	numGot := func(payloadLen int) int {
+		se := newSideEffects(s)
+		for range numSent {
+			s.routeUDPPacket(UDPPacket{
+				Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+				Dst:     netip.MustParseAddrPort("2.1.1.1:12345"),
+				Payload: make([]byte, payloadLen),
+			})
+		}
+		return len(se.got)
+	}
+	if got := numGot(100); got != numSent {
+		t.Errorf("small packets: got %d of %d; want all", got, numSent)
+	}
+	// With a 50% loss rate, the odds of getting all or none of 200 packets
+	// are negligible.
+	got := numGot(1200)
+	if got == 0 || got == numSent {
+		t.Errorf("large packets: got %d of %d; want some but not all", got, numSent)
+	}
+	if rx := s.Stats().Nodes[nodeMac(1)].RxPackets; rx != int64(numSent+got) {
+		t.Errorf("node RxPackets = %d; want %d, counting only delivered packets", rx, numSent+got)
+	}
+}
+
+func TestLargePacketLossNotOnLAN(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.SetLargePacketLoss(1000, 1)
+	c.AddNode(nw)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	se := newSideEffects(s)
+	for range 20 {
+		must.Do(s.handleEthernetFrameFromVM(mkEth(nodeMac(2), nodeMac(1), testingEthertype, make([]byte, 1400))))
+	}
+	if len(se.got) != 20 {
+		t.Errorf("got %d of 20 large LAN frames; want all", len(se.got))
+	}
+}
+
+func TestLargePacketLossTCP(t *testing.T) {
+	// newServer returns a server whose single node reaches h at
+	// 203.0.113.9:9000 over a network that loses all packets over 1000 bytes.
+	newServer := func(t *testing.T, h TCPHandler) (*Server, *Node, *dropObserver) {
+		obs := new(dropObserver)
+		var c Config
+		c.SetObserver(obs)
+		nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+		nw.SetLargePacketLoss(1000, 1)
+		node := c.AddNode(nw, HostStack)
+		c.AddTCPHandler(netip.MustParsePrefix("203.0.113.9/32").Contains, 9000, h)
+		s := must.Get(New(&c))
+		t.Cleanup(s.Close)
+		return s, node, obs
+	}
+	dial := func(t *testing.T, node *Node) net.Conn {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn := must.Get(node.Dial(ctx, "tcp", "203.0.113.9:9000"))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	awaitDrop := func(t *testing.T, obs *dropObserver) {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if slices.Contains(obs.drops(), DropLargePacketLoss) {
+				return
+			}
+		}
+		t.Fatalf("drops = %v; want %v", obs.drops(), DropLargePacketLoss)
+	}
+
+	t.Run("outbound", func(t *testing.T) {
+		_, node, obs := newServer(t, func(tc *gonet.TCPConn) {
+			io.Copy(tc, tc)
+		})
+		conn := dial(t, node)
+		// Small segments get through.
+		must.Get(conn.Write([]byte("hello")))
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("read %q, %v; want echo of hello", buf, err)
+		}
+		must.Get(conn.Write(make([]byte, 3000)))
+		awaitDrop(t, obs)
+	})
+	t.Run("inbound", func(t *testing.T) {
+		_, node, obs := newServer(t, func(tc *gonet.TCPConn) {
+			tc.Write(make([]byte, 3000))
+			io.Copy(io.Discard, tc)
+		})
+		conn := dial(t, node)
+		awaitDrop(t, obs)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, err := conn.Read(make([]byte, 3000)); n > 0 {
+			t.Errorf("read %d bytes, %v; want large segments dropped", n, err)
+		}
+	})
+}
+
+func TestDHCPLeaseHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("skipping on %s", runtime.GOOS)
+	}
+	s := must.Get(newTwoNodesSameV4Network())
+	defer s.Close()
+	s.SetLoggerForTest(t.Logf)
+
+	type lease struct {
+		mac MAC
+		ip  netip.Addr
+	}
+	leased := make(chan lease, 1)
+	s.SetDHCPLeaseHook(func(mac MAC, ip netip.Addr) {
+		leased <- lease{mac, ip}
+	})
+
+	td := t.TempDir()
+	serverAddr := must.Get(net.ResolveUnixAddr("unixgram", filepath.Join(td, "vnet.sock")))
+	uc, err := net.ListenUnixgram("unixgram", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeUnixConn(uc, ProtocolUnixDGRAM)
+
+	c, err := net.DialUnix("unixgram",
+		must.Get(net.ResolveUnixAddr("unixgram", filepath.Join(td, "c.sock"))),
+		serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A DHCP discover gets an offer, which doesn't count as a lease.
+	must.Get(c.Write(mkDHCP(nodeMac(1), layers.DHCPMsgTypeDiscover)))
+	must.Get(c.Write(mkDHCP(nodeMac(1), layers.DHCPMsgTypeRequest)))
+
+	select {
+	case got := <-leased:
+		want := lease{nodeMac(1), clientIPv4(1)}
+		if got != want {
+			t.Errorf("got lease %+v; want %+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for DHCP lease")
+	}
+	select {
+	case got := <-leased:
+		t.Errorf("unexpected second lease %+v", got)
+	default:
+	}
+}
+
+func TestDHCPLeaseOptions(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.SetDHCPLeaseTime(90 * time.Second)
+	nw.SetDHCPDNSServers(netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("8.8.8.8"))
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	se := newSideEffects(s)
+	must.Do(s.handleEthernetFrameFromVM(mkDHCP(nodeMac(1), layers.DHCPMsgTypeRequest)))
+	if err := all(
+		numPkts(1),
+		pktSubstr("Option(MessageType:Ack)"),
+		pktSubstr("Option(LeaseTime:90)"),
+		pktSubstr("Option(DNS:[1 1 1 1 8 8 8 8])"),
+	)(se); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDHCPClasslessRoutes(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.AddDHCPRoute(netip.MustParsePrefix("10.2.0.0/16"), netip.MustParseAddr("192.168.0.1"))
+	nw.AddDHCPRoute(netip.MustParsePrefix("172.16.5.0/25"), netip.MustParseAddr("192.168.0.2"))
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	got := nodePackets(s, nodeMac(1))[0]
+	must.Do(s.handleEthernetFrameFromVM(mkDHCP(nodeMac(1), layers.DHCPMsgTypeRequest)))
+	pkt := awaitPacket(t, got, "DHCP ACK", func(pkt gopacket.Packet) bool {
+		return pkt.Layer(layers.LayerTypeDHCPv4) != nil
+	})
+	var opt []byte
+	for _, o := range pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4).Options {
+		if o.Type == layers.DHCPOptClasslessStaticRoute {
+			opt = o.Data
+		}
+	}
+	if opt == nil {
+		t.Fatal("no classless static route option")
+	}
+
+	// Decode the RFC 3442 routes.
+	var routes []string
+	for len(opt) > 0 {
+		bits := int(opt[0])
+		n := (bits + 7) / 8
+		if len(opt) < 1+n+4 {
+			t.Fatalf("truncated option: %x", opt)
+		}
+		var a [4]byte
+		copy(a[:], opt[1:1+n])
+		gw := netip.AddrFrom4([4]byte(opt[1+n : 1+n+4]))
+		routes = append(routes, fmt.Sprintf("%v via %v", netip.PrefixFrom(netip.AddrFrom4(a), bits), gw))
+		opt = opt[1+n+4:]
+	}
+	want := []string{
+		"10.2.0.0/16 via 192.168.0.1",
+		"172.16.5.0/25 via 192.168.0.2",
+		"0.0.0.0/0 via 192.168.0.1", // added default route
+	}
+	if !slices.Equal(routes, want) {
+		t.Errorf("routes = %q; want %q", routes, want)
+	}
+}
+
+func TestDHCPHostname(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+	newSideEffects(s)
+
+	if _, ok := s.NodeHostname(nodeMac(1)); ok {
+		t.Error("got hostname before any DHCP request")
+	}
+	pkt := gopacket.NewPacket(mkDHCP(nodeMac(1), layers.DHCPMsgTypeDiscover), layers.LayerTypeEthernet, gopacket.Default)
+	dhcp := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	dhcp.Options = append(dhcp.Options, layers.NewDHCPOption(layers.DHCPOptHostname, []byte("foo-vm")))
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet),
+		pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4),
+		pkt.Layer(layers.LayerTypeUDP).(*layers.UDP),
+		dhcp,
+	)))
+	if got, ok := s.NodeHostname(nodeMac(1)); got != "foo-vm" || !ok {
+		t.Errorf("NodeHostname = %q, %v; want foo-vm, true", got, ok)
+	}
+	if got := s.Topology().Nodes[0].Hostname; got != "foo-vm" {
+		t.Errorf("Topology hostname = %q; want foo-vm", got)
+	}
+	var buf bytes.Buffer
+	s.WriteStartingBanner(&buf)
+	if !strings.Contains(buf.String(), "foo-vm") {
+		t.Errorf("banner missing hostname:\n%s", buf.String())
+	}
+}
+
+func mkDHCPv6(srcMAC MAC, typ layers.DHCPv6MsgType) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC.HWAddr(),
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0, 1, 0, 2},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip := &layers.IPv6{
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("fe80::50cc:ccff:fecc:cc01"),
+		DstIP:      net.ParseIP("ff02::1:2"), // All_DHCP_Relay_Agents_and_Servers
+	}
+	udp := &layers.UDP{
+		SrcPort: 546,
+		DstPort: 547,
+	}
+	clientID := &layers.DHCPv6DUID{
+		Type:             layers.DHCPv6DUIDTypeLL,
+		HardwareType:     []byte{0, 1},
+		LinkLayerAddress: srcMAC.HWAddr(),
+	}
+	dhcp := &layers.DHCPv6{
+		MsgType:       typ,
+		TransactionID: []byte{1, 2, 3},
+		Options: layers.DHCPv6Options{
+			layers.NewDHCPv6Option(layers.DHCPv6OptClientID, clientID.Encode()),
+			layers.NewDHCPv6Option(layers.DHCPv6OptIANA, make([]byte, 12)), // IAID 0, T1 0, T2 0
+		},
+	}
+	return mustPacket(eth, ip, udp, dhcp)
+}
+
+func TestDHCPv6(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", "2000:52::1/64", EasyNAT)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	var leased netip.Addr
+	s.SetDHCPLeaseHook(func(mac MAC, ip netip.Addr) { leased = ip })
+
+	got := nodePackets(s, nodeMac(1))[0]
+	wantIP := netip.MustParseAddr("2000:52::65")
+	for _, tt := range []struct {
+		req  layers.DHCPv6MsgType
+		want layers.DHCPv6MsgType
+	}{
+		{layers.DHCPv6MsgTypeSolicit, layers.DHCPv6MsgTypeAdverstise},
+		{layers.DHCPv6MsgTypeRequest, layers.DHCPv6MsgTypeReply},
+	} {
+		must.Do(s.handleEthernetFrameFromVM(mkDHCPv6(nodeMac(1), tt.req)))
+		pkt := awaitPacket(t, got, tt.want.String(), func(pkt gopacket.Packet) bool {
+			return pkt.Layer(layers.LayerTypeDHCPv6) != nil
+		})
+		res := pkt.Layer(layers.LayerTypeDHCPv6).(*layers.DHCPv6)
+		if res.MsgType != tt.want {
+			t.Fatalf("response to %v = %v; want %v", tt.req, res.MsgType, tt.want)
+		}
+		if !bytes.Equal(res.TransactionID, []byte{1, 2, 3}) {
+			t.Errorf("transaction ID = %x; want 010203", res.TransactionID)
+		}
+		var gotIP, gotDNS netip.Addr
+		var gotClientID bool
+		for _, o := range res.Options {
+			switch o.Code {
+			case layers.DHCPv6OptClientID:
+				gotClientID = true
+			case layers.DHCPv6OptIANA:
+				// IAID, T1, T2, then the IAADDR option's code, length, and address.
+				if len(o.Data) >= 12+4+16 {
+					gotIP = netip.AddrFrom16([16]byte(o.Data[16:32]))
+				}
+			case layers.DHCPv6OptDNSServers:
+				gotDNS, _ = netip.AddrFromSlice(o.Data)
+			}
+		}
+		if !gotClientID {
+			t.Errorf("%v: missing client ID", tt.want)
+		}
+		if gotIP != wantIP {
+			t.Errorf("%v: address = %v; want %v", tt.want, gotIP, wantIP)
+		}
+		if gotDNS != FakeDNSIPv6() {
+			t.Errorf("%v: DNS = %v; want %v", tt.want, gotDNS, FakeDNSIPv6())
+		}
+	}
+	if leased != wantIP {
+		t.Errorf("lease hook got %v; want %v", leased, wantIP)
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.AddService(UPnP)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// Discover the router by multicast SSDP, as the portmapper does.
+	se := newSideEffects(s)
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{
+			SrcMAC: nodeMac(1).HWAddr(),
+			DstMAC: MAC{0x01, 0x00, 0x5e, 0x7f, 0xff, 0xfa}.HWAddr(),
+		},
+		mkIPLayer(layers.IPProtocolUDP, clientIPv4(1), ssdpMulticastIP),
+		&layers.UDP{SrcPort: 40000, DstPort: ssdpPort},
+		gopacket.Payload("M-SEARCH * HTTP/1.1\r\n"+
+			"HOST: 239.255.255.250:1900\r\n"+
+			"ST: ssdp:all\r\n"+
+			"MAN: \"ssdp:discover\"\r\n"+
+			"MX: 2\r\n\r\n"),
+	)))
+	var location string
+	if err := all(
+		numPkts(1),
+		pktSubstr("SrcIP=192.168.0.1 DstIP=192.168.0.101"),
+		pktSubstr("SrcPort=1900(ssdp) DstPort=40000"),
+		udpPayload(func(b []byte) error {
+			res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+			if err != nil {
+				return err
+			}
+			location = res.Header.Get("Location")
+			if want := "http://192.168.0.1:5000/rootDesc.xml"; location != want {
+				return fmt.Errorf("Location = %q; want %q", location, want)
+			}
+			return nil
+		}),
+	)(se); err != nil {
+		t.Fatal(err)
+	}
+
+	// Talk to the router's UPnP HTTP server directly rather than through
+	// netstack, pointing the discovered location at it.
+	n := mustNode(s, nodeMac(1)).net
+	ts := httptest.NewServer(n.upnpHandler(clientIPv4(1)))
+	defer ts.Close()
+	loc := must.Get(url.Parse(location))
+	loc.Host = must.Get(url.Parse(ts.URL)).Host
+
+	ctx := context.Background()
+	clients, err := internetgateway2.NewWANIPConnection1ClientsByURL(ctx, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 {
+		t.Fatalf("got %d WANIPConnection1 clients; want 1", len(clients))
+	}
+	upnp := clients[0]
+
+	extIP, err := upnp.GetExternalIPAddress(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extIP != "2.1.1.1" {
+		t.Errorf("external IP = %q; want 2.1.1.1", extIP)
+	}
+
+	if err := upnp.AddPortMapping(ctx, "", 4000, "UDP", 1234, "192.168.0.199", true, "test", 0); err == nil {
+		t.Error("AddPortMapping for another client succeeded; want error")
+	}
+	if err := upnp.AddPortMapping(ctx, "", 4000, "UDP", 1234, clientIPv4(1).String(), true, "test", 0); err != nil {
+		t.Fatalf("AddPortMapping: %v", err)
+	}
+
+	mappings := func() int {
+		n.natMu.Lock()
+		defer n.natMu.Unlock()
+		return len(n.portMap)
+	}
+	if err := upnp.AddPortMapping(ctx, "", 4000, "UDP", 5678, clientIPv4(1).String(), true, "test", 0); err == nil {
+		t.Error("AddPortMapping for a taken port succeeded; want error")
+	}
+	if err := upnp.AddPortMapping(ctx, "", 4001, "UDP", 1234, clientIPv4(1).String(), true, "test", 0); err != nil {
+		t.Fatalf("AddPortMapping of second external port: %v", err)
+	}
+	// Mapping the same LAN port on 4001 replaces the mapping on 4000.
+	if got := mappings(); got != 1 {
+		t.Errorf("got %d port mappings; want 1", got)
+	}
+	if err := upnp.DeletePortMapping(ctx, "", 4000, "UDP"); err == nil {
+		t.Error("DeletePortMapping of replaced mapping succeeded; want error")
+	}
+	if err := upnp.AddPortMapping(ctx, "", 4000, "UDP", 1234, clientIPv4(1).String(), true, "test", 0); err != nil {
+		t.Fatalf("AddPortMapping: %v", err)
+	}
+	if err := upnp.DeletePortMapping(ctx, "", 4001, "UDP"); err == nil {
+		t.Error("DeletePortMapping of replaced mapping succeeded; want error")
+	}
+	if got := mappings(); got != 1 {
+		t.Errorf("got %d port mappings; want 1", got)
+	}
+
+	res, err := http.Get(ts.URL + upnpSCPDPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("GET %s: %v", upnpSCPDPath, res.Status)
+	}
+
+	inbound := UDPPacket{
+		Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+		Dst:     netip.MustParseAddrPort("2.1.1.1:4000"),
+		Payload: []byte("hello"),
+	}
+	se = newSideEffects(s)
+	s.routeUDPPacket(inbound)
+	if err := all(
+		numPkts(1),
+		pktSubstr("SrcIP=8.8.8.8 DstIP=192.168.0.101"),
+		pktSubstr("DstPort=1234"),
+	)(se); err != nil {
+		t.Error(err)
+	}
+
+	if err := upnp.DeletePortMapping(ctx, "", 4000, "UDP"); err != nil {
+		t.Fatalf("DeletePortMapping: %v", err)
+	}
+	if err := upnp.DeletePortMapping(ctx, "", 4000, "UDP"); err == nil {
+		t.Error("second DeletePortMapping succeeded; want error")
+	}
+	se = newSideEffects(s)
+	s.routeUDPPacket(inbound)
+	if err := numPkts(0)(se); err != nil {
+		t.Errorf("after delete: %v", err)
+	}
+}
+
+func TestTopology(t *testing.T) {
+	var c Config
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	nw2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", "2052::1/64", HardNAT)
+	c.AddNode(nw1)
+	c.AddNode(nw2)
+	c.AddNode(nw2)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	want := TopologyInfo{
+		Networks: []NetworkInfo{
+			{
+				Num:    1,
+				MAC:    routerMac(1),
+				LANIP4: netip.MustParsePrefix("192.168.1.1/24"),
+				WANIP4: netip.MustParseAddr("2.1.1.1"),
+				NAT:    EasyNAT,
+			},
+			{
+				Num:    2,
+				MAC:    routerMac(2),
+				LANIP4: netip.MustParsePrefix("10.2.0.1/16"),
+				WANIP4: netip.MustParseAddr("2.2.2.2"),
+				WANIP6: netip.MustParsePrefix("2052::1/64"),
+				NAT:    HardNAT,
+			},
+		},
+		Nodes: []NodeInfo{
+			{Num: 1, MAC: nodeMac(1), LANIP: netip.MustParseAddr("192.168.1.101"), Network: 1},
+			{Num: 2, MAC: nodeMac(2), LANIP: netip.MustParseAddr("10.2.0.102"), Network: 2},
+			{Num: 3, MAC: nodeMac(3), LANIP: netip.MustParseAddr("10.2.0.103"), Network: 2},
+		},
+	}
+	if got := s.Topology(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Topology mismatch\n got: %+v\nwant: %+v", got, want)
+	}
+
+	var buf bytes.Buffer
+	s.WriteStartingBanner(&buf)
+	for _, n := range want.Nodes {
+		if !strings.Contains(buf.String(), n.MAC.String()) {
+			t.Errorf("banner missing node %v:\n%s", n.MAC, buf.String())
+		}
+	}
+}
+
+func TestTCPPortMap(t *testing.T) {
+	var c Config
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT, NATPMP)
+	nw2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", EasyNAT)
+	c.AddNode(nw1)
+	c.AddNode(nw2)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	got := nodePackets(s, nodeMac(1), nodeMac(2))
+	await := func(node int, what string, match func(gopacket.Packet) bool) gopacket.Packet {
+		t.Helper()
+		return awaitPacket(t, got[node-1], what, match)
+	}
+
+	// Map TCP port 8080 on node 1 with NAT-PMP.
+	node1 := netip.AddrPortFrom(netip.MustParseAddr("192.168.1.101"), 8080)
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1),
+		netip.AddrPortFrom(node1.Addr(), 5351),
+		netip.MustParseAddrPort("192.168.1.1:5351"),
+		"\x00\x02\x00\x00\x1f\x90\x1f\x90\x00\x00\x1c\x20"))) // op=2 (TCP), 8080 => 8080, 7200s
+	res := await(1, "NAT-PMP response", func(pkt gopacket.Packet) bool {
+		udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		return ok && udp.SrcPort == 5351
+	})
+	if p := res.Layer(layers.LayerTypeUDP).(*layers.UDP).Payload; len(p) != 16 || p[1] != 130 || binary.BigEndian.Uint16(p[10:12]) != 8080 {
+		t.Fatalf("unexpected NAT-PMP response % 02x", p)
+	}
+	wanAP := netip.MustParseAddrPort("2.1.1.1:8080")
+
+	// Node 2 connects to the mapped port, which the router forwards to node
+	// 1's service, which this test plays the part of.
+	node2 := netip.MustParseAddrPort("10.2.0.102:40000")
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(2), routerMac(2), node2, wanAP,
+		&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+
+	routerLAN := netip.MustParseAddr("192.168.1.1")
+	syn := await(1, "forwarded SYN", func(pkt gopacket.Packet) bool {
+		f, ok := flow(pkt)
+		tcp, isTCP := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return ok && isTCP && f.src == routerLAN && f.dst == node1.Addr() &&
+			uint16(tcp.DstPort) == node1.Port() && tcp.SYN && !tcp.ACK
+	}).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	routerAP := netip.AddrPortFrom(routerLAN, uint16(syn.SrcPort))
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), node1, routerAP,
+		&layers.TCP{Seq: 5000, Ack: syn.Seq + 1, SYN: true, ACK: true, Window: 65535})))
+	await(1, "ACK of forwarded SYN-ACK", isTCPPacket(routerAP, node1, false, true))
+
+	// With the LAN side connected, node 2's connection is accepted.
+	synAck := await(2, "SYN-ACK to node 2", isTCPPacket(wanAP, node2, true, true)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if synAck.Ack != 1001 {
+		t.Errorf("SYN-ACK acks %v; want 1001", synAck.Ack)
+	}
+}
+
+func TestDialTCPFromInternet(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	node := c.AddNode(nw)
+	nw.AddPortForward(8080, node, 80)
+	s := must.Get(New(&c))
+	defer s.Close()
+	got := nodePackets(s, nodeMac(1))[0]
+
+	if _, err := s.DialTCPFromInternet(context.Background(),
+		netip.MustParseAddrPort("8.8.8.8:40000"),
+		netip.MustParseAddrPort("2.1.1.1:8081")); err == nil {
+		t.Error("dial to unforwarded port succeeded; want error")
+	}
+
+	src := netip.MustParseAddrPort("8.8.8.8:40000")
+	lanAP := netip.MustParseAddrPort("192.168.1.101:80")
+	type dialRes struct {
+		c   net.Conn
+		err error
+	}
+	dialc := make(chan dialRes, 1)
+	go func() {
+		c, err := s.DialTCPFromInternet(context.Background(), src, netip.MustParseAddrPort("2.1.1.1:8080"))
+		dialc <- dialRes{c, err}
+	}()
+
+	// Play the part of node 1's service: the SYN should come from the
+	// internet address, DNATed to the LAN service.
+	syn := awaitPacket(t, got, "SYN", isTCPPacket(src, lanAP, true, false)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), lanAP, src,
+		&layers.TCP{Seq: 5000, Ack: syn.Seq + 1, SYN: true, ACK: true, Window: 65535})))
+
+	res := <-dialc
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	defer res.c.Close()
+	if _, err := io.WriteString(res.c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	awaitPacket(t, got, "data", func(pkt gopacket.Packet) bool {
+		tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return ok && isTCPPacket(src, lanAP, false, true)(pkt) && string(tcp.Payload) == "hello"
+	})
+}
+
+// mkTCPPacket makes a TCP packet from src to dst, filling in tcp's ports.
+func mkTCPPacket(srcMAC, dstMAC MAC, src, dst netip.AddrPort, tcp *layers.TCP) []byte {
+	tcp.SrcPort = layers.TCPPort(src.Port())
+	tcp.DstPort = layers.TCPPort(dst.Port())
+	return mustPacket(
+		&layers.Ethernet{SrcMAC: srcMAC.HWAddr(), DstMAC: dstMAC.HWAddr()},
+		mkIPLayer(layers.IPProtocolTCP, src.Addr(), dst.Addr()),
+		tcp,
+	)
+}
+
+// nodePackets registers test sinks for the nodes with the given MACs,
+// returning a channel per node of the packets it receives.
+func nodePackets(s *Server, macs ...MAC) []chan gopacket.Packet {
+	var chans []chan gopacket.Packet
+	for _, mac := range macs {
+		ch := make(chan gopacket.Packet, 16)
+		s.RegisterSinkForTest(mac, func(eth []byte) {
+			ch <- gopacket.NewPacket(eth, layers.LayerTypeEthernet, gopacket.Default)
+		})
+		chans = append(chans, ch)
+	}
+	return chans
+}
+
+// awaitPacket returns the first packet from ch that matches match, failing
+// the test if none arrives in time.
+func awaitPacket(t testing.TB, ch <-chan gopacket.Packet, what string, match func(gopacket.Packet) bool) gopacket.Packet {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pkt := <-ch:
+			if match(pkt) {
+				return pkt
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// isTCPPacket returns a packet matcher for TCP packets from src to dst with
+// the given SYN and ACK flags.
+func isTCPPacket(src, dst netip.AddrPort, syn, ack bool) func(gopacket.Packet) bool {
+	return func(pkt gopacket.Packet) bool {
+		tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			return false
+		}
+		f, ok := flow(pkt)
+		return ok &&
+			netip.AddrPortFrom(f.src, uint16(tcp.SrcPort)) == src &&
+			netip.AddrPortFrom(f.dst, uint16(tcp.DstPort)) == dst &&
+			tcp.SYN == syn && tcp.ACK == ack
+	}
+}
+
+func TestPortMapExpiry(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	var c Config
+	c.SetClock(clock)
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT, NATPMP)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	se := newSideEffects(s)
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1),
+		netip.MustParseAddrPort("192.168.1.101:5351"),
+		netip.MustParseAddrPort("192.168.1.1:5351"),
+		"\x00\x01\x00\x00\xa2\xa9\xa2\xa9\x00\x00\x00\x3c"))) // UDP 41641 => 41641 for 60s
+	if err := numPkts(1)(se); err != nil {
+		t.Fatalf("NAT-PMP response: %v", err)
+	}
+
+	inbound := UDPPacket{
+		Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+		Dst:     netip.MustParseAddrPort("2.1.1.1:41641"),
+		Payload: []byte("hello"),
+	}
+	se = newSideEffects(s)
+	s.routeUDPPacket(inbound)
+	if err := numPkts(1)(se); err != nil {
+		t.Errorf("before expiry: %v", err)
+	}
+
+	clock.Advance(61 * time.Second)
+	se = newSideEffects(s)
+	s.routeUDPPacket(inbound)
+	if err := all(
+		numPkts(0),
+		logSubstr("port mapping EXPIRED"),
+	)(se); err != nil {
+		t.Errorf("after expiry: %v", err)
+	}
+}
+
+func TestPortMapDoesNotReplacePortForward(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT, NATPMP)
+	node1 := c.AddNode(nw)
+	c.AddNode(nw)
+	nw.AddPortForward(8080, node1, 80)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	n := s.nodes[0].net
+	node2IP := netip.MustParseAddr("192.168.1.102")
+	wanAP := netip.MustParseAddrPort("2.1.1.1:8080")
+	for _, proto := range []layers.IPProtocol{layers.IPProtocolUDP, layers.IPProtocolTCP} {
+		gotPort, ok := n.doPortMap(proto, node2IP, 5000, 8080, 3600)
+		if !ok || gotPort == 8080 {
+			t.Errorf("%v: doPortMap = %v, %v; want a port other than 8080", proto, gotPort, ok)
+		}
+		if lanAP, ok := n.lookupPortMap(proto, wanAP); !ok || lanAP != netip.MustParseAddrPort("192.168.1.101:80") {
+			t.Errorf("%v: port forward now goes to %v, %v", proto, lanAP, ok)
+		}
+
+		// Deleting the port forward's mapping on behalf of a client must
+		// not work either.
+		n.doPortMap(proto, netip.MustParseAddr("192.168.1.101"), 80, 8080, 0)
+		if _, ok := n.lookupPortMap(proto, wanAP); !ok {
+			t.Errorf("%v: port forward deleted", proto)
+		}
+	}
+}
+
+func TestReordering(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	var c Config
+	c.SetClock(clock)
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT)
+	nw.SetReordering(0.5, time.Second)
+	nw.SetImpairmentSeed(2) // holds back the 1st and 3rd packets, not the 4th
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+	ch := nodePackets(s, nodeMac(1))[0]
+
+	send := func(payload string) {
+		s.routeUDPPacket(UDPPacket{
+			Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+			Dst:     netip.MustParseAddrPort("2.1.1.1:1234"),
+			Payload: []byte(payload),
+		})
+	}
+	// Packets are delivered synchronously unless held back.
+	received := func() (got []string) {
+		for {
+			select {
+			case pkt := <-ch:
+				got = append(got, string(pkt.ApplicationLayer().Payload()))
+			default:
+				return got
+			}
+		}
+	}
+
+	send("one")
+	send("two")
+	if got, want := received(), []string{"two", "one"}; !slices.Equal(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// A held packet with nothing after it is delivered after the hold time.
+	send("three")
+	if got := received(); len(got) > 0 {
+		t.Errorf("got %q before the hold time", got)
+	}
+	clock.Advance(time.Second)
+	awaitPacket(t, ch, "held packet", func(pkt gopacket.Packet) bool {
+		return string(pkt.ApplicationLayer().Payload()) == "three"
+	})
+	send("four")
+	if got, want := received(), []string{"four"}; !slices.Equal(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestDuplication(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT)
+	nw.SetDuplication(1)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+	ch := nodePackets(s, nodeMac(1))[0]
+	var lanCaptures int
+	defer s.RegisterPacketSink(func(ci gopacket.CaptureInfo, _ []byte) {
+		if ci.InterfaceIndex == s.nodes[0].net.lanInterfaceID {
+			lanCaptures++
+		}
+	})()
+
+	var pkts []gopacket.Packet
+	for _, payload := range []string{"one", "two"} {
+		s.routeUDPPacket(UDPPacket{
+			Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+			Dst:     netip.MustParseAddrPort("2.1.1.1:1234"),
+			Payload: []byte(payload),
+		})
+		for range 2 {
+			pkts = append(pkts, <-ch)
+		}
+	}
+	select {
+	case pkt := <-ch:
+		t.Fatalf("extra packet %v", pkt)
+	default:
+	}
+	for i := 0; i < len(pkts); i += 2 {
+		if !bytes.Equal(pkts[i].Data(), pkts[i+1].Data()) {
+			t.Errorf("packet %d isn't an exact copy of packet %d", i+1, i)
+		}
+	}
+	if got, want := string(pkts[2].ApplicationLayer().Payload()), "two"; got != want {
+		t.Errorf("second packet payload = %q; want %q", got, want)
+	}
+	if lanCaptures != 4 {
+		t.Errorf("captured %d packets on the LAN; want 4", lanCaptures)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.SetCorruption(1, false)
+	nw.SetImpairmentSeed(1)
+	c.AddNode(nw)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+	ch := nodePackets(s, nodeMac(2))[0]
+
+	src := netip.AddrPortFrom(clientIPv4(1), 1234)
+	dst := netip.AddrPortFrom(clientIPv4(2), 80)
+	payload := []byte("some TCP payload")
+	sent := mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: nodeMac(2).HWAddr()},
+		mkIPLayer(layers.IPProtocolTCP, src.Addr(), dst.Addr()),
+		&layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 1000, ACK: true, PSH: true, Window: 65535},
+		gopacket.Payload(payload),
+	)
+	must.Do(s.handleEthernetFrameFromVM(sent))
+	got := awaitPacket(t, ch, "TCP packet", isTCPPacket(src, dst, false, true))
+
+	tcp := got.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	var flipped int
+	for i := range payload {
+		if tcp.Payload[i] != payload[i] {
+			flipped++
+		}
+	}
+	if flipped != 1 {
+		t.Errorf("%d payload bytes changed; want 1", flipped)
+	}
+	if !bytes.Equal(got.NetworkLayer().LayerContents(), gopacket.NewPacket(sent, layers.LayerTypeEthernet, gopacket.Default).NetworkLayer().LayerContents()) {
+		t.Error("IP header changed")
+	}
+
+	// A receiver checking checksums, as with RX checksum offload, should
+	// reject the corrupted packet but not the original.
+	checksumOK := func(eth []byte) bool {
+		var p packet.Parsed
+		p.Decode(eth[14:])
+		pb := gro.RXChecksumOffload(&p)
+		if pb == nil {
+			return false
+		}
+		pb.DecRef()
+		return true
+	}
+	if !checksumOK(sent) {
+		t.Error("original packet rejected")
+	}
+	if checksumOK(got.Data()) {
+		t.Error("corrupted packet accepted")
+	}
+}
+
+func TestSetWANIP(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	var c Config
+	c.SetClock(clock)
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT, NATPMP)
+	node := c.AddNode(nw)
+	nw2 := c.AddNetwork("2.2.2.2", "192.168.2.1/24", EasyNAT)
+	c.AddNode(nw2)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	n := s.nodes[0].net
+	if got, ok := n.doPortMap(layers.IPProtocolUDP, netip.MustParseAddr("192.168.1.101"), 41641, 41641, 3600); !ok || got != 41641 {
+		t.Fatalf("doPortMap = %v, %v", got, ok)
+	}
+	ch := nodePackets(s, nodeMac(1))[0]
+
+	if err := s.SetWANIP(nw, netip.MustParseAddr("2.2.2.2")); err == nil {
+		t.Error("SetWANIP to another network's WAN IP succeeded")
+	}
+	newIP := netip.MustParseAddr("3.1.1.1")
+	must.Do(s.SetWANIP(nw, newIP))
+
+	pkt := awaitPacket(t, ch, "NAT-PMP announcement", func(pkt gopacket.Packet) bool {
+		udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		return ok && udp.SrcPort == 5351 && udp.DstPort == 5350
+	})
+	if ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ip.DstIP.Equal(net.IPv4(224, 0, 0, 1)) {
+		t.Errorf("announcement sent to %v; want 224.0.0.1", ip.DstIP)
+	}
+	want := "\x00\x80\x00\x00\x65\x53\xf1\x00\x03\x01\x01\x01" // epoch 1700000000, 3.1.1.1
+	if got := string(pkt.ApplicationLayer().Payload()); got != want {
+		t.Errorf("announcement = % 02x; want % 02x", got, want)
+	}
+	if got := node.WANIP(); got != newIP {
+		t.Errorf("node WANIP = %v; want %v", got, newIP)
+	}
+
+	// The port mapping moved to the new IP, and the old IP doesn't route.
+	for _, dst := range []string{"2.1.1.1:41641", "3.1.1.1:41641"} {
+		s.routeUDPPacket(UDPPacket{
+			Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+			Dst:     netip.MustParseAddrPort(dst),
+			Payload: []byte("to " + dst),
+		})
+	}
+	awaitPacket(t, ch, "inbound packet", func(pkt gopacket.Packet) bool {
+		app := pkt.ApplicationLayer()
+		if app == nil {
+			return false
+		}
+		switch string(app.Payload()) {
+		case "to 2.1.1.1:41641":
+			t.Fatal("packet to old WAN IP delivered")
+		case "to 3.1.1.1:41641":
+			return true
+		}
+		return false
+	})
+}
+
+func TestRotateWANIP(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	node := c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	got := nodePackets(s, nodeMac(1))[0]
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	stunServer := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+	stunMapped := func() netip.AddrPort {
+		t.Helper()
+		txid := stun.NewTxID()
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, stunServer, string(stun.Request(txid)))))
+		var mapped netip.AddrPort
+		awaitPacket(t, got, "STUN response", func(pkt gopacket.Packet) bool {
+			app := pkt.ApplicationLayer()
+			if app == nil {
+				return false
+			}
+			if strings.HasPrefix(string(app.Payload()), "stale") {
+				t.Fatalf("got %q through an invalidated mapping", app.Payload())
+			}
+			gotTxID, ap, err := stun.ParseResponse(app.Payload())
+			if err != nil || gotTxID != txid {
+				return false
+			}
+			mapped = ap
+			return true
+		})
+		return mapped
+	}
+
+	before := stunMapped()
+	if before.Addr() != netip.MustParseAddr("2.1.1.1") {
+		t.Fatalf("STUN mapped address before rotation = %v", before)
+	}
+	newIP, err := s.RotateWANIP(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("2.1.1.2"); newIP != want {
+		t.Errorf("RotateWANIP = %v; want %v", newIP, want)
+	}
+	if got := node.WANIP(); got != newIP {
+		t.Errorf("node WANIP = %v; want %v", got, newIP)
+	}
+
+	// Neither the old address nor the old mapping's port on the new
+	// address reach the node any more.
+	for _, dst := range []netip.AddrPort{before, netip.AddrPortFrom(newIP, before.Port())} {
+		s.routeUDPPacket(UDPPacket{Src: stunServer, Dst: dst, Payload: []byte("stale " + dst.String())})
+	}
+	if after := stunMapped(); after.Addr() != newIP {
+		t.Errorf("STUN mapped address after rotation = %v; want %v", after, newIP)
+	}
+}
+
+func TestFlushNAT(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	var c Config
+	c.SetClock(clock)
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.SetNATFlushInterval(time.Minute)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	got := nodePackets(s, nodeMac(1))[0]
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	stunServer := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+	// punch sends a STUN request from src, returning its mapped address.
+	punch := func() netip.AddrPort {
+		t.Helper()
+		txid := stun.NewTxID()
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, stunServer, string(stun.Request(txid)))))
+		var mapped netip.AddrPort
+		awaitPacket(t, got, "STUN response", func(pkt gopacket.Packet) bool {
+			app := pkt.ApplicationLayer()
+			if app == nil {
+				return false
+			}
+			if strings.HasPrefix(string(app.Payload()), "stale") {
+				t.Fatalf("got %q through a flushed mapping", app.Payload())
+			}
+			gotTxID, ap, err := stun.ParseResponse(app.Payload())
+			if err != nil || gotTxID != txid {
+				return false
+			}
+			mapped = ap
+			return true
+		})
+		return mapped
+	}
+	// reaches checks that a packet with payload from the STUN server to
+	// mapped reaches the node.
+	reaches := func(mapped netip.AddrPort, payload string) {
+		t.Helper()
+		s.routeUDPPacket(UDPPacket{Src: stunServer, Dst: mapped, Payload: []byte(payload)})
+		awaitPacket(t, got, payload, func(pkt gopacket.Packet) bool {
+			app := pkt.ApplicationLayer()
+			return app != nil && string(app.Payload()) == payload
+		})
+	}
+
+	mapped := punch()
+	reaches(mapped, "before")
+	if err := s.FlushNAT(nw); err != nil {
+		t.Fatal(err)
+	}
+	s.routeUDPPacket(UDPPacket{Src: stunServer, Dst: mapped, Payload: []byte("stale")})
+	reaches(punch(), "after")
+
+	// The flush interval flushes it again.
+	n := nw.n
+	n.natMu.Lock()
+	table := n.natTable
+	n.natMu.Unlock()
+	clock.Advance(time.Minute)
+	awaitCond(t, 5*time.Second, func() error {
+		n.natMu.Lock()
+		defer n.natMu.Unlock()
+		if n.natTable == table {
+			return errors.New("not flushed")
+		}
+		return nil
+	})
+	reaches(punch(), "after interval")
+
+	var c2 Config
+	s2 := must.Get(New(&c2))
+	defer s2.Close()
+	if err := s2.FlushNAT(nw); err == nil {
+		t.Error("FlushNAT of another Server's network succeeded")
+	}
+}
+
+func TestGratuitousARP(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	var c Config
+	c.SetClock(clock)
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.SetARPTimeout(time.Minute)
+	c.AddNode(nw)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+	chans := nodePackets(s, nodeMac(1), nodeMac(2))
+
+	ip := clientIPv4(1)
+	// send sends a UDP packet from the router to ip, awaiting it at the
+	// node numbered want.
+	send := func(payload string, want int) {
+		t.Helper()
+		nw.n.WriteUDPPacketNoNAT(UDPPacket{
+			Src:     netip.AddrPortFrom(nw.n.lanIP4.Addr(), 9999),
+			Dst:     netip.AddrPortFrom(ip, 1234),
+			Payload: []byte(payload),
+		})
+		awaitPacket(t, chans[want-1], payload, func(pkt gopacket.Packet) bool {
+			if pkt.Layer(layers.LayerTypeARP) != nil {
+				t.Fatalf("node %d got ARP packet %v", want, pkt)
+			}
+			app := pkt.ApplicationLayer()
+			return app != nil && string(app.Payload()) == payload
+		})
+	}
+
+	send("before", 1)
+
+	// Node 2 takes over node 1's address, announcing it.
+	must.Do(s.handleEthernetFrameFromVM(mkARPRequest(nodeMac(2), ip, ip)))
+	if mac, _ := nw.n.MACOfIP(ip); mac != nodeMac(2) {
+		t.Errorf("MACOfIP(%v) = %v; want %v", ip, mac, nodeMac(2))
+	}
+	send("after", 2)
+
+	// Once the learned MAC ages out, the router goes back to the node
+	// configured with the address.
+	clock.Advance(time.Minute)
+	send("aged out", 1)
+}
+
+func TestProxyARP(t *testing.T) {
+	for _, proxy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("proxy=%v", proxy), func(t *testing.T) {
+			var c Config
+			nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+			nw.SetProxyARP(proxy)
+			c.AddNode(nw)
+			s := must.Get(New(&c))
+			defer s.Close()
+			got := nodePackets(s, nodeMac(1))[0]
+
+			// arp returns the MAC the router answers an ARP request for ip
+			// with, or the zero MAC if it doesn't answer.
+			arp := func(ip netip.Addr) MAC {
+				t.Helper()
+				must.Do(s.handleEthernetFrameFromVM(mkARPRequest(nodeMac(1), clientIPv4(1), ip)))
+				select {
+				case pkt := <-got:
+					a, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+					if !ok || a.Operation != layers.ARPReply || !bytes.Equal(a.SourceProtAddress, ip.AsSlice()) {
+						t.Fatalf("unexpected reply %v", pkt)
+					}
+					return MAC(a.SourceHwAddress)
+				default:
+					return MAC{}
+				}
+			}
+
+			offLink := netip.MustParseAddr("8.8.8.8")
+			var want MAC
+			if proxy {
+				want = nw.n.mac
+			}
+			if got := arp(offLink); got != want {
+				t.Errorf("ARP for %v answered with %v; want %v", offLink, got, want)
+			}
+			// Proxy ARP or not, the router answers for itself but not
+			// for unused LAN addresses.
+			if got := arp(nw.n.lanIP4.Addr()); got != nw.n.mac {
+				t.Errorf("ARP for the router answered with %v; want %v", got, nw.n.mac)
+			}
+			if got := arp(clientIPv4(50)); got != (MAC{}) {
+				t.Errorf("ARP for an unused LAN address answered with %v", got)
+			}
+		})
+	}
+}
+
+// mkARPRequest makes a broadcast ARP request from srcMAC and srcIP for dstIP.
+// If srcIP is dstIP, it's a gratuitous ARP announcing srcIP.
+func mkARPRequest(srcMAC MAC, srcIP, dstIP netip.Addr) []byte {
+	return mustPacket(
+		&layers.Ethernet{SrcMAC: srcMAC.HWAddr(), DstMAC: macBroadcast.HWAddr(), EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   srcMAC.HWAddr(),
+			SourceProtAddress: srcIP.AsSlice(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    dstIP.AsSlice(),
+		},
+	)
+}
+
+func TestIGMPSnooping(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	for range 3 {
+		c.AddNode(nw)
+	}
+	s := must.Get(New(&c))
+	defer s.Close()
+	chans := nodePackets(s, nodeMac(1), nodeMac(2), nodeMac(3))
+
+	group := netip.MustParseAddrPort("239.1.2.3:4567")
+	// send multicasts payload from node 1 to dst, returning which other
+	// nodes got it.
+	send := func(dst netip.AddrPort, payload string) (got []int) {
+		t.Helper()
+		must.Do(s.handleEthernetFrameFromVM(mkMulticastUDPPacket(nodeMac(1), netip.AddrPortFrom(clientIPv4(1), 4567), dst, payload)))
+		for i, ch := range chans {
+			select {
+			case pkt := <-ch:
+				if app := pkt.ApplicationLayer(); app != nil && string(app.Payload()) == payload {
+					got = append(got, i+1)
+				}
+			default:
+			}
+		}
+		return got
+	}
+
+	if got := send(group, "nobody"); len(got) > 0 {
+		t.Errorf("multicast to a group without members reached nodes %v", got)
+	}
+	must.Do(s.handleEthernetFrameFromVM(mkIGMPv2(nodeMac(2), clientIPv4(2), layers.IGMPMembershipReportV2, group.Addr())))
+	if got, want := send(group, "joined"), []int{2}; !slices.Equal(got, want) {
+		t.Errorf("multicast after node 2 joined reached nodes %v; want %v", got, want)
+	}
+	allHosts := netip.MustParseAddrPort("224.0.0.1:4567")
+	if got, want := send(allHosts, "all hosts"), []int{2, 3}; !slices.Equal(got, want) {
+		t.Errorf("multicast to all hosts reached nodes %v; want %v", got, want)
+	}
+	must.Do(s.handleEthernetFrameFromVM(mkIGMPv2(nodeMac(2), clientIPv4(2), layers.IGMPLeaveGroup, group.Addr())))
+	if got := send(group, "left"); len(got) > 0 {
+		t.Errorf("multicast after node 2 left reached nodes %v", got)
+	}
+}
+
+// mkMulticastUDPPacket makes a UDP packet ethernet frame from srcMAC to the
+// IPv4 multicast group of dst.
+func mkMulticastUDPPacket(srcMAC MAC, src, dst netip.AddrPort, payload string) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC: srcMAC.HWAddr(),
+		DstMAC: multicastMAC(dst.Addr()).HWAddr(),
+	}
+	ip := mkIPLayer(layers.IPProtocolUDP, src.Addr(), dst.Addr())
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port()),
+		DstPort: layers.UDPPort(dst.Port()),
+	}
+	return mustPacket(eth, ip, udp, gopacket.Payload([]byte(payload)))
+}
+
+// mkIGMPv2 makes an IGMPv2 message ethernet frame of type typ about group,
+// from srcMAC and srcIP.
+func mkIGMPv2(srcMAC MAC, srcIP netip.Addr, typ layers.IGMPType, group netip.Addr) []byte {
+	msg := make([]byte, 8)
+	msg[0] = byte(typ)
+	copy(msg[4:], group.AsSlice())
+	binary.BigEndian.PutUint16(msg[2:], ^checksum.Checksum(msg, 0))
+	dst := group
+	if typ == layers.IGMPLeaveGroup {
+		dst = netip.MustParseAddr("224.0.0.2") // all routers
+	}
+	return mustPacket(
+		&layers.Ethernet{SrcMAC: srcMAC.HWAddr(), DstMAC: multicastMAC(dst).HWAddr()},
+		&layers.IPv4{Protocol: layers.IPProtocolIGMP, TTL: 1, SrcIP: srcIP.AsSlice(), DstIP: dst.AsSlice()},
+		gopacket.Payload(msg),
+	)
+}
+
+func TestMDNSRelay(t *testing.T) {
+	s := must.Get(newTwoNodesSameNetwork())
+	defer s.Close()
+	got := nodePackets(s, nodeMac(2))[0]
+
+	query := string(mustPacket(&layers.DNS{ID: 0, Questions: []layers.DNSQuestion{{
+		Name:  []byte("_ssh._tcp.local"),
+		Type:  layers.DNSTypePTR,
+		Class: layers.DNSClassIN,
+	}}}))
+	isQuery := func(pkt gopacket.Packet) bool {
+		app := pkt.ApplicationLayer()
+		return app != nil && string(app.Payload()) == query
+	}
+
+	// Over IPv4, once node 2 joins the mDNS group.
+	must.Do(s.handleEthernetFrameFromVM(mkIGMPv2(nodeMac(2), clientIPv4(2), layers.IGMPMembershipReportV2, mdnsGroup4)))
+	must.Do(s.handleEthernetFrameFromVM(mkMulticastUDPPacket(nodeMac(1),
+		netip.AddrPortFrom(clientIPv4(1), 5353), netip.AddrPortFrom(mdnsGroup4, 5353), query)))
+	awaitPacket(t, got, "IPv4 mDNS query", isQuery)
+
+	// Over IPv6.
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: macMDNS6.HWAddr()},
+		mkIPLayer(layers.IPProtocolUDP, netip.MustParseAddr("fe80::1"), mdnsGroup6),
+		&layers.UDP{SrcPort: 5353, DstPort: 5353},
+		gopacket.Payload(query),
+	)))
+	awaitPacket(t, got, "IPv6 mDNS query", isQuery)
+}
+
+func TestAddRemoveNode(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	node := must.Get(s.AddNode(nw))
+	if got, want := node.MAC(), nodeMac(2); got != want {
+		t.Fatalf("added node's MAC = %v; want %v", got, want)
+	}
+	if name := s.CaptureInterfaceName(node.n.interfaceID); name != "node2" {
+		t.Errorf("added node's capture interface = %q; want node2", name)
+	}
+	got := nodePackets(s, nodeMac(2))[0]
+
+	// It gets a DHCP offer of the address its node number implies.
+	must.Do(s.handleEthernetFrameFromVM(mkDHCP(nodeMac(2), layers.DHCPMsgTypeDiscover)))
+	awaitPacket(t, got, "DHCP offer", func(pkt gopacket.Packet) bool {
+		dhcp, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		return ok && netip.AddrFrom4([4]byte(dhcp.YourClientIP.To4())) == clientIPv4(2)
+	})
+
+	// And can reach the internet through the NAT.
+	txid := stun.NewTxID()
+	src := netip.AddrPortFrom(clientIPv4(2), 40000)
+	stunServer := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(2), src, stunServer, string(stun.Request(txid)))))
+	awaitPacket(t, got, "STUN response", func(pkt gopacket.Packet) bool {
+		app := pkt.ApplicationLayer()
+		if app == nil {
+			return false
+		}
+		gotTxID, mapped, err := stun.ParseResponse(app.Payload())
+		return err == nil && gotTxID == txid && mapped.Addr() == netip.MustParseAddr("2.1.1.1")
+	})
+
+	must.Do(s.RemoveNode(node))
+	if slices.Contains(slices.Collect(s.MACs()), nodeMac(2)) {
+		t.Error("removed node's MAC still listed")
+	}
+	if err := s.handleEthernetFrameFromVM(mkDHCP(nodeMac(2), layers.DHCPMsgTypeDiscover)); err == nil {
+		t.Error("frame from removed node accepted")
+	}
+	if err := s.RemoveNode(node); err == nil {
+		t.Error("removing the node twice succeeded")
+	}
+
+	// Node numbers aren't reused.
+	if mac := must.Get(s.AddNode(nw)).MAC(); mac != nodeMac(3) {
+		t.Errorf("next added node's MAC = %v; want %v", mac, nodeMac(3))
+	}
+	if _, err := s.AddNode(nw, nw); err == nil {
+		t.Error("AddNode with a *Network opt succeeded")
+	}
+	must.Do(s.RemoveNode(must.Get(s.AddNode(nw, HostStack))))
+}
+
+func TestAddRemoveNetwork(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	if _, err := s.AddNetwork("2.1.1.1", "10.0.0.1/24", EasyNAT); err == nil {
+		t.Error("AddNetwork with a WAN IP in use succeeded")
+	}
+	if _, err := s.AddNetwork("2.2.2.2", "192.168.0.1/24", EasyNAT); err == nil {
+		t.Error("AddNetwork with an overlapping LAN succeeded")
+	}
+	nw := must.Get(s.AddNetwork("2.2.2.2", "10.0.0.1/24", EasyNAT))
+	if nw.num != 2 {
+		t.Errorf("added network number = %d; want 2", nw.num)
+	}
+	node := must.Get(s.AddNode(nw))
+	lanIP := node.n.lanIP
+	if !netip.MustParsePrefix("10.0.0.0/24").Contains(lanIP) {
+		t.Fatalf("added node's LAN IP = %v; want one in 10.0.0.0/24", lanIP)
+	}
+	got := nodePackets(s, node.MAC())[0]
+
+	// Its traffic goes out through its WAN IP, and replies are routed back
+	// in to it.
+	var from netip.AddrPort
+	svc := netip.MustParseAddrPort("5.6.7.8:7")
+	must.Do(s.RegisterWANUDPService(svc.Addr(), svc.Port(), func(src netip.AddrPort, payload []byte) []byte {
+		from = src
+		return payload
+	}))
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: node.MAC().HWAddr(), DstMAC: routerMac(2).HWAddr()},
+		mkIPLayer(layers.IPProtocolUDP, lanIP, svc.Addr()),
+		&layers.UDP{SrcPort: 40000, DstPort: layers.UDPPort(svc.Port())},
+		gopacket.Payload("hello"),
+	)))
+	awaitPacket(t, got, "echo reply", func(pkt gopacket.Packet) bool {
+		f, ok := flow(pkt)
+		udp, isUDP := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		return ok && isUDP && f.dst == lanIP && udp.DstPort == 40000 && string(udp.Payload) == "hello"
+	})
+	if from.Addr() != netip.MustParseAddr("2.2.2.2") {
+		t.Errorf("echo service saw the packet from %v; want 2.2.2.2", from)
+	}
+	if n := len(s.Topology().Networks); n != 2 {
+		t.Errorf("Topology has %d networks; want 2", n)
+	}
+
+	must.Do(s.RemoveNetwork(nw))
+	if n := len(s.Topology().Networks); n != 1 {
+		t.Errorf("Topology has %d networks after removal; want 1", n)
+	}
+	if _, ok := s.networkByWAN.Load().Lookup(netip.MustParseAddr("2.2.2.2")); ok {
+		t.Error("removed network's WAN IP still routed")
+	}
+	if err := s.handleEthernetFrameFromVM(mkDHCP(node.MAC(), layers.DHCPMsgTypeDiscover)); err == nil {
+		t.Error("frame from removed network's node accepted")
+	}
+	if _, err := s.AddNode(nw); err == nil {
+		t.Error("AddNode to a removed network succeeded")
+	}
+	if err := s.RemoveNetwork(nw); err == nil {
+		t.Error("removing the network twice succeeded")
+	}
+
+	// Its WAN IP is free for reuse.
+	must.Get(s.AddNetwork("2.2.2.2", "10.0.0.1/24", EasyNAT))
+}
+
+func TestTopologyAfterRemoveNetwork(t *testing.T) {
+	var c Config
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	c.AddNode(nw1)
+	c.AddNode(c.AddNetwork("2.2.2.2", "10.0.0.1/24", HardNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	must.Do(s.RemoveNetwork(nw1))
+	top := s.Topology()
+	if len(top.Networks) != 1 || len(top.Nodes) != 1 {
+		t.Fatalf("Topology has %d networks and %d nodes; want 1 and 1", len(top.Networks), len(top.Nodes))
+	}
+	if _, ok := top.Network(1); ok {
+		t.Error("Topology still has removed network 1")
+	}
+	nw, ok := top.Network(top.Nodes[0].Network)
+	if !ok || nw.Num != 2 || nw.WANIP4 != netip.MustParseAddr("2.2.2.2") {
+		t.Errorf("node's network = %+v, %v; want network 2 with WAN IP 2.2.2.2", nw, ok)
+	}
+
+	var buf bytes.Buffer
+	s.WriteStartingBanner(&buf)
+	if got := buf.String(); !strings.Contains(got, "2.2.2.2, hard") || strings.Contains(got, "2.1.1.1") {
+		t.Errorf("banner doesn't describe only network 2:\n%s", got)
+	}
+}
+
+func TestWANIPPool(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw.SetWANIPPool(WANIPPerHost, netip.MustParseAddr("2.1.1.5"), netip.MustParseAddr("2.1.1.6"))
+	c.AddNode(nw)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	var mu sync.Mutex
+	var srcs []netip.AddrPort
+	svc := netip.MustParseAddrPort("5.6.7.8:7")
+	must.Do(s.RegisterWANUDPService(svc.Addr(), svc.Port(), func(src netip.AddrPort, payload []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		srcs = append(srcs, src)
+		return payload
+	}))
+
+	chans := nodePackets(s, nodeMac(1), nodeMac(2))
+	// send sends a datagram from node num's LAN port to the service,
+	// returning the WAN ip:port it came from after awaiting the reply.
+	send := func(num int, port uint16) netip.AddrPort {
+		t.Helper()
+		payload := fmt.Sprintf("from %d:%d", num, port)
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(num), netip.AddrPortFrom(clientIPv4(num), port), svc, payload)))
+		awaitPacket(t, chans[num-1], "reply", func(pkt gopacket.Packet) bool {
+			udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			return ok && uint16(udp.DstPort) == port && string(udp.Payload) == payload
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		return srcs[len(srcs)-1]
+	}
+
+	node1 := send(1, 1000)
+	node2 := send(2, 1000)
+	if node1.Addr() != netip.MustParseAddr("2.1.1.1") || node2.Addr() != netip.MustParseAddr("2.1.1.5") {
+		t.Errorf("nodes' WAN IPs = %v, %v; want 2.1.1.1, 2.1.1.5", node1.Addr(), node2.Addr())
+	}
+	for port := uint16(2000); port < 2005; port++ {
+		if got := send(2, port); got.Addr() != node2.Addr() {
+			t.Errorf("node 2 flow from port %d came from %v; want %v", port, got, node2.Addr())
+		}
+	}
+}
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		in   string
+		want SyslogEntry
+	}{
+		{
+			name: "rfc3164",
+			in:   "<34>Dec 31 23:59:58 mymachine su: 'su root' failed\n",
+			want: SyslogEntry{Facility: 4, Severity: 2, Time: time.Date(2024, 12, 31, 23, 59, 58, 0, time.UTC), Hostname: "mymachine", Tag: "su", Message: "'su root' failed"},
+		},
+		{
+			name: "rfc3164-rfc3339-time",
+			in:   "<6>2024-08-30T10:36:06-07:00 natlabapp tailscaled[1]: 2024/08/30 10:36:06 some-message",
+			want: SyslogEntry{Facility: 0, Severity: 6, Time: time.Date(2024, 8, 30, 17, 36, 6, 0, time.UTC), Hostname: "natlabapp", Tag: "tailscaled", PID: "1", Message: "2024/08/30 10:36:06 some-message"},
+		},
+		{
+			name: "rfc5424",
+			in:   `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 123 ID47 [exampleSDID@32473 iut="3" eventID="1011\]"][x@1 a="b"] An application event`,
+			want: SyslogEntry{Facility: 20, Severity: 5, Time: time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC), Hostname: "mymachine.example.com", Tag: "evntslog", PID: "123", Message: "An application event"},
+		},
+		{
+			name: "rfc5424-nil-values",
+			in:   "<13>1 - - - - - - \ufeffhello",
+			want: SyslogEntry{Facility: 1, Severity: 5, Message: "hello"},
+		},
+		{
+			name: "no-header",
+			in:   "<14>just a message",
+			want: SyslogEntry{Facility: 1, Severity: 6, Message: "just a message"},
+		},
+		{
+			name: "no-priority",
+			in:   "<999>x",
+			want: SyslogEntry{Facility: 1, Severity: 5, Message: "<999>x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSyslog([]byte(tt.in), now)
+			if !got.Time.Equal(tt.want.Time) {
+				t.Errorf("Time = %v; want %v", got.Time, tt.want.Time)
+			}
+			got.Time, tt.want.Time = time.Time{}, time.Time{}
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeSyslogs(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	must.Do(s.handleEthernetFrameFromVM(mkSyslogPacket(clientIPv4(1), "<6>2024-08-30T10:36:06-07:00 natlabapp tailscaled[1]: some-message")))
+	got := node.Syslogs()
+	if len(got) != 1 {
+		t.Fatalf("got %d syslog entries; want 1", len(got))
+	}
+	if e := got[0]; e.Tag != "tailscaled" || e.Severity != 6 || e.Message != "some-message" {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestStats(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT)
+	c.AddNode(nw)
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+	newSideEffects(s)
+
+	lanFrame := mkEth(nodeMac(2), nodeMac(1), testingEthertype, []byte("hello"))
+	must.Do(s.handleEthernetFrameFromVM(lanFrame))
+	wanFrame := mkUDPPacket(nodeMac(1),
+		netip.MustParseAddrPort("192.168.1.101:1234"),
+		netip.MustParseAddrPort("8.8.8.8:9999"),
+		"to-internet")
+	must.Do(s.handleEthernetFrameFromVM(wanFrame))
+	s.routeUDPPacket(UDPPacket{
+		Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+		Dst:     netip.MustParseAddrPort("2.1.1.1:4444"),
+		Payload: []byte("unsolicited"),
+	})
+
+	got := s.Stats()
+	want1 := NodeStats{
+		TxPackets:    2,
+		TxBytes:      int64(len(lanFrame) + len(wanFrame)),
+		LANDelivered: 1,
+		WANForwarded: 1,
+	}
+	if got := got.Nodes[nodeMac(1)]; got != want1 {
+		t.Errorf("node 1 stats = %+v; want %+v", got, want1)
+	}
+	want2 := NodeStats{
+		RxPackets: 1,
+		RxBytes:   int64(len(lanFrame)),
+	}
+	if got := got.Nodes[nodeMac(2)]; got != want2 {
+		t.Errorf("node 2 stats = %+v; want %+v", got, want2)
+	}
+	if got, want := got.Networks[1], (NetworkStats{NATDropped: 1}); got != want {
+		t.Errorf("network 1 stats = %+v; want %+v", got, want)
+	}
+}
+
+// connectDERP plays the part of node i (1-based) completing a TCP handshake
+// with the first fake DERP server.
+func connectDERP(t *testing.T, s *Server, i int) {
+	got := nodePackets(s, nodeMac(i))[0]
+	src := netip.AddrPortFrom(mustNode(s, nodeMac(i)).lanIP, 40000)
+	derp := netip.AddrPortFrom(fakeDERPs[0].v4, 443)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(i), routerMac(i), src, derp,
+		&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+	synAck := awaitPacket(t, got, "SYN-ACK", isTCPPacket(derp, src, true, true)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(i), routerMac(i), src, derp,
+		&layers.TCP{Seq: 1001, Ack: synAck.Seq + 1, ACK: true, Window: 65535})))
+	node := mustNode(s, nodeMac(i))
+	awaitCond(t, 5*time.Second, func() error {
+		s.paths.mu.Lock()
+		defer s.paths.mu.Unlock()
+		if !s.paths.derp.Contains(node) {
+			return fmt.Errorf("%v not connected to DERP", node)
+		}
+		return nil
+	})
+}
+
+// sendDirect sends UDP from node i (1 or 2) to the WAN IP of the other node's
+// network, 2.2.2.2 or 2.1.1.1 respectively.
+func sendDirect(s *Server, i int) {
+	lanIP := mustNode(s, nodeMac(i)).lanIP
+	peerWAN := [...]netip.Addr{1: netip.MustParseAddr("2.2.2.2"), 2: netip.MustParseAddr("2.1.1.1")}[i]
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(i).HWAddr(), DstMAC: routerMac(i).HWAddr()},
+		mkIPLayer(layers.IPProtocolUDP, lanIP, peerWAN),
+		&layers.UDP{SrcPort: 41641, DstPort: 41641},
+		gopacket.Payload("disco"))))
+}
+
+func TestAwaitDirectUpgrade(t *testing.T) {
+	newPair := func(t *testing.T) (*Server, [2]*Node) {
+		var c Config
+		n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT))
+		n2 := c.AddNode(c.AddNetwork("2.2.2.2", "10.0.0.1/24", One2OneNAT))
+		s := must.Get(New(&c))
+		t.Cleanup(s.Close)
+		newSideEffects(s) // register sinks so the nodes are reachable
+		return s, [2]*Node{n1, n2}
+	}
+	t.Run("upgrade", func(t *testing.T) {
+		s, nodes := newPair(t)
+		errc := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			errc <- s.AwaitDirectUpgrade(ctx, nodes[0], nodes[1])
+		}()
+		connectDERP(t, s, 1)
+		connectDERP(t, s, 2)
+		sendDirect(s, 1)
+		sendDirect(s, 2)
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("never-upgraded", func(t *testing.T) {
+		s, nodes := newPair(t)
+		connectDERP(t, s, 1)
+		connectDERP(t, s, 2)
+		sendDirect(s, 1) // but no reply
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := s.AwaitDirectUpgrade(ctx, nodes[0], nodes[1])
+		if err == nil || !strings.Contains(err.Error(), "never upgraded") {
+			t.Fatalf("got error %v; want never upgraded", err)
+		}
+	})
+
+	t.Run("direct-without-derp", func(t *testing.T) {
+		s, nodes := newPair(t)
+		sendDirect(s, 1)
+		sendDirect(s, 2)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := s.AwaitDirectUpgrade(ctx, nodes[0], nodes[1])
+		if err == nil || !strings.Contains(err.Error(), "before both connected to DERP") {
+			t.Fatalf("got error %v; want direct before DERP", err)
+		}
+	})
+}
+
+func TestPathKind(t *testing.T) {
+	tests := []struct {
+		name string
+		nat  NAT
+		want PathKind
+	}{
+		{"open-cone", One2OneNAT, PathDirect},
+		{"symmetric", HardNAT, PathDERP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", tt.nat))
+			n2 := c.AddNode(c.AddNetwork("2.2.2.2", "10.0.0.1/24", tt.nat))
+			s := must.Get(New(&c))
+			defer s.Close()
+			newSideEffects(s) // register sinks so the nodes are reachable
+
+			if got := s.PathKind(n1, n2); got != PathNone {
+				t.Errorf("initially PathKind = %q; want %q", got, PathNone)
+			}
+			connectDERP(t, s, 1)
+			connectDERP(t, s, 2)
+			// Neither NAT has a mapping for the other's packets, so only
+			// One2OneNAT lets them through.
+			sendDirect(s, 1)
+			sendDirect(s, 2)
+			if got := s.PathKind(n1, n2); got != tt.want {
+				t.Errorf("PathKind = %q; want %q", got, tt.want)
+			}
+			if got := s.PathKind(n2, n1); got != tt.want {
+				t.Errorf("reversed PathKind = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitNodeOnline(t *testing.T) {
+	var c Config
+	n1 := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+	newSideEffects(s) // register sinks so the node is reachable
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitNodeOnline(ctx, n1); err == nil || !strings.Contains(err.Error(), "never registered") {
+		t.Fatalf("got error %v; want never registered", err)
+	}
+
+	// Register the node with control as tailscaled would, reporting its LAN
+	// address as an endpoint, but without DERP yet.
+	s.Control().AddFakeNode()
+	cn := s.Control().AllNodes()[0]
+	cn.Endpoints = []netip.AddrPort{netip.AddrPortFrom(n1.LANIP(), 41641)}
+	s.Control().UpdateNode(cn)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitNodeOnline(ctx, n1); err == nil || !strings.Contains(err.Error(), "never connected") {
+		t.Fatalf("got error %v; want never connected", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errc <- s.WaitNodeOnline(ctx, n1)
+	}()
+	connectDERP(t, s, 1)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// natOutObserver is an Observer recording OnNATOut calls.
+type natOutObserver struct {
+	NopObserver
+	got [][3]netip.AddrPort
+}
+
+func (o *natOutObserver) OnNATOut(src, dst, newSrc netip.AddrPort) {
+	o.got = append(o.got, [3]netip.AddrPort{src, dst, newSrc})
+}
+
+func TestObserverNATOut(t *testing.T) {
+	obs := new(natOutObserver)
+	var c Config
+	c.SetObserver(obs)
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	src := netip.MustParseAddrPort("192.168.1.101:1234")
+	dst := netip.MustParseAddrPort("8.8.8.8:9999")
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, dst, "hello")))
+
+	want := [][3]netip.AddrPort{{src, dst, netip.MustParseAddrPort("2.1.1.1:1234")}}
+	if !reflect.DeepEqual(obs.got, want) {
+		t.Errorf("OnNATOut calls = %v; want %v", obs.got, want)
+	}
+}
+
+func TestNumDERPs(t *testing.T) {
+	var c Config
+	c.SetNumDERPs(3)
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	if got := len(s.control.DERPMap.Regions); got != 3 {
+		t.Fatalf("got %d DERP regions; want 3", got)
+	}
+	seen := set.Set[*derpServer]{}
+	for id, r := range s.control.DERPMap.Regions {
+		ip := netip.MustParseAddr(r.Nodes[0].IPv4)
+		if want := netip.AddrFrom4([4]byte{33, 4, 0, byte(id)}); ip != want {
+			t.Errorf("region %d IP = %v; want %v", id, ip, want)
+		}
+		ds, ok := s.derpServerFor(ip)
+		if !ok {
+			t.Errorf("region %d: no DERP server for %v", id, ip)
+			continue
+		}
+		seen.Add(ds)
+
+		syn := gopacket.NewPacket(mkTCPPacket(nodeMac(1), routerMac(1),
+			netip.AddrPortFrom(clientIPv4(1), 40000), netip.AddrPortFrom(ip, 443),
+			&layers.TCP{SYN: true}), layers.LayerTypeEthernet, gopacket.Default)
+		if !s.shouldInterceptTCP(syn) {
+			t.Errorf("region %d: TCP to %v:443 not intercepted", id, ip)
+		}
+
+		rec := httptest.NewRecorder()
+		ds.handler.ServeHTTP(rec, httptest.NewRequest("GET", "/generate_204", nil))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("region %d: /generate_204 = %v", id, rec.Code)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("got %d distinct DERP servers; want 3", len(seen))
+	}
+
+	c.SetNumDERPs(len(derpRegions) + 1)
+	if _, err := New(&c); err == nil {
+		t.Error("New with too many DERPs succeeded")
+	}
+}
+
+// startControlClient logs a control client in to the fake control server over
+// node, which must have the HostStack option, and polls for netmaps until the
+// test ends. It returns a channel of the netmaps it gets.
+func startControlClient(t *testing.T, s *Server, node *Node) <-chan *netmap.NetworkMap {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	hc := &http.Client{Transport: &http.Transport{DialContext: node.Dial}}
+	req := must.Get(http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://control.tailscale/key?v=%d", tailcfg.CurrentCapabilityVersion), nil))
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys tailcfg.OverTLSPublicKeyResponse
+	err = json.NewDecoder(res.Body).Decode(&keys)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controlIP, _, _ := s.VIP("control.tailscale")
+	mk := key.NewMachine()
+	d := &controlhttp.Dialer{
+		Hostname:        "control.tailscale",
+		HTTPPort:        "80",
+		HTTPSPort:       controlhttp.NoPort,
+		MachineKey:      mk,
+		ControlKey:      keys.PublicKey,
+		ProtocolVersion: uint16(tailcfg.CurrentCapabilityVersion),
+		Dialer:          node.Dial,
+		DNSCache: &dnscache.Resolver{
+			SingleHost:             "control.tailscale",
+			SingleHostStaticResult: []netip.Addr{controlIP},
+		},
+	}
+	conn, err := d.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var dialed atomic.Bool
+	noise := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(context.Context, string, string, *tls.Config) (net.Conn, error) {
+			if dialed.Swap(true) {
+				return nil, errors.New("Noise connection already used")
+			}
+			return conn, nil
+		},
+	}}
+
+	cc := must.Get(controlclient.NewDirect(controlclient.Options{
+		ServerURL:            "http://control.tailscale",
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) { return mk, nil },
+		Logf:                 logger.Discard,
+		Hostinfo:             &tailcfg.Hostinfo{BackendLogID: "vnet-test"},
+		HTTPTestClient:       hc,
+		NoiseTestClient:      noise,
+		Dialer:               tsdial.NewDialer(netmon.NewStatic()),
+	}))
+	t.Cleanup(func() { cc.Close() })
+	if _, err := cc.TryLogin(ctx, controlclient.LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	nms := make(chan *netmap.NetworkMap, 100)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cc.PollNetMap(ctx, netmapUpdater(nms))
+	}()
+	return nms
+}
+
+// netmapUpdater is a controlclient.NetmapUpdater that sends the netmaps it
+// gets to a channel.
+type netmapUpdater chan *netmap.NetworkMap
+
+func (u netmapUpdater) UpdateFullNetmap(nm *netmap.NetworkMap) { u <- nm }
+
+// awaitNetmap returns the first netmap from nms for which cond returns true,
+// failing the test if there isn't one within 10 seconds.
+func awaitNetmap(t *testing.T, nms <-chan *netmap.NetworkMap, cond func(*netmap.NetworkMap) bool) *netmap.NetworkMap {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case nm := <-nms:
+			if cond(nm) {
+				return nm
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for netmap")
+		}
+	}
+}
+
+func TestSetDERPMap(t *testing.T) {
+	var c Config
+	var base *tailcfg.DERPMap
+	c.SetDERPMapHook(func(dm *tailcfg.DERPMap) {
+		dm.Regions[900] = &tailcfg.DERPRegion{RegionID: 900, RegionCode: "custom"}
+		base = dm.Clone()
+	})
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	nms := startControlClient(t, s, node)
+	awaitNetmap(t, nms, func(nm *netmap.NetworkMap) bool {
+		return nm.DERPMap != nil && nm.DERPMap.Regions[900] != nil
+	})
+
+	dm := base.Clone()
+	delete(dm.Regions, 1)
+	dm.Regions[901] = &tailcfg.DERPRegion{RegionID: 901, RegionCode: "added"}
+	s.SetDERPMap(dm)
+	nm := awaitNetmap(t, nms, func(nm *netmap.NetworkMap) bool {
+		return nm.DERPMap != nil && nm.DERPMap.Regions[901] != nil
+	})
+	if _, ok := nm.DERPMap.Regions[1]; ok {
+		t.Errorf("region 1 still in the DERP map after its removal")
+	}
+}
+
+func TestControlSubnetRoutes(t *testing.T) {
+	var c Config
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nodeA := c.AddNode(nw, HostStack)
+	nodeB := c.AddNode(nw, HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	nmsA := startControlClient(t, s, nodeA)
+	nmsB := startControlClient(t, s, nodeB)
+	keyB := awaitNetmap(t, nmsB, func(*netmap.NetworkMap) bool { return true }).NodeKey
+	awaitNetmap(t, nmsA, func(nm *netmap.NetworkMap) bool { return len(nm.Peers) == 1 })
+
+	// The clients poll for netmaps only once, so node A must see each
+	// change to B's routes over its existing map poll, without
+	// reconnecting.
+	hasRoutes := func(routes ...netip.Prefix) func(*netmap.NetworkMap) bool {
+		return func(nm *netmap.NetworkMap) bool {
+			return len(nm.Peers) == 1 &&
+				nm.Peers[0].Key() == keyB &&
+				slices.Equal(nm.Peers[0].PrimaryRoutes().AsSlice(), routes)
+		}
+	}
+	route1 := netip.MustParsePrefix("10.1.0.0/24")
+	route2 := netip.MustParsePrefix("10.2.0.0/24")
+	s.Control().SetSubnetRoutes(keyB, []netip.Prefix{route1})
+	awaitNetmap(t, nmsA, hasRoutes(route1))
+	s.Control().SetSubnetRoutes(keyB, []netip.Prefix{route2})
+	awaitNetmap(t, nmsA, hasRoutes(route2))
+	s.Control().SetSubnetRoutes(keyB, nil)
+	awaitNetmap(t, nmsA, hasRoutes())
+}
+
+func TestDERPLatency(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	var c Config
+	c.SetClock(clock)
+	c.SetNumDERPs(3)
+	c.SetDERPLatency(1, 80*time.Millisecond)
+	c.SetDERPLatency(2, 20*time.Millisecond)
+	c.SetDERPLatency(3, 50*time.Millisecond)
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// Probe all regions' /generate_204 at once, as netcheck does, and see
+	// which answers first as the clock advances.
+	done := make(chan int, len(s.derps))
+	for i, ds := range s.derps {
+		go func() {
+			rec := httptest.NewRecorder()
+			ds.handler.ServeHTTP(rec, httptest.NewRequest("GET", "/generate_204", nil))
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("region %d: /generate_204 = %v", i+1, rec.Code)
+			}
+			done <- i + 1
+		}()
+	}
+	var order []int
+	for len(order) < len(s.derps) {
+		select {
+		case region := <-done:
+			order = append(order, region)
+		case <-time.After(time.Millisecond):
+			clock.Advance(5 * time.Millisecond)
+		}
+	}
+	if want := []int{2, 3, 1}; !slices.Equal(order, want) {
+		t.Errorf("regions answered in order %v; want %v", order, want)
+	}
+
+	c.SetDERPLatency(4, time.Second)
+	if _, err := New(&c); err == nil {
+		t.Error("New with latency for nonexistent region succeeded")
+	}
+}
+
+func TestSetDERPUp(t *testing.T) {
+	var c Config
+	c.SetDERPDownClosesConns(true)
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	got := nodePackets(s, nodeMac(1))[0]
+	srcPort := uint16(40000)
+	// dial plays the part of node 1 connecting to region's DERP server,
+	// returning the first TCP packet it gets back.
+	dial := func(region int) (src, dst netip.AddrPort, res *layers.TCP) {
+		srcPort++
+		src = netip.AddrPortFrom(clientIPv4(1), srcPort)
+		dst = netip.AddrPortFrom(fakeDERPs[region-1].v4, 443)
+		must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, dst,
+			&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+		pkt := awaitPacket(t, got, "TCP reply", func(pkt gopacket.Packet) bool {
+			f, ok := flow(pkt)
+			return ok && f.src == dst.Addr() && pkt.Layer(layers.LayerTypeTCP).(*layers.TCP).DstPort == layers.TCPPort(srcPort)
+		})
+		return src, dst, pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	}
+
+	src, dst, res := dial(1)
+	if !res.SYN || !res.ACK {
+		t.Fatalf("region 1 before going down: got %+v; want SYN-ACK", res)
+	}
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, dst,
+		&layers.TCP{Seq: 1001, Ack: res.Seq + 1, ACK: true, Window: 65535})))
+	awaitCond(t, 5*time.Second, func() error {
+		ds := s.derps[0]
+		ds.mu.Lock()
+		defer ds.mu.Unlock()
+		if len(ds.conns) != 1 {
+			return fmt.Errorf("got %d DERP conns; want 1", len(ds.conns))
+		}
+		return nil
+	})
+
+	must.Do(s.SetDERPUp(1, false))
+	awaitPacket(t, got, "FIN or RST of existing conn", func(pkt gopacket.Packet) bool {
+		tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return ok && tcp.DstPort == layers.TCPPort(src.Port()) && (tcp.FIN || tcp.RST)
+	})
+	if _, _, res := dial(1); !res.RST {
+		t.Errorf("region 1 while down: got %+v; want RST", res)
+	}
+	if _, _, res := dial(2); !res.SYN || !res.ACK {
+		t.Errorf("region 2 while region 1 down: got %+v; want SYN-ACK", res)
+	}
+
+	must.Do(s.SetDERPUp(1, true))
+	if _, _, res := dial(1); !res.SYN || !res.ACK {
+		t.Errorf("region 1 back up: got %+v; want SYN-ACK", res)
+	}
+	if err := s.SetDERPUp(3, false); err == nil {
+		t.Error("SetDERPUp of nonexistent region succeeded")
+	}
+}
+
+func TestRelocatedVIPs(t *testing.T) {
+	var c Config
+	c.SetVIP("dns", netip.MustParseAddr("10.99.0.53"))
+	c.SetVIP("control.tailscale", netip.MustParseAddr("10.99.0.3"))
+	c.SetVIP("derp1.tailscale", netip.MustParseAddr("10.99.0.1"))
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// The relocated DNS server answers, with the relocated control IP.
+	se := newSideEffects(s)
+	udp := &layers.UDP{SrcPort: 12345, DstPort: 53}
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: routerMac(1).HWAddr()},
+		mkIPLayer(layers.IPProtocolUDP, clientIPv4(1), netip.MustParseAddr("10.99.0.53")),
+		udp,
+		&layers.DNS{ID: 789, Questions: []layers.DNSQuestion{{
+			Name:  []byte("control.tailscale"),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+		}}},
+	)))
+	if err := all(
+		numPkts(1),
+		pktSubstr("SrcIP=10.99.0.53"),
+		pktSubstr("IP=10.99.0.3"),
+	)(se); err != nil {
+		t.Errorf("DNS: %v", err)
+	}
+
+	// DERP is served on, and advertised with, its relocated IP only.
+	isIntercepted := func(dst string) bool {
+		return s.shouldInterceptTCP(gopacket.NewPacket(mkTCPPacket(nodeMac(1), routerMac(1),
+			netip.AddrPortFrom(clientIPv4(1), 40000), netip.MustParseAddrPort(dst),
+			&layers.TCP{SYN: true}), layers.LayerTypeEthernet, gopacket.Default))
+	}
+	if !isIntercepted("10.99.0.1:443") {
+		t.Error("TCP to relocated DERP not intercepted")
+	}
+	if isIntercepted("33.4.0.1:443") {
+		t.Error("TCP to default DERP IP intercepted")
+	}
+	if got := s.control.DERPMap.Regions[1].Nodes[0].IPv4; got != "10.99.0.1" {
+		t.Errorf("DERP map IPv4 = %q; want 10.99.0.1", got)
+	}
+	if got := s.FakeDNSIPv4(); got != netip.MustParseAddr("10.99.0.53") {
+		t.Errorf("FakeDNSIPv4 = %v; want 10.99.0.53", got)
+	}
+	if v4, _, ok := s.VIP("control.tailscale"); !ok || v4 != netip.MustParseAddr("10.99.0.3") {
+		t.Errorf("VIP(control.tailscale) = %v, %v; want 10.99.0.3", v4, ok)
+	}
+
+	for name, ip := range map[string]string{
+		"not-a-fake":        "10.99.0.1",
+		"control.tailscale": "33.4.0.2", // derp2's
+	} {
+		var c Config
+		c.SetVIP(name, netip.MustParseAddr(ip))
+		c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+		if s, err := New(&c); err == nil {
+			s.Close()
+			t.Errorf("SetVIP(%q, %v): New succeeded; want error", name, ip)
+		}
+	}
+}
+
+// mkDNSQuery makes a DNS query from node 1 to the fake DNS server's IPv4
+// address for name's records of type typ.
+func mkDNSQuery(name string, typ layers.DNSType) []byte {
+	udp := &layers.UDP{SrcPort: 12345, DstPort: 53}
+	return mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: routerMac(1).HWAddr()},
+		mkIPLayer(layers.IPProtocolUDP, clientIPv4(1), FakeDNSIPv4()),
+		udp,
+		&layers.DNS{ID: 789, RD: true, Questions: []layers.DNSQuestion{{
+			Name:  []byte(name),
+			Type:  typ,
+			Class: layers.DNSClassIN,
+		}}},
+	)
+}
+
+// dnsResponse returns a side effect checker that checks a DNS response was
+// received with the response code rcode and the answer IPs want.
+func dnsResponse(rcode layers.DNSResponseCode, want ...string) func(*sideEffects) error {
+	return udpPayload(func(payload []byte) error {
+		var dns layers.DNS
+		if err := dns.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+			return err
+		}
+		if dns.ResponseCode != rcode {
+			return fmt.Errorf("got response code %v; want %v", dns.ResponseCode, rcode)
+		}
+		var got []string
+		for _, a := range dns.Answers {
+			got = append(got, a.IP.String())
+		}
+		if !slices.Equal(got, want) {
+			return fmt.Errorf("got answers %q; want %q", got, want)
+		}
+		return nil
+	})
+}
+
+func TestDNSRecords(t *testing.T) {
+	var c Config
+	c.AddDNSRecord("foo.example", netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("10.1.2.4"))
+	c.AddDNSRecord("Foo.Example.", netip.MustParseAddr("fd00::1"))
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	tests := []struct {
+		name  string
+		typ   layers.DNSType
+		check func(*sideEffects) error
+	}{
+		{"foo.example", layers.DNSTypeA, dnsResponse(layers.DNSResponseCodeNoErr, "10.1.2.3", "10.1.2.4")},
+		{"FOO.example", layers.DNSTypeAAAA, dnsResponse(layers.DNSResponseCodeNoErr, "fd00::1")},
+		{"control.tailscale", layers.DNSTypeA, dnsResponse(layers.DNSResponseCodeNoErr, "52.52.0.3")},
+		{"bar.example", layers.DNSTypeA, dnsResponse(layers.DNSResponseCodeNXDomain)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.typ.String(), func(t *testing.T) {
+			se := newSideEffects(s)
+			must.Do(s.handleEthernetFrameFromVM(mkDNSQuery(tt.name, tt.typ)))
+			if err := all(numPkts(1), tt.check)(se); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	var bad Config
+	bad.AddDNSRecord("derp1.tailscale", netip.MustParseAddr("10.1.2.3"))
+	if s, err := New(&bad); err == nil {
+		s.Close()
+		t.Error("record for built-in name: New succeeded; want error")
+	}
+}
+
+func TestDNSResponseCodes(t *testing.T) {
+	var c Config
+	c.AddDNSRecord("v4only.example", netip.MustParseAddr("10.1.2.3"))
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	tests := []struct {
+		desc  string
+		name  string
+		typ   layers.DNSType
+		check func(*sideEffects) error
+	}{
+		{"unknown-name", "nope.example", layers.DNSTypeA, dnsResponse(layers.DNSResponseCodeNXDomain)},
+		{"unknown-name-aaaa", "nope.example", layers.DNSTypeAAAA, dnsResponse(layers.DNSResponseCodeNXDomain)},
+		{"a-only-queried-for-aaaa", "v4only.example", layers.DNSTypeAAAA, dnsResponse(layers.DNSResponseCodeNoErr)},
+		{"a-only-queried-for-mx", "v4only.example", layers.DNSTypeMX, dnsResponse(layers.DNSResponseCodeNoErr)},
+		{"a-only-queried-for-a", "v4only.example", layers.DNSTypeA, dnsResponse(layers.DNSResponseCodeNoErr, "10.1.2.3")},
+		{"ntp-pool", "0.debian.pool.ntp.org", layers.DNSTypeA, dnsResponse(layers.DNSResponseCodeNoErr, "52.52.0.123")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			se := newSideEffects(s)
+			must.Do(s.handleEthernetFrameFromVM(mkDNSQuery(tt.name, tt.typ)))
+			if err := all(numPkts(1), tt.check)(se); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDNSOverTCP(t *testing.T) {
+	var c Config
+	c.AddDNSRecord("foo.example", netip.MustParseAddr("10.1.2.3"))
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+	got := nodePackets(s, nodeMac(1))[0]
+
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	dns := netip.AddrPortFrom(FakeDNSIPv4(), 53)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, dns,
+		&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+	synAck := awaitPacket(t, got, "SYN-ACK", isTCPPacket(dns, src, true, true)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	buf := gopacket.NewSerializeBuffer()
+	must.Do((&layers.DNS{ID: 42, RD: true, Questions: []layers.DNSQuestion{{
+		Name:  []byte("foo.example"),
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+	}}}).SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}))
+	query := binary.BigEndian.AppendUint16(nil, uint16(len(buf.Bytes())))
+	query = append(query, buf.Bytes()...)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, dns,
+		&layers.TCP{Seq: 1001, Ack: synAck.Seq + 1, ACK: true, Window: 65535})))
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: routerMac(1).HWAddr()},
+		mkIPLayer(layers.IPProtocolTCP, src.Addr(), dns.Addr()),
+		&layers.TCP{SrcPort: 40000, DstPort: 53, Seq: 1001, Ack: synAck.Seq + 1, ACK: true, PSH: true, Window: 65535},
+		gopacket.Payload(query),
+	)))
+
+	resPkt := awaitPacket(t, got, "DNS response", func(pkt gopacket.Packet) bool {
+		tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return ok && isTCPPacket(dns, src, false, true)(pkt) && len(tcp.Payload) > 0
+	})
+	res := resPkt.Layer(layers.LayerTypeTCP).(*layers.TCP).Payload
+	if len(res) < 2 || int(binary.BigEndian.Uint16(res)) != len(res)-2 {
+		t.Fatalf("bad length-prefixed response %q", res)
+	}
+	var resp layers.DNS
+	must.Do(resp.DecodeFromBytes(res[2:], gopacket.NilDecodeFeedback))
+	if resp.ID != 42 || len(resp.Answers) != 1 || resp.Answers[0].IP.String() != "10.1.2.3" {
+		t.Errorf("got response ID %v with answers %v; want ID 42 with 10.1.2.3", resp.ID, resp.Answers)
+	}
+}
+
+func TestDNSPTR(t *testing.T) {
+	var c Config
+	c.AddDNSRecord("foo.example", netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("fd00::1"))
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ptrAnswer := func(want string) func(*sideEffects) error {
+		return udpPayload(func(payload []byte) error {
+			var dns layers.DNS
+			if err := dns.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+				return err
+			}
+			if len(dns.Answers) != 1 || string(dns.Answers[0].PTR) != want {
+				return fmt.Errorf("got answers %v; want PTR %q", dns.Answers, want)
+			}
+			return nil
+		})
+	}
+	tests := []struct {
+		name  string
+		check func(*sideEffects) error
+	}{
+		{"3.0.52.52.in-addr.arpa", ptrAnswer("control.tailscale")}, // fakeControl
+		{"3.2.1.10.in-addr.arpa", ptrAnswer("foo.example")},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", ptrAnswer("foo.example")},
+		{"9.9.9.10.in-addr.arpa", dnsResponse(layers.DNSResponseCodeNXDomain)},
+		{"bogus.in-addr.arpa", dnsResponse(layers.DNSResponseCodeNXDomain)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := newSideEffects(s)
+			must.Do(s.handleEthernetFrameFromVM(mkDNSQuery(tt.name, layers.DNSTypePTR)))
+			if err := all(numPkts(1), tt.check)(se); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDNSCNAME(t *testing.T) {
+	var c Config
+	c.AddDNSRecord("foo.example", netip.MustParseAddr("10.1.2.3"))
+	c.AddDNSCNAME("www.example", "web.example")
+	c.AddDNSCNAME("web.example", "foo.example.")
+	c.AddDNSCNAME("loop.example", "loop.example")
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// answers returns a checker that the DNS response has response code
+	// rcode and answers want, formatted as "name type value".
+	answers := func(rcode layers.DNSResponseCode, want ...string) func(*sideEffects) error {
+		return udpPayload(func(payload []byte) error {
+			var dns layers.DNS
+			if err := dns.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+				return err
+			}
+			if dns.ResponseCode != rcode {
+				return fmt.Errorf("got response code %v; want %v", dns.ResponseCode, rcode)
+			}
+			var got []string
+			for _, a := range dns.Answers {
+				v := string(a.CNAME)
+				if a.IP != nil {
+					v = a.IP.String()
+				}
+				got = append(got, fmt.Sprintf("%s %v %s", a.Name, a.Type, v))
+			}
+			if !slices.Equal(got, want) {
+				return fmt.Errorf("got answers %q; want %q", got, want)
+			}
+			return nil
+		})
+	}
+
+	t.Run("two-hops", func(t *testing.T) {
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkDNSQuery("www.example", layers.DNSTypeA)))
+		if err := answers(layers.DNSResponseCodeNoErr,
+			"www.example CNAME web.example",
+			"web.example CNAME foo.example",
+			"foo.example A 10.1.2.3",
+		)(se); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("loop", func(t *testing.T) {
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkDNSQuery("loop.example", layers.DNSTypeA)))
+		if err := answers(layers.DNSResponseCodeServFail)(se); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestDNSLatency(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	var c Config
+	c.SetClock(clock)
+	c.SetDNSLatency(2 * time.Second)
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	se := newSideEffects(s)
+	must.Do(s.handleEthernetFrameFromVM(mkDNSQuery("control.tailscale", layers.DNSTypeA)))
+	if err := numPkts(0)(se); err != nil {
+		t.Fatalf("before delay: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := numPkts(0)(se); err != nil {
+		t.Fatalf("after 1s: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := all(
+		numPkts(1),
+		dnsResponse(layers.DNSResponseCodeNoErr, "52.52.0.3"),
+	)(se); err != nil {
+		t.Fatalf("after 2s: %v", err)
+	}
+
+	t.Run("close", func(t *testing.T) {
+		clock := tstest.NewClock(tstest.ClockOpts{})
+		var c Config
+		c.SetClock(clock)
+		c.SetDNSLatency(time.Second)
+		c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+		s := must.Get(New(&c))
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkDNSQuery("control.tailscale", layers.DNSTypeA)))
+		s.Close()
+		clock.Advance(time.Second)
+		if err := numPkts(0)(se); err != nil {
+			t.Errorf("reply delayed past Close: %v", err)
+		}
+	})
+
+	t.Run("total-loss", func(t *testing.T) {
+		var c Config
+		c.SetDNSQueryLoss(1)
+		c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+		s := must.Get(New(&c))
+		defer s.Close()
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkDNSQuery("control.tailscale", layers.DNSTypeA)))
+		if err := numPkts(0)(se); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestCaptivePortal(t *testing.T) {
+	var c Config
+	all := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	all.SetCaptivePortal()
+	some := c.AddNetwork("2.2.2.2", "10.2.0.1/16", EasyNAT)
+	some.SetCaptivePortal(netip.MustParsePrefix("5.6.0.0/16"))
+	c.AddNode(all)
+	c.AddNode(some)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	nAll := s.nodes[0].net
+	nSome := s.nodes[1].net
+	for _, tt := range []struct {
+		n    *network
+		dst  netip.Addr
+		want bool
+	}{
+		{nAll, netip.MustParseAddr("1.2.3.4"), true},
+		{nAll, fakeDERPs[0].v4, true},
+		{nAll, s.vip(fakeControl).v4, false},
+		{nSome, netip.MustParseAddr("5.6.7.8"), true},
+		{nSome, netip.MustParseAddr("1.2.3.4"), false},
+		{nSome, fakeDERPs[0].v4, false},
+	} {
+		if got := tt.n.isCaptivePortalDst(tt.dst); got != tt.want {
+			t.Errorf("net %v: isCaptivePortalDst(%v) = %v; want %v", tt.n.num, tt.dst, got, tt.want)
+		}
+	}
+
+	// A connection to port 80 of an arbitrary internet IP is answered by
+	// the router rather than forwarded.
+	got := nodePackets(s, nodeMac(1))[0]
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	dst := netip.AddrPortFrom(netip.MustParseAddr("1.2.3.4"), 80)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, dst,
+		&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+	awaitPacket(t, got, "SYN-ACK from captive portal", isTCPPacket(dst, src, true, true))
+
+	ts := httptest.NewServer(nAll.captivePortalHandler())
+	defer ts.Close()
+	hc := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res := must.Get(hc.Get(ts.URL + "/generate_204"))
+	res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		t.Fatalf("/generate_204 got 204 under captive portal")
+	}
+	if res.StatusCode != http.StatusFound {
+		t.Errorf("/generate_204 status = %v; want %v", res.StatusCode, http.StatusFound)
+	}
+	if got, want := res.Header.Get("Location"), "http://192.168.0.1/login"; got != want {
+		t.Errorf("/generate_204 Location = %q; want %q", got, want)
+	}
+	res = must.Get(hc.Get(ts.URL + "/"))
+	body := must.Get(io.ReadAll(res.Body))
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "<html>") {
+		t.Errorf("/ got %v %q; want 200 with login page", res.StatusCode, body)
+	}
+}
+
+// mkSTUNChangeRequest returns a Tailscale STUN binding request with a
+// CHANGE-REQUEST attribute holding flags.
+func mkSTUNChangeRequest(txid stun.TxID, flags uint32) []byte {
+	req := stun.Request(txid)
+	const lenFingerprint = 8
+	b := slices.Clone(req[:len(req)-lenFingerprint])
+	b = binary.BigEndian.AppendUint16(b, stunAttrChangeRequest)
+	b = binary.BigEndian.AppendUint16(b, 4)
+	b = binary.BigEndian.AppendUint32(b, flags)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)+lenFingerprint-stunHeaderLen))
+	b = binary.BigEndian.AppendUint16(b, 0x8028) // FINGERPRINT
+	b = binary.BigEndian.AppendUint16(b, 4)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[:len(b)-4])^0x5354554e)
+}
+
+func TestSTUNChangeRequest(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", One2OneNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	client := netip.MustParseAddrPort("2.1.1.1:40000")
+	primary := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+	alt := netip.AddrPortFrom(s.vip(fakeSTUNAlt).v4, stunAltPort)
+	for _, tt := range []struct {
+		name    string
+		dst     netip.AddrPort
+		flags   uint32
+		wantSrc netip.AddrPort
+	}{
+		{"no-change", primary, 0, primary},
+		{"change-port", primary, stunChangePort, netip.AddrPortFrom(primary.Addr(), stunAltPort)},
+		{"change-ip", primary, stunChangeIP, netip.AddrPortFrom(alt.Addr(), stunPort)},
+		{"change-both", primary, stunChangeIP | stunChangePort, alt},
+		{"change-both-from-alt", alt, stunChangeIP | stunChangePort, primary},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			txid := stun.NewTxID()
+			res, ok := s.makeSTUNReply(UDPPacket{Src: client, Dst: tt.dst, Payload: mkSTUNChangeRequest(txid, tt.flags)})
+			if !ok {
+				t.Fatal("request not answered")
+			}
+			if res.Src != tt.wantSrc || res.Dst != client {
+				t.Errorf("response %v -> %v; want %v -> %v", res.Src, res.Dst, tt.wantSrc, client)
+			}
+			gotTxID, mapped, err := stun.ParseResponse(res.Payload)
+			if err != nil || gotTxID != txid || mapped != client {
+				t.Errorf("ParseResponse = %x, %v, %v; want %x, %v", gotTxID, mapped, err, txid, client)
+			}
+			wantOther := alt
+			if tt.dst == alt {
+				wantOther = primary
+			}
+			for _, attr := range [][]byte{
+				appendSTUNAddr(nil, stunAttrOtherAddress, wantOther),
+				appendSTUNAddr(nil, stunAttrChangedAddress, wantOther),
+				appendSTUNAddr(nil, stunAttrResponseOrigin, tt.wantSrc),
+			} {
+				if !bytes.Contains(res.Payload, attr) {
+					t.Errorf("response lacks attribute % x", attr)
+				}
+			}
+		})
+	}
+
+	// End to end, the response to a change-IP request makes it back through
+	// a 1:1 NAT, as it doesn't filter inbound traffic.
+	got := nodePackets(s, nodeMac(1))[0]
+	src := netip.AddrPortFrom(clientIPv4(1), 40001)
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, primary,
+		string(mkSTUNChangeRequest(stun.NewTxID(), stunChangeIP|stunChangePort)))))
+	awaitPacket(t, got, "STUN response from alternate address", func(pkt gopacket.Packet) bool {
+		f, ok := flow(pkt)
+		udp, isUDP := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		return ok && isUDP && f.src == alt.Addr() && udp.SrcPort == stunAltPort && udp.DstPort == 40001
+	})
+}
+
+func TestSTUNChangeRequestFiltered(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// An easy NAT filters inbound packets by address and port, so responses
+	// from the STUN server's alternate port are dropped while those from the
+	// port the request went to aren't.
+	n := s.nodes[0].net
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	dst := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+	for _, tt := range []struct {
+		flags       uint32
+		wantDropped int64
+	}{
+		{0, 0},
+		{stunChangePort, 1},
+		{stunChangeIP, 2},
+	} {
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, dst,
+			string(mkSTUNChangeRequest(stun.NewTxID(), tt.flags)))))
+		if got := n.natDropped.Load(); got != tt.wantDropped {
+			t.Errorf("flags %#x: NAT dropped %d packets; want %d", tt.flags, got, tt.wantDropped)
+		}
+		wantPkts := 0
+		if tt.flags == 0 {
+			wantPkts = 1
+		}
+		if err := numPkts(wantPkts)(se); err != nil {
+			t.Errorf("flags %#x: %v", tt.flags, err)
+		}
+	}
+}
+
+func TestSTUNOverTCP(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+	got := nodePackets(s, nodeMac(1))[0]
+
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	stunAP := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, stunAP,
+		&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+	synAck := awaitPacket(t, got, "SYN-ACK", isTCPPacket(stunAP, src, true, true)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	txid := stun.NewTxID()
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, stunAP,
+		&layers.TCP{Seq: 1001, Ack: synAck.Seq + 1, ACK: true, Window: 65535})))
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: routerMac(1).HWAddr()},
+		mkIPLayer(layers.IPProtocolTCP, src.Addr(), stunAP.Addr()),
+		&layers.TCP{SrcPort: 40000, DstPort: stunPort, Seq: 1001, Ack: synAck.Seq + 1, ACK: true, PSH: true, Window: 65535},
+		gopacket.Payload(stun.Request(txid)),
+	)))
+
+	resPkt := awaitPacket(t, got, "STUN response", func(pkt gopacket.Packet) bool {
+		tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return ok && isTCPPacket(stunAP, src, false, true)(pkt) && len(tcp.Payload) > 0
+	})
+	res := resPkt.Layer(layers.LayerTypeTCP).(*layers.TCP).Payload
+	if len(res) < stunHeaderLen || int(binary.BigEndian.Uint16(res[2:4])) != len(res)-stunHeaderLen {
+		t.Fatalf("response %q isn't one STUN message", res)
+	}
+	gotTxID, mapped, err := stun.ParseResponse(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddrPort("2.1.1.1:40000"); gotTxID != txid || mapped != want {
+		t.Errorf("got txid %x, reflexive address %v; want %x, %v", gotTxID, mapped, txid, want)
+	}
+}
+
+// dropObserver is an Observer recording OnDrop calls.
+type dropObserver struct {
+	NopObserver
+	mu  sync.Mutex
+	got []DropReason
+}
+
+func (o *dropObserver) OnDrop(reason DropReason) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.got = append(o.got, reason)
+}
+
+func (o *dropObserver) drops() []DropReason {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.got)
+}
+
+func TestFirewallBlockUDP(t *testing.T) {
+	obs := new(dropObserver)
+	var c Config
+	c.SetObserver(obs)
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", One2OneNAT)
+	nw.AddFirewallRule(FirewallRule{Proto: "UDP", Action: FirewallDrop})
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	t.Run("outbound", func(t *testing.T) {
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src,
+			netip.AddrPortFrom(fakeDERPs[0].v4, stunPort), string(stun.Request(stun.NewTxID())))))
+		if err := numPkts(0)(se); err != nil {
+			t.Errorf("STUN: %v", err)
+		}
+	})
+	t.Run("inbound", func(t *testing.T) {
+		se := newSideEffects(s)
+		s.routeUDPPacket(UDPPacket{
+			Src:     netip.MustParseAddrPort("8.8.8.8:9999"),
+			Dst:     netip.MustParseAddrPort("2.1.1.1:40000"),
+			Payload: []byte("hello"),
+		})
+		if err := numPkts(0)(se); err != nil {
+			t.Error(err)
+		}
+	})
+	if got, want := obs.drops(), []DropReason{DropFirewall, DropFirewall}; !reflect.DeepEqual(got, want) {
+		t.Errorf("drops = %v; want %v", got, want)
+	}
+
+	// With UDP blocked, DERP over TCP still works.
+	got := nodePackets(s, nodeMac(1))[0]
+	derp := netip.AddrPortFrom(fakeDERPs[0].v4, 443)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, derp,
+		&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+	awaitPacket(t, got, "SYN-ACK from DERP", isTCPPacket(derp, src, true, true))
+}
+
+func TestFirewallPortDeny(t *testing.T) {
+	obs := new(natOutObserver)
+	var c Config
+	c.SetObserver(obs)
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", One2OneNAT)
+	nw.AddFirewallRule(FirewallRule{
+		Dir:      FirewallOutbound,
+		Proto:    "UDP",
+		DstPorts: PortRange{9000, 9999},
+		Action:   FirewallReject,
+	})
+	nw.AddFirewallRule(FirewallRule{
+		Dir:      FirewallOutbound,
+		Proto:    "TCP",
+		Dst:      netip.PrefixFrom(fakeDERPs[0].v4, 32),
+		DstPorts: PortRange{443, 443},
+		Action:   FirewallReject,
+	})
+	c.AddNode(nw)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	t.Run("udp-denied", func(t *testing.T) {
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, netip.MustParseAddrPort("8.8.8.8:9999"), "hello")))
+		if err := all(
+			numPkts(1),
+			pktSubstr("TypeCode=DestinationUnreachable(CommAdminProhibited)"),
+			pktSubstr("SrcIP=192.168.0.1 DstIP=192.168.0.101"),
+		)(se); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("udp-other-port", func(t *testing.T) {
+		se := newSideEffects(s)
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, netip.MustParseAddrPort("8.8.8.8:8999"), "hello")))
+		if err := numPkts(0)(se); err != nil {
+			t.Error(err)
+		}
+		if len(obs.got) != 1 {
+			t.Errorf("got %d NAT'd packets; want 1 forwarded", len(obs.got))
+		}
+	})
+
+	got := nodePackets(s, nodeMac(1))[0]
+	for i, want := range []string{"ICMP error", "SYN-ACK"} {
+		derp := netip.AddrPortFrom(fakeDERPs[i].v4, 443)
+		must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, derp,
+			&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+		awaitPacket(t, got, fmt.Sprintf("%s for DERP %d", want, i+1), func(pkt gopacket.Packet) bool {
+			if i == 0 {
+				icmp, ok := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+				return ok && icmp.TypeCode == layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeCommAdminProhibited)
+			}
+			return isTCPPacket(derp, src, true, true)(pkt)
+		})
+	}
+}
+
+func TestUDPBlocked(t *testing.T) {
+	var c Config
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT)
+	nw2 := c.AddNetwork("2.2.2.2", "10.0.0.1/24", One2OneNAT)
+	for _, nw := range []*Network{nw1, nw2} {
+		nw.SetUDPBlocked(true)
+	}
+	nw1.SetUDPBlockedAllowSTUN(true)
+	n1 := c.AddNode(nw1)
+	n2 := c.AddNode(nw2)
+	s := must.Get(New(&c))
+	defer s.Close()
+	newSideEffects(s) // register sinks so the nodes are reachable
+
+	// Both nodes can reach DERP, but their direct UDP never gets through,
+	// leaving them relayed.
+	connectDERP(t, s, 1)
+	connectDERP(t, s, 2)
+	sendDirect(s, 1)
+	sendDirect(s, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.AwaitDirectUpgrade(ctx, n1, n2); err == nil || !strings.Contains(err.Error(), "never upgraded") {
+		t.Fatalf("got error %v; want never upgraded from DERP", err)
+	}
+	if got := s.Stats().Networks[1].UDPBlocked + s.Stats().Networks[2].UDPBlocked; got != 2 {
+		t.Errorf("UDPBlocked total = %d; want 2", got)
+	}
+
+	// STUN is still allowed on network 1, but not on network 2.
+	for i, wantReply := range []bool{true, false} {
+		se := newSideEffects(s)
+		src := netip.AddrPortFrom(mustNode(s, nodeMac(i+1)).lanIP, 40000)
+		stunAP := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+		pkt := mkUDPPacket(nodeMac(i+1), src, stunAP, string(stun.Request(stun.NewTxID())))
+		copy(pkt[:6], routerMac(i+1).HWAddr()) // to this node's router
+		must.Do(s.handleEthernetFrameFromVM(pkt))
+		want := 0
+		if wantReply {
+			want = 1
+		}
+		if err := numPkts(want)(se); err != nil {
+			t.Errorf("network %d STUN: %v", i+1, err)
+		}
+	}
+}
+
+func TestDERPBlocked(t *testing.T) {
+	obs := new(dropObserver)
+	var c Config
+	c.SetObserver(obs)
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", One2OneNAT)
+	nw2 := c.AddNetwork("2.2.2.2", "10.0.0.1/24", One2OneNAT)
+	for _, nw := range []*Network{nw1, nw2} {
+		nw.SetUDPBlocked(true)
+		nw.SetDERPBlocked(true)
+	}
+	n1 := c.AddNode(nw1)
+	n2 := c.AddNode(nw2)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	got := nodePackets(s, nodeMac(1), nodeMac(2))
+	for i := 1; i <= 2; i++ {
+		src := netip.AddrPortFrom(mustNode(s, nodeMac(i)).lanIP, 40000)
+		for _, port := range []uint16{80, 443} {
+			derp := netip.AddrPortFrom(fakeDERPs[0].v4, port)
+			must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(i), routerMac(i), src, derp,
+				&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+		}
+		sendDirect(s, i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.AwaitDirectUpgrade(ctx, n1, n2); err == nil || !strings.Contains(err.Error(), "never both connected to DERP") {
+		t.Fatalf("got error %v; want never connected to DERP", err)
+	}
+	for i, ch := range got {
+		select {
+		case pkt := <-ch:
+			t.Errorf("node %d got %v; want nothing", i+1, pkt)
+		default:
+		}
+	}
+	want := []DropReason{DropDERPBlocked, DropDERPBlocked, DropUDPBlocked, DropDERPBlocked, DropDERPBlocked, DropUDPBlocked}
+	if got := obs.drops(); !reflect.DeepEqual(got, want) {
+		t.Errorf("drops = %v; want %v", got, want)
+	}
+}
+
+func TestNPTv6(t *testing.T) {
+	var c Config
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", "2000:1::1/64", EasyNAT)
+	nw1.SetNPTv6(netip.MustParsePrefix("fd00:1::/64"))
+	nw2 := c.AddNetwork("2.2.2.2", "10.0.0.1/24", "2000:2::1/64", EasyNAT)
+	c.AddNode(nw1)
+	c.AddNode(nw2)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	n1 := s.nodes[0].net
+	if got, want := n1.lanIP6, netip.MustParsePrefix("fd00:1::1/64"); got != want {
+		t.Errorf("router LAN IPv6 = %v; want %v", got, want)
+	}
+	if got, want := s.nodes[0].dhcp6IP, netip.MustParseAddr("fd00:1::65"); got != want {
+		t.Errorf("node 1 DHCPv6 IP = %v; want %v", got, want)
+	}
+
+	got := nodePackets(s, nodeMac(1), nodeMac(2))
+	send := func(i int, src, dst netip.AddrPort) {
+		must.Do(s.handleEthernetFrameFromVM(mustPacket(
+			&layers.Ethernet{SrcMAC: nodeMac(i).HWAddr(), DstMAC: routerMac(i).HWAddr()},
+			mkIPLayer(layers.IPProtocolUDP, src.Addr(), dst.Addr()),
+			&layers.UDP{SrcPort: layers.UDPPort(src.Port()), DstPort: layers.UDPPort(dst.Port())},
+			gopacket.Payload("hi"))))
+	}
+	isUDP := func(src, dst netip.AddrPort) func(gopacket.Packet) bool {
+		return func(pkt gopacket.Packet) bool {
+			f, ok := flow(pkt)
+			udp, isUDP := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			return ok && isUDP &&
+				netip.AddrPortFrom(f.src, uint16(udp.SrcPort)) == src &&
+				netip.AddrPortFrom(f.dst, uint16(udp.DstPort)) == dst
+		}
+	}
+
+	lan1 := netip.MustParseAddrPort("[fd00:1::65]:1234")
+	wan1 := netip.MustParseAddrPort("[2000:1::65]:1234")
+	node2 := netip.MustParseAddrPort("[2000:2::66]:5678")
+
+	// Let network 2's router learn node 2's MAC.
+	send(2, node2, netip.MustParseAddrPort("[2000:9::1]:9"))
+
+	send(1, lan1, node2)
+	awaitPacket(t, got[1], "packet from node 1's WAN prefix", isUDP(wan1, node2))
+	send(2, node2, wan1)
+	awaitPacket(t, got[0], "reply to node 1's LAN prefix", isUDP(node2, lan1))
+}
+
+func TestIPv6TemporaryAddresses(t *testing.T) {
+	var c Config
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.1.1/24", "2000:1::1/64", EasyNAT)
+	nw2 := c.AddNetwork("2.2.2.2", "10.0.0.1/24", "2000:2::1/64", EasyNAT)
+	c.AddNode(nw1)
+	c.AddNode(nw2)
+	s := must.Get(New(&c))
+	defer s.Close()
+	got := nodePackets(s, nodeMac(1), nodeMac(2))
+
+	send := func(i int, src, dst netip.AddrPort) {
+		must.Do(s.handleEthernetFrameFromVM(mustPacket(
+			&layers.Ethernet{SrcMAC: nodeMac(i).HWAddr(), DstMAC: routerMac(i).HWAddr()},
+			mkIPLayer(layers.IPProtocolUDP, src.Addr(), dst.Addr()),
+			&layers.UDP{SrcPort: layers.UDPPort(src.Port()), DstPort: layers.UDPPort(dst.Port())},
+			gopacket.Payload("hi"))))
+	}
+	isUDPTo := func(dst netip.AddrPort) func(gopacket.Packet) bool {
+		return func(pkt gopacket.Packet) bool {
+			f, ok := flow(pkt)
+			udp, isUDP := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			return ok && isUDP && netip.AddrPortFrom(f.dst, uint16(udp.DstPort)) == dst
+		}
+	}
+
+	node2 := netip.MustParseAddrPort("[2000:2::66]:5678")
+	send(2, node2, netip.MustParseAddrPort("[2000:9::1]:9")) // let router 2 learn node 2
+
+	// Node 1 runs Duplicate Address Detection for a new temporary address
+	// and doesn't send from it yet; a packet to it must still arrive.
+	dadIP := netip.MustParseAddr("2000:1::1234:5678:9abc:def0")
+	a := dadIP.As16()
+	solicited := netip.AddrFrom16([16]byte{0: 0xff, 1: 0x02, 11: 0x01, 12: 0xff, 13: a[13], 14: a[14], 15: a[15]})
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: net.HardwareAddr{0x33, 0x33, 0xff, a[13], a[14], a[15]}},
+		&layers.IPv6{
+			Version:    6,
+			HopLimit:   255,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      net.IPv6unspecified,
+			DstIP:      solicited.AsSlice(),
+		},
+		&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)},
+		&layers.ICMPv6NeighborSolicitation{TargetAddress: dadIP.AsSlice()},
+	)))
+	dadDst := netip.AddrPortFrom(dadIP, 1234)
+	send(2, node2, dadDst)
+	awaitPacket(t, got[0], "packet to DAD-announced address", isUDPTo(dadDst))
+
+	// Node 1 sends from yet another address; the reply reaches it too.
+	tmp := netip.MustParseAddrPort("[2000:1::aaaa:bbbb:cccc:dddd]:4321")
+	send(1, tmp, node2)
+	awaitPacket(t, got[1], "packet from second address", isUDPTo(node2))
+	send(2, node2, tmp)
+	awaitPacket(t, got[0], "reply to second address", isUDPTo(tmp))
+}
+
+func TestIPv6OnlyNetwork(t *testing.T) {
+	var c Config
+	c.AddDNSRecord("foo.example", netip.MustParseAddr("2001:db8::1"))
+	c.AddNode(c.AddNetwork("2000:52::1/64"))
+	s := must.Get(New(&c))
+	defer s.Close()
+	got := nodePackets(s, nodeMac(1))[0]
+
+	// SLAAC: the router advertises its /64, from which the node forms an
+	// address with its EUI-64 interface identifier.
+	must.Do(s.handleEthernetFrameFromVM(mkIPv6RouterSolicit(nodeMac(1), nodeLANIP6(1))))
+	raPkt := awaitPacket(t, got, "router advertisement", func(pkt gopacket.Packet) bool {
+		_, ok := pkt.Layer(layers.LayerTypeICMPv6RouterAdvertisement).(*layers.ICMPv6RouterAdvertisement)
+		return ok
+	})
+	ra := raPkt.Layer(layers.LayerTypeICMPv6RouterAdvertisement).(*layers.ICMPv6RouterAdvertisement)
+	var prefix netip.Prefix
+	var dnsIP netip.Addr // from the RDNSS option
+	for _, o := range ra.Options {
+		switch {
+		case o.Type == layers.ICMPv6OptPrefixInfo && len(o.Data) == 30:
+			prefix = netip.PrefixFrom(netip.AddrFrom16([16]byte(o.Data[14:30])), int(o.Data[0])).Masked()
+		case o.Type == icmpv6OptRDNSS && len(o.Data) == 22:
+			dnsIP = netip.AddrFrom16([16]byte(o.Data[6:]))
+		}
+	}
+	if want := netip.MustParsePrefix("2000:52::/64"); prefix != want {
+		t.Fatalf("advertised prefix %v; want %v", prefix, want)
+	}
+	ll := nodeLANIP6(1).As16()
+	slaac := prefix.Addr().As16()
+	copy(slaac[8:], ll[8:])
+	nodeIP := netip.AddrFrom16(slaac)
+
+	if dnsIP != FakeDNSIPv6() {
+		t.Fatalf("RA RDNSS = %v; want %v", dnsIP, FakeDNSIPv6())
+	}
+
+	// DNS over IPv6.
+	must.Do(s.handleEthernetFrameFromVM(mustPacket(
+		&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: routerMac(1).HWAddr()},
+		mkIPLayer(layers.IPProtocolUDP, nodeIP, dnsIP),
+		&layers.UDP{SrcPort: 12345, DstPort: 53},
+		&layers.DNS{ID: 789, RD: true, Questions: []layers.DNSQuestion{{
+			Name:  []byte("foo.example"),
+			Type:  layers.DNSTypeAAAA,
+			Class: layers.DNSClassIN,
+		}}},
+	)))
+	dnsPkt := awaitPacket(t, got, "DNS response", func(pkt gopacket.Packet) bool {
+		_, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		return ok
+	})
+	if f, _ := flow(dnsPkt); f.src != dnsIP || f.dst != nodeIP {
+		t.Errorf("DNS response %v => %v; want %v => %v", f.src, f.dst, dnsIP, nodeIP)
+	}
+	if dns := dnsPkt.Layer(layers.LayerTypeDNS).(*layers.DNS); len(dns.Answers) != 1 || dns.Answers[0].IP.String() != "2001:db8::1" {
+		t.Errorf("DNS answers = %v; want 2001:db8::1", dns.Answers)
+	}
+
+	// TCP to a virtual service over IPv6.
+	src := netip.AddrPortFrom(nodeIP, 40000)
+	control := netip.AddrPortFrom(s.vip(fakeControl).v6, 80)
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src, control,
+		&layers.TCP{Seq: 1000, SYN: true, Window: 65535})))
+	awaitPacket(t, got, "SYN-ACK from control", isTCPPacket(control, src, true, true))
+}
+
+// icmpv6ChecksumOK reports whether the ICMPv6 message in pkt has a valid
+// checksum (RFC 4443 section 2.3).
+func icmpv6ChecksumOK(pkt gopacket.Packet) bool {
+	v6, ok := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		return false
+	}
+	msg := v6.Payload
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(v6.SrcIP)
+	add(v6.DstIP)
+	add(binary.BigEndian.AppendUint32(nil, uint32(len(msg))))
+	add([]byte{0, 0, 0, byte(layers.IPProtocolICMPv6)})
+	add(msg)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum == 0xffff
+}
+
+func TestIPv6EchoReply(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2000:52::1/64"))
+	s := must.Get(New(&c))
+	defer s.Close()
+	got := nodePackets(s, nodeMac(1))[0]
+
+	slaac := netip.MustParseAddr("2000:52::50cc:ccff:fecc:cc01")
+	for i, tt := range []struct {
+		src, dst netip.Addr
+	}{
+		{nodeLANIP6(1), routerLinkLocalIP6},
+		{slaac, netip.MustParseAddr("2000:52::1")},
+	} {
+		ip := &layers.IPv6{
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      tt.src.AsSlice(),
+			DstIP:      tt.dst.AsSlice(),
+		}
+		must.Do(s.handleEthernetFrameFromVM(mustPacket(
+			&layers.Ethernet{SrcMAC: nodeMac(1).HWAddr(), DstMAC: routerMac(1).HWAddr()},
+			ip,
+			&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)},
+			&layers.ICMPv6Echo{Identifier: 77, SeqNumber: uint16(i)},
+			gopacket.Payload("ping payload"),
+		)))
+		pkt := awaitPacket(t, got, fmt.Sprintf("echo reply from %v", tt.dst), func(pkt gopacket.Packet) bool {
+			icmp, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+			return ok && icmp.TypeCode.Type() == layers.ICMPv6TypeEchoReply
+		})
+		if f, _ := flow(pkt); f.src != tt.dst || f.dst != tt.src {
+			t.Errorf("reply %v => %v; want %v => %v", f.src, f.dst, tt.dst, tt.src)
+		}
+		echo, ok := pkt.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo)
+		if !ok || echo.Identifier != 77 || echo.SeqNumber != uint16(i) {
+			t.Errorf("reply echo = %+v; want ID 77, seq %d", echo, i)
+		}
+		// gopacket doesn't decode echo data, so look past the identifier
+		// and sequence number.
+		if icmp := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); len(icmp.Payload) < 4 || string(icmp.Payload[4:]) != "ping payload" {
+			t.Errorf("reply lacks the request's data")
+		}
+		if !icmpv6ChecksumOK(pkt) {
+			t.Errorf("reply to %v has bad checksum", tt.dst)
+		}
+	}
+}
+
+func TestPCAPRotation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.pcapng")
+	var c Config
+	c.SetPCAPFile(name)
+	c.SetPCAPRotation(2000, 0)
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+
+	const numPkts = 20
+	for i := range numPkts {
+		src := netip.AddrPortFrom(clientIPv4(1), uint16(1000+i))
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(
+			nodeMac(1), src, netip.MustParseAddrPort("2.2.2.2:9"), strings.Repeat("x", 200))))
+	}
+	s.Close()
+
+	total := 0
+	for seq := 0; ; seq++ {
+		f, err := os.Open(pcapSegmentName(name, seq))
+		if errors.Is(err, os.ErrNotExist) {
+			if seq < 2 {
+				t.Fatalf("got %d pcap files; want at least 2", seq)
+			}
+			break
+		}
+		must.Do(err)
+		defer f.Close()
+		r, err := pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+		if err != nil {
+			t.Fatalf("segment %d: %v", seq, err)
+		}
+		n := 0
+		for {
+			_, ci, err := r.ReadPacketData()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("segment %d, packet %d: %v", seq, n, err)
+			}
+			if _, err := r.Interface(ci.InterfaceIndex); err != nil {
+				t.Errorf("segment %d, packet %d: %v", seq, n, err)
+			}
+			n++
+		}
+		if n == 0 {
+			t.Errorf("segment %d is empty", seq)
+		}
+		if got, want := r.NInterfaces(), 4; got != want { // default, LAN, WAN, node
+			t.Errorf("segment %d has %d interfaces; want %d", seq, got, want)
+		}
+		total += n
+	}
+	if total < numPkts {
+		t.Errorf("got %d packets in all segments; want at least %d", total, numPkts)
+	}
+}
+
+func TestPCAPInterfaceNames(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.pcapng")
+	var c Config
+	c.SetPCAPFile(name)
+	nw1 := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	nw2 := c.AddNetwork("2.2.2.2", "10.2.0.1/16", "2000:2::1/64", HardNAT)
+	c.AddNode(nw1)
+	c.AddNode(nw2)
+	s := must.Get(New(&c))
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1),
+		netip.AddrPortFrom(clientIPv4(1), 1234), netip.MustParseAddrPort("2.2.2.2:9"), "hi")))
+	s.Close()
+
+	f := must.Get(os.Open(name))
+	defer f.Close()
+	r := must.Get(pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{WantMixedLinkType: true}))
+	if _, _, err := r.ReadPacketData(); err != nil { // reads the interface blocks first
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 1; i < r.NInterfaces(); i++ {
+		intf := must.Get(r.Interface(i))
+		got = append(got, intf.Name+": "+intf.Description)
+	}
+	want := []string{
+		"net1-lan: LAN of network 1 (192.168.0.1/24)",
+		"net1-wan: WAN of network 1 (2.1.1.1, easy NAT)",
+		"net2-lan: LAN of network 2 (10.2.0.1/16, 2000:2::1/64)",
+		"net2-wan: WAN of network 2 (2.2.2.2, 2000:2::1/64, hard NAT)",
+		"node1: node 1 (MAC 52:cc:cc:cc:cc:01) on network 1",
+		"node2: node 2 (MAC 52:cc:cc:cc:cc:02) on network 2",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("interfaces:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPacketSink(t *testing.T) {
+	var c Config
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	c.AddNode(c.AddNetwork("2.2.2.2", "10.2.0.1/16", One2OneNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	var mu sync.Mutex
+	got := map[string]int{} // capture interface name => frames
+	unregister := s.RegisterPacketSink(func(ci gopacket.CaptureInfo, data []byte) {
+		if ci.CaptureLength != len(data) {
+			t.Errorf("CaptureLength = %d; want %d", ci.CaptureLength, len(data))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got[s.CaptureInterfaceName(ci.InterfaceIndex)]++
+	})
+
+	// Node 1 sends a datagram to node 2's one-to-one NAT WAN address.
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1),
+		netip.AddrPortFrom(clientIPv4(1), 1234), netip.MustParseAddrPort("2.2.2.2:5678"), "hello")))
+	unregister()
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1),
+		netip.AddrPortFrom(clientIPv4(1), 1234), netip.MustParseAddrPort("2.2.2.2:5678"), "unseen")))
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{
+		"node1":    1, // from the VM
+		"net1-lan": 1, // into the router
+		"net1-wan": 1, // out of router 1, NATed
+		"net2-wan": 1, // into router 2
+		"net2-lan": 1, // out of router 2, NATed
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("frames per interface = %v; want %v", got, want)
+	}
+}
+
+func TestPCAPFilter(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.pcapng")
+	var c Config
+	c.SetPCAPFile(name)
+	c.SetPCAPFilter(CaptureFilter{Proto: "UDP", Ports: []uint16{stunPort}})
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+
+	src := netip.AddrPortFrom(clientIPv4(1), 1234)
+	stunDst := netip.AddrPortFrom(fakeDERPs[0].v4, stunPort)
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, netip.MustParseAddrPort("2.2.2.2:9"), "not STUN")))
+	must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, stunDst, string(stun.Request(stun.NewTxID())))))
+	must.Do(s.handleEthernetFrameFromVM(mkTCPPacket(nodeMac(1), routerMac(1), src,
+		netip.AddrPortFrom(stunDst.Addr(), 443), &layers.TCP{SYN: true, Window: 1000})))
+	s.Close()
+
+	f := must.Get(os.Open(name))
+	defer f.Close()
+	r := must.Get(pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{WantMixedLinkType: true}))
+	n := 0
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		must.Do(err)
+		pkt := s.decodeCaptured(ci.InterfaceIndex, data)
+		udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || (udp.SrcPort != stunPort && udp.DstPort != stunPort) {
+			t.Errorf("packet on %v isn't STUN: %v", s.CaptureInterfaceName(ci.InterfaceIndex), pkt)
+		}
+		n++
+	}
+	// The request from node 1, on the router's LAN and NATed on its WAN,
+	// and the response on the WAN and LAN.
+	if n != 5 {
+		t.Errorf("got %d packets; want 5", n)
+	}
+}
+
+func TestHostStackDial(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	if _, err := node.Dial(context.Background(), "tcp", "control.tailscale:80"); err == nil {
+		t.Error("Dial before New succeeded")
+	}
+	other := c.AddNode(c.FirstNetwork())
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	if _, err := other.Dial(context.Background(), "tcp", "control.tailscale:80"); err == nil {
+		t.Error("Dial from node without HostStack succeeded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{DialContext: node.Dial}}
+	req := must.Get(http.NewRequestWithContext(ctx, "GET", "http://control.tailscale/generate_204", nil))
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %v; want 204", res.Status)
+	}
+	if st := s.Stats().Nodes[node.MAC()]; st.TxPackets == 0 || st.RxPackets == 0 {
+		t.Errorf("node stats = %+v; want traffic both ways", st)
+	}
+}
+
+func TestNodeLogs(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext:     node.Dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // as tailscaled is configured to under natlab
+	}}
+	const body = `[{"logtail": {"client_time": "2024-08-30T17:36:06.1234Z"}, "text": "hello from the node"}]`
+	req := must.Get(http.NewRequestWithContext(ctx, "POST", "https://log.tailscale.com/c/tailnode.log.tailscale.io/0123", strings.NewReader(body)))
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	text, uploads := node.Logs()
+	if want := "[2024-08-30T17:36:06.123Z] hello from the node\n"; text != want || uploads != 1 {
+		t.Errorf("Logs = %q, %d; want %q, 1", text, uploads, want)
+	}
+}
+
+func TestLogUploadMaxSize(t *testing.T) {
+	var c Config
+	c.SetLogUploadMaxSize(1 << 10)
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext:     node.Dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	post := func(body []byte, zstd bool) int {
+		t.Helper()
+		req := must.Get(http.NewRequestWithContext(ctx, "POST", "https://log.tailscale.com/c/tailnode.log.tailscale.io/0123", bytes.NewReader(body)))
+		if zstd {
+			req.Header.Set("Content-Encoding", "zstd")
+		}
+		res, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// A megabyte of log text compresses to well under the limit.
+	big := fmt.Appendf(nil, `[{"text": %q}]`, strings.Repeat("x", 1<<20))
+	bomb := zstdframe.AppendEncode(nil, big)
+	if len(bomb) >= 1<<10 {
+		t.Fatalf("compressed upload is %d bytes; want under the limit", len(bomb))
+	}
+	if got := post(bomb, true); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("zstd upload: status %d; want %d", got, http.StatusRequestEntityTooLarge)
+	}
+	if got := post(big, false); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("plain upload: status %d; want %d", got, http.StatusRequestEntityTooLarge)
+	}
+	if got := post(zstdframe.AppendEncode(nil, []byte(`[{"text": "hi"}]`)), true); got != http.StatusOK {
+		t.Errorf("small upload: status %d; want %d", got, http.StatusOK)
+	}
+	if text, uploads := node.Logs(); uploads != 1 || !strings.Contains(text, "hi") {
+		t.Errorf("Logs = %q, %d; want only the small upload", text, uploads)
+	}
+}
+
+func TestLogDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	var c Config
+	c.SetLogDir(dir)
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+
+	must.Do(s.handleEthernetFrameFromVM(mkSyslogPacket(clientIPv4(1), "<6>2024-08-30T10:36:06-07:00 natlabapp tailscaled[1]: some-message")))
+	s.nodes[0].logMu.Lock()
+	s.nodes[0].logBuf.WriteString("[2024-08-30T17:36:06.123Z] hello from the node\n")
+	s.nodes[0].logMu.Unlock()
+	wantLogs, _ := node.Logs()
+	s.Close()
+
+	base := filepath.Join(dir, "node1-52cccccccc01")
+	if got := string(must.Get(os.ReadFile(base + ".log"))); got != wantLogs {
+		t.Errorf("log file = %q; want %q", got, wantLogs)
+	}
+	if got, want := string(must.Get(os.ReadFile(base+".syslog"))), "[2024-08-30T10:36:06-07:00] <0.6> tailscaled[1]: some-message\n"; got != want {
+		t.Errorf("syslog file = %q; want %q", got, want)
+	}
+}
+
+func TestSubnetRouter(t *testing.T) {
+	var c Config
+	nodeA := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	nodeB := c.AddNode(c.AddNetwork("2.2.2.2", "192.168.1.1/24", EasyNAT), HostStack)
+	nodeB.SetSubnetRoutes(netip.MustParsePrefix("10.1.0.0/24"))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// Stand in for a host at 10.1.0.5, behind node B, with B's host stack.
+	hs := nodeB.n.hs
+	host := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFrom4([4]byte{10, 1, 0, 5}), Port: 80}
+	ln := must.Get(gonet.ListenTCP(hs.ns, host, ipv4.ProtocolNumber))
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host)
+	}))
+	host.Port = 7
+	pc := must.Get(gonet.DialUDP(hs.ns, &host, nil, ipv4.ProtocolNumber))
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{DialContext: nodeA.Dial}}
+	req := must.Get(http.NewRequestWithContext(ctx, "GET", "http://10.1.0.5/", nil))
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := must.Get(io.ReadAll(res.Body))
+	res.Body.Close()
+	if got, want := string(body), "hello from 10.1.0.5"; got != want {
+		t.Errorf("HTTP body = %q; want %q", got, want)
+	}
+
+	uc := must.Get(nodeA.Dial(ctx, "udp", "10.1.0.5:7"))
+	defer uc.Close()
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	must.Get(uc.Write([]byte("ping")))
+	buf := make([]byte, 100)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatalf("reading UDP reply: %v", err)
+	}
+	if got, want := string(buf[:n]), "echo ping"; got != want {
+		t.Errorf("UDP reply = %q; want %q", got, want)
+	}
+}
+
+func TestWANService(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	svcIP := netip.MustParseAddr("5.6.7.8")
+	must.Do(s.RegisterWANService(svcIP, 80, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "echo "+r.URL.Path)
+	})))
+	must.Do(s.RegisterWANUDPService(svcIP, 7, func(src netip.AddrPort, payload []byte) []byte {
+		return fmt.Appendf(nil, "%s from %v", payload, src.Addr())
+	}))
+	if err := s.RegisterWANService(svcIP, 80, http.NotFoundHandler()); err == nil {
+		t.Error("registering a service twice succeeded")
+	}
+	if err := s.RegisterWANService(netip.MustParseAddr("2.1.1.1"), 80, http.NotFoundHandler()); err == nil {
+		t.Error("registering a service on a network's WAN IP succeeded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{DialContext: node.Dial}}
+	req := must.Get(http.NewRequestWithContext(ctx, "GET", "http://5.6.7.8/hello", nil))
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := must.Get(io.ReadAll(res.Body))
+	res.Body.Close()
+	if got, want := string(body), "echo /hello"; got != want {
+		t.Errorf("HTTP body = %q; want %q", got, want)
+	}
+
+	uc := must.Get(node.Dial(ctx, "udp", "5.6.7.8:7"))
+	defer uc.Close()
+	must.Get(uc.Write([]byte("ping")))
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "ping from 2.1.1.1"; got != want {
+		t.Errorf("UDP reply = %q; want %q", got, want)
+	}
+}
+
+func TestShutdownDrainsTCP(t *testing.T) {
+	var c Config
+	nodeA := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	nodeB := c.AddNode(c.AddNetwork("2.2.2.2", "192.168.1.1/24", EasyNAT), HostStack)
+	nodeB.SetSubnetRoutes(netip.MustParsePrefix("10.1.0.0/24"))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// A host at 10.1.0.5, behind node B, that replies to each line once
+	// it's sent.
+	host := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFrom4([4]byte{10, 1, 0, 5}), Port: 80}
+	ln := must.Get(gonet.ListenTCP(nodeB.n.hs.ns, host, ipv4.ProtocolNumber))
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err != nil {
+					return
+				}
+				io.WriteString(c, "echo "+line)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn := must.Get(nodeA.Dial(ctx, "tcp", "10.1.0.5:80"))
+	defer conn.Close()
+	// Wait for the router to pick up the connection before shutting down.
+	awaitCond(t, 5*time.Second, func() error {
+		if numProxyConns(s) == 0 {
+			return errors.New("connection not proxied yet")
+		}
+		return nil
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Shutdown(ctx) }()
+	awaitCond(t, 5*time.Second, func() error {
+		if !s.isDraining() {
+			return errors.New("not draining yet")
+		}
+		return nil
+	})
+	select {
+	case err := <-errc:
+		t.Fatalf("Shutdown returned %v with a connection in flight", err)
+	default:
+	}
+
+	// The connection in flight still works.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	must.Get(io.WriteString(conn, "hello\n"))
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading reply during Shutdown: %v", err)
+	}
+	if want := "echo hello\n"; got != want {
+		t.Errorf("reply = %q; want %q", got, want)
+	}
+	conn.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Shutdown = %v; want nil", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	var c Config
+	nodeA := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	nodeB := c.AddNode(c.AddNetwork("2.2.2.2", "192.168.1.1/24", EasyNAT), HostStack)
+	nodeB.SetSubnetRoutes(netip.MustParsePrefix("10.1.0.0/24"))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// A host at 10.1.0.5, behind node B, that holds connections open.
+	host := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFrom4([4]byte{10, 1, 0, 5}), Port: 80}
+	ln := must.Get(gonet.ListenTCP(nodeB.n.hs.ns, host, ipv4.ProtocolNumber))
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn := must.Get(nodeA.Dial(ctx, "tcp", "10.1.0.5:80"))
+	defer conn.Close()
+	awaitCond(t, 5*time.Second, func() error {
+		if numProxyConns(s) == 0 {
+			return errors.New("connection not proxied yet")
+		}
+		return nil
+	})
+
+	sctx, scancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer scancel()
+	if err := s.Shutdown(sctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if n := numProxyConns(s); n != 0 {
+		t.Errorf("%d proxied connections left after Shutdown", n)
+	}
+}
+
+func numProxyConns(s *Server) int {
+	s.proxyMu.Lock()
+	defer s.proxyMu.Unlock()
+	return len(s.proxyConns)
+}
+
+func TestTCPHandler(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	svc := netip.MustParsePrefix("203.0.113.0/24")
+	c.AddTCPHandler(svc.Contains, 9000, func(tc *gonet.TCPConn) {
+		line, err := bufio.NewReader(tc).ReadString('\n')
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(tc, "%s from %v to %v\n", strings.TrimSpace(line), tc.RemoteAddr(), tc.LocalAddr())
+	})
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn := must.Get(node.Dial(ctx, "tcp", "203.0.113.9:9000"))
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	must.Get(io.WriteString(conn, "hello\n"))
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("hello from %v to 203.0.113.9:9000\n", conn.LocalAddr()); got != want {
+		t.Errorf("reply = %q; want %q", got, want)
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("reading to EOF after the handler returned: %v", err)
+	}
+
+}
+
+func TestTCPHandlerShutdown(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	started := make(chan struct{})
+	returned := make(chan struct{})
+	c.AddTCPHandler(netip.MustParsePrefix("203.0.113.9/32").Contains, 9000, func(tc *gonet.TCPConn) {
+		close(started)
+		io.Copy(io.Discard, tc) // until the connection is closed
+		close(returned)
+	})
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn := must.Get(node.Dial(ctx, "tcp", "203.0.113.9:9000"))
+	defer conn.Close()
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal("handler not called")
+	}
+
+	sctx, scancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer scancel()
+	if err := s.Shutdown(sctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v; want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-returned:
+	default:
+		t.Error("Shutdown returned before the handler")
+	}
+}
+
+func TestUDPService(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	var from netip.AddrPort
+	echo := func(up UDPPacket) (UDPPacket, bool) {
+		from = up.Src
+		return UDPPacket{Src: up.Dst, Dst: up.Src, Payload: append([]byte("echo "), up.Payload...)}, true
+	}
+	must.Do(s.RegisterUDPService(netip.MustParseAddr("203.0.113.7"), 7, echo))
+	if err := s.RegisterUDPService(netip.MustParseAddr("203.0.113.7"), 7, echo); err == nil {
+		t.Error("registering a service twice succeeded")
+	}
+	if err := s.RegisterUDPService(netip.MustParseAddr("2.1.1.1"), 7, echo); err == nil {
+		t.Error("registering a service on a network's WAN IP succeeded")
+	}
+	// Unlike WAN services, UDP services can be at a fake's virtual IP.
+	must.Do(s.RegisterUDPService(s.vip(fakeControl).v4, 7, echo))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	uc := must.Get(node.Dial(ctx, "udp", "203.0.113.7:7"))
+	defer uc.Close()
+	must.Get(uc.Write([]byte("ping")))
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "echo ping"; got != want {
+		t.Errorf("UDP reply = %q; want %q", got, want)
+	}
+	if from.Addr() != netip.MustParseAddr("2.1.1.1") {
+		t.Errorf("service saw the packet from %v; want 2.1.1.1", from)
+	}
+}
+
+func TestNTP(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2024, 5, 6, 7, 8, 9, 500_000_000, time.UTC)})
+	var c Config
+	c.SetClock(clock)
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	uc := must.Get(node.Dial(ctx, "udp", "ntp.tailscale:123"))
+	defer uc.Close()
+
+	req := make([]byte, ntpLen)
+	req[0] = 4<<3 | ntpClient // NTPv4 client
+	binary.BigEndian.PutUint64(req[40:], 0x1122334455667788)
+	must.Get(uc.Write(req))
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res := make([]byte, 100)
+	n, err := uc.Read(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = res[:n]
+	if len(res) != ntpLen {
+		t.Fatalf("got %d-byte response; want %d", len(res), ntpLen)
+	}
+	if vn, mode := res[0]>>3&7, res[0]&7; vn != 4 || mode != ntpServer {
+		t.Errorf("response version, mode = %d, %d; want 4, %d", vn, mode, ntpServer)
+	}
+	if res[1] != 1 {
+		t.Errorf("stratum = %d; want 1", res[1])
+	}
+	if got := binary.BigEndian.Uint64(res[24:]); got != 0x1122334455667788 {
+		t.Errorf("originate timestamp = %#x; want the request's transmit timestamp", got)
+	}
+	tx := binary.BigEndian.Uint64(res[40:])
+	secs, frac := int64(tx>>32)-ntpEpochOffset, tx&0xffffffff
+	got := time.Unix(secs, int64(frac*uint64(time.Second)>>32))
+	if d := got.Sub(clock.Now()); d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("transmit timestamp = %v; want %v", got, clock.Now())
+	}
+
+	// Non-client packets get no reply.
+	req[0] = 4<<3 | ntpServer
+	must.Get(uc.Write(req))
+	uc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := uc.Read(res); err == nil {
+		t.Error("got a reply to a server-mode packet")
+	}
+}
+
+func TestEchoServer(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext:     node.Dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	for _, scheme := range []string{"http", "https"} {
+		t.Run(scheme, func(t *testing.T) {
+			req := must.Get(http.NewRequestWithContext(ctx, "GET", scheme+"://echo.tailscale/foo", nil))
+			req.Header.Set("X-Test", "yes")
+			res, err := hc.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			var er EchoResponse
+			if err := json.NewDecoder(res.Body).Decode(&er); err != nil {
+				t.Fatal(err)
+			}
+			if want := netip.MustParseAddr("2.1.1.1"); er.ClientIP != want {
+				t.Errorf("ClientIP = %v; want %v", er.ClientIP, want)
+			}
+			if er.Path != "/foo" || er.Host != "echo.tailscale" || er.Header.Get("X-Test") != "yes" {
+				t.Errorf("echoed request = %+v; want GET echo.tailscale/foo with X-Test header", er)
+			}
+			if er.TLS != (scheme == "https") {
+				t.Errorf("TLS = %v; want %v", er.TLS, scheme == "https")
+			}
+
+			req = must.Get(http.NewRequestWithContext(ctx, "GET", scheme+"://echo.tailscale/status/503", nil))
+			res, err = hc.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("/status/503 status = %v; want 503", res.Status)
+			}
+		})
+	}
+}
+
+func TestTLSServiceSNI(t *testing.T) {
+	var c Config
+	svcIP := netip.MustParseAddr("203.0.113.20")
+	c.AddDNSRecord("a.example", svcIP)
+	c.AddDNSRecord("b.example", svcIP)
+	c.AddDNSRecord("c.example", svcIP)
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	for _, name := range []string{"a.example", "b.example"} {
+		must.Do(s.RegisterTLSService(svcIP, name, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s for %s", name, r.TLS.ServerName)
+		})))
+	}
+	if err := s.RegisterTLSService(svcIP, "A.example.", http.NotFoundHandler()); err == nil {
+		t.Error("registering a service twice succeeded")
+	}
+	// One on the echo server's IP, which gets other server names.
+	echoIP, _, _ := s.VIP("echo.tailscale")
+	must.Do(s.RegisterTLSService(echoIP, "echo.example", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "not the echo server")
+	})))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	get := func(url, serverName string) (string, error) {
+		hc := &http.Client{Transport: &http.Transport{
+			DialContext:     node.Dial,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: serverName},
+		}}
+		req := must.Get(http.NewRequestWithContext(ctx, "GET", url, nil))
+		res, err := hc.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+	for _, name := range []string{"a.example", "b.example"} {
+		got, err := get("https://"+name+"/", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := name + " for " + name; got != want {
+			t.Errorf("body = %q; want %q", got, want)
+		}
+	}
+	if _, err := get("https://c.example/", ""); err == nil {
+		t.Error("request for an unregistered server name succeeded")
+	}
+
+	if got, err := get("https://"+echoIP.String()+"/", "echo.example"); err != nil || got != "not the echo server" {
+		t.Errorf("echo.example = %q, %v; want the registered service", got, err)
+	}
+	got, err := get("https://echo.tailscale/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var er EchoResponse
+	if err := json.Unmarshal([]byte(got), &er); err != nil || !er.TLS {
+		t.Errorf("echo.tailscale = %q; want the echo server's response", got)
+	}
+}
+
+func TestDERPOverWebSocket(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialDERP := func() *derp.Client {
+		t.Helper()
+		hc := &http.Client{Transport: &http.Transport{
+			DialContext:     node.Dial,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		wc, _, err := websocket.Dial(ctx, "wss://derp1.tailscale/derp", &websocket.DialOptions{
+			HTTPClient:   hc,
+			Subprotocols: []string{"derp"},
+		})
+		if err != nil {
+			t.Fatalf("websocket.Dial: %v", err)
+		}
+		t.Cleanup(func() { wc.CloseNow() })
+		nc := wsconn.NetConn(context.Background(), wc, websocket.MessageBinary, "derp1.tailscale")
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		dc, err := derp.NewClient(key.NewNode(), nc, brw, t.Logf)
+		if err != nil {
+			t.Fatalf("derp.NewClient: %v", err)
+		}
+		return dc
+	}
+	a, b := dialDERP(), dialDERP()
+
+	// Wait for b to be connected to the server, then send it a packet from a.
+	for {
+		m, err := b.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(derp.ServerInfoMessage); ok {
+			break
+		}
+	}
+	must.Do(a.Send(b.PublicKey(), []byte("hello")))
+	for {
+		m, err := b.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.(derp.ReceivedPacket); ok {
+			if p.Source != a.PublicKey() || string(p.Data) != "hello" {
+				t.Errorf("got packet %q from %v; want %q from %v", p.Data, p.Source, "hello", a.PublicKey())
+			}
+			break
+		}
+	}
+}
+
+func TestTLSCA(t *testing.T) {
+	ca := must.Get(generateCertAuthority())
+	for _, supplied := range []bool{false, true} {
+		t.Run(fmt.Sprintf("supplied=%v", supplied), func(t *testing.T) {
+			var c Config
+			if supplied {
+				c.SetTLSCA(tls.Certificate{Certificate: [][]byte{ca.cert.Raw}, PrivateKey: ca.key})
+			}
+			node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+			s := must.Get(New(&c))
+			defer s.Close()
+			if got := s.CACert().Equal(ca.cert); got != supplied {
+				t.Errorf("CACert is the supplied CA's = %v; want %v", got, supplied)
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(s.CACert())
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			hc := &http.Client{Transport: &http.Transport{
+				DialContext:     node.Dial,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}}
+			echoIP, _, _ := s.VIP("echo.tailscale")
+			for _, url := range []string{
+				"https://derp1.tailscale/generate_204",
+				"https://echo.tailscale/generate_204",
+				"https://" + echoIP.String() + "/generate_204", // no SNI
+			} {
+				req := must.Get(http.NewRequestWithContext(ctx, "GET", url, nil))
+				res, err := hc.Do(req)
+				if err != nil {
+					t.Errorf("GET %s: %v", url, err)
+					continue
+				}
+				res.Body.Close()
+			}
+
+			// A client not trusting the CA rejects the certificates.
+			hc = &http.Client{Transport: &http.Transport{
+				DialContext:     node.Dial,
+				TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()},
+			}}
+			req := must.Get(http.NewRequestWithContext(ctx, "GET", "https://echo.tailscale/", nil))
+			if res, err := hc.Do(req); err == nil {
+				res.Body.Close()
+				t.Error("GET succeeded without trusting the CA")
+			}
+		})
+	}
+
+	var c Config
+	c.SetTLSCA(tls.Certificate{Certificate: [][]byte{must.Get(ca.issue("leaf.example")).Leaf.Raw}, PrivateKey: ca.key})
+	if _, err := New(&c); err == nil {
+		t.Error("New with a non-CA certificate as the TLS CA succeeded")
+	}
+}
+
+func TestControlHTTP2(t *testing.T) {
+	for _, h2 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("h2=%v", h2), func(t *testing.T) {
+			var c Config
+			c.SetControlHTTP2(h2)
+			node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+			s := must.Get(New(&c))
+			defer s.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			roots := x509.NewCertPool()
+			roots.AddCert(s.CACert())
+			tr := &http.Transport{
+				DialContext:       node.Dial,
+				TLSClientConfig:   &tls.Config{RootCAs: roots},
+				ForceAttemptHTTP2: true,
+			}
+			req := must.Get(http.NewRequestWithContext(ctx, "GET", "https://control.tailscale/generate_204", nil))
+			res, err := (&http.Client{Transport: tr}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			want := 1
+			if h2 {
+				want = 2
+			}
+			if res.ProtoMajor != want {
+				t.Errorf("HTTPS protocol = %s; want HTTP/%d", res.Proto, want)
+			}
+			if got := res.TLS.NegotiatedProtocol == "h2"; got != h2 {
+				t.Errorf("negotiated %q; want h2 = %v", res.TLS.NegotiatedProtocol, h2)
+			}
+
+			// h2c with prior knowledge on port 80.
+			h2c := &http.Transport{DialContext: node.Dial, Protocols: new(http.Protocols)}
+			h2c.Protocols.SetUnencryptedHTTP2(true)
+			req = must.Get(http.NewRequestWithContext(ctx, "GET", "http://control.tailscale/generate_204", nil))
+			res, err = (&http.Client{Transport: h2c}).Do(req)
+			if h2 {
+				if err != nil {
+					t.Fatalf("h2c: %v", err)
+				}
+				res.Body.Close()
+				if res.ProtoMajor != 2 {
+					t.Errorf("h2c protocol = %s; want HTTP/2", res.Proto)
+				}
+			} else if err == nil {
+				res.Body.Close()
+				t.Error("h2c succeeded without HTTP/2 enabled")
+			}
+		})
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	var c Config
+	nodeA := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	nodeB := c.AddNode(c.AddNetwork("2.2.2.2", "192.168.1.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// A virtual QUIC endpoint, standing in for a QUIC server on the conn by
+	// echoing each datagram with where it came from.
+	quicIP := netip.MustParseAddr("203.0.113.30")
+	pc := must.Get(s.ListenUDP(quicIP, 443))
+	defer pc.Close()
+	if _, err := s.ListenUDP(quicIP, 443); err == nil {
+		t.Error("second ListenUDP on the same address succeeded")
+	}
+	if err := s.RegisterUDPService(quicIP, 443, nil); err == nil {
+		t.Error("RegisterUDPService on a ListenUDP address succeeded")
+	}
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom with nothing sent = %v; want deadline exceeded", err)
+	}
+	pc.SetReadDeadline(time.Time{})
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(fmt.Appendf(nil, "%s from %v", buf[:n], addr.(*net.UDPAddr).IP), addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, tt := range []struct {
+		node  *Node
+		wanIP string
+	}{
+		{nodeA, "2.1.1.1"},
+		{nodeB, "2.2.2.2"},
+	} {
+		uc := must.Get(tt.node.Dial(ctx, "udp", "203.0.113.30:443"))
+		defer uc.Close()
+		must.Get(uc.Write([]byte("initial")))
+		uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 100)
+		n, err := uc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), "initial from "+tt.wanIP; got != want {
+			t.Errorf("reply = %q; want %q", got, want)
+		}
+	}
+
+	must.Do(pc.Close())
+	if _, _, err := pc.ReadFrom(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom after Close = %v; want net.ErrClosed", err)
+	}
+	pc2 := must.Get(s.ListenUDP(quicIP, 443))
+	pc2.Close()
+}
+
+func TestRandSeed(t *testing.T) {
+	// ports returns the external ports a HardNAT allocates for a node's
+	// flows to a few peers, given the Server's random seed.
+	ports := func(seed uint64) (ports []uint16) {
+		var c Config
+		c.SetRandSeed(seed)
+		nw := c.AddNetwork("2.1.1.1", "192.168.1.1/24", HardNAT)
+		c.AddNode(nw)
+		s := must.Get(New(&c))
+		defer s.Close()
+		src := netip.MustParseAddrPort("192.168.1.101:41641")
+		for i := range 5 {
+			dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte{8, 8, 8, byte(i + 1)}), 41641)
+			ports = append(ports, nw.n.doNATOut(src, dst).Port())
+		}
+		return ports
+	}
+	a, b := ports(1), ports(1)
+	if !slices.Equal(a, b) {
+		t.Errorf("same seed gave ports %v, then %v", a, b)
+	}
+	if c := ports(2); slices.Equal(a, c) {
+		t.Errorf("seeds 1 and 2 both gave ports %v", a)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("skipping on %s", runtime.GOOS)
+	}
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)})
+	var c Config
+	c.SetClock(clock)
+	nw := c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT)
+	ahead := c.AddNode(nw, HostStack)
+	ahead.SetClockSkew(time.Hour)
+	behind := c.AddNode(nw, HostStack)
+	behind.SetClockSkew(-30 * 365 * 24 * time.Hour) // before the TLS certs are valid
+	vm := c.AddNode(nw)
+	vm.SetClockSkew(time.Hour)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The fake NTP server tells a node its skewed time.
+	uc := must.Get(ahead.Dial(ctx, "udp", "ntp.tailscale:123"))
+	defer uc.Close()
+	req := make([]byte, ntpLen)
+	req[0] = 4<<3 | ntpClient
+	must.Get(uc.Write(req))
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res := make([]byte, ntpLen)
+	if _, err := io.ReadFull(uc, res); err != nil {
+		t.Fatal(err)
+	}
+	secs := int64(binary.BigEndian.Uint64(res[40:])>>32) - ntpEpochOffset
+	if got, want := time.Unix(secs, 0), clock.Now().Add(time.Hour); !got.Equal(want) {
+		t.Errorf("NTP time = %v; want %v", got, want)
+	}
+
+	// An hour ahead, TLS handshakes still verify, but decades behind, the
+	// certs aren't valid yet.
+	roots := x509.NewCertPool()
+	roots.AddCert(s.CACert())
+	handshake := func(n *Node) error {
+		c := must.Get(n.Dial(ctx, "tcp", "echo.tailscale:443"))
+		defer c.Close()
+		tc := tls.Client(c, &tls.Config{ServerName: "echo.tailscale", RootCAs: roots, Time: n.Now})
+		return tc.HandshakeContext(ctx)
+	}
+	if err := handshake(ahead); err != nil {
+		t.Errorf("handshake an hour ahead: %v", err)
+	}
+	var certErr x509.CertificateInvalidError
+	if err := handshake(behind); !errors.As(err, &certErr) || certErr.Reason != x509.Expired {
+		t.Errorf("handshake decades behind: got %v; want an invalid cert error", err)
+	}
+
+	// An external VM's skew is logged when it connects.
+	var (
+		logMu sync.Mutex
+		logs  []string
+	)
+	s.SetLoggerForTest(func(format string, args ...any) {
+		logMu.Lock()
+		defer logMu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	})
+	td := t.TempDir()
+	serverAddr := must.Get(net.ResolveUnixAddr("unixgram", filepath.Join(td, "vnet.sock")))
+	sc := must.Get(net.ListenUnixgram("unixgram", serverAddr))
+	go s.ServeUnixConn(sc, ProtocolUnixDGRAM)
+	cc := must.Get(net.DialUnix("unixgram", must.Get(net.ResolveUnixAddr("unixgram", filepath.Join(td, "vm.sock"))), serverAddr))
+	defer cc.Close()
+	must.Get(cc.Write(mkEth(nodeMac(1), vm.MAC(), testingEthertype, []byte("hello"))))
+	awaitCond(t, 5*time.Second, func() error {
+		logMu.Lock()
+		defer logMu.Unlock()
+		if !slices.ContainsFunc(logs, func(l string) bool { return strings.Contains(l, "clock skew 1h0m0s") }) {
+			return errors.New("clock skew not logged")
+		}
+		return nil
+	})
+}
+
+// serveFakeAgent stands in for cmd/tta on node, which must have the HostStack
+// option, serving h on connections to the test driver, as the agent does.
+// Each of NodeAgentClient's two HTTP clients takes its own connection.
+func serveFakeAgent(t *testing.T, ctx context.Context, node *Node, h http.Handler) {
+	for range 2 {
+		c := must.Get(node.Dial(ctx, "tcp", "test-driver.tailscale:8008"))
+		hs := &http.Server{Handler: h}
+		go hs.Serve(netutil.NewOneConnListener(c, nil))
+		t.Cleanup(func() { hs.Close() })
+	}
+}
+
+func TestNodeAgentClient(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	peerKey := key.NewNode().Public()
+	var mux http.ServeMux
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&ipnstate.Status{
+			BackendState: "Running",
+			Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+				peerKey: {PublicKey: peerKey, HostName: "peer", Online: true},
+			},
+		})
+	})
+	mux.HandleFunc("/netcheck", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&netcheck.Report{UDP: true, PreferredDERP: 1})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	serveFakeAgent(t, ctx, node, &mux)
+
+	agent := s.NodeAgentClient(node)
+	st, err := agent.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps, ok := st.Peer[peerKey]; !ok || ps.HostName != "peer" || !ps.Online {
+		t.Errorf("status peers = %v; want online peer %v", st.Peer, peerKey.ShortString())
+	}
+	report, err := agent.NetCheck(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.UDP || report.PreferredDERP != 1 {
+		t.Errorf("netcheck report = %+v; want UDP and preferred DERP 1", report)
+	}
+}
+
+func TestNodeAgentHostFirewall(t *testing.T) {
+	var c Config
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", One2OneNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	// The fake agent records the firewall endpoints requested and serves
+	// state from /fw/state, as cmd/tta does.
+	var (
+		mu    sync.Mutex
+		paths []string
+		state = "disabled\n"
+	)
+	var mux http.ServeMux
+	for _, path := range []string{"/fw", "/fw/disable"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			paths = append(paths, r.URL.Path)
+		})
+	}
+	mux.HandleFunc("/fw/state", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, state)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	serveFakeAgent(t, ctx, node, &mux)
+	agent := s.NodeAgentClient(node)
+
+	must.Do(agent.EnableHostFirewall(ctx))
+	must.Do(agent.DisableHostFirewall(ctx))
+	mu.Lock()
+	got := slices.Clone(paths)
+	mu.Unlock()
+	if want := []string{"/fw", "/fw/disable"}; !slices.Equal(got, want) {
+		t.Errorf("requested %q; want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		state   string
+		want    bool
+		wantErr bool
+	}{
+		{"enabled\n", true, false},
+		{"disabled\n", false, false},
+		{"disabled", false, false},
+		{"unknown\n", false, true},
+	} {
+		mu.Lock()
+		state = tt.state
+		mu.Unlock()
+		enabled, err := agent.FirewallState(ctx)
+		if (err != nil) != tt.wantErr || enabled != tt.want {
+			t.Errorf("FirewallState with %q = %v, %v; want %v, error %v", tt.state, enabled, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTakeAgentConn(t *testing.T) {
+	var c Config
+	c.SetAgentConnPollInterval(-1) // only be woken by arriving conns
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+	n := node.n
+
+	// Many callers wait for the node's conns at once, while they arrive at
+	// random times. Each caller must get its own without polling.
+	const numConns = 50
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, numConns)
+	gotc := make(chan *agentConn, numConns)
+	for range numConns {
+		go func() {
+			ac, err := s.takeAgentConn(ctx, n)
+			if err != nil {
+				errc <- err
+				return
+			}
+			gotc <- ac
+		}()
+		go func() {
+			time.Sleep(rand.N(20 * time.Millisecond))
+			s.addIdleAgentConn(&agentConn{node: n})
+		}()
+	}
+	got := set.Set[*agentConn]{}
+	for range numConns {
+		select {
+		case ac := <-gotc:
+			if got.Contains(ac) {
+				t.Fatal("two callers took the same conn")
+			}
+			got.Add(ac)
+		case err := <-errc:
+			t.Fatal(err)
+		}
+	}
+
+	var c2 Config
+	c2.SetAgentConnTimeout(50 * time.Millisecond)
+	node2 := c2.AddNode(c2.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s2 := must.Get(New(&c2))
+	defer s2.Close()
+	if _, err := s2.takeAgentConn(context.Background(), node2.n); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v; want deadline exceeded", err)
+	}
+}
+
+func TestDERPNodesPerRegion(t *testing.T) {
+	var c Config
+	c.SetNumDERPNodes(1, 2)
+	node := c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT), HostStack)
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	var got []string
+	for _, n := range s.Control().DERPMap.Regions[1].Nodes {
+		got = append(got, fmt.Sprintf("%s %s %s", n.Name, n.HostName, n.IPv4))
+	}
+	want := []string{"1a derp1.tailscale 33.4.0.1", "1b derp1b.tailscale 33.4.1.1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("region 1 nodes = %q; want %q", got, want)
+	}
+	if n := len(s.Control().DERPMap.Regions[2].Nodes); n != 1 {
+		t.Errorf("region 2 has %d nodes; want 1", n)
+	}
+
+	// Clients of either of the region's servers reach each other.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext:     node.Dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	dialDERP := func(host string) *derp.Client {
+		t.Helper()
+		wc, _, err := websocket.Dial(ctx, "wss://"+host+"/derp", &websocket.DialOptions{
+			HTTPClient:   hc,
+			Subprotocols: []string{"derp"},
+		})
+		if err != nil {
+			t.Fatalf("websocket.Dial %s: %v", host, err)
+		}
+		t.Cleanup(func() { wc.CloseNow() })
+		nc := wsconn.NetConn(context.Background(), wc, websocket.MessageBinary, host)
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		return must.Get(derp.NewClient(key.NewNode(), nc, brw, t.Logf))
+	}
+	a, b := dialDERP("derp1.tailscale"), dialDERP("derp1b.tailscale")
+	for {
+		m := must.Get(b.Recv())
+		if _, ok := m.(derp.ServerInfoMessage); ok {
+			break
+		}
+	}
+	must.Do(a.Send(b.PublicKey(), []byte("hello")))
+	for {
+		m := must.Get(b.Recv())
+		if p, ok := m.(derp.ReceivedPacket); ok {
+			if p.Source != a.PublicKey() || string(p.Data) != "hello" {
+				t.Errorf("got packet %q from %v; want %q from %v", p.Data, p.Source, "hello", a.PublicKey())
+			}
+			break
+		}
+	}
+
+	// With one server down, the other still serves the region.
+	must.Do(s.SetDERPNodeUp("1a", false))
+	probe := func(host string) error {
+		hc := &http.Client{Transport: &http.Transport{DialContext: node.Dial}}
+		res, err := hc.Get("http://" + host + "/generate_204")
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+	if err := probe("derp1.tailscale"); err == nil {
+		t.Error("probe of 1a succeeded while it's down")
+	}
+	if err := probe("derp1b.tailscale"); err != nil {
+		t.Errorf("probe of 1b: %v", err)
+	}
+	if err := s.SetDERPNodeUp("1c", false); err == nil {
+		t.Error("SetDERPNodeUp of nonexistent node succeeded")
+	}
+
+	c.SetNumDERPNodes(1, maxDERPNodes+1)
+	if _, err := New(&c); err == nil {
+		t.Errorf("New with %d DERP nodes in a region succeeded", maxDERPNodes+1)
+	}
+}
+
+func TestDERPNodeSTUN(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	var c Config
+	c.SetClock(clock)
+	c.SetNumDERPNodes(1, 2)
+	c.SetDERPLatency(2, time.Minute)
+	c.AddNode(c.AddNetwork("2.1.1.1", "192.168.0.1/24", EasyNAT))
+	s := must.Get(New(&c))
+	defer s.Close()
+
+	got := nodePackets(s, nodeMac(1))[0]
+	src := netip.AddrPortFrom(clientIPv4(1), 40000)
+	// sendSTUN sends a STUN request from src to the DERP server at ip.
+	sendSTUN := func(ip netip.Addr) stun.TxID {
+		t.Helper()
+		txid := stun.NewTxID()
+		dst := netip.AddrPortFrom(ip, stunPort)
+		must.Do(s.handleEthernetFrameFromVM(mkUDPPacket(nodeMac(1), src, dst, string(stun.Request(txid)))))
+		return txid
+	}
+	// isReply matches the response to txid, checking that it comes from ip
+	// and reports the network's WAN IP.
+	isReply := func(ip netip.Addr, txid stun.TxID) func(gopacket.Packet) bool {
+		return func(pkt gopacket.Packet) bool {
+			app := pkt.ApplicationLayer()
+			if app == nil {
+				return false
+			}
+			gotTxID, mapped, err := stun.ParseResponse(app.Payload())
+			if err != nil || gotTxID != txid {
+				return false
+			}
+			if f, ok := flow(pkt); !ok || f.src != ip {
+				t.Errorf("STUN response from %v came from %v", ip, f.src)
+			}
+			if mapped.Addr() != netip.MustParseAddr("2.1.1.1") {
+				t.Errorf("STUN response from %v mapped %v; want the WAN IP", ip, mapped)
+			}
+			return true
+		}
+	}
+
+	for _, ip := range []netip.Addr{fakeDERPs[0].v4, extraDERPs[0][0].v4} {
+		awaitPacket(t, got, "STUN response from "+ip.String(), isReply(ip, sendSTUN(ip)))
+	}
+
+	// Region 2's server answers after its latency.
+	ip := fakeDERPs[1].v4
+	txid := sendSTUN(ip)
+	select {
+	case pkt := <-got:
+		if isReply(ip, txid)(pkt) {
+			t.Fatal("got STUN response before the region's latency")
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+	clock.Advance(time.Minute)
+	awaitPacket(t, got, "delayed STUN response", isReply(ip, txid))
+}
@@ -0,0 +1,163 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vnet
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+)
+
+// WANUDPHandler handles a datagram with payload from src, a node's address as
+// seen on the internet, to a service registered with
+// Server.RegisterWANUDPService. It returns the payload of the reply to send
+// back to src, or nil for none. It must not retain payload.
+type WANUDPHandler func(src netip.AddrPort, payload []byte) (reply []byte)
+
+// UDPServiceHandler handles a UDP packet up addressed to a service registered
+// with Server.RegisterUDPService. Its Src is the sender's address as seen on
+// the internet. It returns the reply to route back, usually with Src and Dst
+// those of up swapped, and whether there is one. It must not retain up's
+// Payload.
+type UDPServiceHandler func(up UDPPacket) (reply UDPPacket, ok bool)
+
+// RegisterWANService registers h to serve HTTP on TCP port port of the
+// internet address ip, standing up a fake internet server that nodes can
+// reach through their networks' routers. ip must not be a network's WAN IP
+// or one of the built-in fakes' addresses.
+func (s *Server) RegisterWANService(ip netip.Addr, port uint16, h http.Handler) error {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	ap, err := s.wanServiceAddr(ip, port)
+	if err != nil {
+		return err
+	}
+	if _, loaded := s.wanTCPServices.LoadOrStore(ap, h); loaded {
+		return fmt.Errorf("TCP service %v already registered", ap)
+	}
+	return nil
+}
+
+// RegisterWANUDPService is like RegisterWANService, but for a UDP service,
+// whose datagrams are handled by h.
+func (s *Server) RegisterWANUDPService(ip netip.Addr, port uint16, h WANUDPHandler) error {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	ap, err := s.wanServiceAddr(ip, port)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.udpServices.Load(ap); ok {
+		return fmt.Errorf("UDP service %v already registered", ap)
+	}
+	if _, ok := s.udpListeners.Load(ap); ok {
+		return fmt.Errorf("UDP address %v already in use by ListenUDP", ap)
+	}
+	if _, loaded := s.wanUDPServices.LoadOrStore(ap, h); loaded {
+		return fmt.Errorf("UDP service %v already registered", ap)
+	}
+	return nil
+}
+
+// RegisterUDPService registers h to handle the UDP packets nodes send to port
+// port of ip, standing up an in-process UDP service such as a fake NTP server
+// or a QUIC echo responder. Unlike RegisterWANUDPService, ip may be one of
+// the built-in fakes' virtual IPs, and h sees and writes whole packets, so it
+// can reply from a different address. ip must not be a network's WAN IP.
+//
+// Registered services are consulted before any other routing of UDP
+// packets, including the in-process STUN servers.
+func (s *Server) RegisterUDPService(ip netip.Addr, port uint16, h UDPServiceHandler) error {
+	s.wanMu.Lock()
+	defer s.wanMu.Unlock()
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || port == 0 {
+		return errors.New("invalid UDP service address")
+	}
+	if _, ok := s.networkByWAN.Load().Lookup(ip); ok {
+		return fmt.Errorf("UDP service IP %v is a network's WAN IP", ip)
+	}
+	ap := netip.AddrPortFrom(ip, port)
+	if _, ok := s.wanUDPServices.Load(ap); ok {
+		return fmt.Errorf("UDP service %v already registered", ap)
+	}
+	if _, ok := s.udpListeners.Load(ap); ok {
+		return fmt.Errorf("UDP address %v already in use by ListenUDP", ap)
+	}
+	if _, loaded := s.udpServices.LoadOrStore(ap, h); loaded {
+		return fmt.Errorf("UDP service %v already registered", ap)
+	}
+	return nil
+}
+
+// wanServiceAddr validates ip:port as the address of a WAN service.
+func (s *Server) wanServiceAddr(ip netip.Addr, port uint16) (netip.AddrPort, error) {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || port == 0 {
+		return netip.AddrPort{}, errors.New("invalid WAN service address")
+	}
+	if _, ok := s.networkByWAN.Load().Lookup(ip); ok {
+		return netip.AddrPort{}, fmt.Errorf("WAN service IP %v is a network's WAN IP", ip)
+	}
+	for _, v := range s.vips {
+		if v.Match(ip) {
+			return netip.AddrPort{}, fmt.Errorf("WAN service IP %v is %s's", ip, v.name)
+		}
+	}
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// isWANServiceIP reports whether any WAN, UDP or TLS service is registered at
+// ip, or a UDP listener from ListenUDP is there.
+func (s *Server) isWANServiceIP(ip netip.Addr) bool {
+	for ap := range s.wanTCPServices.Keys() {
+		if ap.Addr() == ip {
+			return true
+		}
+	}
+	for ap := range s.wanUDPServices.Keys() {
+		if ap.Addr() == ip {
+			return true
+		}
+	}
+	for ap := range s.udpServices.Keys() {
+		if ap.Addr() == ip {
+			return true
+		}
+	}
+	for ap := range s.udpListeners.Keys() {
+		if ap.Addr() == ip {
+			return true
+		}
+	}
+	return s.hasTLSServices(ip)
+}
+
+// handleWANUDPService passes up to the WAN UDP service it's addressed to, if
+// any, routing back the reply. It reports whether there was such a service.
+func (s *Server) handleWANUDPService(up UDPPacket) bool {
+	h, ok := s.wanUDPServices.Load(netip.AddrPortFrom(up.Dst.Addr().Unmap(), up.Dst.Port()))
+	if !ok {
+		return false
+	}
+	if reply := h(up.Src, up.Payload); reply != nil {
+		s.routeUDPPacket(UDPPacket{Src: up.Dst, Dst: up.Src, Payload: reply})
+	}
+	return true
+}
+
+// handleUDPService passes up to the service from RegisterUDPService it's
+// addressed to, if any, routing back the reply. It reports whether there was
+// such a service.
+func (s *Server) handleUDPService(up UDPPacket) bool {
+	h, ok := s.udpServices.Load(netip.AddrPortFrom(up.Dst.Addr().Unmap(), up.Dst.Port()))
+	if !ok {
+		return false
+	}
+	if reply, ok := h(up); ok {
+		s.routeUDPPacket(reply)
+	}
+	return true
+}
@@ -25,28 +25,59 @@
 // e.g. ICMP{v6}, are still validated by gVisor regardless of rx checksum
 // offloading capabilities.
 func RXChecksumOffload(p *packet.Parsed) *stack.PacketBuffer {
-	var (
-		pn        tcpip.NetworkProtocolNumber
-		csumStart int
-	)
+	return rxChecksumOffload(p, false)
+}
+
+// rxChecksumOffload is RXChecksumOffload, additionally validating ICMPv6
+// checksums if icmp6.
+func rxChecksumOffload(p *packet.Parsed, icmp6 bool) *stack.PacketBuffer {
+	pn, ok := validateRXChecksums(p, icmp6)
+	if !ok {
+		return nil
+	}
+	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(bytes.Clone(p.Buffer())),
+	})
+	packetBuf.NetworkProtocolNumber = pn
+	// Setting this is not technically required. gVisor overrides where
+	// stack.CapabilityRXChecksumOffload is advertised from Capabilities().
+	// https://github.com/google/gvisor/blob/64c016c92987cc04dfd4c7b091ddd21bdad875f8/pkg/tcpip/stack/nic.go#L763
+	// This is also why we offload for all packets since we cannot signal this
+	// per-packet.
+	packetBuf.RXChecksumValidated = true
+	return packetBuf
+}
+
+// validateRXChecksums validates the checksums of p as described at
+// RXChecksumOffload, plus the ICMPv6 checksum if icmp6, returning p's
+// network protocol number and whether they are valid. For IPv6 packets with
+// extension headers before a TCP or UDP (or, if icmp6, ICMPv6) header, it
+// sets p.IPProto to the transport protocol.
+func validateRXChecksums(p *packet.Parsed, icmp6 bool) (pn tcpip.NetworkProtocolNumber, ok bool) {
+	var csumStart int
 	buf := p.Buffer()
 
 	switch p.IPVersion {
 	case 4:
 		if len(buf) < header.IPv4MinimumSize {
-			return nil
+			return 0, false
 		}
-		csumStart = int((buf[0] & 0x0F) * 4)
-		if csumStart < header.IPv4MinimumSize || csumStart > header.IPv4MaximumHeaderSize || len(buf) < csumStart {
-			return nil
+		if buf[0] == 0x45 {
+			// The common case: version 4, no options.
+			csumStart = header.IPv4MinimumSize
+		} else {
+			csumStart = int((buf[0] & 0x0F) * 4)
+			if csumStart < header.IPv4MinimumSize || csumStart > header.IPv4MaximumHeaderSize || len(buf) < csumStart {
+				return 0, false
+			}
 		}
 		if ^tun.Checksum(buf[:csumStart], 0) != 0 {
-			return nil
+			return 0, false
 		}
 		pn = header.IPv4ProtocolNumber
 	case 6:
 		if len(buf) < header.IPv6FixedHeaderSize {
-			return nil
+			return 0, false
 		}
 		csumStart = header.IPv6FixedHeaderSize
 		pn = header.IPv6ProtocolNumber
@@ -54,31 +85,42 @@ func RXChecksumOffload(p *packet.Parsed) *stack.PacketBuffer {
 			// buf could have extension headers before a UDP or TCP header, but
 			// packet.Parsed.IPProto will be set to the ext header type, so we
 			// have to look deeper. We are still responsible for validating the
-			// L4 checksum in this case. So, make use of gVisor's existing
-			// extension header parsing via parse.IPv6() in order to unpack the
-			// L4 csumStart index. This is not particularly efficient as we have
-			// to allocate a short-lived stack.PacketBuffer that cannot be
-			// re-used. parse.IPv6() "consumes" the IPv6 headers, so we can't
-			// inject this stack.PacketBuffer into the stack at a later point.
-			packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
-				Payload: buffer.MakeWithData(bytes.Clone(buf)),
-			})
-			defer packetBuf.DecRef()
-			// The rightmost bool returns false only if packetBuf is too short,
-			// which we've already accounted for above.
-			transportProto, _, _, _, _ := parse.IPv6(packetBuf)
-			if transportProto == header.TCPProtocolNumber || transportProto == header.UDPProtocolNumber {
-				csumLen := packetBuf.Data().Size()
-				if len(buf) < csumLen {
-					return nil
+			// L4 checksum in this case. The common extension headers are
+			// walked by ipv6TransportOffset without allocating.
+			if proto, off, ok := ipv6TransportOffset(buf); ok {
+				if proto == ipproto.TCP || proto == ipproto.UDP || (icmp6 && proto == ipproto.ICMPv6) {
+					csumStart = off
+					p.IPProto = proto
+				}
+			} else {
+				// For others, make use of gVisor's existing extension header
+				// parsing via parse.IPv6() in order to unpack the L4
+				// csumStart index. This is not particularly efficient as we
+				// have to allocate a short-lived stack.PacketBuffer that
+				// cannot be re-used. parse.IPv6() "consumes" the IPv6
+				// headers, so we can't inject this stack.PacketBuffer into
+				// the stack at a later point.
+				packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
+					Payload: buffer.MakeWithData(bytes.Clone(buf)),
+				})
+				defer packetBuf.DecRef()
+				// The rightmost bool returns false only if packetBuf is too
+				// short, which we've already accounted for above.
+				transportProto, _, _, _, _ := parse.IPv6(packetBuf)
+				if transportProto == header.TCPProtocolNumber || transportProto == header.UDPProtocolNumber {
+					csumLen := packetBuf.Data().Size()
+					if len(buf) < csumLen {
+						return 0, false
+					}
+					csumStart = len(buf) - csumLen
+					p.IPProto = ipproto.Proto(transportProto)
 				}
-				csumStart = len(buf) - csumLen
-				p.IPProto = ipproto.Proto(transportProto)
 			}
 		}
 	}
 
-	if p.IPProto == ipproto.TCP || p.IPProto == ipproto.UDP {
+	// ICMPv6, unlike ICMPv4, covers a pseudo-header too (RFC 4443, 2.3).
+	if p.IPProto == ipproto.TCP || p.IPProto == ipproto.UDP || (icmp6 && p.IPProto == ipproto.ICMPv6 && p.IPVersion == 6) {
 		lenForPseudo := len(buf) - csumStart
 		csum := tun.PseudoHeaderChecksum(
 			uint8(p.IPProto),
@@ -87,19 +129,44 @@ func RXChecksumOffload(p *packet.Parsed) *stack.PacketBuffer {
 			uint16(lenForPseudo))
 		csum = tun.Checksum(buf[csumStart:], csum)
 		if ^csum != 0 {
-			return nil
+			return 0, false
 		}
 	}
 
-	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
-		Payload: buffer.MakeWithData(bytes.Clone(buf)),
-	})
-	packetBuf.NetworkProtocolNumber = pn
-	// Setting this is not technically required. gVisor overrides where
-	// stack.CapabilityRXChecksumOffload is advertised from Capabilities().
-	// https://github.com/google/gvisor/blob/64c016c92987cc04dfd4c7b091ddd21bdad875f8/pkg/tcpip/stack/nic.go#L763
-	// This is also why we offload for all packets since we cannot signal this
-	// per-packet.
-	packetBuf.RXChecksumValidated = true
-	return packetBuf
+	return pn, true
+}
+
+// ipv6AuthenticationHeader is the IPv6 next header value of the
+// Authentication Header (RFC 4302).
+const ipv6AuthenticationHeader header.IPv6ExtensionHeaderIdentifier = 51
+
+// ipv6TransportOffset walks the Hop-by-Hop Options, Routing and Destination
+// Options extension headers of the IPv6 packet buf, returning the protocol
+// that follows them and the offset of its header. It reports false if buf is
+// truncated or has other extension headers, such as Fragment or
+// Authentication headers, which are left to parse.IPv6.
+func ipv6TransportOffset(buf []byte) (proto ipproto.Proto, off int, ok bool) {
+	next := header.IPv6ExtensionHeaderIdentifier(buf[6])
+	off = header.IPv6FixedHeaderSize
+	for {
+		switch next {
+		case header.IPv6HopByHopOptionsExtHdrIdentifier,
+			header.IPv6RoutingExtHdrIdentifier,
+			header.IPv6DestinationOptionsExtHdrIdentifier:
+			// Each starts with the next header and its length in 8-octet
+			// units, not including the first 8 octets.
+			if len(buf) < off+8 {
+				return 0, 0, false
+			}
+			next = header.IPv6ExtensionHeaderIdentifier(buf[off])
+			off += (int(buf[off+1]) + 1) * 8
+			if off > len(buf) {
+				return 0, 0, false
+			}
+		case header.IPv6FragmentExtHdrIdentifier, ipv6AuthenticationHeader:
+			return 0, 0, false
+		default:
+			return ipproto.Proto(next), off, true
+		}
+	}
 }
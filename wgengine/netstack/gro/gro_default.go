@@ -7,6 +7,7 @@
 
 import (
 	"sync"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	nsgro "gvisor.dev/gvisor/pkg/tcpip/stack/gro"
@@ -29,6 +30,29 @@ func init() {
 type GRO struct {
 	gro           nsgro.GRO
 	maybeEnqueued bool
+
+	opts Options
+	held int // packets enqueued since the last flush
+
+	// mu guards the fields above if opts.MaxHold is non-zero, as
+	// holdTimer flushes from its own goroutine.
+	mu         sync.Mutex
+	holdTimer  *time.Timer // or nil if not yet needed
+	timerArmed bool        // whether holdTimer is pending
+}
+
+// Options are options for NewGROWithOptions. Most bound how long GRO holds
+// packets before flushing them to the stack.NetworkDispatcher on its own,
+// without waiting for the caller's Flush.
+type Options struct {
+	// MaxHold, if non-zero, is the longest that GRO holds a packet.
+	MaxHold time.Duration
+	// MaxSegments, if non-zero, is the number of enqueued packets at which
+	// GRO flushes.
+	MaxSegments int
+	// ValidateICMPv6 is whether GRO validates the checksums of ICMPv6
+	// packets too, dropping corrupt ones before they reach gVisor.
+	ValidateICMPv6 bool
 }
 
 // NewGRO returns a new instance of *GRO from a sync.Pool. It can be returned to
@@ -37,9 +61,28 @@ func NewGRO() *GRO {
 	return groPool.Get().(*GRO)
 }
 
+// NewGROWithOptions returns a new *GRO that flushes automatically per opts.
+// If opts.MaxHold is non-zero, GRO delivers packets from a timer's goroutine,
+// so the stack.NetworkDispatcher must allow that; GRO itself is still NOT
+// thread-safe. Flush() releases it as with NewGRO.
+func NewGROWithOptions(opts Options) *GRO {
+	if opts == (Options{}) {
+		return NewGRO()
+	}
+	// Not from the pool: a hold timer may fire after Flush, and must not
+	// find the GRO in use by someone else.
+	g := &GRO{opts: opts}
+	g.gro.Init(true)
+	return g
+}
+
 // SetDispatcher sets the underlying stack.NetworkDispatcher where packets are
 // delivered.
 func (g *GRO) SetDispatcher(d stack.NetworkDispatcher) {
+	if g.opts.MaxHold > 0 {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+	}
 	g.gro.Dispatcher = d
 }
 
@@ -47,30 +90,134 @@ func (g *GRO) SetDispatcher(d stack.NetworkDispatcher) {
 // it to the underlying stack.NetworkDispatcher depending on its contents. To
 // explicitly flush previously enqueued packets see Flush().
 func (g *GRO) Enqueue(p *packet.Parsed) {
+	if g.opts.MaxHold > 0 {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+	}
 	if g.gro.Dispatcher == nil {
 		return
 	}
-	pkt := RXChecksumOffload(p)
-	if pkt == nil {
+	if !g.enqueue(p) {
 		return
 	}
+	g.maybeEnqueued = true
+	g.held++
+	if g.opts.MaxSegments > 0 && g.held >= g.opts.MaxSegments {
+		g.flush()
+		return
+	}
+	if g.opts.MaxHold > 0 && !g.timerArmed {
+		if g.holdTimer == nil {
+			g.holdTimer = time.AfterFunc(g.opts.MaxHold, g.onHoldTimer)
+		} else {
+			g.holdTimer.Reset(g.opts.MaxHold)
+		}
+		g.timerArmed = true
+	}
+}
+
+// enqueue enqueues p, reporting whether it was valid.
+func (g *GRO) enqueue(p *packet.Parsed) bool {
+	pkt := rxChecksumOffload(p, g.opts.ValidateICMPv6)
+	if pkt == nil {
+		return false
+	}
 	// TODO(jwhited): g.gro.Enqueue() duplicates a lot of p.Decode().
 	//  We may want to push stack.PacketBuffer further up as a
 	//  replacement for packet.Parsed, or inversely push packet.Parsed
 	//  down into refactored GRO logic.
 	g.gro.Enqueue(pkt)
-	g.maybeEnqueued = true
 	pkt.DecRef()
+	return true
+}
+
+// onHoldTimer is called by holdTimer when a packet has been held for
+// opts.MaxHold.
+func (g *GRO) onHoldTimer() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.timerArmed {
+		g.flush()
+	}
 }
 
 // Flush flushes previously enqueued packets to the underlying
 // stack.NetworkDispatcher, and returns GRO to a pool for later re-use. Callers
 // MUST NOT use GRO once it has been Flush()'d.
 func (g *GRO) Flush() {
+	if g.opts.MaxHold > 0 {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+	}
+	g.flush()
+	g.gro.Dispatcher = nil
+	if g.opts == (Options{}) {
+		groPool.Put(g)
+	}
+}
+
+// flush flushes previously enqueued packets to the underlying
+// stack.NetworkDispatcher, leaving g usable.
+func (g *GRO) flush() {
 	if g.gro.Dispatcher != nil && g.maybeEnqueued {
 		g.gro.Flush()
 	}
-	g.gro.Dispatcher = nil
 	g.maybeEnqueued = false
-	groPool.Put(g)
+	g.held = 0
+	if g.timerArmed {
+		g.holdTimer.Stop()
+		g.timerArmed = false
+	}
+}
+
+// LockedGRO is a GRO that is safe for concurrent use, such as by the
+// goroutines reading the queues of a multi-queue TUN device. Unlike GRO, it
+// can be flushed any number of times; Close returns its GRO to the pool.
+type LockedGRO struct {
+	mu sync.Mutex
+	g  *GRO // or nil once closed
+}
+
+// NewLockedGRO returns a new LockedGRO using a *GRO from the pool.
+func NewLockedGRO() *LockedGRO {
+	return &LockedGRO{g: NewGRO()}
+}
+
+// SetDispatcher is like GRO.SetDispatcher.
+func (l *LockedGRO) SetDispatcher(d stack.NetworkDispatcher) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.g != nil {
+		l.g.SetDispatcher(d)
+	}
+}
+
+// Enqueue is like GRO.Enqueue. It does nothing once l is closed.
+func (l *LockedGRO) Enqueue(p *packet.Parsed) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.g != nil {
+		l.g.Enqueue(p)
+	}
+}
+
+// Flush flushes previously enqueued packets to the underlying
+// stack.NetworkDispatcher. l remains usable.
+func (l *LockedGRO) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.g != nil {
+		l.g.flush()
+	}
+}
+
+// Close flushes previously enqueued packets and returns l's GRO to the pool.
+// Later calls to l's methods do nothing.
+func (l *LockedGRO) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.g != nil {
+		l.g.Flush()
+		l.g = nil
+	}
 }
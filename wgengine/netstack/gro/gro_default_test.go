@@ -0,0 +1,217 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ios
+
+package gro
+
+import (
+	"bytes"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"tailscale.com/net/packet"
+)
+
+// mkUDPTestPacket returns a UDP datagram from src to dst carrying payload,
+// with valid checksums.
+func mkUDPTestPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	return mkL4TestPacket(header.UDPProtocolNumber, src, dst, payload)
+}
+
+// mkTCPTestPacket returns a TCP segment from src to dst carrying payload,
+// with only the ACK flag set and valid checksums, which GRO holds rather than
+// delivering immediately.
+func mkTCPTestPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	return mkL4TestPacket(header.TCPProtocolNumber, src, dst, payload)
+}
+
+func mkL4TestPacket(proto tcpip.TransportProtocolNumber, src, dst netip.AddrPort, payload []byte) []byte {
+	pkt := mkSegmentTestPacket(proto, src.Addr(), dst.Addr(), payload)
+	ipHdrLen := header.IPv4MinimumSize
+	if src.Addr().Is6() {
+		ipHdrLen = header.IPv6FixedHeaderSize
+	} else {
+		ip := header.IPv4(pkt)
+		ip.SetChecksum(^ip.CalculateChecksum())
+	}
+	l4 := pkt[ipHdrLen:]
+	csum := tun.PseudoHeaderChecksum(uint8(proto), src.Addr().AsSlice(), dst.Addr().AsSlice(), uint16(len(l4)))
+	if proto == header.TCPProtocolNumber {
+		tcp := header.TCP(l4)
+		tcp.SetSourcePort(src.Port())
+		tcp.SetDestinationPort(dst.Port())
+		tcp.SetFlags(uint8(header.TCPFlagAck))
+		tcp.SetChecksum(^tun.Checksum(l4, csum))
+	} else {
+		udp := header.UDP(l4)
+		udp.SetSourcePort(src.Port())
+		udp.SetDestinationPort(dst.Port())
+		udp.SetChecksum(^tun.Checksum(l4, csum))
+	}
+	return pkt
+}
+
+// countingDispatcher is a stack.NetworkDispatcher that counts the packets
+// delivered to it.
+type countingDispatcher struct {
+	n atomic.Int64
+}
+
+func (d *countingDispatcher) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+	d.n.Add(1)
+}
+
+func (d *countingDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {}
+
+func TestLockedGRO(t *testing.T) {
+	const (
+		goroutines = 8
+		perG       = 200
+	)
+	dst := netip.MustParseAddrPort("192.0.2.2:2000")
+	pktsFrom := func(port uint16) [][]byte {
+		src := netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), port)
+		var pkts [][]byte
+		for range perG {
+			pkts = append(pkts, mkUDPTestPacket(src, dst, make([]byte, 100)))
+		}
+		return pkts
+	}
+
+	// A plain GRO, owned by one goroutine.
+	d := &countingDispatcher{}
+	g := NewGRO()
+	g.SetDispatcher(d)
+	for _, pkt := range pktsFrom(1000) {
+		p := &packet.Parsed{}
+		p.Decode(pkt)
+		g.Enqueue(p)
+	}
+	g.Flush()
+	if got := d.n.Load(); got != perG {
+		t.Errorf("GRO delivered %d packets; want %d", got, perG)
+	}
+
+	// A LockedGRO, shared by many.
+	d = &countingDispatcher{}
+	l := NewLockedGRO()
+	l.SetDispatcher(d)
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		pkts := pktsFrom(uint16(2000 + i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j, pkt := range pkts {
+				p := &packet.Parsed{}
+				p.Decode(pkt)
+				l.Enqueue(p)
+				if j%50 == 0 {
+					l.Flush()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	l.Close()
+	if got, want := d.n.Load(), int64(goroutines*perG); got != want {
+		t.Errorf("LockedGRO delivered %d packets; want %d", got, want)
+	}
+
+	// Once closed, it's inert.
+	p := &packet.Parsed{}
+	p.Decode(pktsFrom(3000)[0])
+	l.Enqueue(p)
+	l.Flush()
+	l.Close()
+	if got, want := d.n.Load(), int64(goroutines*perG); got != want {
+		t.Errorf("closed LockedGRO delivered %d packets; want %d", got, want)
+	}
+}
+
+func TestGROOptions(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.2:2000")
+	// enqueue enqueues a TCP segment of flow i. Each flow's segment is held
+	// by GRO on its own, rather than coalesced with the others.
+	enqueue := func(g *GRO, i uint16) {
+		src := netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), 1000+i)
+		pkt := mkTCPTestPacket(src, dst, make([]byte, 100))
+		p := &packet.Parsed{}
+		p.Decode(pkt)
+		g.Enqueue(p)
+	}
+
+	t.Run("max-segments", func(t *testing.T) {
+		d := &countingDispatcher{}
+		g := NewGROWithOptions(Options{MaxSegments: 3})
+		defer g.Flush()
+		g.SetDispatcher(d)
+		for i := range 5 {
+			enqueue(g, uint16(i))
+		}
+		if got := d.n.Load(); got != 3 {
+			t.Errorf("delivered %d packets before Flush; want 3", got)
+		}
+	})
+
+	t.Run("max-hold", func(t *testing.T) {
+		const hold = 50 * time.Millisecond
+		d := &countingDispatcher{}
+		g := NewGROWithOptions(Options{MaxHold: hold})
+		defer g.Flush()
+		g.SetDispatcher(d)
+		start := time.Now()
+		enqueue(g, 0)
+		enqueue(g, 1)
+		if got := d.n.Load(); got != 0 {
+			t.Fatalf("delivered %d packets immediately; want them held", got)
+		}
+		// Allow for a slow scheduler, but not for waiting on Flush.
+		deadline := start.Add(hold + 5*time.Second)
+		for d.n.Load() < 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("packets not delivered %v after enqueueing, with MaxHold %v", time.Since(start), hold)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if elapsed := time.Since(start); elapsed < hold {
+			t.Errorf("packets delivered after %v; want them held for %v", elapsed, hold)
+		}
+
+		// The timer is rearmed by the next packet.
+		enqueue(g, 2)
+		for d.n.Load() < 3 {
+			if time.Now().After(deadline) {
+				t.Fatal("packet after the first flush not delivered")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestGROValidateICMPv6(t *testing.T) {
+	d := &countingDispatcher{}
+	g := NewGROWithOptions(Options{ValidateICMPv6: true})
+	defer g.Flush()
+	g.SetDispatcher(d)
+
+	valid := mkICMPv6Echo()
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)-1] ^= 0xff
+	for _, pkt := range [][]byte{valid, corrupt} {
+		p := &packet.Parsed{}
+		p.Decode(pkt)
+		g.Enqueue(p)
+	}
+	if got := d.n.Load(); got != 1 {
+		t.Errorf("delivered %d packets; want only the valid echo", got)
+	}
+}
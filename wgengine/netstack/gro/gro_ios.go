@@ -6,6 +6,8 @@
 package gro
 
 import (
+	"time"
+
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"tailscale.com/net/packet"
 )
@@ -16,8 +18,32 @@ func NewGRO() *GRO {
 	panic("unsupported on iOS")
 }
 
+type Options struct {
+	MaxHold        time.Duration
+	MaxSegments    int
+	ValidateICMPv6 bool
+}
+
+func NewGROWithOptions(_ Options) *GRO {
+	panic("unsupported on iOS")
+}
+
 func (g *GRO) SetDispatcher(_ stack.NetworkDispatcher) {}
 
 func (g *GRO) Enqueue(_ *packet.Parsed) {}
 
 func (g *GRO) Flush() {}
+
+type LockedGRO struct{}
+
+func NewLockedGRO() *LockedGRO {
+	panic("unsupported on iOS")
+}
+
+func (l *LockedGRO) SetDispatcher(_ stack.NetworkDispatcher) {}
+
+func (l *LockedGRO) Enqueue(_ *packet.Parsed) {}
+
+func (l *LockedGRO) Flush() {}
+
+func (l *LockedGRO) Close() {}
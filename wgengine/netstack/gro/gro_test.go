@@ -5,10 +5,12 @@
 
 import (
 	"bytes"
+	"encoding/binary"
 	"net/netip"
 	"testing"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"tailscale.com/net/packet"
 )
@@ -57,6 +59,32 @@ func Test_RXChecksumOffload(t *testing.T) {
 	pseudoCsum = header.PseudoHeaderChecksum(header.TCPProtocolNumber, ipv6H.SourceAddress(), ipv6H.DestinationAddress(), uint16(20+payloadLen))
 	tcpH.SetChecksum(^tcpH.CalculateChecksum(pseudoCsum))
 
+	udp6HopByHop := mkUDP6HopByHop(payloadLen)
+	udp6HopByHopInvalidCsum := bytes.Clone(udp6HopByHop)
+	udp6HopByHopInvalidCsum[40+8+6] ^= 0xff
+
+	// tcp4RouterAlert is tcp4 with a Router Alert option (RFC 2113).
+	tcp4RouterAlert := make([]byte, 24+20+payloadLen)
+	ipv4H = header.IPv4(tcp4RouterAlert)
+	ipv4H.Encode(&header.IPv4Fields{
+		SrcAddr:     tcpip.AddrFromSlice(netip.MustParseAddr("192.0.2.1").AsSlice()),
+		DstAddr:     tcpip.AddrFromSlice(netip.MustParseAddr("192.0.2.2").AsSlice()),
+		Protocol:    uint8(header.TCPProtocolNumber),
+		TTL:         64,
+		TotalLength: uint16(len(tcp4RouterAlert)),
+		Options:     header.IPv4OptionsSerializer{&header.IPv4SerializableRouterAlertOption{}},
+	})
+	ipv4H.SetChecksum(^ipv4H.CalculateChecksum())
+	copy(tcp4RouterAlert[24:], tcp4[20:]) // the TCP checksum doesn't cover the IP options
+
+	// ip4TruncatedOptions claims a 4-byte option but ends after 2.
+	ip4TruncatedOptions := make([]byte, 22)
+	copy(ip4TruncatedOptions, tcp4RouterAlert[:22])
+	binary.BigEndian.PutUint16(ip4TruncatedOptions[2:], uint16(len(ip4TruncatedOptions)))
+	ipv4H = header.IPv4(ip4TruncatedOptions)
+	ipv4H.SetChecksum(0)
+	ipv4H.SetChecksum(^checksum.Checksum(ip4TruncatedOptions, 0))
+
 	tcp4InvalidCsum := make([]byte, len(tcp4))
 	copy(tcp4InvalidCsum, tcp4)
 	at := 20 + 16
@@ -82,6 +110,26 @@ func Test_RXChecksumOffload(t *testing.T) {
 			tcp6ExtHeader,
 			true,
 		},
+		{
+			"tcp4 with router alert option valid csum",
+			tcp4RouterAlert,
+			true,
+		},
+		{
+			"ipv4 with truncated options",
+			ip4TruncatedOptions,
+			false,
+		},
+		{
+			"udp6 with hop-by-hop header valid csum",
+			udp6HopByHop,
+			true,
+		},
+		{
+			"udp6 with hop-by-hop header invalid csum",
+			udp6HopByHopInvalidCsum,
+			false,
+		},
 		{
 			"tcp4 packet invalid csum",
 			tcp4InvalidCsum,
@@ -110,3 +158,127 @@ func Test_RXChecksumOffload(t *testing.T) {
 		})
 	}
 }
+
+// mkUDP6HopByHop returns an IPv6 UDP packet with a Hop-by-Hop Options
+// extension header and a payload of payloadLen bytes.
+func mkUDP6HopByHop(payloadLen int) []byte {
+	pkt := make([]byte, 40+8+8+payloadLen)
+	ipv6H := header.IPv6(pkt)
+	ipv6H.Encode(&header.IPv6Fields{
+		SrcAddr:           tcpip.AddrFromSlice(netip.MustParseAddr("2001:db8::1").AsSlice()),
+		DstAddr:           tcpip.AddrFromSlice(netip.MustParseAddr("2001:db8::2").AsSlice()),
+		TransportProtocol: 0, // really next header; hop-by-hop options ext header
+		HopLimit:          64,
+		PayloadLength:     uint16(8 + 8 + payloadLen),
+	})
+	pkt[40] = uint8(header.UDPProtocolNumber) // next header
+	pkt[41] = 0                               // length of ext header in 8-octet units, exclusive of first 8 octets.
+	pkt[42] = 1                               // PadN option
+	pkt[43] = 4                               // PadN option length
+	udpH := header.UDP(pkt[48:])
+	udpH.Encode(&header.UDPFields{
+		SrcPort: 1,
+		DstPort: 1,
+		Length:  uint16(8 + payloadLen),
+	})
+	pseudoCsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ipv6H.SourceAddress(), ipv6H.DestinationAddress(), uint16(8+payloadLen))
+	udpH.SetChecksum(^udpH.CalculateChecksum(checksum.Checksum(udpH.Payload(), pseudoCsum)))
+	return pkt
+}
+
+func BenchmarkRXChecksumOffload(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		pkt  []byte
+	}{
+		{"tcp4-no-options", mkTCP4(1200)},
+		{"udp6-hop-by-hop", mkUDP6HopByHop(1200)},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			p := &packet.Parsed{}
+			b.SetBytes(int64(len(tt.pkt)))
+			b.ReportAllocs()
+			for range b.N {
+				p.Decode(tt.pkt)
+				if _, ok := validateRXChecksums(p, false); !ok {
+					b.Fatal("invalid checksums")
+				}
+			}
+		})
+	}
+}
+
+// mkICMPv6Echo returns an ICMPv6 echo request with a valid checksum.
+func mkICMPv6Echo() []byte {
+	pkt := make([]byte, 40+header.ICMPv6EchoMinimumSize+16)
+	ipv6H := header.IPv6(pkt)
+	ipv6H.Encode(&header.IPv6Fields{
+		SrcAddr:           tcpip.AddrFromSlice(netip.MustParseAddr("2001:db8::1").AsSlice()),
+		DstAddr:           tcpip.AddrFromSlice(netip.MustParseAddr("2001:db8::2").AsSlice()),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		PayloadLength:     uint16(len(pkt) - 40),
+	})
+	icmpH := header.ICMPv6(pkt[40:])
+	icmpH.SetType(header.ICMPv6EchoRequest)
+	icmpH.SetIdent(7)
+	icmpH.SetSequence(1)
+	copy(icmpH.Payload(), "ping payload....")
+	icmpH.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: icmpH,
+		Src:    ipv6H.SourceAddress(),
+		Dst:    ipv6H.DestinationAddress(),
+	}))
+	return pkt
+}
+
+func Test_validateRXChecksumsICMPv6(t *testing.T) {
+	valid := mkICMPv6Echo()
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	for _, tt := range []struct {
+		name  string
+		pkt   []byte
+		icmp6 bool
+		want  bool
+	}{
+		{"valid", valid, true, true},
+		{"corrupt", corrupt, true, false},
+		{"corrupt-not-validated", corrupt, false, true}, // left to gVisor
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &packet.Parsed{}
+			p.Decode(tt.pkt)
+			if _, got := validateRXChecksums(p, tt.icmp6); got != tt.want {
+				t.Errorf("validateRXChecksums(icmp6=%v) = %v; want %v", tt.icmp6, got, tt.want)
+			}
+		})
+	}
+}
+
+// mkTCP4 returns an IPv4 TCP packet without IP options and with a payload of
+// payloadLen bytes.
+func mkTCP4(payloadLen int) []byte {
+	pkt := make([]byte, 20+20+payloadLen)
+	ipv4H := header.IPv4(pkt)
+	ipv4H.Encode(&header.IPv4Fields{
+		SrcAddr:     tcpip.AddrFromSlice(netip.MustParseAddr("192.0.2.1").AsSlice()),
+		DstAddr:     tcpip.AddrFromSlice(netip.MustParseAddr("192.0.2.2").AsSlice()),
+		Protocol:    uint8(header.TCPProtocolNumber),
+		TTL:         64,
+		TotalLength: uint16(len(pkt)),
+	})
+	ipv4H.SetChecksum(^ipv4H.CalculateChecksum())
+	tcpH := header.TCP(pkt[20:])
+	tcpH.Encode(&header.TCPFields{
+		SrcPort:    1,
+		DstPort:    1,
+		DataOffset: 20,
+		Flags:      header.TCPFlagAck,
+		WindowSize: 3000,
+	})
+	pseudoCsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ipv4H.SourceAddress(), ipv4H.DestinationAddress(), uint16(20+payloadLen))
+	tcpH.SetChecksum(^tcpH.CalculateChecksum(checksum.Checksum(tcpH.Payload(), pseudoCsum)))
+	return pkt
+}
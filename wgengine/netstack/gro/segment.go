@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gro
+
+import (
+	"encoding/binary"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// udpChecksumOffset is the offset of the checksum field in a UDP header.
+const udpChecksumOffset = 6
+
+// Segment implements TSO/GSO for the transmit (read) path out of gVisor. It
+// splits pkt, an IPv4 or IPv6 TCP or UDP packet, into packets of at most mtu
+// bytes, each carrying a copy of pkt's IP and TCP or UDP headers and a
+// consecutive chunk of its payload. TCP segments get their sequence numbers
+// advanced, and only the last keeps pkt's FIN and PSH flags. UDP payloads
+// are split into separate datagrams, as with Linux's UDP GSO.
+//
+// The IPv4 header checksum and the TCP or UDP checksum of every segment are
+// computed afresh, covering the same headers that RXChecksumOffload
+// validates, so pkt's own checksums may be partial or missing.
+//
+// If pkt already fits in mtu, Segment returns it alone, unmodified. It
+// returns nil if pkt is malformed, is an IPv4 fragment, has IPv6 extension
+// headers, or is neither TCP nor UDP, or if mtu leaves no room for payload.
+func Segment(pkt []byte, mtu int) [][]byte {
+	if mtu <= 0 {
+		return nil
+	}
+	if len(pkt) <= mtu {
+		return [][]byte{pkt}
+	}
+	var (
+		ipHdrLen int
+		proto    uint8
+		src, dst []byte
+	)
+	is6 := pkt[0]>>4 == 6
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < header.IPv4MinimumSize {
+			return nil
+		}
+		ip := header.IPv4(pkt)
+		ipHdrLen = int(ip.HeaderLength())
+		if ipHdrLen < header.IPv4MinimumSize || len(pkt) < ipHdrLen ||
+			int(ip.TotalLength()) != len(pkt) || ip.More() || ip.FragmentOffset() != 0 {
+			return nil
+		}
+		proto = ip.Protocol()
+		src, dst = pkt[12:16], pkt[16:20]
+	case 6:
+		if len(pkt) < header.IPv6FixedHeaderSize {
+			return nil
+		}
+		ip := header.IPv6(pkt)
+		if int(ip.PayloadLength()) != len(pkt)-header.IPv6FixedHeaderSize {
+			return nil
+		}
+		ipHdrLen = header.IPv6FixedHeaderSize
+		proto = ip.NextHeader()
+		src, dst = pkt[8:24], pkt[24:40]
+	default:
+		return nil
+	}
+
+	var l4HdrLen, csumAt int
+	switch proto {
+	case uint8(header.TCPProtocolNumber):
+		if len(pkt) < ipHdrLen+header.TCPMinimumSize {
+			return nil
+		}
+		l4HdrLen = int(header.TCP(pkt[ipHdrLen:]).DataOffset())
+		if l4HdrLen < header.TCPMinimumSize || len(pkt) < ipHdrLen+l4HdrLen {
+			return nil
+		}
+		csumAt = header.TCPChecksumOffset
+	case uint8(header.UDPProtocolNumber):
+		l4HdrLen = header.UDPMinimumSize
+		if len(pkt) < ipHdrLen+l4HdrLen {
+			return nil
+		}
+		csumAt = udpChecksumOffset
+	default:
+		return nil
+	}
+
+	hdrLen := ipHdrLen + l4HdrLen
+	segSize := mtu - hdrLen
+	if segSize <= 0 {
+		return nil
+	}
+	payload := pkt[hdrLen:]
+	segs := make([][]byte, 0, (len(payload)+segSize-1)/segSize)
+	for off := 0; off < len(payload); off += segSize {
+		end := min(off+segSize, len(payload))
+		seg := make([]byte, hdrLen+end-off)
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		if is6 {
+			header.IPv6(seg).SetPayloadLength(uint16(len(seg) - ipHdrLen))
+		} else {
+			ip := header.IPv4(seg)
+			ip.SetTotalLength(uint16(len(seg)))
+			ip.SetID(ip.ID() + uint16(len(segs)))
+			ip.SetChecksum(0)
+			ip.SetChecksum(^tun.Checksum(seg[:ipHdrLen], 0))
+		}
+
+		l4 := seg[ipHdrLen:]
+		if proto == uint8(header.TCPProtocolNumber) {
+			tcp := header.TCP(l4)
+			tcp.SetSequenceNumber(tcp.SequenceNumber() + uint32(off))
+			if end < len(payload) {
+				tcp.SetFlags(uint8(tcp.Flags() &^ (header.TCPFlagFin | header.TCPFlagPsh)))
+			}
+		} else {
+			header.UDP(l4).SetLength(uint16(len(l4)))
+		}
+		binary.BigEndian.PutUint16(l4[csumAt:], 0)
+		csum := ^tun.Checksum(l4, tun.PseudoHeaderChecksum(proto, src, dst, uint16(len(l4))))
+		if csum == 0 && proto == uint8(header.UDPProtocolNumber) {
+			csum = 0xffff // zero means no checksum for UDP
+		}
+		binary.BigEndian.PutUint16(l4[csumAt:], csum)
+		segs = append(segs, seg)
+	}
+	return segs
+}
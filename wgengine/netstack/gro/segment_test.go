@@ -0,0 +1,171 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gro
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"tailscale.com/net/packet"
+)
+
+// mkSegmentTestPacket returns an IP packet from src to dst of protocol proto
+// (TCP or UDP) carrying payload, with zeroed checksums, as gVisor emits them
+// when it expects GSO to fill them in.
+func mkSegmentTestPacket(proto tcpip.TransportProtocolNumber, src, dst netip.Addr, payload []byte) []byte {
+	ipHdrLen := header.IPv4MinimumSize
+	if src.Is6() {
+		ipHdrLen = header.IPv6FixedHeaderSize
+	}
+	l4HdrLen := header.UDPMinimumSize
+	if proto == header.TCPProtocolNumber {
+		l4HdrLen = header.TCPMinimumSize
+	}
+	pkt := make([]byte, ipHdrLen+l4HdrLen+len(payload))
+	copy(pkt[ipHdrLen+l4HdrLen:], payload)
+	if src.Is4() {
+		header.IPv4(pkt).Encode(&header.IPv4Fields{
+			SrcAddr:     tcpip.AddrFromSlice(src.AsSlice()),
+			DstAddr:     tcpip.AddrFromSlice(dst.AsSlice()),
+			Protocol:    uint8(proto),
+			TTL:         64,
+			ID:          100,
+			TotalLength: uint16(len(pkt)),
+		})
+	} else {
+		header.IPv6(pkt).Encode(&header.IPv6Fields{
+			SrcAddr:           tcpip.AddrFromSlice(src.AsSlice()),
+			DstAddr:           tcpip.AddrFromSlice(dst.AsSlice()),
+			TransportProtocol: proto,
+			HopLimit:          64,
+			PayloadLength:     uint16(len(pkt) - ipHdrLen),
+		})
+	}
+	if proto == header.TCPProtocolNumber {
+		header.TCP(pkt[ipHdrLen:]).Encode(&header.TCPFields{
+			SrcPort:    1,
+			DstPort:    2,
+			SeqNum:     1000,
+			AckNum:     1,
+			DataOffset: header.TCPMinimumSize,
+			Flags:      header.TCPFlagAck | header.TCPFlagPsh | header.TCPFlagFin,
+			WindowSize: 3000,
+		})
+	} else {
+		header.UDP(pkt[ipHdrLen:]).Encode(&header.UDPFields{
+			SrcPort: 1,
+			DstPort: 2,
+			Length:  uint16(len(pkt) - ipHdrLen),
+		})
+	}
+	return pkt
+}
+
+func TestSegment(t *testing.T) {
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	const mtu = 1280
+	v4src, v4dst := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	v6src, v6dst := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+
+	tests := []struct {
+		name     string
+		proto    tcpip.TransportProtocolNumber
+		src, dst netip.Addr
+		wantSegs int
+	}{
+		{"tcp4", header.TCPProtocolNumber, v4src, v4dst, 3}, // 1240 bytes of payload per segment
+		{"tcp6", header.TCPProtocolNumber, v6src, v6dst, 3}, // 1220
+		{"udp4", header.UDPProtocolNumber, v4src, v4dst, 3}, // 1252
+		{"udp6", header.UDPProtocolNumber, v6src, v6dst, 3}, // 1232
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segs := Segment(mkSegmentTestPacket(tt.proto, tt.src, tt.dst, payload), mtu)
+			if len(segs) != tt.wantSegs {
+				t.Fatalf("got %d segments; want %d", len(segs), tt.wantSegs)
+			}
+			ipHdrLen := header.IPv4MinimumSize
+			if tt.src.Is6() {
+				ipHdrLen = header.IPv6FixedHeaderSize
+			}
+			var gotPayload []byte
+			var ids []uint16
+			for i, seg := range segs {
+				if len(seg) > mtu {
+					t.Errorf("segment %d is %d bytes; want at most %d", i, len(seg), mtu)
+				}
+				p := &packet.Parsed{}
+				p.Decode(seg)
+				pb := RXChecksumOffload(p)
+				if pb == nil {
+					t.Fatalf("segment %d has bad checksums", i)
+				}
+				pb.DecRef()
+				if p.Src.Addr() != tt.src || p.Dst.Addr() != tt.dst {
+					t.Errorf("segment %d is %v => %v", i, p.Src, p.Dst)
+				}
+				if tt.src.Is4() {
+					ids = append(ids, header.IPv4(seg).ID())
+				}
+				last := i == len(segs)-1
+				if tt.proto == header.TCPProtocolNumber {
+					tcp := header.TCP(seg[ipHdrLen:])
+					if got, want := tcp.SequenceNumber(), uint32(1000+len(gotPayload)); got != want {
+						t.Errorf("segment %d seq = %d; want %d", i, got, want)
+					}
+					fin := tcp.Flags().Contains(header.TCPFlagFin)
+					psh := tcp.Flags().Contains(header.TCPFlagPsh)
+					if fin != last || psh != last {
+						t.Errorf("segment %d flags = %v; want FIN and PSH only on the last", i, tcp.Flags())
+					}
+					if !tcp.Flags().Contains(header.TCPFlagAck) {
+						t.Errorf("segment %d lacks ACK", i)
+					}
+				} else if got, want := header.UDP(seg[ipHdrLen:]).Length(), uint16(len(p.Payload())+header.UDPMinimumSize); got != want {
+					t.Errorf("segment %d UDP length = %d; want %d", i, got, want)
+				}
+				gotPayload = append(gotPayload, p.Payload()...)
+			}
+			if !bytes.Equal(gotPayload, payload) {
+				t.Error("segments' payloads don't add up to the original")
+			}
+			for i := 1; i < len(ids); i++ {
+				if ids[i] != ids[i-1]+1 {
+					t.Errorf("IPv4 IDs = %v; want consecutive", ids)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentUnsegmentable(t *testing.T) {
+	small := mkSegmentTestPacket(header.TCPProtocolNumber, netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), []byte("hi"))
+	if segs := Segment(small, 1280); len(segs) != 1 || &segs[0][0] != &small[0] {
+		t.Errorf("small packet: got %d segments; want itself", len(segs))
+	}
+
+	icmp := mkSegmentTestPacket(header.UDPProtocolNumber, netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), make([]byte, 2000))
+	icmp[9] = uint8(header.ICMPv4ProtocolNumber) // IPv4 protocol field
+	frag := mkSegmentTestPacket(header.UDPProtocolNumber, netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), make([]byte, 2000))
+	header.IPv4(frag).SetFlagsFragmentOffset(header.IPv4FlagMoreFragments, 0)
+	for name, pkt := range map[string][]byte{
+		"icmp":      icmp,
+		"fragment":  frag,
+		"truncated": small[:10],
+	} {
+		if segs := Segment(pkt, 8); segs != nil {
+			t.Errorf("%s: got %d segments; want nil", name, len(segs))
+		}
+	}
+	if segs := Segment(small, header.IPv4MinimumSize+header.TCPMinimumSize); segs != nil {
+		t.Errorf("MTU without room for payload: got %d segments; want nil", len(segs))
+	}
+}